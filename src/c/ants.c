@@ -0,0 +1,459 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+#include "ants.h"
+
+#define CRC16_POLYNOMIAL 0x8408u
+#define CRC32_POLYNOMIAL 0xeb31d82eu
+
+/*###########*/
+/*### CRC ###*/
+/*###########*/
+
+/*
+ * The checksums are calculated bitwise to keep the code size small.
+ * Both are reflected CRCs with an inverted initial value and result.
+ */
+
+uint16_t ants_crc16(uint16_t crc, const uint8_t *data, size_t len)
+{
+    size_t i;
+    int bit;
+
+    crc = (uint16_t)~crc;
+    for (i = 0; i < len; i++) {
+        crc ^= data[i];
+        for (bit = 0; bit < 8; bit++) {
+            crc = (crc & 1u) ? (uint16_t)((crc >> 1) ^ CRC16_POLYNOMIAL) : (uint16_t)(crc >> 1);
+        }
+    }
+    return (uint16_t)~crc;
+}
+
+uint32_t ants_crc32(uint32_t crc, const uint8_t *data, size_t len)
+{
+    size_t i;
+    int bit;
+
+    crc = ~crc;
+    for (i = 0; i < len; i++) {
+        crc ^= data[i];
+        for (bit = 0; bit < 8; bit++) {
+            crc = (crc & 1u) ? (crc >> 1) ^ CRC32_POLYNOMIAL : crc >> 1;
+        }
+    }
+    return ~crc;
+}
+
+size_t ants_crc_length(ants_crc_type type)
+{
+    return type == ANTS_CRC32 ? 4 : 2;
+}
+
+/* crc_flag returns the CRC type field of the data message flags. */
+static uint8_t crc_flag(ants_crc_type type)
+{
+    return type == ANTS_CRC32 ? ANTS_FLAG_CRC32 : ANTS_FLAG_CRC16;
+}
+
+/* crc_validate returns true if the little-endian checksum is the checksum of data. */
+static int crc_validate(ants_crc_type type, const uint8_t *data, size_t len, const uint8_t *crc)
+{
+    if (type == ANTS_CRC32) {
+        uint32_t v = ants_crc32(0, data, len);
+        return crc[0] == (uint8_t)v && crc[1] == (uint8_t)(v >> 8) &&
+               crc[2] == (uint8_t)(v >> 16) && crc[3] == (uint8_t)(v >> 24);
+    } else {
+        uint16_t v = ants_crc16(0, data, len);
+        return crc[0] == (uint8_t)v && crc[1] == (uint8_t)(v >> 8);
+    }
+}
+
+/*##############*/
+/*### Config ###*/
+/*##############*/
+
+void ants_config_init(ants_config *c)
+{
+    c->data_crc = ANTS_CRC16;
+    c->control_crc = ANTS_CRC16;
+    c->enhanced_layout = 0;
+    c->addressing = 0;
+    c->address = 0;
+    c->peer_address = 0;
+}
+
+/*################*/
+/*### Encoding ###*/
+/*################*/
+
+/*
+ * A frame writer escapes the message body into the frame buffer and
+ * calculates the CRC checksum of the written body bytes on the fly.
+ */
+typedef struct {
+    uint8_t *frame;
+    size_t cap;
+    size_t len;
+    int overflow;
+    ants_crc_type crc_type;
+    uint16_t crc16;
+    uint32_t crc32;
+} frame_writer;
+
+static void writer_init(frame_writer *w, uint8_t *frame, size_t cap, ants_crc_type crc_type)
+{
+    w->frame = frame;
+    w->cap = cap;
+    w->len = 0;
+    w->overflow = 0;
+    w->crc_type = crc_type;
+    w->crc16 = 0;
+    w->crc32 = 0;
+}
+
+/* put_raw writes the byte without escaping. */
+static void put_raw(frame_writer *w, uint8_t b)
+{
+    if (w->len >= w->cap) {
+        w->overflow = 1;
+        return;
+    }
+    w->frame[w->len++] = b;
+}
+
+/* put writes the escaped body byte. DLE characters are sent twice. */
+static void put(frame_writer *w, uint8_t b)
+{
+    if (b == ANTS_DLE) {
+        put_raw(w, ANTS_DLE);
+    }
+    put_raw(w, b);
+}
+
+/* put_body writes the escaped body bytes and adds them to the checksum. */
+static void put_body(frame_writer *w, const uint8_t *data, size_t len)
+{
+    size_t i;
+
+    for (i = 0; i < len; i++) {
+        put(w, data[i]);
+    }
+
+    if (w->crc_type == ANTS_CRC32) {
+        w->crc32 = ants_crc32(w->crc32, data, len);
+    } else {
+        w->crc16 = ants_crc16(w->crc16, data, len);
+    }
+}
+
+/* put_crc writes the escaped little-endian checksum of the body. */
+static void put_crc(frame_writer *w)
+{
+    if (w->crc_type == ANTS_CRC32) {
+        put(w, (uint8_t)w->crc32);
+        put(w, (uint8_t)(w->crc32 >> 8));
+        put(w, (uint8_t)(w->crc32 >> 16));
+        put(w, (uint8_t)(w->crc32 >> 24));
+    } else {
+        put(w, (uint8_t)w->crc16);
+        put(w, (uint8_t)(w->crc16 >> 8));
+    }
+}
+
+/*
+ * put_start writes the escaped start character and the optional address header.
+ * The address header is covered by its own CRC-16 checksum.
+ */
+static void put_start(const ants_config *c, frame_writer *w, uint8_t start)
+{
+    put_raw(w, ANTS_DLE);
+    put_raw(w, start);
+
+    if (c->addressing) {
+        uint8_t header[2];
+        uint16_t crc;
+
+        header[0] = c->peer_address;
+        header[1] = c->address;
+        crc = ants_crc16(0, header, sizeof(header));
+
+        put(w, header[0]);
+        put(w, header[1]);
+        put(w, (uint8_t)crc);
+        put(w, (uint8_t)(crc >> 8));
+    }
+}
+
+/* put_end writes the escaped end character and returns the frame length. */
+static int put_end(frame_writer *w)
+{
+    put_raw(w, ANTS_DLE);
+    put_raw(w, ANTS_ETX);
+
+    if (w->overflow) {
+        return ANTS_ERR_BUFFER;
+    }
+    return (int)w->len;
+}
+
+int ants_encode_data_message(const ants_config *c, uint8_t *frame, size_t cap,
+                             uint8_t msn, uint8_t flags,
+                             const uint8_t *data, size_t len)
+{
+    frame_writer w;
+    uint8_t header[ANTS_ENHANCED_HEADER_LENGTH];
+
+    if (c->enhanced_layout && len > 0xffff) {
+        return ANTS_ERR_ARGUMENT;
+    }
+
+    writer_init(&w, frame, cap, c->data_crc);
+
+    /* The flags always indicate the CRC type. */
+    header[0] = msn;
+    header[1] = (uint8_t)((flags & ~ANTS_FLAG_CRC_MASK) | crc_flag(c->data_crc));
+
+    if (c->enhanced_layout) {
+        uint16_t crc;
+
+        /* The header contains the binary data length and its own CRC-16 checksum. */
+        header[2] = (uint8_t)len;
+        header[3] = (uint8_t)(len >> 8);
+        crc = ants_crc16(0, header, 4);
+        header[4] = (uint8_t)crc;
+        header[5] = (uint8_t)(crc >> 8);
+
+        put_start(c, &w, ANTS_SOH);
+        put_body(&w, header, ANTS_ENHANCED_HEADER_LENGTH);
+    } else {
+        put_start(c, &w, ANTS_STX);
+        put_body(&w, header, 2);
+    }
+
+    put_body(&w, data, len);
+    put_crc(&w);
+
+    return put_end(&w);
+}
+
+int ants_encode_control_message(const ants_config *c, uint8_t *frame, size_t cap,
+                                uint8_t type, uint8_t msn,
+                                const uint8_t *payload, size_t len)
+{
+    frame_writer w;
+
+    if (!ants_is_control_message(type)) {
+        return ANTS_ERR_ARGUMENT;
+    }
+
+    /* Handshake control messages announce the CRC types and always use CRC-16. */
+    writer_init(&w, frame, cap, type == ANTS_ENQ ? ANTS_CRC16 : c->control_crc);
+
+    put_start(c, &w, type);
+    put_body(&w, &msn, 1);
+    put_body(&w, payload, len);
+    put_crc(&w);
+
+    return put_end(&w);
+}
+
+/*################*/
+/*### Decoding ###*/
+/*################*/
+
+int ants_is_data_message(uint8_t type)
+{
+    return type == ANTS_STX || type == ANTS_SOH;
+}
+
+int ants_is_control_message(uint8_t type)
+{
+    return type == ANTS_ACK || type == ANTS_NAK || type == ANTS_CAN ||
+           type == ANTS_BST || type == ANTS_RSD || type == ANTS_BEL ||
+           type == ANTS_ENQ || type == ANTS_WAT || type == ANTS_RDY;
+}
+
+void ants_decoder_init(ants_decoder *d, uint8_t *buf, size_t cap)
+{
+    d->buf = buf;
+    d->cap = cap;
+    ants_decoder_reset(d);
+}
+
+void ants_decoder_reset(ants_decoder *d)
+{
+    d->len = 0;
+    d->start = 0;
+    d->in_frame = 0;
+    d->escaped = 0;
+}
+
+int ants_decoder_push(ants_decoder *d, uint8_t b)
+{
+    /* An unescaped DLE escapes the next byte. */
+    if (!d->escaped && b == ANTS_DLE) {
+        d->escaped = 1;
+        return ANTS_DECODE_NONE;
+    }
+
+    if (d->escaped) {
+        d->escaped = 0;
+
+        /* A start character starts a new frame, even within a frame. */
+        if (ants_is_data_message(b) || ants_is_control_message(b)) {
+            d->start = b;
+            d->in_frame = 1;
+            d->len = 0;
+            return ANTS_DECODE_NONE;
+        }
+
+        /* The end character completes the frame. */
+        if (b == ANTS_ETX) {
+            if (!d->in_frame) {
+                return ANTS_DECODE_NONE;
+            }
+            d->in_frame = 0;
+            return ANTS_DECODE_FRAME;
+        }
+
+        /* Escaped DLE characters are appended once. */
+    }
+
+    /* Discard bytes outside of a frame. */
+    if (!d->in_frame) {
+        return ANTS_DECODE_NONE;
+    }
+
+    if (d->len >= d->cap) {
+        ants_decoder_reset(d);
+        return ANTS_DECODE_OVERFLOW;
+    }
+    d->buf[d->len++] = b;
+
+    return ANTS_DECODE_NONE;
+}
+
+/* parse_data_message parses the body of a data message without the address header. */
+static int parse_data_message(const ants_config *c, const uint8_t *body, size_t len, ants_message *m)
+{
+    size_t header_len = m->type == ANTS_SOH ? ANTS_ENHANCED_HEADER_LENGTH : 2;
+    ants_crc_type crc_type = c->data_crc;
+    size_t crc_len;
+
+    if (len < header_len) {
+        return ANTS_ERR_FORMAT;
+    }
+
+    /* The enhanced header is validated first, so the MSN is trustworthy. */
+    if (m->type == ANTS_SOH && !crc_validate(ANTS_CRC16, body, 4, body + 4)) {
+        return ANTS_ERR_CRC;
+    }
+
+    m->msn = body[0];
+    m->flags = body[1];
+
+    /* The flags indicate the CRC type. Legacy peers don't set the field. */
+    switch (m->flags & ANTS_FLAG_CRC_MASK) {
+    case ANTS_FLAG_CRC16:
+        crc_type = ANTS_CRC16;
+        break;
+    case ANTS_FLAG_CRC32:
+        crc_type = ANTS_CRC32;
+        break;
+    case ANTS_FLAG_CRC_CUSTOM:
+        /* Custom checksums are not supported by this implementation. */
+        return ANTS_ERR_CRC;
+    default:
+        break;
+    }
+
+    crc_len = ants_crc_length(crc_type);
+    if (len < header_len + crc_len) {
+        return ANTS_ERR_FORMAT;
+    }
+    if (!crc_validate(crc_type, body, len - crc_len, body + len - crc_len)) {
+        return ANTS_ERR_CRC;
+    }
+
+    m->payload = body + header_len;
+    m->payload_len = len - crc_len - header_len;
+
+    /* The length of the enhanced header has to match the binary data. */
+    if (m->type == ANTS_SOH && m->payload_len != (size_t)(body[2] | (body[3] << 8))) {
+        return ANTS_ERR_FORMAT;
+    }
+
+    return ANTS_OK;
+}
+
+/* parse_control_message parses the body of a control message without the address header. */
+static int parse_control_message(const ants_config *c, const uint8_t *body, size_t len, ants_message *m)
+{
+    ants_crc_type crc_type = m->type == ANTS_ENQ ? ANTS_CRC16 : c->control_crc;
+    size_t crc_len = ants_crc_length(crc_type);
+
+    if (len < 1 + crc_len) {
+        return ANTS_ERR_FORMAT;
+    }
+    if (!crc_validate(crc_type, body, len - crc_len, body + len - crc_len)) {
+        return ANTS_ERR_CRC;
+    }
+
+    m->msn = body[0];
+    m->flags = 0;
+    m->payload = body + 1;
+    m->payload_len = len - crc_len - 1;
+
+    return ANTS_OK;
+}
+
+int ants_parse_message(const ants_config *c, uint8_t type,
+                       const uint8_t *body, size_t len, ants_message *m)
+{
+    m->type = type;
+    m->destination = 0;
+    m->source = 0;
+    m->msn = ANTS_UMSN;
+    m->flags = 0;
+    m->payload = NULL;
+    m->payload_len = 0;
+
+    /* Validate and remove the address header. */
+    if (c->addressing) {
+        if (len < ANTS_ADDRESS_HEADER_LENGTH) {
+            return ANTS_ERR_FORMAT;
+        }
+        if (!crc_validate(ANTS_CRC16, body, 2, body + 2)) {
+            return ANTS_ERR_CRC;
+        }
+
+        m->destination = body[0];
+        m->source = body[1];
+        body += ANTS_ADDRESS_HEADER_LENGTH;
+        len -= ANTS_ADDRESS_HEADER_LENGTH;
+    }
+
+    if (ants_is_data_message(type)) {
+        return parse_data_message(c, body, len, m);
+    } else if (ants_is_control_message(type)) {
+        return parse_control_message(c, body, len, m);
+    }
+
+    return ANTS_ERR_FORMAT;
+}
@@ -0,0 +1,240 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * ANTS reference implementation for embedded peers.
+ *
+ * This is a portable C99 implementation of the ANTS wire format:
+ * the DLE escaping, the data and control message frames, the CRC
+ * checksums and a streaming frame decoder. It never allocates memory.
+ * All buffers are passed by the caller. The message sequencing, the
+ * acknowledges and the resends are left to the application.
+ * See protocol.md for the protocol specification.
+ */
+
+#ifndef ANTS_H
+#define ANTS_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Protocol control characters. */
+#define ANTS_SOH 0x01 /* Start of a data message with the enhanced layout. */
+#define ANTS_STX 0x02 /* Start of a data message. */
+#define ANTS_ETX 0x03 /* End of a message. */
+#define ANTS_ENQ 0x05 /* Session handshake. */
+#define ANTS_ACK 0x06 /* Acknowledge. */
+#define ANTS_BEL 0x07 /* Ping. */
+#define ANTS_DLE 0x10 /* Data link escape. */
+#define ANTS_BST 0x12 /* Buffer status. */
+#define ANTS_RSD 0x14 /* Request resend. */
+#define ANTS_NAK 0x15 /* Negative acknowledge. */
+#define ANTS_WAT 0x16 /* Wait. */
+#define ANTS_RDY 0x17 /* Ready. */
+#define ANTS_CAN 0x18 /* Abort. */
+
+/* The unknown message sequence number. Valid numbers range from 1 to 255. */
+#define ANTS_UMSN 0x00
+
+/* The broadcast address of the address header. */
+#define ANTS_BROADCAST_ADDRESS 0xff
+
+/* Data message flags. */
+#define ANTS_FLAG_APPEND_DATA 0x01 /* The binary data is continued in the next message. */
+#define ANTS_FLAG_URGENT      0x02 /* Urgent message which bypasses the bulk queue. */
+#define ANTS_FLAG_DELTA       0x04 /* The binary data is delta encoded. */
+#define ANTS_FLAG_SERVICE     0x08 /* The binary data belongs to a service channel. */
+#define ANTS_FLAG_PIPELINED   0x40 /* The data message was sent within a send window. */
+#define ANTS_FLAG_ENCRYPTED   0x80 /* The binary data is encrypted. */
+
+/* CRC type field of the data message flags. */
+#define ANTS_FLAG_CRC_MASK   0x30
+#define ANTS_FLAG_CRC16      0x10
+#define ANTS_FLAG_CRC32      0x20
+#define ANTS_FLAG_CRC_CUSTOM 0x30
+
+/* Header lengths in bytes. */
+#define ANTS_ENHANCED_HEADER_LENGTH 6 /* MSN | Flags | Length | Header CRC-16 */
+#define ANTS_ADDRESS_HEADER_LENGTH  4 /* Destination | Source | Header CRC-16 */
+
+/*
+ * The maximum frame lengths of data messages with the binary data length
+ * and of control messages with the payload length. In the worst case
+ * every byte of the message body is escaped.
+ */
+#define ANTS_MAX_DATA_FRAME_LENGTH(len) \
+    (2 * (ANTS_ADDRESS_HEADER_LENGTH + ANTS_ENHANCED_HEADER_LENGTH + (len) + 4) + 4)
+#define ANTS_MAX_CONTROL_FRAME_LENGTH(len) \
+    (2 * (ANTS_ADDRESS_HEADER_LENGTH + 1 + (len) + 4) + 4)
+
+/* Return codes. */
+#define ANTS_OK             0
+#define ANTS_ERR_BUFFER    -1 /* The buffer is too small. */
+#define ANTS_ERR_FORMAT    -2 /* The message is malformed. */
+#define ANTS_ERR_CRC       -3 /* A CRC checksum is invalid. */
+#define ANTS_ERR_ARGUMENT  -4 /* An argument is invalid. */
+
+/*###########*/
+/*### CRC ###*/
+/*###########*/
+
+/* The CRC types. The values match the Go implementation. */
+typedef enum {
+    ANTS_CRC16 = 1, /* CRC-16 CCITT (X.25), reversed polynomial 0x8408. */
+    ANTS_CRC32 = 2  /* CRC-32 Koopman, reversed polynomial 0xeb31d82e. */
+} ants_crc_type;
+
+/*
+ * ants_crc16 returns the CRC-16 checksum of the data.
+ * Continue a checksum by passing the previous result as crc,
+ * otherwise pass 0. The checksum is transmitted little-endian.
+ */
+uint16_t ants_crc16(uint16_t crc, const uint8_t *data, size_t len);
+
+/*
+ * ants_crc32 returns the CRC-32 checksum of the data.
+ * Continue a checksum by passing the previous result as crc,
+ * otherwise pass 0. The checksum is transmitted little-endian.
+ */
+uint32_t ants_crc32(uint32_t crc, const uint8_t *data, size_t len);
+
+/* ants_crc_length returns the checksum length of the CRC type in bytes. */
+size_t ants_crc_length(ants_crc_type type);
+
+/*##############*/
+/*### Config ###*/
+/*##############*/
+
+/* The configuration of the wire format. Both peers have to agree on it. */
+typedef struct {
+    ants_crc_type data_crc;    /* CRC type of the transmitted data messages. */
+    ants_crc_type control_crc; /* CRC type of the control messages. */
+    int enhanced_layout;       /* Transmit data messages with the enhanced layout. */
+
+    /* Multi-drop addressing. All nodes on the bus have to enable it. */
+    int addressing;
+    uint8_t address;      /* Address of this node. */
+    uint8_t peer_address; /* Destination address of the transmitted messages. */
+} ants_config;
+
+/* ants_config_init sets the default configuration: CRC-16 without addressing. */
+void ants_config_init(ants_config *c);
+
+/*################*/
+/*### Encoding ###*/
+/*################*/
+
+/*
+ * ants_encode_data_message writes the escaped data message frame to frame:
+ * DLE | STX | MSN | Flags | Binary Data | CRC | DLE | ETX
+ * or with the enhanced layout:
+ * DLE | SOH | MSN | Flags | Length | Header CRC | Binary Data | CRC | DLE | ETX
+ * The CRC type field of the flags is set from the config.
+ * Returns the frame length or ANTS_ERR_BUFFER if the frame does not fit.
+ * Use ANTS_MAX_DATA_FRAME_LENGTH to size the buffer.
+ */
+int ants_encode_data_message(const ants_config *c, uint8_t *frame, size_t cap,
+                             uint8_t msn, uint8_t flags,
+                             const uint8_t *data, size_t len);
+
+/*
+ * ants_encode_control_message writes the escaped control message frame to frame:
+ * DLE | Type | MSN | Payload | CRC | DLE | ETX
+ * Handshake (ENQ) control messages always use CRC-16.
+ * Returns the frame length or ANTS_ERR_BUFFER if the frame does not fit.
+ * Use ANTS_MAX_CONTROL_FRAME_LENGTH to size the buffer.
+ */
+int ants_encode_control_message(const ants_config *c, uint8_t *frame, size_t cap,
+                                uint8_t type, uint8_t msn,
+                                const uint8_t *payload, size_t len);
+
+/*################*/
+/*### Decoding ###*/
+/*################*/
+
+/* Return values of ants_decoder_push. */
+#define ANTS_DECODE_NONE     0 /* More bytes are required. */
+#define ANTS_DECODE_FRAME    1 /* A frame was completed. */
+#define ANTS_DECODE_OVERFLOW 2 /* The frame exceeded the buffer and was discarded. */
+
+/*
+ * A streaming frame decoder. Pass each received byte to ants_decoder_push.
+ * Completed frames are unescaped into the buffer. Bytes outside of frames
+ * are discarded. A start character within a frame starts a new frame.
+ * Reset the decoder if no frame was completed within the read timeout.
+ */
+typedef struct {
+    uint8_t *buf;
+    size_t cap;
+    size_t len;         /* Length of the unescaped message body. */
+    uint8_t start;      /* Start character of the current frame. */
+    uint8_t in_frame;   /* A start character was found. */
+    uint8_t escaped;    /* The previous byte was an unescaped DLE. */
+} ants_decoder;
+
+/* ants_decoder_init initializes the decoder with the message body buffer. */
+void ants_decoder_init(ants_decoder *d, uint8_t *buf, size_t cap);
+
+/* ants_decoder_reset discards the current frame. */
+void ants_decoder_reset(ants_decoder *d);
+
+/*
+ * ants_decoder_push passes a received byte to the decoder.
+ * If ANTS_DECODE_FRAME is returned, then d->start is the start character
+ * and d->buf contains the d->len bytes of the unescaped message body.
+ * Pass them to ants_parse_message before the next byte is pushed.
+ */
+int ants_decoder_push(ants_decoder *d, uint8_t b);
+
+/* A parsed message. The pointers refer to the message body buffer. */
+typedef struct {
+    uint8_t type;        /* Start character: STX, SOH or the control message type. */
+    uint8_t destination; /* Address header, if the addressing is enabled. */
+    uint8_t source;
+    uint8_t msn;         /* MSN of data messages, PMSN of control messages. */
+    uint8_t flags;       /* Flags of data messages. */
+    const uint8_t *payload;
+    size_t payload_len;
+} ants_message;
+
+/* ants_is_data_message returns true if the type is a data message start character. */
+int ants_is_data_message(uint8_t type);
+
+/* ants_is_control_message returns true if the type is a control message type. */
+int ants_is_control_message(uint8_t type);
+
+/*
+ * ants_parse_message validates and parses an unescaped message body
+ * returned by the decoder. Data messages with a CRC type field use the
+ * indicated CRC type, legacy data messages the configured type.
+ * Returns ANTS_OK, ANTS_ERR_FORMAT or ANTS_ERR_CRC. Reply to data messages
+ * with ANTS_ERR_CRC with a negative acknowledge. The application has to
+ * discard messages addressed to other nodes.
+ */
+int ants_parse_message(const ants_config *c, uint8_t type,
+                       const uint8_t *body, size_t len, ants_message *m);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* ANTS_H */
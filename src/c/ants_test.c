@@ -0,0 +1,207 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * Tests of the reference implementation. The expected frames
+ * were created by the Go implementation. Run them with: make test
+ */
+
+#include <stdio.h>
+#include <string.h>
+
+#include "ants.h"
+
+static int failures = 0;
+
+#define CHECK(cond)                                                      \
+    do {                                                                 \
+        if (!(cond)) {                                                   \
+            fprintf(stderr, "%s:%d: check failed: %s\n", __FILE__, __LINE__, #cond); \
+            failures++;                                                  \
+        }                                                                \
+    } while (0)
+
+/* check_frame compares the encoded frame with the expected frame. */
+static void check_frame(int n, const uint8_t *frame, const uint8_t *expected, size_t len)
+{
+    CHECK(n == (int)len);
+    CHECK(n == (int)len && memcmp(frame, expected, len) == 0);
+}
+
+/* decode pushes the bytes to the decoder and parses the first completed frame. */
+static int decode(const ants_config *c, const uint8_t *data, size_t len, ants_message *m)
+{
+    static uint8_t buf[64];
+    ants_decoder d;
+    size_t i;
+
+    ants_decoder_init(&d, buf, sizeof(buf));
+    for (i = 0; i < len; i++) {
+        if (ants_decoder_push(&d, data[i]) == ANTS_DECODE_FRAME) {
+            return ants_parse_message(c, d.start, d.buf, d.len, m);
+        }
+    }
+
+    return ANTS_ERR_FORMAT;
+}
+
+static void test_crc(void)
+{
+    const uint8_t check[] = "123456789";
+
+    CHECK(ants_crc16(0, check, 9) == 0x906e);
+    CHECK(ants_crc32(0, check, 9) == 0x2d3dd0ae);
+
+    /* Checksums can be continued. */
+    CHECK(ants_crc16(ants_crc16(0, check, 4), check + 4, 5) == 0x906e);
+    CHECK(ants_crc32(ants_crc32(0, check, 4), check + 4, 5) == 0x2d3dd0ae);
+}
+
+static void test_encode(void)
+{
+    uint8_t frame[ANTS_MAX_DATA_FRAME_LENGTH(16)];
+    ants_config c;
+    int n;
+
+    ants_config_init(&c);
+
+    {
+        const uint8_t expected[] = {0x10, 0x02, 0x01, 0x10, 0x10, 0x61, 0x6e, 0x74, 0x73, 0x55, 0x01, 0x10, 0x03};
+        n = ants_encode_data_message(&c, frame, sizeof(frame), 1, 0, (const uint8_t *)"ants", 4);
+        check_frame(n, frame, expected, sizeof(expected));
+    }
+    {
+        const uint8_t expected[] = {0x10, 0x06, 0x01, 0xf1, 0xe1, 0x10, 0x03};
+        n = ants_encode_control_message(&c, frame, sizeof(frame), ANTS_ACK, 1, NULL, 0);
+        check_frame(n, frame, expected, sizeof(expected));
+    }
+    {
+        const uint8_t data[] = {0x10, 0x02, 0x10};
+        const uint8_t expected[] = {0x10, 0x02, 0x10, 0x10, 0x21, 0x10, 0x10, 0x02, 0x10, 0x10, 0xfb, 0xbe, 0x18, 0x40, 0x10, 0x03};
+        c.data_crc = ANTS_CRC32;
+        n = ants_encode_data_message(&c, frame, sizeof(frame), 0x10, ANTS_FLAG_APPEND_DATA, data, sizeof(data));
+        check_frame(n, frame, expected, sizeof(expected));
+        c.data_crc = ANTS_CRC16;
+    }
+    {
+        const uint8_t expected[] = {0x10, 0x01, 0x02, 0x12, 0x02, 0x00, 0x35, 0xc6, 0x68, 0x69, 0x8c, 0xa9, 0x10, 0x03};
+        c.enhanced_layout = 1;
+        n = ants_encode_data_message(&c, frame, sizeof(frame), 2, ANTS_FLAG_URGENT, (const uint8_t *)"hi", 2);
+        check_frame(n, frame, expected, sizeof(expected));
+        c.enhanced_layout = 0;
+    }
+    {
+        const uint8_t data[] = {0xff};
+        const uint8_t expected_nak[] = {0x10, 0x15, 0x02, 0x01, 0x7e, 0x2d, 0x03, 0xe3, 0xc2, 0x10, 0x03};
+        const uint8_t expected_data[] = {0x10, 0x02, 0x02, 0x01, 0x7e, 0x2d, 0x03, 0x10, 0x10, 0xff, 0x41, 0xb3, 0x10, 0x03};
+        c.addressing = 1;
+        c.address = 1;
+        c.peer_address = 2;
+        n = ants_encode_control_message(&c, frame, sizeof(frame), ANTS_NAK, 3, NULL, 0);
+        check_frame(n, frame, expected_nak, sizeof(expected_nak));
+        n = ants_encode_data_message(&c, frame, sizeof(frame), 3, 0, data, sizeof(data));
+        check_frame(n, frame, expected_data, sizeof(expected_data));
+    }
+
+    /* Too small buffers are reported. */
+    ants_config_init(&c);
+    CHECK(ants_encode_data_message(&c, frame, 8, 1, 0, (const uint8_t *)"ants", 4) == ANTS_ERR_BUFFER);
+    CHECK(ants_encode_control_message(&c, frame, sizeof(frame), ANTS_STX, 1, NULL, 0) == ANTS_ERR_ARGUMENT);
+}
+
+static void test_decode(void)
+{
+    uint8_t frame[ANTS_MAX_DATA_FRAME_LENGTH(16)];
+    uint8_t stream[2 * sizeof(frame)];
+    const uint8_t data[] = {'a', ANTS_DLE, 'b'};
+    ants_message m;
+    ants_config c;
+    int n;
+
+    ants_config_init(&c);
+    c.enhanced_layout = 1;
+    c.addressing = 1;
+    c.address = 1;
+    c.peer_address = 2;
+
+    /* Round trip of a data message with an escaped DLE character. */
+    n = ants_encode_data_message(&c, frame, sizeof(frame), 7, ANTS_FLAG_SERVICE, data, sizeof(data));
+    CHECK(n > 0);
+    CHECK(decode(&c, frame, (size_t)n, &m) == ANTS_OK);
+    CHECK(m.type == ANTS_SOH);
+    CHECK(m.destination == 2 && m.source == 1);
+    CHECK(m.msn == 7);
+    CHECK((m.flags & ~ANTS_FLAG_CRC_MASK) == ANTS_FLAG_SERVICE);
+    CHECK(m.payload_len == sizeof(data) && memcmp(m.payload, data, sizeof(data)) == 0);
+
+    /* Garbage and an interrupted frame are discarded. */
+    stream[0] = 0xaa;
+    memcpy(stream + 1, frame, 5);
+    memcpy(stream + 6, frame, (size_t)n);
+    CHECK(decode(&c, stream, (size_t)n + 6, &m) == ANTS_OK);
+    CHECK(m.msn == 7);
+
+    /* Corrupted frames are reported. */
+    frame[n - 3] ^= 0x01;
+    CHECK(decode(&c, frame, (size_t)n, &m) == ANTS_ERR_CRC);
+
+    /* Control messages. */
+    n = ants_encode_control_message(&c, frame, sizeof(frame), ANTS_ACK, 7, NULL, 0);
+    CHECK(decode(&c, frame, (size_t)n, &m) == ANTS_OK);
+    CHECK(m.type == ANTS_ACK && m.msn == 7 && m.payload_len == 0);
+
+    /* Flow control messages. */
+    n = ants_encode_control_message(&c, frame, sizeof(frame), ANTS_WAT, ANTS_UMSN, NULL, 0);
+    CHECK(decode(&c, frame, (size_t)n, &m) == ANTS_OK);
+    CHECK(m.type == ANTS_WAT && m.msn == ANTS_UMSN);
+    n = ants_encode_control_message(&c, frame, sizeof(frame), ANTS_RDY, ANTS_UMSN, NULL, 0);
+    CHECK(decode(&c, frame, (size_t)n, &m) == ANTS_OK);
+    CHECK(m.type == ANTS_RDY && m.msn == ANTS_UMSN);
+}
+
+static void test_decoder_overflow(void)
+{
+    uint8_t buf[4];
+    ants_decoder d;
+    const uint8_t stream[] = {ANTS_DLE, ANTS_STX, 1, 2, 3, 4, 5};
+    size_t i;
+    int r = ANTS_DECODE_NONE;
+
+    ants_decoder_init(&d, buf, sizeof(buf));
+    for (i = 0; i < sizeof(stream); i++) {
+        r = ants_decoder_push(&d, stream[i]);
+    }
+    CHECK(r == ANTS_DECODE_OVERFLOW);
+    CHECK(!d.in_frame);
+}
+
+int main(void)
+{
+    test_crc();
+    test_encode();
+    test_decode();
+    test_decoder_overflow();
+
+    if (failures > 0) {
+        fprintf(stderr, "FAIL: %d checks failed\n", failures);
+        return 1;
+    }
+
+    printf("PASS\n");
+    return 0;
+}
@@ -0,0 +1,92 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"fmt"
+)
+
+const (
+	// BroadcastAddress addresses all nodes on a multi-drop bus.
+	BroadcastAddress byte = 0xff
+
+	// Length of the address header: Destination | Source | Header CRC-16
+	addressHeaderLength = 1 + 1 + 2
+)
+
+//##################//
+//### Addressing ###//
+//##################//
+
+// filterAddressHeader validates and removes the address header of a received
+// message body. Returns false if the message is not addressed to this node
+// or was not sent by the peer. Such messages are discarded without a negative
+// acknowledge, because the other nodes on the bus answer them.
+// This method must be only called by the read messages loop.
+func (p *Port) filterAddressHeader(body []byte) ([]byte, bool) {
+	p.decoder.isBroadcast = false
+
+	if !p.config.AddressingEnabled {
+		return body, true
+	}
+
+	if len(body) < addressHeaderLength {
+		p.log.Debugf("read data: discarding message: address header is too short")
+		return nil, false
+	}
+
+	// Validate the header with its checksum. The destination
+	// of a corrupted header is unknown, so discard the message.
+	header := body[:addressHeaderLength-2]
+	if !getCRC16Validator().Validate(header, body[addressHeaderLength-2:addressHeaderLength]) {
+		p.stats.update(func(c *StatsSnapshot) { c.ChecksumErrors++ })
+		p.log.Debugf("read data: discarding message: address header CRC checksum is invalid")
+		return nil, false
+	}
+
+	dst, src := header[0], header[1]
+	if err := p.checkAddresses(dst, src); err != nil {
+		p.log.Debugf("read data: discarding message: %v", err)
+		return nil, false
+	}
+
+	p.decoder.isBroadcast = dst == BroadcastAddress
+	return body[addressHeaderLength:], true
+}
+
+// checkAddresses returns an error if a message with the destination
+// and source address has to be ignored by this node.
+func (p *Port) checkAddresses(dst, src byte) error {
+	if dst != p.config.Address && dst != BroadcastAddress {
+		return fmt.Errorf("addressed to node %v", dst)
+	}
+
+	// A broadcasting node accepts the replies of all nodes.
+	if src != p.config.PeerAddress && p.config.PeerAddress != BroadcastAddress {
+		return fmt.Errorf("sent by node %v", src)
+	}
+
+	return nil
+}
+
+// isBroadcasting returns true if the data messages are sent to all nodes.
+// Broadcast data messages are never acknowledged.
+func (p *Port) isBroadcasting() bool {
+	return p.config.AddressingEnabled && p.config.PeerAddress == BroadcastAddress
+}
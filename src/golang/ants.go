@@ -21,6 +21,9 @@
 package ants
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -33,26 +36,73 @@ import (
 //#################//
 
 const (
-	readChanSize     = 25
-	readBufferSize   = 512
-	readWaitDuration = 50 * time.Millisecond
+	readChanSize          = 8   // Number of queued received chunks.
+	defaultReadBufferSize = 512 // In bytes.
+	readWaitDuration      = 50 * time.Millisecond
+	idleWaitDuration      = 500 * time.Millisecond // Poll interval of idle sources without blocking support.
 
-	maxMessageSize     = 2048 // In bytes.
-	readMessageTimeout = 5 * time.Second
+	minMessageBufferSize      = 2048 // In bytes.
+	maxMessageOverhead        = 16   // Header and CRC checksum of a data message in bytes.
+	defaultMaxMessageSize     = 1024 // In bytes.
+	defaultReadMessageTimeout = 5 * time.Second
+
+	defaultReassemblyTimeout    = 30 * time.Second
+	defaultReassemblyBufferSize = 64 * 1024 // In bytes.
+	peerBufferWaitTimeout       = 5 * time.Second
+
+	maxResendRequests = 16 // Maximum requested messages of one sequence gap.
+
+	maxPartialWriteRetries   = 10
+	partialWriteTimeout      = 1 * time.Second
+	partialWriteWaitDuration = 10 * time.Millisecond
+
+	closeDrainWaitDuration = 10 * time.Millisecond
+
+	defaultEchoWindow = 100 * time.Millisecond
 
 	readControlMessageChanSize = 3
 	readDataChunkChanSize      = 5
-	writeDataChunkChanSize     = 5
+	defaultWriteQueueSize      = 5
+	readUrgentChunkChanSize    = 2
+	writeUrgentChunkChanSize   = 2
 
 	// Protocol constants:
-	dle  = 0x10
-	umsn = 0 // Unknown message sequence number (UMSN)
+	dle        = 0x10
+	umsn       = 0 // Unknown message sequence number (UMSN)
+	initialMSN = 1
+
+	// Data message flags:
+	flagAppendData = 1 << 0 // The binary data is continued in the next message.
+	flagUrgent     = 1 << 1 // Urgent message which bypasses the bulk queue.
+	flagDelta      = 1 << 2 // The binary data is delta encoded.
+	flagService    = 1 << 3 // The binary data belongs to a service channel.
+	flagPipelined  = 1 << 6 // The data message was sent within a send window.
+	flagEncrypted  = 1 << 7 // The binary data is encrypted by the cipher.
+
+	// The CRC type field indicates the checksum variant of the data message.
+	// Zero is set by legacy peers. The configured CRC type is used then.
+	flagCRCMask   = 3 << 4
+	flagCRC16     = 1 << 4
+	flagCRC32     = 2 << 4
+	flagCRCCustom = 3 << 4
+
+	// Header length of data messages with the enhanced layout:
+	// MSN + Flags + Length + Header CRC-16
+	enhancedHeaderLength = 1 + 1 + 2 + 2
 
 	// Protocol control characters:
+	soh = 0x01 // Start of a data message with the enhanced layout.
 	stx = 0x02
 	etx = 0x03
 	ack = 0x06
 	nak = 0x15
+	can = 0x18 // Abort
+	bst = 0x12 // Buffer status
+	rsd = 0x14 // Request resend
+	bel = 0x07 // Ping
+	enq = 0x05 // Session handshake
+	wat = 0x16 // Wait. XON and XOFF are consumed by software flow control.
+	rdy = 0x17 // Ready (ETB)
 )
 
 //#################//
@@ -61,11 +111,50 @@ const (
 
 // Errors:
 var (
+	// ErrAborted is returned by WriteAndConfirm if the transfer
+	// was cancelled with AbortTransfer.
+	ErrAborted = errors.New("transfer aborted")
+
 	// ErrTimeout is thrown if a timeout is reached.
 	ErrTimeout = errors.New("timeout reached")
 
+	// ErrMaxRetriesReached is passed to the OnWriteError hook if the peer
+	// never acknowledged a data chunk and the ARQ strategy gave up.
+	ErrMaxRetriesReached = errors.New("max retries reached")
+
 	// ErrClosed is thrown if the port is closed.
 	ErrClosed = errors.New("port closed")
+
+	// ErrSourceEOF is returned by Port.Err() if the port was closed,
+	// because the source reached the end of file and the
+	// EOF behavior is set to EOFClose.
+	ErrSourceEOF = errors.New("source reached end of file")
+
+	// ErrBreakerOpen is returned by the write methods if the circuit breaker
+	// paused the transmission after sustained failures.
+	ErrBreakerOpen = errors.New("circuit breaker open: transmission paused")
+
+	// ErrResponderMode is returned by the read and write methods
+	// if the port runs in responder mode.
+	ErrResponderMode = errors.New("port is in responder mode")
+
+	// ErrWriteQueueFull is returned by TryWrite if the write queue is full.
+	ErrWriteQueueFull = errors.New("write queue full")
+
+	// ErrNotReconfigurable is returned by Reconfigure if the
+	// source does not implement the ReconfigurableSource interface.
+	ErrNotReconfigurable = errors.New("source does not support reconfiguration")
+
+	// ErrNoModemControl is returned by the modem control methods if the
+	// source does not implement the ModemControlSource interface.
+	ErrNoModemControl = errors.New("source does not support modem control")
+
+	// ErrNotSuspended is returned by Resume if the port is not suspended.
+	ErrNotSuspended = errors.New("port is not suspended")
+
+	// ErrNoHandshakeReply is returned by ProbeHandshake
+	// if no peer replied to the handshake requests.
+	ErrNoHandshakeReply = errors.New("no handshake reply from the peer")
 )
 
 //#############################//
@@ -74,7 +163,55 @@ var (
 
 type controlMessage struct {
 	TypeCharacter byte
-	MSN           byte // Message sequence number.
+	MSN           byte      // Message sequence number.
+	Reason        NakReason // Reason of a negative acknowledge.
+}
+
+// answers returns a boolean whenever the control message is
+// a reply to the data message with the passed message sequence number.
+func (cm controlMessage) answers(msn byte) bool {
+	// A negative acknowledge with the unknown message sequence number
+	// refers to the current data message. The peer could not extract
+	// the message sequence number from the corrupted message.
+	if cm.TypeCharacter == nak && cm.MSN == umsn {
+		return true
+	}
+
+	return cm.MSN == msn
+}
+
+//########################//
+//### Write Chunk type ###//
+//########################//
+
+// writeChunk is a queued bulk data chunk.
+type writeChunk struct {
+	data    []byte
+	buf     *Buffer    // Released once the data chunk was written. Might be nil.
+	confirm chan error // Receives the transmission result. Nil if not confirmed.
+	noAck   bool       // The data messages are never acknowledged.
+}
+
+//#############################//
+//### Message Decoder type ###//
+//#############################//
+
+// receivedChunk are the bytes of a single source read with their arrival time.
+// The time is only set if timestamping is enabled. The buffer is returned
+// to the free read buffers after the bytes were decoded.
+type receivedChunk struct {
+	buf  []byte
+	data []byte
+	t    time.Time
+}
+
+// messageDecoder is the state of the received message decoder.
+type messageDecoder struct {
+	frame       *FrameDecoder
+	deadline    time.Time // Timeout of the current message. Zero if none is in progress.
+	startTime   time.Time // Arrival of the start character, if timestamping is enabled.
+	endTime     time.Time // Arrival of the end character, if timestamping is enabled.
+	isBroadcast bool      // The current message was sent to the broadcast address.
 }
 
 //#################//
@@ -83,22 +220,117 @@ type controlMessage struct {
 
 // A Port is an open port which reads and writes from a source.
 type Port struct {
-	source io.ReadWriteCloser
+	config *Config
+	log    Logger
+
+	source      io.ReadWriteCloser
+	sourceMutex sync.Mutex
+	writeMutex  sync.Mutex    // Serializes the message frames written to the source.
+	suspended   bool          // Protected by the source mutex.
+	resumeChan  chan struct{} // Closed and replaced on each resume. Protected by the source mutex.
 
 	isClosed   bool
+	closeErr   error
 	closeChan  chan struct{}
 	closeMutex sync.Mutex
+	onClose    func() // Called once the port is closed.
 
-	readChan               chan byte
+	readChan               chan receivedChunk
+	readBufferChan         chan []byte // Free read buffers.
+	readBuffers            int         // Number of allocated read buffers. Only used by the read from source routine.
 	readBinaryDataBuffer   []byte
+	readBinaryDataTime     time.Time // Arrival of the last appended binary data.
+	readBinaryDataStart    time.Time // Arrival of the first data message, if timestamping is enabled.
+	readBinaryDataOverflow bool      // Drop the current transmission.
+	readBinaryDataMessages int       // Number of data messages of the current transmission.
+	readDuplicates         bool      // Duplicates of the current transmission were suppressed.
+	readLastPMSN           byte      // The last received peer message sequence number.
+	readLastPMSNValid      bool
+	readAckedPMSN          byte // The last acknowledged peer message sequence number.
+	readAckedPMSNValid     bool
+	readAckedChecksum      []byte    // CRC checksum of the last acknowledged data message.
+	readSequenceTime       time.Time // Arrival of the last valid data message.
+	reassemblyTimer        Timer     // Only used by the read messages routine.
 	readControlMessageChan chan controlMessage
+	decoder                messageDecoder // Only used by the read messages routine.
+	lineErrors             lineErrorState // Only used by the read routine.
+	poolJobChan            chan func()
+	poolScheduled          int32 // Atomic flag. Set if the port is queued on the decoder pool.
+
+	msn byte // The current message sequence number.
+
+	// Debug state, which is published by the loop routines.
+	stateMutex     sync.Mutex
+	inFlight       *InFlightFrame
+	inFlightFrames []InFlightFrame // Data messages of the send window.
+	pendingWrites  int
+	readDebugInfo  readDebugInfo
 
-	readDataChunkChan  chan []byte
-	writeDataChunkChan chan []byte
+	readDataChunkChan  chan *Message
+	writeDataChunkChan chan writeChunk
+	readPendingDone    chan struct{} // Closed once the pending data chunk was delivered. Only used by the read messages loop.
 
-	crc16Validator          crcValidator
-	dataMessageCRCValidator crcValidator
-	dataMessageCRCLength    int // Bytes counted.
+	readUrgentChunkChan  chan *Message
+	writeUrgentChunkChan chan []byte
+
+	dataHandlerMutex    sync.Mutex
+	dataHandlerStopChan chan struct{} // Closed to stop the data handler workers.
+	typeHandlers        map[byte]func(payload []byte)
+	typeHandlersMutex   sync.RWMutex
+
+	writeServiceChunkChan chan []byte
+	services              map[byte]*Service
+	servicesMutex         sync.Mutex
+
+	rpcOnce    sync.Once
+	rpcMutex   sync.Mutex
+	rpcID      uint16
+	rpcPending map[uint16]chan rpcResult
+	rpcHandler func(request []byte) []byte
+
+	abortChan chan struct{}
+
+	lastReceived    int64 // Atomic Unix nanoseconds of the last received bytes.
+	lastTransmitted int64 // Atomic Unix nanoseconds of the last transmitted bytes.
+	linkDown        int32 // Atomic flag. Set if the link supervision detected a silent link.
+
+	peerInfo      *PeerInfo // Parameters of the peer. Protected by the state mutex.
+	handshakeChan chan struct{}
+
+	session          *session          // Session of the encrypted data chunks. Protected by the state mutex.
+	sessionInitiator *sessionInitiator // Pending sent session handshake. Protected by the state mutex.
+	sessionResponder *sessionResponder // Pending received session handshake. Only used by the read messages loop.
+
+	pingMutex     sync.Mutex
+	pingNonce     byte
+	pingReplyChan chan byte
+
+	writeDeltaBase  []byte // Only used by the write loop.
+	writeDeltaCount int    // Delta encoded data chunks since the last keyframe.
+	readDeltaBase   []byte // Only used by the read messages loop.
+
+	echo *echoCanceller // Nil if the echo cancellation is disabled.
+
+	window          *sendWindow               // Nil for stop-and-wait. Only used by the write loop.
+	readReorder     map[byte]reorderedMessage // Out of order data messages of the peer's send window.
+	readReorderTime time.Time                 // Arrival of the first out of order data message.
+
+	eventListeners []func(e Event) // Internal listeners. Copied on write.
+	eventMutex     sync.Mutex
+
+	stats      Stats
+	throughput throughputMeter
+	breaker    *breaker // Nil if the circuit breaker is disabled.
+
+	writeRateLimiter *rateLimiter
+	readRateLimiter  *rateLimiter
+
+	peerFreeBuffer       int  // Free reassembly buffer space of the peer. -1 if unknown.
+	peerWaiting          bool // Set if the peer asked to pause the transmission.
+	peerBufferMutex      sync.Mutex
+	peerBufferUpdateChan chan struct{}
+
+	codec *FrameCodec
 }
 
 // NewPort creates and returns a new ANTS port.
@@ -118,62 +350,170 @@ func NewPort(source io.ReadWriteCloser, config ...*Config) *Port {
 
 	// Create a new port.
 	p := &Port{
+		config:                 c,
+		log:                    c.Logger,
 		source:                 source,
 		closeChan:              make(chan struct{}),
-		readChan:               make(chan byte, readChanSize),
-		readControlMessageChan: make(chan controlMessage, readControlMessageChanSize),
-		readDataChunkChan:      make(chan []byte, readDataChunkChanSize),
-		writeDataChunkChan:     make(chan []byte, writeDataChunkChanSize),
-		crc16Validator:         getCRC16Validator(),
-	}
-
-	// Set the data message CRC length depending on the config CRC type.
-	// Also set the CRC validator.
-	if c.DataMessageCRC == CRC32 {
-		p.dataMessageCRCValidator = getCRC32Validator()
-		p.dataMessageCRCLength = 4
-	} else {
-		p.dataMessageCRCValidator = getCRC16Validator()
-		p.dataMessageCRCLength = 2
+		resumeChan:             make(chan struct{}),
+		readChan:               make(chan receivedChunk, readChanSize),
+		readBufferChan:         make(chan []byte, readChanSize+2),
+		readControlMessageChan: make(chan controlMessage, readControlMessageChanSize+2*c.SendWindow),
+		readDataChunkChan:      make(chan *Message, readDataChunkChanSize),
+		writeDataChunkChan:     make(chan writeChunk, c.WriteQueueSize),
+		readUrgentChunkChan:    make(chan *Message, readUrgentChunkChanSize),
+		writeUrgentChunkChan:   make(chan []byte, writeUrgentChunkChanSize),
+		writeServiceChunkChan:  make(chan []byte, writeServiceChunkChanSize),
+		services:               make(map[byte]*Service),
+		abortChan:              make(chan struct{}, 1),
+		pingReplyChan:          make(chan byte, 1),
+		handshakeChan:          make(chan struct{}, 1),
+		peerFreeBuffer:         -1,
+		peerBufferUpdateChan:   make(chan struct{}, 1),
+		msn:                    initialMSN,
+		writeRateLimiter:       newRateLimiter(c.WriteRateLimit),
+		readRateLimiter:        newRateLimiter(c.ReadRateLimit),
+		codec:                  newFrameCodec(c),
+	}
+
+	// Create the received message decoder.
+	// The escaped frames are only collected for the raw frame hook.
+	p.decoder.frame = p.codec.NewDecoder()
+	p.decoder.frame.keepRaw = c.OnRawFrameReceived != nil
+
+	// The pre-shared key is used for all data chunks,
+	// unless the session handshake agrees on a session.
+	if c.Cipher != nil && !c.hasSessionHandshake() {
+		p.session = &session{cipher: c.Cipher}
+	}
+
+	// Report key exchanges, which can't authenticate the peer.
+	if c.KeyExchange != nil {
+		if err := c.KeyExchange.validate(); err != nil {
+			p.log.Errorf("%v", err)
+		}
+	}
+
+	// Enable the echo cancellation for half-duplex buses.
+	if c.EchoCancellation {
+		p.echo = newEchoCanceller(c.EchoWindow)
 	}
 
+	// Start the counting period of the statistics.
+	p.stats.Reset()
+
+	// The link supervision starts with the creation of the port.
+	p.markReceived()
+	p.markTransmitted()
+
+	// Create the circuit breaker if enabled.
+	p.breaker = newBreaker(p)
+
+	// Create the send window if enabled.
+	p.window = newSendWindow(c.SendWindow, c.Clock)
+
 	// Start the loop goroutines.
+	// The received messages are either decoded by an own goroutine or on the decoder pool.
+	if c.DecoderPool != nil {
+		p.poolJobChan = make(chan func(), poolJobChanSize)
+		p.startPoolTimers()
+	} else {
+		// Create the reassembly timer in a stopped state.
+		// It is started as soon as partial binary data is buffered.
+		p.reassemblyTimer = newStoppedTimer(c.Clock)
+
+		go p.readMessagesLoop()
+	}
 	go p.readFromSourceLoop()
-	go p.readMessagesLoop()
 	go p.writeDataMessagesLoop()
 
+	if c.Responder != nil {
+		go p.respondLoop()
+	}
+
+	if c.KeepaliveInterval > 0 || c.LinkTimeout > 0 {
+		go p.keepaliveLoop()
+	}
+
 	return p
 }
 
 // IsClosed returns a boolean whenever the port is closed.
 func (p *Port) IsClosed() bool {
-	return p.isClosed
+	select {
+	case <-p.closeChan:
+		return true
+	default:
+		return false
+	}
 }
 
-// Close the serial port.
-func (p *Port) Close() error {
+// Err returns the error which caused the port to close.
+// Nil is returned if the port is open or if it was closed by calling Close().
+func (p *Port) Err() error {
 	// Lock the mutex.
 	p.closeMutex.Lock()
 	defer p.closeMutex.Unlock()
 
-	// Return if already closed.
-	if p.isClosed {
-		return nil
+	return p.closeErr
+}
+
+// Close the serial port.
+func (p *Port) Close() error {
+	return p.close(nil)
+}
+
+// CloseContext closes the serial port gracefully. It waits until all queued
+// data chunks were transmitted and tells the peer to discard any partially
+// received data before the port is closed.
+// If the context is done before, then the port and its source are closed
+// immediately and the context's error is returned.
+func (p *Port) CloseContext(ctx context.Context) error {
+	// Wait until the write queues are drained.
+	ticker := time.NewTicker(closeDrainWaitDuration)
+	defer ticker.Stop()
+
+	for p.hasPendingWrites() {
+		select {
+		case <-p.closeChan:
+			// Already closed.
+			return nil
+
+		case <-ctx.Done():
+			// Forcibly tear down the port.
+			p.log.Warningf("close: %v: closing port without draining the write queues", ctx.Err())
+			if err := p.close(nil); err != nil {
+				return err
+			}
+			return ctx.Err()
+
+		case <-ticker.C:
+		}
 	}
 
-	// Set the flag.
-	p.isClosed = true
+	// Notify the peer. Nothing is in flight anymore, so the abort
+	// control message only discards stale partial data of the peer.
+	// A responder never initiates a transmission.
+	if !p.IsClosed() && p.config.Responder == nil {
+		p.writeControlMessage(can, p.currentMSN())
+	}
 
-	// Close the close channel.
-	close(p.closeChan)
+	return p.close(nil)
+}
 
-	// Close the source
-	err := p.source.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close port's source: %v", err)
+// CloseGracefully closes the serial port like CloseContext, but waits at
+// most for the timeout until the queued data chunks were transmitted and
+// acknowledged. If the timeout is reached, then the port and its source
+// are closed immediately and ErrTimeout is returned.
+func (p *Port) CloseGracefully(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := p.CloseContext(ctx)
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
 	}
 
-	return nil
+	return err
 }
 
 // Read a verified data chunk from the serial port.
@@ -181,194 +521,1237 @@ func (p *Port) Close() error {
 // If the timeout is reached, then ErrTimeout is returned.
 // If the port is closed, then ErrClosed is returned.
 func (p *Port) Read(timeout ...time.Duration) (data []byte, err error) {
-	timeoutChan := make(chan (struct{}))
+	m, err := p.ReadMessage(timeout...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
 
-	// Create a timeout timer if a timeout is specified.
-	if len(timeout) > 0 && timeout[0] > 0 {
-		timer := time.AfterFunc(timeout[0], func() {
-			// Trigger the timeout by closing the channel.
-			close(timeoutChan)
-		})
+// ReadMessage reads a verified data chunk from the serial port
+// including its reception metadata.
+// Optionally pass a timeout duration.
+// If the timeout is reached, then ErrTimeout is returned.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) ReadMessage(timeout ...time.Duration) (*Message, error) {
+	return p.readChunk(p.readDataChunkChan, p.readRateLimiter, timeout...)
+}
 
-		// Always stop the timer on defer.
-		defer timer.Stop()
+// ReadUrgent reads a verified urgent data chunk from the serial port.
+// Urgent data chunks are delivered separately from the data chunks returned by Read.
+// Optionally pass a timeout duration.
+// If the timeout is reached, then ErrTimeout is returned.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) ReadUrgent(timeout ...time.Duration) (data []byte, err error) {
+	m, err := p.readChunk(p.readUrgentChunkChan, nil, timeout...)
+	if err != nil {
+		return nil, err
 	}
+	return m.Data, nil
+}
 
-	// Read from the data channel or timeout.
-	select {
-	case <-p.closeChan:
-		return nil, ErrClosed
-	case <-timeoutChan:
-		return nil, ErrTimeout
-	case data = <-p.readDataChunkChan:
-		return data, nil
-	}
+// ReadUrgentMessage reads a verified urgent data chunk from the serial port
+// including its reception metadata.
+// Optionally pass a timeout duration.
+// If the timeout is reached, then ErrTimeout is returned.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) ReadUrgentMessage(timeout ...time.Duration) (*Message, error) {
+	return p.readChunk(p.readUrgentChunkChan, nil, timeout...)
 }
 
 // Write a data chunk to the port.
+// This method blocks as long as the write queue is full.
 // If the port is closed, then ErrClosed is returned.
 func (p *Port) Write(data []byte) error {
-	if p.isClosed {
-		return ErrClosed
-	}
+	return p.queueDataChunk(writeChunk{data: data}, true)
+}
 
-	// Just write to the channel.
-	p.writeDataChunkChan <- data
+// WriteNoAck writes a data chunk to the port without waiting for an
+// acknowledgement. Its data messages are transmitted only once and are
+// never acknowledged by the peer, so the data chunk might get lost.
+// Use it to transmit to multiple receivers on a shared bus, which can't
+// all acknowledge. Unacknowledged data chunks are never delta encoded.
+// This method blocks as long as the write queue is full.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) WriteNoAck(data []byte) error {
+	return p.queueDataChunk(writeChunk{data: data, noAck: true}, true)
+}
 
-	return nil
+// TryWrite writes a data chunk to the port like Write, but never blocks.
+// ErrWriteQueueFull is returned if the write queue is full. Use it with
+// PendingWrites to apply backpressure to the data source.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) TryWrite(data []byte) error {
+	return p.queueDataChunk(writeChunk{data: data}, false)
 }
 
-//#######################//
-//### Private methods ###//
-//#######################//
+// PendingWrites returns the number of data chunks, which were passed
+// to the write methods and are queued or not acknowledged yet.
+// This includes urgent and service data chunks.
+func (p *Port) PendingWrites() int {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	return p.pendingWrites
+}
 
-func (p *Port) closeAndLogError() {
-	err := p.Close()
+// WriteBuffer writes the data chunk of the buffer to the port like Write.
+// The buffer is released to the pool once the data chunk was written
+// or if an error is returned. It must not be used after the call.
+// This method blocks as long as the write queue is full.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) WriteBuffer(b *Buffer) error {
+	err := p.queueDataChunk(writeChunk{data: b.B, buf: b}, true)
 	if err != nil {
-		Log.Errorf("failed to close port: %v", err)
+		b.Release()
 	}
+	return err
 }
 
-func (p *Port) writeDataMessagesLoop() {
-	for {
-		select {
-		case <-p.closeChan:
-			// Just release this goroutine if the port is closed.
-			return
-		case data := <-p.writeDataChunkChan:
-			// Escape the data.
-			data = escapeDLE(data)
-
-			// Prepend the escaped STX control character.
-			data = append([]byte{dle, stx}, data...)
+// WriteAndConfirm writes a data chunk to the port like Write, but blocks
+// until the peer acknowledged all of its data messages.
+// The data chunk is never coalesced with other data chunks.
+// Optionally pass a timeout. ErrTimeout is returned if the timeout is reached.
+// The data chunk stays queued and might still be transmitted afterwards.
+// ErrMaxRetriesReached is returned if the ARQ strategy gave up and ErrAborted
+// if the transfer was cancelled. If the port is closed, then ErrClosed is returned.
+func (p *Port) WriteAndConfirm(data []byte, timeout ...time.Duration) error {
+	if p.config.Responder != nil {
+		return ErrResponderMode
+	} else if err := p.breaker.allow(); err != nil {
+		return err
+	}
 
-			// Calculate the CRC checksum.
-			crc := p.dataMessageCRCValidator.Checksum(data)
+	var timeoutChan <-chan time.Time
+	if len(timeout) > 0 && timeout[0] > 0 {
+		timer := time.NewTimer(timeout[0])
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
 
-			// Escape the CRC.
-			crc = escapeDLE(crc)
+	// Track the pending data chunk until it was written.
+	p.addPendingWrites(1)
 
-			// Append the CRC.
-			data = append(data, crc...)
+	// The write routine never blocks on the buffered channel.
+	c := writeChunk{data: data, confirm: make(chan error, 1)}
 
-			// Append the escaped ETX control character.
-			data = append(data, []byte{dle, etx}...)
+	select {
+	case <-p.closeChan:
+		p.addPendingWrites(-1)
+		return ErrClosed
+	case <-timeoutChan:
+		p.addPendingWrites(-1)
+		return ErrTimeout
+	case p.writeDataChunkChan <- c:
+	}
 
-			// Resend the data until an acknowledge control character is received.
-		ResendLoop:
-			for {
-				// Write the data to the source.
-				err := p.writeToSource(data)
-				if err != nil {
-					// Log the error and close the port.
-					Log.Errorf("failed to write data to the source: %v", err)
-					p.closeAndLogError()
-					return
-				}
+	// Wait for the acknowledgement.
+	select {
+	case <-p.closeChan:
+		return ErrClosed
+	case <-timeoutChan:
+		return ErrTimeout
+	case err := <-c.confirm:
+		return err
+	}
+}
 
-				// TODO: Add timeout.
+// WriteUrgent writes an urgent data chunk to the port.
+// Urgent data chunks bypass the queued data chunks passed to Write
+// and are delivered to ReadUrgent on the peer side.
+// Use this for small emergency-stop style commands, which must not
+// wait behind a large bulk transfer. Urgent data chunks are never
+// split into multiple data messages.
+// This method blocks as long as the urgent write queue is full.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) WriteUrgent(data []byte) error {
+	if p.config.Responder != nil {
+		return ErrResponderMode
+	} else if err := p.breaker.allow(); err != nil {
+		return err
+	}
 
-				// Wait for a control character as response.
-				select {
-				case cm := <-p.readControlMessageChan:
-					// Break the resend loop on a successful transmission.
-					if cm.TypeCharacter == ack {
-						break ResendLoop
-					}
+	// Track the pending data chunk until it was written.
+	p.addPendingWrites(1)
 
-					// Otherwise resend the data.
-					continue ResendLoop
-				}
-			}
-		}
+	select {
+	case <-p.closeChan:
+		p.addPendingWrites(-1)
+		return ErrClosed
+	case p.writeUrgentChunkChan <- data:
+		return nil
 	}
 }
 
-func (p *Port) writeControlMessage(ctrlType byte, msn byte) {
-	// TODO
+// AbortTransfer cancels the data message transmission which is currently in progress.
+// The message is not resent anymore and an abort control message is sent
+// to the peer, which discards its partially received binary data.
+// Use this to cancel a large transfer without leaving both sides
+// holding half of the data. Queued data chunks are not affected.
+// Urgent data chunks, which are interleaved with the transfer, are
+// never aborted. This method never blocks.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) AbortTransfer() error {
+	if p.IsClosed() {
+		return ErrClosed
+	}
+
+	// The write loop handles the request at its next wait point.
+	p.requestAbort()
+	return nil
 }
 
-// writeToSource writes the data bytes to the source.
-func (p *Port) writeToSource(data []byte) (err error) {
-	// Catch all panics, and return the error.
-	// Panics could occur in the p.source.Write call, which is third-party code...
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("panic: write data to source: %v", e)
-		}
-	}()
+//#######################//
+//### Private methods ###//
+//#######################//
 
-	// Write to the source.
-	n, err := p.source.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write to source: %v", err)
+// queueDataChunk pushes the data chunk to the write queue.
+// If block is set, then this method blocks as long as the write queue
+// is full. Otherwise ErrWriteQueueFull is returned.
+func (p *Port) queueDataChunk(c writeChunk, block bool) error {
+	if p.config.Responder != nil {
+		return ErrResponderMode
+	} else if err := p.breaker.allow(); err != nil {
+		return err
 	}
 
-	// Check if data was partially transmitted.
-	if n != len(data) {
-		// Send the escaped ETX control character and dismiss any write error.
-		// Pretend as no error occurred. The peer will request a resend...
-		_, _ = p.source.Write([]byte{dle, etx})
+	// Track the pending data chunk until it was written.
+	p.addPendingWrites(1)
 
-		// Log
-		Log.Warningf("write data to source: failed to send complete data chunk: data was only transmitted partially")
+	// Try to push the data to the write channel without blocking.
+	select {
+	case <-p.closeChan:
+		p.addPendingWrites(-1)
+		return ErrClosed
+	case p.writeDataChunkChan <- c:
+		return nil
+	default:
+		if !block {
+			p.addPendingWrites(-1)
+			return ErrWriteQueueFull
+		}
 	}
 
-	return nil
+	// Wait until the write channel has room, but never block
+	// if the port gets closed in the meantime.
+	select {
+	case <-p.closeChan:
+		p.addPendingWrites(-1)
+		return ErrClosed
+	case p.writeDataChunkChan <- c:
+		return nil
+	}
 }
 
-func (p *Port) readFromSourceLoop() {
-	// Catch all panics, log the error and close the port.
-	// Panics could occur in the p.source.Read call, which is third-party code...
-	defer func() {
-		if e := recover(); e != nil {
-			Log.Errorf("panic: read data from source: %v", e)
-			p.closeAndLogError()
-		}
-	}()
+// readChunk reads a data chunk from the channel with an optional timeout.
+// The data chunks are released at the pace of the optional rate limiter.
+// They stay queued as long as the rate limiter holds them back.
+func (p *Port) readChunk(c chan *Message, limiter *rateLimiter, timeout ...time.Duration) (m *Message, err error) {
+	// The received data chunks are passed to the responder hook.
+	if p.config.Responder != nil {
+		return nil, ErrResponderMode
+	}
 
-	// The read buffer.
-	buf := make([]byte, readBufferSize)
+	timeoutChan := make(chan (struct{}))
 
-	// Read from the source as long as the port is open.
-	for !p.isClosed {
-		// Read data from the source.
-		n, err := p.source.Read(buf)
-		if err != nil && err != io.EOF {
-			// Log the error and close the port.
-			Log.Errorf("failed to read data from source: %v", err)
-			p.closeAndLogError()
-			return
-		}
+	// Create a timeout timer if a timeout is specified.
+	if len(timeout) > 0 && timeout[0] > 0 {
+		timer := time.AfterFunc(timeout[0], func() {
+			// Trigger the timeout by closing the channel.
+			close(timeoutChan)
+		})
 
-		// If nothing was received, then read again after a short timeout.
-		if n == 0 {
-			time.Sleep(readWaitDuration)
-			continue
-		}
+		// Always stop the timer on defer.
+		defer timer.Stop()
+	}
 
-		// Iterate through all received bytes and push them to the read channel.
-		for _, b := range buf[:n] {
-			p.readChan <- b
-		}
+	// Wait for the rate limiter before the data chunk is dequeued.
+	if err = limiter.waitUntilReady(p.closeChan, timeoutChan); err != nil {
+		return nil, err
+	}
+
+	// Read from the data channel or timeout.
+	select {
+	case <-p.closeChan:
+		return nil, ErrClosed
+	case <-timeoutChan:
+		return nil, ErrTimeout
+	case m = <-c:
+		limiter.take(len(m.Data))
+		return m, nil
 	}
 }
 
-func (p *Port) readMessagesLoop() {
-	var buf []byte
-	var controlCharacter byte
+// close the port and set the cause, which is returned by Err().
+func (p *Port) close(cause error) error {
+	// Lock the mutex.
+	p.closeMutex.Lock()
 
-	// Flags:
-	isControlMessage := false
-	startCharacterFound := false
-	byteIsEscaped := false
+	// Return if already closed.
+	if p.isClosed {
+		p.closeMutex.Unlock()
+		return nil
+	}
 
-	// Create a new timeout timer in a stopped state.
-	timeoutTimer := time.NewTimer(readMessageTimeout)
-	timeoutTimer.Stop()
+	// Set the flag and the cause.
+	p.isClosed = true
+	p.closeErr = cause
 
-	// Close the timeout always on exit.
-	defer timeoutTimer.Stop()
+	// Close the close channel.
+	close(p.closeChan)
+
+	// Unlock the mutex. Only the first call reaches this point,
+	// so the hooks below may call Err() without a deadlock.
+	p.closeMutex.Unlock()
+
+	// Close the source
+	err := p.getSource().Close()
+
+	// Release the resources of the port pool.
+	if p.onClose != nil {
+		p.onClose()
+	}
+
+	// Report the cause to the application.
+	if cause != nil && p.config.OnError != nil {
+		p.config.OnError(cause)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to close port's source: %v", err)
+	}
+
+	return nil
+}
+
+// closeAndLogError closes the port with the passed cause and logs any close error.
+func (p *Port) closeAndLogError(cause error) {
+	err := p.close(cause)
+	if err != nil {
+		p.log.Errorf("failed to close port: %v", err)
+	}
+}
+
+// getSource returns the current source.
+func (p *Port) getSource() io.ReadWriteCloser {
+	// Lock the mutex.
+	p.sourceMutex.Lock()
+	defer p.sourceMutex.Unlock()
+
+	return p.source
+}
+
+// reconnectSource closes the current source and replaces it
+// with a new one obtained from the OnEOF hook or the transport.
+func (p *Port) reconnectSource() error {
+	// Close the old source and dismiss the error.
+	// It reached the end of file anyway.
+	_ = p.getSource().Close()
+
+	// Obtain the new source.
+	source, err := p.redial()
+	if err != nil {
+		return fmt.Errorf("failed to reconnect source: %v", err)
+	} else if source == nil {
+		return fmt.Errorf("failed to reconnect source: nil source returned")
+	}
+
+	// Lock the close mutex to prevent a concurrent close.
+	p.closeMutex.Lock()
+	defer p.closeMutex.Unlock()
+
+	// Don't leak the new source if the port was closed in the meantime.
+	if p.isClosed {
+		_ = source.Close()
+		return ErrClosed
+	}
+
+	// Replace the source.
+	p.sourceMutex.Lock()
+	p.source = source
+	p.sourceMutex.Unlock()
+
+	return nil
+}
+
+func (p *Port) writeDataMessagesLoop() {
+	var chunk writeChunk
+	var next *writeChunk
+	var flags byte
+
+	// Exchange the parameters with the peer before the first data chunk.
+	// A responder never initiates a transmission.
+	if p.config.Handshake && p.config.Responder == nil {
+		p.handshake()
+	}
+
+	for {
+		// A bulk data chunk, which did not fit into the previous
+		// coalesced data chunk, is transmitted first.
+		if next != nil {
+			chunk, flags, next = *next, 0, nil
+		} else {
+			// Urgent data chunks have a precedence over the bulk data chunks.
+			if !p.nextWriteChunk(&chunk, &flags) {
+				return
+			}
+		}
+
+		// Merge tiny bulk data chunks written within the coalesce window.
+		// Confirmed and unacknowledged data chunks are never merged.
+		chunks := 1
+		if flags == 0 && chunk.confirm == nil && !chunk.noAck && p.config.CoalesceWindow > 0 {
+			chunk.data, chunks, next = p.coalesceDataChunks(chunk.data)
+		}
+
+		// Write the data chunk. The send window reports the result
+		// as soon as all data messages were acknowledged.
+		if p.window != nil && !chunk.noAck {
+			if p.writeDataChunkWindowed(flags, chunk, chunks) == ErrClosed {
+				return
+			}
+			continue
+		}
+
+		err := p.writeDataChunk(flags, chunk.data, chunk.noAck)
+		p.completeDataChunk(chunk, chunks, err)
+		if err == ErrClosed {
+			return
+		}
+	}
+}
+
+// nextWriteChunk waits for the next data chunk to transmit.
+// Returns false if the port was closed.
+func (p *Port) nextWriteChunk(chunk *writeChunk, flags *byte) bool {
+	var data []byte
+
+	for {
+		// Urgent data chunks have a precedence over the bulk data chunks.
+		select {
+		case <-p.closeChan:
+			// Just release this goroutine if the port is closed.
+			return false
+		case data = <-p.writeUrgentChunkChan:
+			*chunk, *flags = writeChunk{data: data}, flagUrgent
+			return true
+		default:
+			select {
+			case <-p.closeChan:
+				// Just release this goroutine if the port is closed.
+				return false
+			case data = <-p.writeUrgentChunkChan:
+				*chunk, *flags = writeChunk{data: data}, flagUrgent
+				return true
+			case *chunk = <-p.writeDataChunkChan:
+				*flags = 0
+				return true
+			case data = <-p.writeServiceChunkChan:
+				*chunk, *flags = writeChunk{data: data}, flagService
+				return true
+			case cm := <-p.windowControlMessages():
+				p.handleWindowControlMessage(cm)
+			case <-p.windowTimeout():
+				p.handleWindowTimeouts()
+			case <-p.abortChan:
+				if p.window != nil && len(p.window.frames) > 0 {
+					p.giveUpWindow(ErrAborted)
+				} else {
+					// Nothing is in progress, but the peer might still hold
+					// partial data of a previous transmission.
+					p.writeControlMessage(can, p.currentMSN())
+				}
+			}
+		}
+	}
+}
+
+// coalesceDataChunks merges the bulk data chunks, which are written within
+// the coalesce window, into one data chunk of at most MaxMessageSize bytes.
+// Returns the merged data chunk, the number of merged data chunks and
+// a data chunk, which did not fit or has to be confirmed, and has to
+// be transmitted next. Urgent data chunks never wait for the coalesce
+// window. They are transmitted first and the merged data chunk is
+// returned early.
+func (p *Port) coalesceDataChunks(data []byte) (merged []byte, chunks int, next *writeChunk) {
+	maxSize := p.maxMessageSize()
+	if len(data) >= maxSize {
+		return data, 1, nil
+	}
+
+	// Never modify the data chunk passed to Write.
+	merged = append(make([]byte, 0, maxSize), data...)
+	chunks = 1
+
+	timer := time.NewTimer(p.config.CoalesceWindow)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.closeChan:
+			return merged, chunks, nil
+		case <-timer.C:
+			return merged, chunks, nil
+		case <-p.abortChan:
+			// The merged data chunk is the transfer in progress.
+			// Keep the request, so its transmission is aborted.
+			p.requestAbort()
+			return merged, chunks, nil
+		case urgent := <-p.writeUrgentChunkChan:
+			// Errors close the port, which is handled by the write loop.
+			if p.writeUrgentChunk(urgent) == nil {
+				_ = p.writePendingUrgentChunks()
+			}
+			return merged, chunks, nil
+		case c := <-p.writeDataChunkChan:
+			if c.confirm != nil || c.noAck || len(merged)+len(c.data) > maxSize {
+				return merged, chunks, &c
+			}
+			merged = append(merged, c.data...)
+			chunks++
+
+			// The data was copied. The merged data chunk is never released.
+			c.buf.Release()
+		}
+	}
+}
+
+// writeDataChunk transmits the data chunk and reports the progress.
+// Data chunks exceeding the maximum message size are split into
+// a multi-message transmission. Urgent data chunks are never split.
+// If noAck is set, then the data messages are transmitted only once.
+// Returns ErrClosed if the port was closed, ErrAborted if the
+// transfer was aborted and ErrMaxRetriesReached if the ARQ strategy gave up.
+func (p *Port) writeDataChunk(flags byte, data []byte, noAck bool) (err error) {
+	if noAck {
+		// The pipelined data messages of the send window have to be
+		// received before, because they might be reassembled.
+		if err := p.drainWindow(); err != nil {
+			return err
+		}
+
+		// The peer updates its delta base without acknowledging the data chunk.
+		// Transmit it and the following data chunk as keyframes.
+		p.setWriteDeltaBase(flags, nil)
+	}
+
+	// Delta encode and encrypt the data chunk if enabled.
+	msgFlags, payload := p.encodeDataChunk(flags, data)
+	msgFlags, payload, err = p.sealDataChunk(msgFlags, payload)
+	if err != nil {
+		p.log.Errorf("write data: %v", err)
+		p.setWriteDeltaBase(flags, nil)
+		return err
+	}
+	total := len(payload)
+	maxSize := p.maxMessageSize()
+
+	for sent := 0; ; {
+		// Urgent data chunks must not wait behind the whole transmission.
+		if sent > 0 {
+			if err = p.writePendingUrgentChunks(); err != nil {
+				break
+			}
+		}
+
+		// Set the append data flag on all but the last data message.
+		part, partFlags := payload[sent:], msgFlags
+		if flags&flagUrgent == 0 && len(part) > maxSize {
+			part, partFlags = part[:maxSize], msgFlags|flagAppendData
+		}
+
+		// Write the data message and wait for the acknowledgement.
+		err = p.writeDataMessage(partFlags, part, noAck)
+		if err == ErrPeerDeltaMismatch {
+			// The delta base of the peer differs. Transmit the complete data chunk.
+			p.log.Debugf("write data: peer failed to decode the delta encoded data chunk: resending it as keyframe")
+			p.setWriteDeltaBase(flags, nil)
+			msgFlags, payload, err = p.sealDataChunk(flags, data)
+			if err != nil {
+				p.log.Errorf("write data: %v", err)
+				break
+			}
+			sent, total = 0, len(payload)
+			continue
+		} else if err != nil {
+			break
+		}
+		sent += len(part)
+
+		// Report the progress of bulk data chunks.
+		if flags&(flagUrgent|flagService) == 0 && p.config.OnWriteProgress != nil {
+			p.config.OnWriteProgress(sent, total)
+		}
+
+		if sent == total {
+			break
+		}
+	}
+
+	if err == ErrMaxRetriesReached && p.config.OnWriteError != nil {
+		p.config.OnWriteError(data, err)
+	}
+	if err != nil {
+		// The peer might not have received the data chunk.
+		// Send a keyframe next time.
+		p.setWriteDeltaBase(flags, nil)
+		return err
+	} else if noAck {
+		// The peer might not have received the data chunk.
+		// Keep sending a keyframe next time.
+		return nil
+	}
+	p.setWriteDeltaBase(msgFlags, data)
+
+	return nil
+}
+
+// writePendingUrgentChunks transmits the queued urgent data chunks between
+// the data messages of a multi-message transmission. The peer delivers them
+// separately, so they don't interfere with the reassembly.
+// Returns ErrClosed if the port was closed.
+func (p *Port) writePendingUrgentChunks() error {
+	for {
+		var data []byte
+		select {
+		case data = <-p.writeUrgentChunkChan:
+		default:
+			return nil
+		}
+
+		if err := p.writeUrgentChunk(data); err != nil {
+			return err
+		}
+	}
+}
+
+// writeUrgentChunk transmits the urgent data chunk and reports the result.
+// Returns ErrClosed if the port was closed.
+func (p *Port) writeUrgentChunk(data []byte) error {
+	chunk := writeChunk{data: data}
+
+	if p.window != nil {
+		if err := p.writeDataChunkWindowed(flagUrgent, chunk, 1); err == ErrClosed {
+			return err
+		}
+		return nil
+	}
+
+	err := p.writeDataChunk(flagUrgent, chunk.data, false)
+	p.completeDataChunk(chunk, 1, err)
+	if err == ErrClosed {
+		return err
+	}
+	return nil
+}
+
+// completeDataChunk reports the result of a written data chunk.
+// The chunks value is the number of coalesced data chunks.
+func (p *Port) completeDataChunk(chunk writeChunk, chunks int, err error) {
+	if err == nil || err == ErrMaxRetriesReached {
+		p.breaker.record(err == ErrMaxRetriesReached)
+	}
+
+	// The data chunk is not referenced anymore.
+	chunk.buf.Release()
+
+	p.addPendingWrites(-chunks)
+	if chunk.confirm != nil {
+		chunk.confirm <- err
+	}
+}
+
+// writeDataMessage writes the data message to the source and resends it
+// until an acknowledge control message is received or the transfer is aborted.
+// The resend decisions are delegated to the configured ARQ strategy.
+// If noAck is set, then the data message is transmitted only once
+// with the unknown message sequence number.
+// Returns ErrClosed if the port was closed, ErrAborted if the
+// transfer was aborted and ErrMaxRetriesReached if the ARQ strategy gave up.
+func (p *Port) writeDataMessage(flags byte, data []byte, noAck bool) error {
+	abortChan := p.transferAbortChan(flags&flagUrgent != 0)
+
+	// Pause the bulk transmission if the peer is nearly out of buffer space.
+	// Urgent messages are never paused.
+	if flags&flagUrgent == 0 {
+		if err := p.waitForPeerBuffer(len(data), abortChan); err != nil {
+			if err == ErrAborted {
+				p.abortTransfer(p.currentMSN())
+			}
+			return err
+		}
+		p.consumePeerBuffer(len(data))
+	}
+
+	// Obtain the next message sequence number for this data message.
+	// Resends of the same data message keep the message sequence number.
+	// The peer never acknowledges data messages with the unknown one.
+	msn := byte(umsn)
+	if !noAck {
+		msn = p.nextMSN()
+	}
+
+	// Track the message in flight for debugging purposes.
+	p.setInFlight(&InFlightFrame{
+		MSN:    msn,
+		Urgent: flags&flagUrgent != 0,
+		Size:   len(data),
+		Since:  time.Now(),
+	})
+	defer p.setInFlight(nil)
+
+	// Create the message frame in a reused frame buffer.
+	buf := getFrameBuffer()
+	defer buf.release()
+	data = p.encodeDataMessageFrame(buf, msn, flags, data)
+
+	// Resend the data until an acknowledge control character is received.
+	arq := p.config.ARQStrategy
+	attempt := ARQAttempt{
+		MSN:   msn,
+		Since: time.Now(),
+	}
+
+	for {
+		p.setInFlightRetries(attempt.Transmissions)
+
+		// Write the data message frame to the source.
+		if err := p.transmitDataMessageFrame(data, attempt.Transmissions > 0, abortChan); err != nil {
+			if err == ErrAborted {
+				p.abortTransfer(msn)
+			}
+			return err
+		}
+		attempt.Transmissions++
+
+		// Broadcast and unacknowledged data messages are never acknowledged.
+		if noAck || p.isBroadcasting() {
+			return nil
+		}
+
+		// Wait for a control character as response.
+		var err error
+		attempt.Reason, attempt.NakReason, err = p.waitForResponse(msn, arq.Timeout(attempt), abortChan)
+		if err != nil {
+			return err
+		} else if attempt.Reason == ARQReasonNone {
+			// The data message was acknowledged.
+			return nil
+		}
+
+		// The peer discarded the delta encoded transmission.
+		// The caller resends the data chunk as keyframe.
+		if attempt.NakReason == NakReasonDeltaMismatch && flags&flagDelta != 0 {
+			return ErrPeerDeltaMismatch
+		}
+
+		// Retransmissions can't resolve some rejections of the peer.
+		if err = attempt.NakReason.err(); err != nil {
+			p.log.Warningf("write data: data message rejected by the peer: %v (MSN=%v)", attempt.NakReason, msn)
+			p.giveUpDataMessage(msn, attempt.Transmissions, msn)
+			return err
+		}
+
+		// Ask the strategy whether to retransmit.
+		if !arq.Retransmit(attempt) {
+			p.giveUpDataMessage(msn, attempt.Transmissions, msn)
+			if attempt.NakReason == NakReasonBusy {
+				return ErrPeerBusy
+			}
+			return ErrMaxRetriesReached
+		}
+	}
+}
+
+// transmitDataMessageFrame writes the data message frame to the source
+// with respect to the transmit rate and the transmit schedule.
+// Returns ErrClosed if the port was closed or the write failed and
+// ErrAborted if an abort was requested on the optional abort channel.
+func (p *Port) transmitDataMessageFrame(frame []byte, retransmission bool, abortChan <-chan struct{}) error {
+	// Respect the configured transmit rate.
+	if err := p.writeRateLimiter.wait(len(frame), p.closeChan, abortChan); err != nil {
+		return err
+	}
+
+	// Hold the transmission during quiet periods.
+	if err := p.waitForTransmitSlot(abortChan); err != nil {
+		return err
+	}
+
+	// Write the data to the source.
+	err := p.writeToSource(frame)
+	if isDeviceRemoved(err) {
+		p.handleDeviceRemoved(err)
+		return ErrClosed
+	} else if err != nil {
+		// Log the error and close the port.
+		err = fmt.Errorf("failed to write data to the source: %v", err)
+		p.log.Errorf("%v", err)
+		p.closeAndLogError(err)
+		return ErrClosed
+	}
+
+	p.stats.update(func(c *StatsSnapshot) {
+		c.DataMessagesSent++
+		if retransmission {
+			c.Retransmissions++
+		}
+	})
+
+	return nil
+}
+
+// giveUpDataMessage reports a data message, which the ARQ strategy gave up,
+// and tells the peer to discard the partially received data.
+// All data messages up to the passed message sequence number are aborted.
+func (p *Port) giveUpDataMessage(msn byte, transmissions int, abortMSN byte) {
+	p.log.Warningf("write data: giving up transmission after %v attempts (MSN=%v)", transmissions, msn)
+	p.stats.update(func(c *StatsSnapshot) { c.TransmissionsFailed++ })
+	p.emitEvent(EventTransmissionFailed, "gave up transmission of data message %v after %v attempts", msn, transmissions)
+
+	p.writeControlMessage(can, abortMSN)
+}
+
+// requestAbort signals the write loop to abort the transfer in progress.
+// A pending request is not queued twice, so this method never blocks.
+func (p *Port) requestAbort() {
+	select {
+	case p.abortChan <- struct{}{}:
+	default:
+	}
+}
+
+// transferAbortChan returns the channel, which signals the requests of
+// AbortTransfer. They target the bulk transfer, so urgent data chunks,
+// which are interleaved with it, are never aborted and nil is returned.
+func (p *Port) transferAbortChan(urgent bool) <-chan struct{} {
+	if urgent {
+		return nil
+	}
+	return p.abortChan
+}
+
+// abortTransfer tells the peer to discard the partially received
+// data of the aborted transfer.
+func (p *Port) abortTransfer(msn byte) {
+	p.log.Debugf("write data: transfer aborted (MSN=%v)", msn)
+	p.writeControlMessage(can, msn)
+}
+
+// waitForResponse waits for the response control message of the data message.
+// Returns ARQReasonNone if the data message was acknowledged. Otherwise the
+// reason for a retransmission and the reason of a negative acknowledge are
+// returned. A timeout <= 0 waits forever. A busy peer is given the timeout
+// before the retransmission. Returns ErrClosed if the port was closed and
+// ErrAborted if an abort was requested on the optional abort channel.
+func (p *Port) waitForResponse(msn byte, timeout time.Duration, abortChan <-chan struct{}) (ARQReason, NakReason, error) {
+	// Only create a timer if required.
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := p.config.Clock.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C()
+	}
+
+	busy := false
+
+	for {
+		select {
+		case <-p.closeChan:
+			// Release this goroutine if the port is closed.
+			return ARQReasonNone, NakReasonUnspecified, ErrClosed
+
+		case <-timeoutChan:
+			if busy {
+				return ARQReasonNak, NakReasonBusy, nil
+			}
+			p.log.Debugf("write data: no response from peer within %v (MSN=%v)", timeout, msn)
+			return ARQReasonTimeout, NakReasonUnspecified, nil
+
+		case cm := <-p.readControlMessageChan:
+			// Discard stale or duplicate control messages of previous
+			// exchanges and continue waiting for the matching one.
+			// Otherwise a delayed acknowledge could falsely confirm a lost data message.
+			if !cm.answers(msn) {
+				p.log.Debugf("write data: discarding control message with unexpected message sequence number: %v != %v", cm.MSN, msn)
+				continue
+			}
+
+			switch cm.TypeCharacter {
+			case ack:
+				// Successful transmission.
+				return ARQReasonNone, NakReasonUnspecified, nil
+			case rsd:
+				// The peer requested a resend of exactly this message.
+				return ARQReasonResendRequest, NakReasonUnspecified, nil
+			}
+
+			// Negative acknowledge. Don't flood the busy peer
+			// with retransmissions. Wait for the timeout.
+			if cm.Reason == NakReasonBusy && timeoutChan != nil {
+				p.log.Debugf("write data: peer is busy: retransmitting after the timeout (MSN=%v)", msn)
+				busy = true
+				continue
+			}
+			return ARQReasonNak, cm.Reason, nil
+
+		case <-abortChan:
+			// Stop resending the data and tell the peer to
+			// discard the partially received data.
+			p.abortTransfer(msn)
+			return ARQReasonNone, NakReasonUnspecified, ErrAborted
+		}
+	}
+}
+
+// nextMSN increments the message sequence number and returns it.
+// The message sequence number cycles from 1 to 255.
+// This method must be only called by the write loop.
+func (p *Port) nextMSN() byte {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	p.msn = nextSequenceNumber(p.msn)
+	return p.msn
+}
+
+// newDataMessageFrame creates a complete escaped data message frame
+// with the data message CRC type of the peer.
+func (p *Port) newDataMessageFrame(msn byte, flags byte, data []byte) []byte {
+	return p.codec.encodeDataMessage(p.dataMessageCRCType(), msn, flags, data)
+}
+
+// encodeDataMessageFrame encodes the complete escaped data message frame
+// with the data message CRC type of the peer into the frame buffer.
+func (p *Port) encodeDataMessageFrame(b *frameBuffer, msn byte, flags byte, data []byte) []byte {
+	return p.codec.encodeDataMessageInto(b, p.dataMessageCRCType(), msn, flags, data)
+}
+
+// writeControlMessage writes a control message with the optional payload to the source.
+// Control messages are written immediately and are never acknowledged.
+func (p *Port) writeControlMessage(ctrlType byte, msn byte, payload ...byte) {
+	// Nothing to do if the port is closed.
+	if p.IsClosed() {
+		return
+	}
+
+	// Create and write the message frame.
+	buf := getFrameBuffer()
+	defer buf.release()
+	err := p.writeToSource(p.codec.encodeControlMessageInto(buf, ctrlType, msn, payload))
+	if isDeviceRemoved(err) {
+		p.handleDeviceRemoved(err)
+	} else if err != nil {
+		// Log the error and close the port.
+		err = fmt.Errorf("failed to write control message to the source: %v", err)
+		p.log.Errorf("%v", err)
+		p.closeAndLogError(err)
+	}
+}
+
+// newControlMessageFrame creates the escaped control message frame.
+func (p *Port) newControlMessageFrame(ctrlType byte, msn byte, payload []byte) []byte {
+	return p.codec.encodeControlMessage(ctrlType, msn, payload)
+}
+
+// writeToSource writes the data bytes to the source.
+func (p *Port) writeToSource(data []byte) (err error) {
+	// Catch all panics, and return the error.
+	// Panics could occur in the p.source.Write call, which is third-party code...
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: write data to source: %v", e)
+		}
+	}()
+
+	// Data and control messages are written by different routines.
+	// Never interleave their frames.
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	// Obtain the current source.
+	source := p.getSource()
+	frame := data
+
+	// Many sources legitimately return short writes under load.
+	// Retry to write the remaining bytes until the retry count
+	// or the deadline is reached.
+	deadline := time.Now().Add(partialWriteTimeout)
+
+	// The transmitted bytes are echoed on half-duplex buses.
+	p.echo.expect(data)
+
+	// Pass the frame to the raw frame hook.
+	// The write mutex keeps the frames in transmission order.
+	if p.config.OnRawFrameSent != nil {
+		p.config.OnRawFrameSent(data)
+	}
+
+	for retries := 0; ; retries++ {
+		// Write to the source.
+		// The removal of the device is passed on unwrapped.
+		n, err := source.Write(data)
+		if err != nil {
+			// Write the complete frame again to the new source
+			// if the port was suspended and resumed.
+			if p.suspend(source, err) {
+				source, data = p.getSource(), frame
+				deadline = time.Now().Add(partialWriteTimeout)
+				continue
+			}
+			if isDeviceRemoved(err) {
+				return err
+			}
+			return fmt.Errorf("failed to write to source: %v", err)
+		}
+		p.stats.update(func(c *StatsSnapshot) { c.BytesSent += uint64(n) })
+		p.throughput.add(time.Now(), n, 0)
+		p.markTransmitted()
+
+		// Remove the written bytes.
+		data = data[n:]
+
+		// Return if the complete data was transmitted.
+		if len(data) == 0 {
+			return nil
+		}
+
+		// Give up if the limits are reached.
+		if retries >= maxPartialWriteRetries || time.Now().After(deadline) {
+			break
+		}
+
+		// Don't spin if the source did not accept any bytes.
+		if n == 0 {
+			time.Sleep(partialWriteWaitDuration)
+		}
+	}
+
+	// The data was only partially transmitted.
+	// Terminate the frame and dismiss any write error.
+	// Pretend as no error occurred. The peer will request a resend...
+	end := p.codec.abortSequence()
+	p.echo.expect(end)
+	_, _ = source.Write(end)
+
+	// Log
+	p.log.Warningf("write data to source: failed to send complete data chunk: data was only transmitted partially")
+
+	return nil
+}
+
+func (p *Port) readFromSourceLoop() {
+	// Catch all panics, log the error and close the port.
+	// Panics could occur in the p.source.Read call, which is third-party code...
+	defer func() {
+		if e := recover(); e != nil {
+			err := fmt.Errorf("panic: read data from source: %v", e)
+			p.log.Errorf("%v", err)
+			p.closeAndLogError(err)
+		}
+	}()
+
+	// The current read buffer. It is passed to the decoder with the
+	// received bytes and replaced by a free buffer.
+	var buf []byte
+
+	// The wait duration if the source returns io.EOF.
+	eofWaitDuration := readWaitDuration
+
+	// Idle mode state.
+	lastTraffic := time.Now()
+	isIdle := false
+	isBlocking := false
+
+	// Read from the source as long as the port is open.
+	for !p.IsClosed() {
+		// Obtain a free read buffer.
+		if buf == nil {
+			buf = p.acquireReadBuffer()
+			if buf == nil {
+				return
+			}
+		}
+
+		// Read data from the source.
+		source := p.getSource()
+		n, err := source.Read(buf)
+
+		// Stamp the arrival time of the received bytes if enabled.
+		var arrival time.Time
+		if p.config.Timestamps && n > 0 {
+			arrival = time.Now()
+		}
+		if err != nil && err != io.EOF && p.suspend(source, err) {
+			// Continue with the new source in its default read mode.
+			lastTraffic = time.Now()
+			isIdle, isBlocking = false, false
+			continue
+		} else if isDeviceRemoved(err) {
+			p.handleDeviceRemoved(err)
+			return
+		} else if err != nil && err != io.EOF {
+			// Log the error and close the port.
+			err = fmt.Errorf("failed to read data from source: %v", err)
+			p.log.Errorf("%v", err)
+			p.closeAndLogError(err)
+			return
+		}
+
+		// Handle the end of file depending on the configured behavior.
+		if n == 0 && err == io.EOF {
+			switch p.config.EOFBehavior {
+			case EOFClose:
+				p.log.Debugf("read data from source: end of file reached: closing port")
+				p.closeAndLogError(ErrSourceEOF)
+				return
+
+			case EOFReconnect:
+				p.log.Debugf("read data from source: end of file reached: reconnecting source")
+				err = p.reconnectSource()
+				if err != nil {
+					if err != ErrClosed {
+						p.log.Errorf("read data from source: %v", err)
+						p.closeAndLogError(err)
+					}
+					return
+				}
+
+				// The new source starts in its default read mode.
+				lastTraffic = time.Now()
+				isIdle, isBlocking = false, false
+
+			default:
+				// Read again after the wait duration and increase it for the next time.
+				time.Sleep(eofWaitDuration)
+
+				eofWaitDuration *= 2
+				if eofWaitDuration > p.config.EOFRetryMaxBackoff {
+					eofWaitDuration = p.config.EOFRetryMaxBackoff
+				}
+			}
+
+			continue
+		}
+
+		// Reset the EOF wait duration.
+		eofWaitDuration = readWaitDuration
+
+		// Merge the hardware line errors into the statistics.
+		p.pollLineErrors(source)
+
+		// If nothing was received, then read again after a short timeout.
+		if n == 0 {
+			// Enter the idle mode if no traffic flowed for the configured period.
+			// Sources with blocking support are parked on a blocking read.
+			// Other sources are polled less frequently.
+			if !isIdle && p.config.IdleTimeout > 0 && time.Since(lastTraffic) > p.config.IdleTimeout {
+				isIdle = true
+				isBlocking = p.setSourceBlocking(source, true)
+			}
+
+			if isIdle && !isBlocking {
+				time.Sleep(idleWaitDuration)
+			} else if p.config.ReadPollInterval > 0 {
+				time.Sleep(p.config.ReadPollInterval)
+			}
+			continue
+		}
+
+		p.stats.update(func(c *StatsSnapshot) { c.BytesReceived += uint64(n) })
+		p.throughput.add(time.Now(), 0, n)
+
+		// Leave the idle mode.
+		lastTraffic = time.Now()
+		if isIdle {
+			if isBlocking {
+				p.setSourceBlocking(source, false)
+			}
+			isIdle, isBlocking = false, false
+		}
+
+		// Discard the echo of the transmitted bytes.
+		data, ok := p.echo.filter(buf[:n])
+		if !ok {
+			p.emitEvent(EventEchoMismatch, "received bytes did not match the transmitted bytes")
+		}
+		if len(data) == 0 {
+			continue
+		}
+		p.markReceived()
+
+		// Pass the received bytes to the decoder pool if set.
+		chunk := receivedChunk{buf: buf, data: data, t: arrival}
+		buf = nil
+
+		if p.config.DecoderPool != nil {
+			if !p.decodePoolData(chunk) {
+				return
+			}
+			continue
+		}
+
+		// Push the received bytes at once to the read channel.
+		select {
+		case <-p.closeChan:
+			return
+		case p.readChan <- chunk:
+		}
+	}
+}
+
+// acquireReadBuffer returns a free read buffer. New buffers are allocated
+// until the maximum number is reached. Afterwards it blocks until the decoder
+// released a buffer. Returns nil if the port was closed.
+// This method must be only called by the read from source routine.
+func (p *Port) acquireReadBuffer() []byte {
+	select {
+	case buf := <-p.readBufferChan:
+		return buf
+	default:
+	}
+
+	if p.readBuffers < cap(p.readBufferChan) {
+		p.readBuffers++
+		return make([]byte, p.config.ReadBufferSize)
+	}
+
+	select {
+	case <-p.closeChan:
+		return nil
+	case buf := <-p.readBufferChan:
+		return buf
+	}
+}
+
+// releaseReadBuffer returns the read buffer of the decoded chunk.
+func (p *Port) releaseReadBuffer(c receivedChunk) {
+	select {
+	case p.readBufferChan <- c.buf:
+	default:
+	}
+}
+
+func (p *Port) readMessagesLoop() {
+	// Create a new timeout timer in a stopped state.
+	timeoutTimer := newStoppedTimer(p.config.Clock)
+
+	// Close the timeout always on exit.
+	defer timeoutTimer.Stop()
+
+	// Always stop the reassembly timer on exit.
+	defer p.reassemblyTimer.Stop()
+
+	// Advertise the free reassembly buffer space periodically if enabled.
+	// A responder never initiates a transmission.
+	var bufferStatusChan <-chan time.Time
+	if p.config.BufferStatusInterval > 0 && p.config.Responder == nil {
+		ticker := time.NewTicker(p.config.BufferStatusInterval)
+		defer ticker.Stop()
+		bufferStatusChan = ticker.C
+	}
 
 	// Start the magic :P
 	for {
@@ -377,138 +1760,200 @@ func (p *Port) readMessagesLoop() {
 			// The port was closed. Release this goroutine.
 			return
 
-		case <-timeoutTimer.C:
+		case <-timeoutTimer.C():
 			// Timeout reached. Reset flags and clear message buffer.
-			isControlMessage = false
-			startCharacterFound = false
-			byteIsEscaped = false
-
-			controlCharacter = 0
-
-			// Clear the buffer.
-			buf = buf[:0]
-
-			// Log
-			Log.Warningf("read data: read message timeout reached: discarding data")
-
-		case b := <-p.readChan:
-			// Anonymous function for defers.
-			func() {
-				// Hint: This protocol uses the Data Link Escape (DLE) character to
-				// differentiate between control characters and the binary data transmission.
-				// Control characters are preceded with the DLE character.
-				// Whenever the DLE character is encountered in the data, it is
-				// sent twice to prevent the byte that follows from being interpreted
-				// as a control character.
-				//
-				// Set the escaped flag.
-				if !byteIsEscaped && b == dle {
-					byteIsEscaped = true
-					return
-				}
+			p.resetDecoder()
 
-				// Always reset the esape flag on defer.
-				defer func() {
-					byteIsEscaped = false
-				}()
-
-				// Check for control characters. They have to be escaped.
-				if byteIsEscaped {
-					// Check if the byte is a start character, if searching for it.
-					if !startCharacterFound {
-						if b == stx || b == ack || b == nak {
-							// Set the flag.
-							if b == stx {
-								isControlMessage = false
-							} else {
-								isControlMessage = true
-
-								// Save the control message character.
-								controlCharacter = b
-							}
-
-							// Set the flag.
-							startCharacterFound = true
-
-							// Restart the timeout timer.
-							timeoutTimer.Reset(readMessageTimeout)
-						} else {
-							// Discard the byte, but log this occurrence.
-							Log.Warningf("read data: expected start character but got other byte: %v", b)
-						}
-
-						return
-					}
+		case <-p.reassemblyTimer.C():
+			// The multi-message transmission stalled. The timer might have
+			// fired before it was reset or stopped. Check the arrival time.
+			if len(p.readBinaryDataBuffer) > 0 && p.config.Clock.Now().Sub(p.readBinaryDataTime) >= p.config.ReassemblyTimeout {
+				p.discardStaleBinaryData()
+			}
 
-					// If the byte is the end character, then handle the received message body
-					// and clear the buffer for the next read procedure.
-					if b == etx {
-						// Stop the timeout timer.
-						timeoutTimer.Stop()
-
-						// Unescape the buffer.
-						buf = unescapeDLE(buf)
-
-						// Handle the message body in a new function to keep things clear.
-						if isControlMessage {
-							err := p.handleReceivedControlMessageBody(controlCharacter, buf)
-							if err != nil {
-								Log.Warningf("read data: handle control message body: %v", err)
-							}
-						} else {
-							err := p.handleReceivedDataMessageBody(buf)
-							if err != nil {
-								Log.Warningf("read data: handle data message body: %v", err)
-							}
-						}
-
-						// Clear the buffer.
-						buf = buf[:0]
-
-						return
-					}
-				}
+		case <-bufferStatusChan:
+			p.writeBufferStatus()
+
+		case c := <-p.readChan:
+			started, ended := p.decodeChunk(c)
+			p.releaseReadBuffer(c)
+			if started {
+				// Restart the timeout timer.
+				timeoutTimer.Reset(p.config.ReadMessageTimeout)
+			} else if ended {
+				// Stop the timeout timer.
+				timeoutTimer.Stop()
+			}
+		}
 
-				// Append the new byte to the message buffer.
-				buf = append(buf, b)
+		// Publish the current read state for debugging purposes.
+		p.publishDecoderState()
+	}
+}
 
-				// Check if the maximum buffer size is reached.
-				if len(buf) > maxMessageSize {
-					// Discard the received bytes and start over again.
-					buf = buf[:0]
+// resetDecoder discards the partially received message after a timeout.
+// This method must be only called by the read messages routine.
+func (p *Port) resetDecoder() {
+	d := &p.decoder
 
-					// Log this.
-					Log.Warningf("read data: maximum message buffer size of %v bytes reached: discarding message", maxMessageSize)
+	// Reset flags and clear message buffer.
+	d.frame.Reset()
+	d.deadline = time.Time{}
 
-					return
-				}
-			}()
+	// Log
+	p.log.Warningf("read data: read message timeout reached: discarding data")
+}
+
+// decodeChunk passes the received bytes to the message decoder.
+// Returns started if the last found start or end character
+// was a start character and ended if it was an end character.
+// This method must be only called by the read messages routine.
+func (p *Port) decodeChunk(c receivedChunk) (started, ended bool) {
+	for _, b := range c.data {
+		s, e := p.decodeByte(b, c.t)
+		if s {
+			started, ended = true, false
+		} else if e {
+			started, ended = false, true
+		}
+	}
+	return
+}
+
+// decodeByte passes a received byte to the message decoder.
+// Complete message bodies are passed to the message handlers.
+// The arrival time is zero if timestamping is disabled.
+// Returns started if a message start character was found
+// and ended if a message end character was found.
+// This method must be only called by the read messages routine.
+func (p *Port) decodeByte(b byte, arrival time.Time) (started, ended bool) {
+	d := &p.decoder
+	buffered := len(d.frame.buf)
+
+	switch d.frame.decodeByte(b) {
+	case decodeRestarted:
+		// The end of the previous message was lost.
+		p.log.Warningf("read data: start character within message: discarding %v bytes", buffered)
+		fallthrough
+
+	case decodeStarted:
+		// Set the timeout deadline.
+		d.deadline = p.config.Clock.Now().Add(p.config.ReadMessageTimeout)
+		d.startTime = arrival
+		started = true
+
+	case decodeUnexpected:
+		// Discard the byte, but log this occurrence.
+		p.log.Warningf("read data: expected start character but got other byte: %v", b)
+
+	case decodeOverflow:
+		p.log.Warningf("read data: maximum message buffer size of %v bytes reached: discarding message", p.codec.maxBodySize)
+
+	case decodeAborted:
+		d.deadline = time.Time{}
+		ended = true
+		p.log.Warningf("read data: frame aborted by the peer: discarding %v bytes", buffered)
+
+	case decodeEnded:
+		d.deadline = time.Time{}
+		d.endTime = arrival
+		ended = true
+
+		p.handleReceivedFrame()
+
+		// Clear the buffer for the next read procedure.
+		d.frame.clearFrame()
+	}
+
+	return
+}
+
+// handleReceivedFrame handles the message body of a complete received frame.
+// This method must be only called by the read messages routine.
+func (p *Port) handleReceivedFrame() {
+	f := p.decoder.frame
+
+	// Pass the escaped frame to the raw frame hook.
+	if p.config.OnRawFrameReceived != nil {
+		p.config.OnRawFrameReceived(f.raw)
+	}
+
+	// Discard messages, which are addressed to other nodes on the bus.
+	body, addressed := p.filterAddressHeader(f.buf)
+	if !addressed {
+		return
+	}
+
+	// Correct the data messages with the forward error correction.
+	if !f.isControlMessage && p.codec.fec != nil {
+		body = p.correctDataMessageBody(body)
+	}
+
+	// Handle the message body in a new function to keep things clear.
+	if f.isControlMessage {
+		err := p.handleReceivedControlMessageBody(f.startCharacter, body)
+		if err != nil {
+			p.log.Warningf("read data: handle control message body: %v", err)
+		}
+	} else {
+		err := p.handleReceivedDataMessageBody(f.startCharacter, body)
+		if err != nil {
+			p.log.Warningf("read data: handle data message body: %v", err)
 		}
 	}
 }
 
 func (p *Port) handleReceivedControlMessageBody(typeCharacter byte, body []byte) (err error) {
-	// Check for the required body length.
+	// Check for the required minimum body length.
 	// Message sequence number and CRC checksum have to be contained.
-	// 1 Byte + 2 Bytes
-	if len(body) != 3 {
+	// Some control messages carry an additional payload.
+	// 1 Byte + (Payload) + 2/4 Bytes
+	crcValidator, crcLength := p.codec.controlMessageCRC(typeCharacter)
+	if len(body) < 1+crcLength {
 		return fmt.Errorf("invalid control message body")
 	}
 
 	// Extract the CRC checksum.
-	pos := len(body) - 2
+	pos := len(body) - crcLength
 	crcChecksum := body[pos:]
 
 	// Remove the CRC checksum from the body.
 	body = body[:pos]
 
 	// Validate the the message body with the checksum.
-	if !p.crc16Validator.Validate(body, crcChecksum) {
+	if !crcValidator.Validate(body, crcChecksum) {
+		p.stats.update(func(c *StatsSnapshot) { c.ChecksumErrors++ })
 		return fmt.Errorf("message body is corrupt: message CRC checksum is invalid")
 	}
 
-	// Extract the peer message sequence number (PMSN).
+	// Extract the peer message sequence number (PMSN) and the payload.
 	pmsn := body[0]
+	payload := body[1:]
+
+	switch typeCharacter {
+	case can:
+		// Abort control messages are handled directly by the read routine,
+		// because they affect the reassembly buffer.
+		p.handleReceivedAbort(pmsn)
+		return nil
+
+	case bst:
+		// Buffer status control messages are not a reply to a data message.
+		return p.handleReceivedBufferStatus(payload)
+
+	case bel:
+		// Ping control messages are not a reply to a data message.
+		return p.handleReceivedPing(payload)
+
+	case enq:
+		// Handshake control messages are not a reply to a data message.
+		return p.handleReceivedHandshake(payload)
+
+	case wat, rdy:
+		// Flow control messages are not a reply to a data message.
+		p.handleReceivedFlowControl(typeCharacter == wat)
+		return nil
+	}
 
 	// Create a new control message value.
 	cm := controlMessage{
@@ -516,104 +1961,666 @@ func (p *Port) handleReceivedControlMessageBody(typeCharacter byte, body []byte)
 		MSN:           pmsn,
 	}
 
-	// Push it to the channel.
-	p.readControlMessageChan <- cm
+	// Negative acknowledges carry the reason. Legacy peers don't send it.
+	if typeCharacter == nak {
+		if len(payload) > 0 {
+			cm.Reason = NakReason(payload[0])
+		}
+		p.countNak(cm.Reason)
+	}
+
+	// Push it to the channel. Never block the read routine,
+	// if no transmission is waiting for a response.
+	select {
+	case <-p.closeChan:
+		return ErrClosed
+	case p.readControlMessageChan <- cm:
+	default:
+		p.log.Debugf("read data: discarding control message: no pending transmission (MSN=%v)", pmsn)
+	}
+
+	return nil
+}
+
+// validateEnhancedHeader validates the header of a data message body with
+// the enhanced layout and returns the contained message sequence number.
+// The header checksum protects the flags and the length, which are
+// otherwise misinterpreted until the complete message is validated.
+func (p *Port) validateEnhancedHeader(body []byte) (pmsn byte, err error) {
+	if len(body) < enhancedHeaderLength {
+		return umsn, fmt.Errorf("invalid data message body: header is too short")
+	}
+
+	// Validate the header with its checksum.
+	header := body[:enhancedHeaderLength-2]
+	if !getCRC16Validator().Validate(header, body[enhancedHeaderLength-2:enhancedHeaderLength]) {
+		p.stats.update(func(c *StatsSnapshot) { c.ChecksumErrors++ })
+		return umsn, fmt.Errorf("message header is corrupt: header CRC checksum is invalid")
+	}
+
+	// The flags are trustworthy. Reject the unsupported custom
+	// CRC type, instead of failing the checksum validation.
+	if header[1]&flagCRCMask == flagCRCCustom && p.config.CustomCRC == nil {
+		return header[0], errUnsupportedCRC
+	}
+
+	// Check if the binary data length matches.
+	// The flags indicate the checksum length.
+	_, crcLength, _ := p.codec.dataMessageCRC(header[1])
+	length := int(binary.LittleEndian.Uint16(header[2:4]))
+	if len(body) != enhancedHeaderLength+length+crcLength {
+		return header[0], fmt.Errorf("invalid data message body: binary data length does not match the header")
+	}
+
+	return header[0], nil
+}
+
+// checkSequenceGap compares the peer message sequence number with the
+// previously received one. If messages are missing in between, then
+// a resend of exactly those messages is requested from the peer.
+// This method must be only called by the read messages loop.
+func (p *Port) checkSequenceGap(pmsn byte) {
+	// Always remember the last received peer message sequence number.
+	defer func() {
+		p.readLastPMSN = pmsn
+		p.readLastPMSNValid = true
+	}()
+
+	// Nothing to compare with or a resent message.
+	// Broadcast data messages are never resent.
+	if !p.readLastPMSNValid || pmsn == p.readLastPMSN || p.decoder.isBroadcast {
+		return
+	}
+
+	// Request each missing message of the gap.
+	expected := nextSequenceNumber(p.readLastPMSN)
+	for i := 0; expected != pmsn && i < maxResendRequests; i++ {
+		p.log.Debugf("read data: sequence gap detected: requesting resend of message %v", expected)
+		p.writeControlMessage(rsd, expected)
+
+		expected = nextSequenceNumber(expected)
+	}
+}
+
+// handleReceivedBufferStatus updates the free reassembly buffer space of the peer.
+func (p *Port) handleReceivedBufferStatus(payload []byte) error {
+	if len(payload) != 2 {
+		return fmt.Errorf("invalid buffer status control message payload")
+	}
+
+	free := int(binary.LittleEndian.Uint16(payload))
+
+	// Lock the mutex.
+	p.peerBufferMutex.Lock()
+	p.peerFreeBuffer = free
+	p.peerBufferMutex.Unlock()
+
+	// Notify a paused write routine without blocking.
+	select {
+	case p.peerBufferUpdateChan <- struct{}{}:
+	default:
+	}
 
 	return nil
 }
 
-func (p *Port) handleReceivedDataMessageBody(body []byte) (err error) {
+// handleReceivedFlowControl pauses the transmission of data messages
+// if the peer asked to wait and resumes it if the peer is ready.
+func (p *Port) handleReceivedFlowControl(wait bool) {
+	// Lock the mutex.
+	p.peerBufferMutex.Lock()
+	p.peerWaiting = wait
+	p.peerBufferMutex.Unlock()
+
+	// Notify a paused write routine without blocking.
+	select {
+	case p.peerBufferUpdateChan <- struct{}{}:
+	default:
+	}
+}
+
+// writeBufferStatus sends the free space of the reassembly buffer to the peer.
+// This method must be only called by the read messages loop.
+func (p *Port) writeBufferStatus() {
+	free := p.config.ReassemblyBufferSize - len(p.readBinaryDataBuffer)
+	if free < 0 {
+		free = 0
+	} else if free > 0xFFFF {
+		free = 0xFFFF
+	}
+
+	payload := make([]byte, 2)
+	binary.LittleEndian.PutUint16(payload, uint16(free))
+
+	p.writeControlMessage(bst, umsn, payload...)
+}
+
+// waitForPeerBuffer pauses the transmission as long as the peer advertised
+// less free reassembly buffer space than required for the data or as long
+// as the peer asked to wait. The wait is limited, because buffer status
+// and flow control messages might get lost. Returns ErrClosed if the port
+// was closed and ErrAborted if an abort was requested on the optional
+// abort channel.
+func (p *Port) waitForPeerBuffer(size int, abortChan <-chan struct{}) error {
+	var timeout *time.Timer
+
+	for {
+		// Lock the mutex.
+		p.peerBufferMutex.Lock()
+		free, waiting := p.peerFreeBuffer, p.peerWaiting
+		p.peerBufferMutex.Unlock()
+
+		// Continue if the peer is ready and the buffer status
+		// is unknown or enough space is available.
+		if !waiting && (free < 0 || free >= size) {
+			return nil
+		}
+
+		// Only create the timer if required.
+		if timeout == nil {
+			timeout = time.NewTimer(peerBufferWaitTimeout)
+			defer timeout.Stop()
+		}
+
+		// Wait for the next buffer status update.
+		select {
+		case <-p.closeChan:
+			return ErrClosed
+		case <-abortChan:
+			return ErrAborted
+		case <-timeout.C:
+			p.log.Warningf("write data: peer buffer status timeout: continuing transmission")
+
+			// The ready control message might got lost.
+			p.peerBufferMutex.Lock()
+			p.peerWaiting = false
+			p.peerBufferMutex.Unlock()
+			return nil
+		case <-p.peerBufferUpdateChan:
+		}
+	}
+}
+
+// consumePeerBuffer reduces the known free reassembly buffer
+// space of the peer until the next buffer status update.
+func (p *Port) consumePeerBuffer(size int) {
+	// Lock the mutex.
+	p.peerBufferMutex.Lock()
+	defer p.peerBufferMutex.Unlock()
+
+	if p.peerFreeBuffer < 0 {
+		return
+	}
+
+	p.peerFreeBuffer -= size
+	if p.peerFreeBuffer < 0 {
+		p.peerFreeBuffer = 0
+	}
+}
+
+// handleReceivedAbort discards the partially received binary data
+// of a multi-message transmission, which was cancelled by the peer.
+func (p *Port) handleReceivedAbort(pmsn byte) {
+	p.log.Debugf("read data: transfer aborted by peer (PMSN=%v): discarding %v buffered bytes", pmsn, len(p.readBinaryDataBuffer))
+
+	p.resetBinaryDataBuffer()
+	p.readBinaryDataOverflow = false
+
+	// Out of order data messages of the send window are aborted, too.
+	p.resetReorderBuffer()
+
+	// The aborted message is not going to be resent.
+	// Don't detect it as a sequence gap, nor the next one as a duplicate.
+	p.readAckedPMSNValid = false
+	if pmsn != umsn {
+		p.readLastPMSN = pmsn
+		p.readLastPMSNValid = true
+	}
+}
+
+// resetReadSequence forgets the received message sequence of the peer.
+// The next data message is neither discarded as a duplicate nor
+// detected as a sequence gap.
+// This method must be only called by the read messages loop.
+func (p *Port) resetReadSequence() {
+	p.readAckedPMSNValid = false
+	p.readLastPMSNValid = false
+	p.resetReorderBuffer()
+}
+
+// isPeerRestart returns a boolean whenever the data message is the first
+// data message of a restarted peer. It carries the first message sequence
+// number of a sequence, but is neither a resend of the acknowledged data
+// message nor the successor of the last received data message.
+// Pipelined data messages might arrive out of order, so only their
+// resends are compared.
+// This method must be only called by the read messages loop.
+func (p *Port) isPeerRestart(pmsn, flags byte, checksum []byte) bool {
+	if pmsn != nextSequenceNumber(initialMSN) {
+		return false
+	} else if p.readAckedPMSNValid && pmsn == p.readAckedPMSN {
+		// Resends of the same data message are identical.
+		return !bytes.Equal(checksum, p.readAckedChecksum)
+	}
+	return flags&flagPipelined == 0 && p.readLastPMSNValid &&
+		pmsn != p.readLastPMSN && pmsn != nextSequenceNumber(p.readLastPMSN)
+}
+
+// discardStaleBinaryData discards the partially received binary data
+// of a stalled multi-message transmission and emits a diagnostic event.
+// Otherwise the stale data would be prepended to the next unrelated transmission.
+func (p *Port) discardStaleBinaryData() {
+	if len(p.readBinaryDataBuffer) == 0 {
+		return
+	}
+
+	p.log.Warningf("read data: reassembly timeout reached: discarding %v buffered bytes", len(p.readBinaryDataBuffer))
+	p.emitEvent(EventReassemblyTimeout, "discarded %v bytes of a stalled multi-message transmission", len(p.readBinaryDataBuffer))
+
+	p.resetBinaryDataBuffer()
+}
+
+// resetBinaryDataBuffer clears the binary data buffer and stops the reassembly timer.
+func (p *Port) resetBinaryDataBuffer() {
+	// Stop the reassembly timer.
+	p.reassemblyTimer.Stop()
+
+	// Clear the binary data chunk buffer.
+	p.readBinaryDataBuffer = p.readBinaryDataBuffer[:0]
+	p.readBinaryDataMessages = 0
+	p.readDuplicates = false
+
+	// Release memory if the capacity of the buffer is huge.
+	if cap(p.readBinaryDataBuffer) > 10240 {
+		p.readBinaryDataBuffer = nil
+	}
+}
+
+func (p *Port) handleReceivedDataMessageBody(startCharacter byte, body []byte) (err error) {
 	// Set the peer message sequence number to the initial unknown constant.
 	var pmsn byte = umsn
+	var checksum []byte
 
 	// Send a control message on defer.
 	// Control messages have to be send as a reply for a data message.
 	defer func() {
+		// Broadcast data messages are never acknowledged,
+		// because all nodes would reply at once.
+		// Neither are data messages with the unknown message sequence number.
+		if p.decoder.isBroadcast || (err == nil && pmsn == umsn) {
+			return
+		}
+
 		// Send an Acknowledge or Negative Acknowledge Control Message.
 		if err != nil {
-			p.writeControlMessage(nak, pmsn)
+			p.writeControlMessage(nak, pmsn, byte(nakReasonOf(err)))
 		} else {
 			p.writeControlMessage(ack, pmsn)
+			p.readAckedPMSN = pmsn
+			p.readAckedPMSNValid = true
+			p.readAckedChecksum = append(p.readAckedChecksum[:0], checksum...)
 		}
 	}()
 
+	// Data messages with the enhanced layout start with a header, which
+	// contains the message sequence number, the flags and the binary data length.
+	headerLength := 2
+	if startCharacter == soh {
+		headerLength = enhancedHeaderLength
+
+		// Validate the header first. The message sequence number is trustworthy
+		// afterwards and is used for the negative acknowledge.
+		pmsn, err = p.validateEnhancedHeader(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The flags indicate the CRC type of the message.
+	// A corrupted CRC type field fails the checksum validation.
+	if len(body) < 2 {
+		return fmt.Errorf("invalid data message body: body is too short")
+	}
+	crcValidator, crcLength, crcType := p.codec.dataMessageCRC(body[1])
+
 	// Check for the required minimum body length.
-	// Message sequence number, append data flag and CRC checksum have to be contained.
+	// Message sequence number, flags and CRC checksum have to be contained.
 	// 1 Byte + 1 Byte + 2/4 Bytes
-	if len(body) < 2+p.dataMessageCRCLength {
+	if len(body) < headerLength+crcLength {
 		return fmt.Errorf("invalid data message body: body is too short")
 	}
 
 	// Extract the CRC checksum.
-	pos := len(body) - p.dataMessageCRCLength
+	pos := len(body) - crcLength
 	crcChecksum := body[pos:]
+	checksum = crcChecksum
 
 	// Remove the CRC checksum from the body.
 	body = body[:pos]
 
 	// Validate the the message body with the checksum.
-	if !p.dataMessageCRCValidator.Validate(body, crcChecksum) {
+	if !crcValidator.Validate(body, crcChecksum) {
+		p.stats.update(func(c *StatsSnapshot) { c.ChecksumErrors++ })
 		return fmt.Errorf("message body is corrupt: message CRC checksum is invalid")
 	}
+	p.stats.update(func(c *StatsSnapshot) { c.DataMessagesReceived++ })
 
 	// Extract the peer message sequence number (PMSN).
 	pmsn = body[0]
 
-	// Extract the append data flag.
-	appendData := body[1]
+	// The message sequence of the peer expires, if it sent no data messages
+	// for a while. A restarted peer begins a new message sequence.
+	now := p.config.Clock.Now()
+	if now.Sub(p.readSequenceTime) > p.config.ReassemblyTimeout {
+		p.resetReadSequence()
+	}
+	p.readSequenceTime = now
+
+	// A restarted peer begins a new message sequence.
+	if p.isPeerRestart(pmsn, body[1], crcChecksum) {
+		p.log.Debugf("read data: peer restarted its message sequence (PMSN=%v)", pmsn)
+		p.resetReadSequence()
+		p.resetBinaryDataBuffer()
+	}
+
+	// Suppress a duplicate of the previously acknowledged data message.
+	// The peer resent it, because the acknowledge got lost. Acknowledge it again.
+	if p.readAckedPMSNValid && pmsn == p.readAckedPMSN {
+		p.log.Debugf("read data: discarding duplicate data message (PMSN=%v)", pmsn)
+		if len(p.readBinaryDataBuffer) > 0 {
+			p.readDuplicates = true
+		}
+		return nil
+	}
+
+	// Extract the flags.
+	flags := body[1]
 
 	// Extract the binary data.
-	binData := body[2:]
+	binData := body[headerLength:]
+
+	// Pipelined data messages of a send window might arrive out of order.
+	if flags&flagPipelined != 0 {
+		return p.receivePipelinedDataMessage(pmsn, crcType, flags, binData)
+	}
+
+	// Unacknowledged data messages are not part of the message sequence.
+	if pmsn == umsn {
+		return p.processDataMessage(pmsn, crcType, flags, binData)
+	}
+
+	// Request missing messages if a sequence gap is detected.
+	p.checkSequenceGap(pmsn)
+
+	return p.processDataMessage(pmsn, crcType, flags, binData)
+}
+
+// processDataMessage passes the binary data of a validated data message
+// to the reassembly buffer or delivers the complete data chunk.
+// This method must be only called by the read messages loop.
+func (p *Port) processDataMessage(pmsn byte, crcType CRCType, flags byte, binData []byte) (err error) {
+	// Urgent messages bypass the reassembly buffer, because they might
+	// arrive in the middle of a bulk transmission. They are never split.
+	if flags&flagUrgent != 0 {
+		// Copy the data, because the body buffer is reused.
+		data, err := p.openDataChunk(flags, append([]byte(nil), binData...))
+		if err != nil {
+			p.discardUnauthenticatedDataChunk(flags, err)
+			return nil
+		}
+		m := p.newMessage(pmsn, crcType, true, data, 1)
+
+		// Push the data chunk to the urgent channel.
+		select {
+		case <-p.closeChan:
+			return ErrClosed
+		case p.readUrgentChunkChan <- m:
+		}
+
+		return nil
+	}
+
+	// Discard stale binary data of a stalled multi-message transmission.
+	// The reassembly timer might not have fired yet.
+	if len(p.readBinaryDataBuffer) > 0 && p.config.Clock.Now().Sub(p.readBinaryDataTime) > p.config.ReassemblyTimeout {
+		p.discardStaleBinaryData()
+	}
 
 	// Check if the binary data is send in multiple messages.
-	if appendData == 0 {
+	if flags&flagAppendData == 0 {
+		// Reject the last message of an overflowed transmission.
+		if p.readBinaryDataOverflow {
+			p.readBinaryDataOverflow = false
+			return errReassemblyOverflow
+		}
+
+		// Keep the order of the data chunks, if the previous one is still
+		// pending. Reject the data message if the peer resends it later.
+		// Otherwise wait until the pending data chunk was delivered.
+		if flags&flagService == 0 {
+			if err = p.waitForPendingDataChunk(p.isRejectable(pmsn, flags)); err != nil {
+				return err
+			}
+		}
+
 		// End of binary data transmission.
-		// Obtain the complete data chunk.
-		data := append(p.readBinaryDataBuffer, binData...)
+		// Obtain the complete data chunk. Always copy the data, because
+		// the binary data buffer is reused for the next transmission.
+		data := make([]byte, 0, len(p.readBinaryDataBuffer)+len(binData))
+		data = append(data, p.readBinaryDataBuffer...)
+		data = append(data, binData...)
+
+		// Decrypt the data chunk if enabled.
+		data, err = p.openDataChunk(flags, data)
+		if err != nil {
+			p.resetBinaryDataBuffer()
+			p.discardUnauthenticatedDataChunk(flags, err)
+			return nil
+		}
+
+		// Service data chunks are dispatched to the registered service.
+		// The peer resends the data message, if it was rejected by a busy
+		// service. Keep the buffered binary data for the resend.
+		if flags&flagService != 0 {
+			m := p.newMessage(pmsn, crcType, false, data, p.readBinaryDataMessages+1)
+			err = p.dispatchServiceMessage(m, p.isRejectable(pmsn, flags))
+			if err != errServiceBusy {
+				p.resetBinaryDataBuffer()
+			} else if s, _ := p.currentSession(); s != nil && p.config.ReplayProtection {
+				// Accept the resent data chunk.
+				s.readWindow.unmark(s.readCounter)
+			}
+			return err
+		}
 
-		// Push the data chunk to the channel.
-		p.readDataChunkChan <- data
+		// Decode delta encoded data chunks. Always keep the base data chunk,
+		// because the peer might enable the delta encoding anytime.
+		if flags&flagDelta != 0 {
+			data, err = decodeDelta(p.readDeltaBase, data)
+			if err != nil {
+				// The peer resends the data chunk as keyframe on the negative acknowledge.
+				p.log.Warningf("read data: failed to decode delta encoded data chunk: %v: discarding data chunk", err)
+				p.resetBinaryDataBuffer()
+				return errDeltaMismatch
+			}
+		}
+		p.readDeltaBase = append(p.readDeltaBase[:0], data...)
+
+		// Create the message with the reception metadata.
+		m := p.newMessage(pmsn, crcType, false, data, p.readBinaryDataMessages+1)
+		m.DuplicatesSuppressed = p.readDuplicates
 
 		// Clear the binary data chunk buffer.
-		p.readBinaryDataBuffer = p.readBinaryDataBuffer[:0]
+		p.resetBinaryDataBuffer()
+
+		// Report the progress. The total size is known now.
+		if p.config.OnReadProgress != nil {
+			p.config.OnReadProgress(len(data), len(data))
+		}
 
-		// Release memory if the capacity of the buffer is huge.
-		if cap(p.readBinaryDataBuffer) > 10240 {
-			p.readBinaryDataBuffer = nil
+		// Push the data chunk to the channel. Never block the read routine
+		// with a slow consumer. The data chunk is delivered in the background.
+		select {
+		case p.readDataChunkChan <- m:
+		default:
+			p.deliverPendingDataChunk(m)
 		}
 	} else {
+		// Discard the transmission if the reassembly buffer would overflow.
+		// The remaining messages of this transmission are rejected, until the
+		// peer aborts the transmission.
+		if p.readBinaryDataOverflow || len(p.readBinaryDataBuffer)+len(binData) > p.config.ReassemblyBufferSize {
+			if !p.readBinaryDataOverflow {
+				p.log.Warningf("read data: reassembly buffer size of %v bytes exceeded: discarding transmission", p.config.ReassemblyBufferSize)
+				p.resetBinaryDataBuffer()
+				p.readBinaryDataOverflow = true
+
+				// Legacy peers might assume a successful transmission.
+				// Following delta encoded data chunks can't be decoded anymore.
+				p.readDeltaBase = nil
+			}
+			return errReassemblyOverflow
+		}
+
 		// The data message transmission is not complete.
 		// Push the received binary data to the buffer.
+		if p.readBinaryDataMessages == 0 {
+			p.readBinaryDataStart = p.decoder.startTime
+		}
 		p.readBinaryDataBuffer = append(p.readBinaryDataBuffer, binData...)
+		p.readBinaryDataMessages++
+
+		// Restart the reassembly timer.
+		p.readBinaryDataTime = p.config.Clock.Now()
+		p.reassemblyTimer.Reset(p.config.ReassemblyTimeout)
+
+		// Report the progress. The total size is unknown until the last message.
+		if p.config.OnReadProgress != nil {
+			p.config.OnReadProgress(len(p.readBinaryDataBuffer), -1)
+		}
 	}
 
 	return nil
 }
 
+// isRejectable returns true if the peer resends the data message after a
+// negative acknowledge. Pipelined, broadcast and unacknowledged data
+// messages are never resent.
+// This method must be only called by the read messages loop.
+func (p *Port) isRejectable(pmsn byte, flags byte) bool {
+	return pmsn != umsn && flags&flagPipelined == 0 && !p.decoder.isBroadcast
+}
+
+// deliverPendingDataChunk delivers the data chunk in the background,
+// because the read queue is full. The peer is asked to pause the
+// transmission until the data chunk was delivered.
+// This method must be only called by the read messages loop.
+func (p *Port) deliverPendingDataChunk(m *Message) {
+	p.log.Debugf("read data: read queue is full: asking the peer to wait")
+	p.writeControlMessage(wat, umsn)
+
+	done := make(chan struct{})
+	p.readPendingDone = done
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-p.closeChan:
+			return
+		case p.readDataChunkChan <- m:
+		}
+
+		p.log.Debugf("read data: pending data chunk delivered: telling the peer to continue")
+		p.writeControlMessage(rdy, umsn)
+	}()
+}
+
+// waitForPendingDataChunk waits until the pending data chunk was delivered.
+// If reject is set, then errReadQueueFull is returned instead of waiting.
+// Returns ErrClosed if the port was closed.
+// This method must be only called by the read messages loop.
+func (p *Port) waitForPendingDataChunk(reject bool) error {
+	if p.readPendingDone == nil {
+		return nil
+	}
+
+	select {
+	case <-p.readPendingDone:
+		p.readPendingDone = nil
+		return nil
+	default:
+	}
+
+	if reject {
+		return errReadQueueFull
+	}
+
+	select {
+	case <-p.closeChan:
+		return ErrClosed
+	case <-p.readPendingDone:
+		p.readPendingDone = nil
+		return nil
+	}
+}
+
 //###############//
 //### Private ###//
 //###############//
 
+// nextSequenceNumber returns the message sequence number following msn.
+// The message sequence number cycles from 1 to 255 and skips
+// the unknown message sequence number.
+func nextSequenceNumber(msn byte) byte {
+	msn++
+	if msn == umsn {
+		msn++
+	}
+	return msn
+}
+
+// isDataMessageCharacter returns a boolean whenever the byte
+// is the start character of a data message.
+func isDataMessageCharacter(b byte) bool {
+	return b == stx || b == soh
+}
+
+// isControlCharacter returns a boolean whenever the byte
+// is the start character of a control message.
+func isControlCharacter(b byte) bool {
+	return b == ack || b == nak || b == can || b == bst || b == rsd || b == bel || b == enq || b == wat || b == rdy
+}
+
 func escapeDLE(data []byte) []byte {
-	escapedData := make([]byte, 0, len(data))
+	return appendEscaped(make([]byte, 0, len(data)), data, dle)
+}
 
+// appendEscaped appends the data escaped with the esc character to dst.
+// The data may precede the appended bytes in the same array.
+func appendEscaped(dst []byte, data []byte, esc byte) []byte {
 	for _, b := range data {
-		if b == dle {
-			escapedData = append(escapedData, dle, dle)
+		if b == esc {
+			dst = append(dst, esc, esc)
 		} else {
-			escapedData = append(escapedData, b)
+			dst = append(dst, b)
 		}
 	}
 
-	return escapedData
+	return dst
 }
 
 func unescapeDLE(data []byte) []byte {
+	return unescape(data, dle)
+}
+
+// unescape removes the esc characters, which escape the following byte.
+func unescape(data []byte, esc byte) []byte {
 	unescapedData := make([]byte, 0, len(data))
 	isEscaped := false
 
 	for _, b := range data {
-		if !isEscaped && b == dle {
+		if !isEscaped && b == esc {
 			isEscaped = true
 			continue
 		}
@@ -19,8 +19,25 @@
 package ants
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/desertbit/ants/src/golang/loopback"
 	"github.com/stretchr/testify/require"
 )
 
@@ -36,3 +53,3611 @@ func TestDLEEscaping(t *testing.T) {
 		require.True(t, b == d[i])
 	}
 }
+
+func TestWriteReturnsOnClose(t *testing.T) {
+	p := NewPort(loopback.New())
+
+	// Fill the write queue. Nobody acknowledges the messages,
+	// so the queue is never drained.
+	errChan := make(chan error)
+	go func() {
+		for {
+			if err := p.Write([]byte("data")); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	// Give the writer some time to block on the full queue.
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, p.Close())
+
+	select {
+	case err := <-errChan:
+		require.Equal(t, ErrClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("write blocked after the port was closed")
+	}
+}
+
+type eofSource struct{}
+
+func (eofSource) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (eofSource) Write(p []byte) (int, error) { return len(p), nil }
+func (eofSource) Close() error                { return nil }
+
+func TestEOFBehavior(t *testing.T) {
+	// Closure.
+	p := NewPort(eofSource{}, &Config{EOFBehavior: EOFClose})
+
+	select {
+	case <-p.closeChan:
+	case <-time.After(time.Second):
+		t.Fatal("port was not closed on EOF")
+	}
+	require.Equal(t, ErrSourceEOF, p.Err())
+
+	// Reconnect.
+	reconnected := make(chan struct{})
+	p = NewPort(eofSource{}, &Config{
+		EOFBehavior: EOFReconnect,
+		OnEOF: func() (io.ReadWriteCloser, error) {
+			close(reconnected)
+			return loopback.New(), nil
+		},
+	})
+	defer p.Close()
+
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("reconnect hook was not called on EOF")
+	}
+	require.False(t, p.IsClosed())
+	require.NoError(t, p.Err())
+}
+
+func TestEnhancedFrameLayout(t *testing.T) {
+	p := NewPort(loopback.New(), &Config{FrameLayout: FrameLayoutEnhanced})
+	defer p.Close()
+
+	data := []byte{1, 2, dle, 3, dle, dle, 4}
+	frame := p.newDataMessageFrame(5, 0, data)
+
+	// Strip the start and end characters and unescape the body.
+	require.Equal(t, []byte{dle, soh}, frame[:2])
+	require.Equal(t, []byte{dle, etx}, frame[len(frame)-2:])
+	body := unescapeDLE(frame[2 : len(frame)-2])
+
+	// A corrupted header is detected before the body is interpreted.
+	corrupt := append([]byte(nil), body...)
+	corrupt[1] ^= flagAppendData
+	_, err := p.validateEnhancedHeader(corrupt)
+	require.Error(t, err)
+
+	// A valid body is delivered.
+	require.NoError(t, p.handleReceivedDataMessageBody(soh, body))
+
+	d, err := p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, data, d)
+}
+
+func TestDebugState(t *testing.T) {
+	p := NewPort(sinkSource{})
+	defer p.Close()
+
+	s := p.DebugState()
+	require.False(t, s.IsClosed)
+	require.Equal(t, -1, s.PeerFreeBuffer)
+	require.Empty(t, s.InFlight)
+
+	// The message stays in flight until it is acknowledged.
+	require.NoError(t, p.Write([]byte{1, 2, 3}))
+	require.Eventually(t, func() bool {
+		return len(p.DebugState().InFlight) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	s = p.DebugState()
+	require.Equal(t, s.MSN, s.InFlight[0].MSN)
+	require.Equal(t, 3, s.InFlight[0].Size)
+	require.False(t, s.InFlight[0].Urgent)
+}
+
+type giveUpStrategy struct {
+	attempts chan ARQAttempt
+}
+
+func (s giveUpStrategy) Timeout(a ARQAttempt) time.Duration {
+	return 10 * time.Millisecond
+}
+
+func (s giveUpStrategy) Retransmit(a ARQAttempt) bool {
+	s.attempts <- a
+	return a.Transmissions < 3
+}
+
+func TestARQStrategy(t *testing.T) {
+	s := giveUpStrategy{attempts: make(chan ARQAttempt, 3)}
+	failed := make(chan Event, 1)
+
+	p := NewPort(sinkSource{}, &Config{
+		ARQStrategy: s,
+		OnEvent: func(e Event) {
+			if e.Type == EventTransmissionFailed {
+				failed <- e
+			}
+		},
+	})
+	defer p.Close()
+
+	// The sink never acknowledges the data message.
+	require.NoError(t, p.Write([]byte{1, 2, 3}))
+
+	select {
+	case <-failed:
+	case <-time.After(time.Second):
+		t.Fatal("transmission was not given up")
+	}
+
+	for i := 1; i <= 3; i++ {
+		a := <-s.attempts
+		require.Equal(t, i, a.Transmissions)
+		require.Equal(t, ARQReasonTimeout, a.Reason)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	failed := make(chan []byte, 1)
+	p := NewPort(sinkSource{}, &Config{
+		AckTimeout: 10 * time.Millisecond,
+		MaxRetries: 2,
+		OnWriteError: func(data []byte, err error) {
+			require.Equal(t, ErrMaxRetriesReached, err)
+			failed <- data
+		},
+	})
+	defer p.Close()
+
+	// The sink never acknowledges the data message.
+	require.NoError(t, p.Write([]byte{1, 2, 3}))
+
+	select {
+	case data := <-failed:
+		require.Equal(t, []byte{1, 2, 3}, data)
+	case <-time.After(time.Second):
+		t.Fatal("transmission was not given up")
+	}
+
+	s := p.Stats().Snapshot()
+	require.Equal(t, uint64(3), s.DataMessagesSent)
+	require.Equal(t, uint64(2), s.Retransmissions)
+}
+
+func TestStaleAcknowledge(t *testing.T) {
+	p := NewPort(sinkSource{})
+	defer p.Close()
+
+	// A delayed acknowledge of the previous data message and a negative
+	// acknowledge of an older one don't answer the current data message.
+	p.readControlMessageChan <- controlMessage{TypeCharacter: ack, MSN: 4}
+	p.readControlMessageChan <- controlMessage{TypeCharacter: nak, MSN: 3}
+	reason, _, err := p.waitForResponse(5, 50*time.Millisecond, p.abortChan)
+	require.NoError(t, err)
+	require.Equal(t, ARQReasonTimeout, reason)
+
+	// A duplicate acknowledge is skipped until the matching one arrives.
+	p.readControlMessageChan <- controlMessage{TypeCharacter: ack, MSN: 4}
+	p.readControlMessageChan <- controlMessage{TypeCharacter: ack, MSN: 5}
+	reason, _, err = p.waitForResponse(5, time.Second, p.abortChan)
+	require.NoError(t, err)
+	require.Equal(t, ARQReasonNone, reason)
+}
+
+func TestCloseContext(t *testing.T) {
+	// Without pending data chunks the port is closed immediately.
+	p := NewPort(loopback.New())
+	require.NoError(t, p.CloseContext(context.Background()))
+	require.True(t, p.IsClosed())
+
+	// The sink never acknowledges the data message,
+	// so the port is forcibly closed after the deadline.
+	p = NewPort(sinkSource{})
+	require.NoError(t, p.Write([]byte{1, 2, 3}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.Equal(t, context.DeadlineExceeded, p.CloseContext(ctx))
+	require.True(t, p.IsClosed())
+}
+
+func TestCloseGracefully(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer peer.Close()
+
+	// The queued data chunks are transmitted before the port is closed.
+	for i := byte(0); i < 3; i++ {
+		require.NoError(t, p.Write([]byte{i}))
+	}
+
+	received := make(chan []byte, 3)
+	go func() {
+		for {
+			data, err := peer.Read()
+			if err != nil {
+				return
+			}
+			received <- data
+		}
+	}()
+
+	require.NoError(t, p.CloseGracefully(time.Second))
+	require.True(t, p.IsClosed())
+	for i := byte(0); i < 3; i++ {
+		require.Equal(t, []byte{i}, <-received)
+	}
+
+	// The sink never acknowledges the data message.
+	p = NewPort(sinkSource{})
+	require.NoError(t, p.Write([]byte{1}))
+	require.Equal(t, ErrTimeout, p.CloseGracefully(50*time.Millisecond))
+	require.True(t, p.IsClosed())
+}
+
+func TestReadMessage(t *testing.T) {
+	p := NewPort(loopback.New(), &Config{DataMessageCRC: CRC32})
+	defer p.Close()
+
+	// Receive a data chunk split into two data messages.
+	frame := p.newDataMessageFrame(7, flagAppendData, []byte{1, 2})
+	require.NoError(t, p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2])))
+	frame = p.newDataMessageFrame(8, 0, []byte{3})
+	require.NoError(t, p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2])))
+
+	m, err := p.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, m.Data)
+	require.Equal(t, byte(8), m.MSN)
+	require.Equal(t, 2, m.Fragments)
+	require.Equal(t, CRCType(CRC32), m.CRC)
+	require.False(t, m.Urgent)
+	require.False(t, m.DuplicatesSuppressed)
+	require.False(t, m.Time.IsZero())
+}
+
+func TestDuplicateSuppression(t *testing.T) {
+	p := NewPort(sinkSource{})
+	defer p.Close()
+
+	receive := func(msn, flags byte, data []byte) {
+		frame := p.newDataMessageFrame(msn, flags, data)
+		require.NoError(t, p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2])))
+	}
+
+	// The acknowledge got lost and the peer resent the data message.
+	receive(7, 0, []byte{1})
+	receive(7, 0, []byte{1})
+
+	m, err := p.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, m.Data)
+	require.False(t, m.DuplicatesSuppressed)
+
+	_, err = p.Read(50 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+
+	// Duplicates within a multi-message transmission are reported.
+	receive(8, flagAppendData, []byte{1, 2})
+	receive(8, flagAppendData, []byte{1, 2})
+	receive(9, 0, []byte{3})
+
+	m, err = p.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, m.Data)
+	require.True(t, m.DuplicatesSuppressed)
+}
+
+func TestPeerRestart(t *testing.T) {
+	// The peer reconnects with a new pipe after each restart.
+	ends := make(chan io.ReadWriteCloser, 1)
+	a, b := loopback.Pipe()
+	p := NewPort(a, &Config{
+		ReassemblyTimeout: 100 * time.Millisecond,
+		EOFBehavior:       EOFReconnect,
+		OnEOF:             func() (io.ReadWriteCloser, error) { return <-ends, nil },
+	})
+	defer p.Close()
+
+	// Each new peer port starts with the same message sequence number.
+	send := func(data string, config *Config) {
+		peer := NewPort(b, config)
+		require.NoError(t, peer.WriteAndConfirm([]byte(data), time.Second))
+
+		d, err := p.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, data, string(d))
+
+		a, b = loopback.Pipe()
+		ends <- a
+		peer.Close()
+	}
+	send("boot-1", &Config{})
+
+	// The handshake starts a new session of the peer.
+	send("boot-2", &Config{Handshake: true})
+
+	// The message sequence of the silent peer expires.
+	time.Sleep(200 * time.Millisecond)
+	send("boot-3", &Config{})
+
+	// The same applies to pipelined data messages.
+	send("boot-4", &Config{Handshake: true, SendWindow: 4})
+	send("boot-5", &Config{Handshake: true, SendWindow: 4})
+
+	// The first data message of a peer, which restarted without a handshake,
+	// is not a duplicate, although it carries the acknowledged message
+	// sequence number. Resends of the data message are identical.
+	send("boot-6", &Config{})
+	send("boot-7", &Config{})
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	p := NewPort(sinkSource{}, &Config{Logger: NewSlogLogger(l.With("port", "test"))})
+	defer p.Close()
+
+	// A duplicate data message is logged.
+	frame := p.newDataMessageFrame(7, 0, []byte{1})
+	body := unescapeDLE(frame[2 : len(frame)-2])
+	require.NoError(t, p.handleReceivedDataMessageBody(stx, body))
+	require.NoError(t, p.handleReceivedDataMessageBody(stx, body))
+
+	require.Contains(t, buf.String(), `level=DEBUG msg="read data: discarding duplicate data message (PMSN=7)" port=test`)
+}
+
+func TestReadRateLimit(t *testing.T) {
+	p := NewPort(loopback.New(), &Config{ReadRateLimit: 100})
+	defer p.Close()
+
+	data := make([]byte, 150)
+	for i := 0; i < 2; i++ {
+		frame := p.newDataMessageFrame(byte(i+1), 0, data)
+		require.NoError(t, p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2])))
+	}
+
+	// The first data chunk drains the bucket below zero.
+	// The second one is released after the debt is paid off.
+	start := time.Now()
+	_, err := p.Read(time.Second)
+	require.NoError(t, err)
+
+	// The wait for the rate limiter is bounded by the timeout.
+	// The data chunk stays queued.
+	_, err = p.Read(50 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+	require.Len(t, p.readDataChunkChan, 1)
+
+	_, err = p.Read(time.Second)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 400*time.Millisecond)
+}
+
+func TestResponderMode(t *testing.T) {
+	requests := make(chan []byte, 1)
+
+	p := NewPort(sinkSource{}, &Config{
+		Responder: func(m *Message) []byte {
+			requests <- m.Data
+			return []byte{9}
+		},
+	})
+	defer p.Close()
+
+	// A responder never initiates a transmission.
+	require.Equal(t, ErrResponderMode, p.Write([]byte{1}))
+	require.Equal(t, ErrResponderMode, p.WriteUrgent([]byte{1}))
+	_, err := p.Read()
+	require.Equal(t, ErrResponderMode, err)
+
+	frame := p.newDataMessageFrame(1, 0, []byte{1, 2})
+	require.NoError(t, p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2])))
+	require.Equal(t, []byte{1, 2}, <-requests)
+
+	// The response is transmitted.
+	require.Eventually(t, func() bool {
+		s := p.DebugState()
+		return len(s.InFlight) == 1 && s.InFlight[0].Size == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestIdleMode(t *testing.T) {
+	l := loopback.New()
+	p := NewPort(l, &Config{IdleTimeout: 10 * time.Millisecond})
+	defer p.Close()
+
+	// Wait until the read routine is parked on a blocking read.
+	time.Sleep(100 * time.Millisecond)
+
+	// Received data is still processed.
+	frame := p.newDataMessageFrame(1, 0, []byte{1, 2, 3})
+	_, err := l.Write(frame)
+	require.NoError(t, err)
+
+	d, err := p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, d)
+}
+
+func TestDeltaEncoding(t *testing.T) {
+	base := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	data := append([]byte(nil), base...)
+	data[1] = 20
+	data[3] = 40
+	data[14] = 150
+
+	delta, ok := encodeDelta(base, data)
+	require.True(t, ok)
+	require.True(t, len(delta) < len(data))
+
+	decoded, err := decodeDelta(base, delta)
+	require.NoError(t, err)
+	require.Equal(t, data, decoded)
+
+	// Data chunks of a different size are not delta encoded.
+	_, ok = encodeDelta(base, data[:10])
+	require.False(t, ok)
+
+	// A delta encoded data chunk is decoded with the previous data chunk.
+	p := NewPort(loopback.New())
+	defer p.Close()
+
+	for i, d := range [][]byte{base, delta} {
+		var flags byte
+		if i > 0 {
+			flags = flagDelta
+		}
+		frame := p.newDataMessageFrame(byte(i+1), flags, d)
+		require.NoError(t, p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2])))
+	}
+
+	for _, d := range [][]byte{base, data} {
+		r, err := p.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, d, r)
+	}
+}
+
+func TestDeltaMismatch(t *testing.T) {
+	// A delta encoded data chunk without a base data chunk is rejected.
+	l := loopback.New()
+	p := NewPort(l)
+	defer p.Close()
+
+	frame := p.newDataMessageFrame(1, flagDelta, []byte{0, 1, 2})
+	err := p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2]))
+	require.Equal(t, errDeltaMismatch, err)
+	require.Equal(t, NakReasonDeltaMismatch, nakReasonOf(err))
+
+	// The sender resends the data chunk as keyframe.
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+
+	a, b := net.Pipe()
+	p = NewPort(a, &Config{Cipher: c, DeltaEncoding: true})
+	peer := NewPort(b, &Config{Cipher: c, DeltaEncoding: true})
+	defer p.Close()
+	defer peer.Close()
+
+	base := bytes.Repeat([]byte{1}, 64)
+	require.NoError(t, p.WriteAndConfirm(base, time.Second))
+	received, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, base, received)
+
+	// A forged data chunk fails the authentication and discards the delta base of the peer.
+	_, err = a.Write(p.newDataMessageFrame(umsn, flagEncrypted, bytes.Repeat([]byte{2}, 64)))
+	require.NoError(t, err)
+
+	data := append([]byte(nil), base...)
+	data[10] = 10
+	require.NoError(t, p.WriteAndConfirm(data, time.Second))
+	received, err = peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, data, received)
+	require.Equal(t, uint64(1), p.Stats().Snapshot().NakDeltaMismatches)
+}
+
+func TestDecoderPool(t *testing.T) {
+	pool := NewDecoderPool(2)
+	defer pool.Close()
+
+	var ports []*Port
+	var sources []io.ReadWriteCloser
+	for i := 0; i < 10; i++ {
+		l := loopback.New()
+		p := NewPort(l, &Config{DecoderPool: pool})
+		defer p.Close()
+
+		ports = append(ports, p)
+		sources = append(sources, l)
+	}
+
+	// Each port decodes its own data. The last port receives nothing.
+	data := []byte{1, 2, 3}
+	for i, p := range ports[:len(ports)-1] {
+		_, err := sources[i].Write(p.newDataMessageFrame(1, 0, data))
+		require.NoError(t, err)
+	}
+
+	for _, p := range ports[:len(ports)-1] {
+		d, err := p.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, data, d)
+	}
+
+	_, err := ports[len(ports)-1].Read(100 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+}
+
+func TestDecoderPoolStall(t *testing.T) {
+	pool := NewDecoderPool(1)
+	defer pool.Close()
+
+	stalled, live := loopback.New(), loopback.New()
+	ps, pl := NewPort(stalled, &Config{DecoderPool: pool}), NewPort(live, &Config{DecoderPool: pool})
+	defer ps.Close()
+	defer pl.Close()
+
+	// Nobody reads the urgent data chunks of the stalled port.
+	for i := byte(0); i < readUrgentChunkChanSize+2; i++ {
+		_, err := stalled.Write(ps.newDataMessageFrame(i+1, flagUrgent, []byte{i}))
+		require.NoError(t, err)
+	}
+	time.Sleep(2 * poolStallTimeout)
+
+	// The live port is still decoded.
+	_, err := live.Write(pl.newDataMessageFrame(1, 0, []byte{1, 2, 3}))
+	require.NoError(t, err)
+	d, err := pl.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, d)
+
+	// The stalled port continues, once its data chunks are read.
+	for i := byte(0); i < readUrgentChunkChanSize+2; i++ {
+		d, err := ps.ReadUrgent(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte{i}, d)
+	}
+}
+
+func TestPool(t *testing.T) {
+	open := func() (io.ReadWriteCloser, error) {
+		return loopback.New(), nil
+	}
+
+	pl := NewPool(PoolConfig{MaxPorts: 1, DecoderWorkers: 1})
+	defer pl.Close()
+
+	// The config of the caller is not modified.
+	config := &Config{}
+	p, err := pl.Open(context.Background(), open, config)
+	require.NoError(t, err)
+	require.Nil(t, config.DecoderPool)
+
+	_, err = pl.Open(context.Background(), open)
+	require.Equal(t, ErrPoolExhausted, err)
+
+	// The resources are released once the port is closed.
+	p.Close()
+	p, err = pl.Open(context.Background(), open)
+	require.NoError(t, err)
+
+	// Queued opens wait for released resources.
+	pl.config.Queue = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pl.Open(ctx, open)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Close()
+	}()
+
+	p, err = pl.Open(context.Background(), open)
+	require.NoError(t, err)
+	p.Close()
+}
+
+func TestPing(t *testing.T) {
+	p := NewPort(sinkSource{})
+	defer p.Close()
+
+	// Without a reply the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := p.Ping(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// Simulate the reply of the peer to the second ping.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.handleReceivedPing([]byte{pingReply, 1})
+		p.handleReceivedPing([]byte{pingReply, 2})
+	}()
+
+	rtt, err := p.Ping(context.Background())
+	require.NoError(t, err)
+	require.True(t, rtt >= 20*time.Millisecond)
+}
+
+func TestSelfDescribingCRC(t *testing.T) {
+	// The receiver is configured with CRC16, but the peer uses CRC32.
+	p := NewPort(loopback.New())
+	defer p.Close()
+
+	peer := NewPort(loopback.New(), &Config{DataMessageCRC: CRC32})
+	defer peer.Close()
+
+	frame := peer.newDataMessageFrame(1, 0, []byte{1, dle, 3})
+	body := unescapeDLE(frame[2 : len(frame)-2])
+	require.Equal(t, byte(flagCRC32), body[1]&flagCRCMask)
+	require.NoError(t, p.handleReceivedDataMessageBody(stx, body))
+
+	m, err := p.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, dle, 3}, m.Data)
+	require.Equal(t, CRCType(CRC32), m.CRC)
+}
+
+// crc8Validator is a CRC-8 with the polynomial 0x07.
+type crc8Validator struct{}
+
+func (crc8Validator) Checksum(data []byte) []byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return []byte{crc}
+}
+
+func (v crc8Validator) Validate(data []byte, rawCRC []byte) bool {
+	return bytes.Equal(v.Checksum(data), rawCRC)
+}
+
+func TestCustomCRC(t *testing.T) {
+	// The custom type falls back to CRC16 without a validator.
+	c := &Config{DataMessageCRC: CRCCustom}
+	c.setDefaults()
+	require.Equal(t, CRCType(CRC16), c.DataMessageCRC)
+
+	a, b := net.Pipe()
+	config := func() *Config {
+		return &Config{
+			DataMessageCRC:    CRCCustom,
+			ControlMessageCRC: CRCCustom,
+			CustomCRC:         crc8Validator{},
+		}
+	}
+	p, peer := NewPort(a, config()), NewPort(b, config())
+	defer p.Close()
+	defer peer.Close()
+
+	require.NoError(t, p.Write([]byte{1, 2, 3}))
+
+	m, err := peer.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, m.Data)
+	require.Equal(t, CRCType(CRCCustom), m.CRC)
+
+	// The control messages use the custom checksum, too.
+	require.Eventually(t, func() bool {
+		return len(p.DebugState().InFlight) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNakReasons(t *testing.T) {
+	// The peer does not support the custom CRC type.
+	a, b := net.Pipe()
+	p := NewPort(a, &Config{
+		DataMessageCRC: CRCCustom,
+		CustomCRC:      crc8Validator{},
+		FrameLayout:    FrameLayoutEnhanced,
+	})
+	peer := NewPort(b)
+	require.Equal(t, ErrPeerUnsupportedVersion, p.WriteAndConfirm([]byte{1, 2, 3}, time.Second))
+	require.Equal(t, uint64(1), p.Stats().Snapshot().NakUnsupportedVersions)
+	p.Close()
+	peer.Close()
+
+	a, b = net.Pipe()
+	p = NewPort(a, &Config{
+		MaxMessageSize: 16,
+		AckTimeout:     20 * time.Millisecond,
+		MaxRetries:     50,
+	})
+	peer = NewPort(b, &Config{ReassemblyBufferSize: 32})
+	defer p.Close()
+	defer peer.Close()
+
+	// The transmission exceeds the reassembly buffer of the peer.
+	require.Equal(t, ErrPeerBufferOverflow, p.WriteAndConfirm(make([]byte, 64), time.Second))
+	require.Equal(t, uint64(1), p.Stats().Snapshot().NakBufferOverflows)
+
+	// The aborted transmission does not affect the next one.
+	require.NoError(t, p.WriteAndConfirm([]byte{4, 5, 6}, time.Second))
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4, 5, 6}, data)
+
+	// A busy service rejects data chunks, until it is read.
+	s, peerService := p.Service(200), peer.Service(200)
+	for i := byte(0); i < readServiceChunkChanSize+2; i++ {
+		require.NoError(t, s.Write([]byte{i}))
+	}
+	require.Eventually(t, func() bool {
+		return p.Stats().Snapshot().NakBusy > 0
+	}, time.Second, 10*time.Millisecond)
+
+	for i := byte(0); i < readServiceChunkChanSize+2; i++ {
+		data, err := peerService.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte{i}, data)
+	}
+
+	snapshot := p.Stats().Snapshot()
+	require.Equal(t, snapshot.NaksReceived, snapshot.NakBufferOverflows+snapshot.NakBusy)
+
+	// The reason is part of the frame description.
+	f, err := ParseFrame(p.codec.encodeControlMessage(nak, 3, []byte{byte(NakReasonBusy)}))
+	require.NoError(t, err)
+	require.Equal(t, "NAK MSN=3 reason=busy CRC-16 ok len=1", f.String())
+}
+
+func TestServiceRequest(t *testing.T) {
+	a, b := loopback.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	s, peerService := p.Service(200), peer.Service(200)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// The first request is not answered. Answer the resent one
+		// after a stale response of another request.
+		req, err := peerService.Read(time.Second)
+		require.NoError(t, err)
+		resent, err := peerService.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, req, resent)
+
+		op, id := req[0], req[1]
+		require.NoError(t, peerService.Write([]byte{op, id - 1, 1, 'x'}))
+		require.NoError(t, peerService.Write(append([]byte{op, id, 2}, req[2:]...)))
+
+		// The notification is not answered.
+		req, err = peerService.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte{9, id + 1, 'n'}, req)
+	}()
+
+	status, resp, err := s.Request(7, []byte("ping"), 100*time.Millisecond, 1)
+	require.NoError(t, err)
+	require.Equal(t, byte(2), status)
+	require.Equal(t, "ping", string(resp))
+	require.NoError(t, s.Notify(9, []byte{'n'}))
+	<-done
+
+	// The retries are exhausted.
+	_, _, err = s.Request(7, nil, 50*time.Millisecond, 1)
+	require.Equal(t, ErrTimeout, err)
+}
+
+func TestLoopbackPipe(t *testing.T) {
+	a, b := loopback.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	// The peer acknowledges the data chunks in both directions.
+	require.NoError(t, p.WriteAndConfirm([]byte{1, 2, 3}, time.Second))
+	require.NoError(t, peer.WriteAndConfirm([]byte{4, 5, 6}, time.Second))
+
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, data)
+
+	data, err = p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4, 5, 6}, data)
+}
+
+func TestFlowControl(t *testing.T) {
+	// Record the transmitted flow control messages of the peer.
+	var mutex sync.Mutex
+	var flowControl []byte
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b, &Config{
+		OnRawFrameSent: func(frame []byte) {
+			if frame[1] == wat || frame[1] == rdy {
+				mutex.Lock()
+				flowControl = append(flowControl, frame[1])
+				mutex.Unlock()
+			}
+		},
+	})
+	defer p.Close()
+	defer peer.Close()
+
+	// The peer asks to wait, if its read queue is full.
+	n := byte(readDataChunkChanSize + 2)
+	for i := byte(0); i < n; i++ {
+		require.NoError(t, p.Write([]byte{i}))
+	}
+	require.Eventually(t, func() bool {
+		return p.DebugState().PeerWaiting
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, p.PendingWrites())
+
+	// The transmission continues in order, once the data chunks are read.
+	for i := byte(0); i < n; i++ {
+		data, err := peer.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte{i}, data)
+	}
+	require.Eventually(t, func() bool {
+		return !p.DebugState().PeerWaiting && p.PendingWrites() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// The flow control messages never use the XON and XOFF characters,
+	// which are consumed by serial drivers with software flow control.
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []byte{wat, rdy}, flowControl)
+	require.NotContains(t, []byte{0x11, 0x13}, wat)
+	require.NotContains(t, []byte{0x11, 0x13}, rdy)
+}
+
+func TestEchoCancellation(t *testing.T) {
+	e := newEchoCanceller(time.Second)
+	e.expect([]byte{1, 2, 3})
+
+	data, ok := e.filter([]byte{1, 2})
+	require.True(t, ok)
+	require.Len(t, data, 0)
+
+	data, ok = e.filter([]byte{3, 4})
+	require.True(t, ok)
+	require.Equal(t, []byte{4}, data)
+
+	// A collision stops the cancellation of the pending bytes.
+	e.expect([]byte{5, 6})
+	data, ok = e.filter([]byte{5, 7, 6})
+	require.False(t, ok)
+	require.Equal(t, []byte{7, 6}, data)
+
+	// Expired bytes are not cancelled anymore.
+	e = newEchoCanceller(10 * time.Millisecond)
+	e.expect([]byte{1})
+	time.Sleep(20 * time.Millisecond)
+	data, ok = e.filter([]byte{1})
+	require.True(t, ok)
+	require.Equal(t, []byte{1}, data)
+
+	// The loopback echoes the transmitted frame. Only the frame of the peer is received.
+	lb := loopback.New()
+	p := NewPort(lb, &Config{EchoCancellation: true})
+	defer p.Close()
+
+	require.NoError(t, p.writeToSource(p.newDataMessageFrame(1, 0, []byte("echo"))))
+
+	peer := NewPort(loopback.New())
+	defer peer.Close()
+
+	_, err := lb.Write(peer.newDataMessageFrame(1, 0, []byte("peer")))
+	require.NoError(t, err)
+
+	m, err := p.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("peer"), m.Data)
+}
+
+type removedError struct{}
+
+func (removedError) Error() string       { return "device removed" }
+func (removedError) DeviceRemoved() bool { return true }
+
+type removedSource struct{}
+
+func (removedSource) Read(p []byte) (int, error)  { return 0, removedError{} }
+func (removedSource) Write(p []byte) (int, error) { return 0, removedError{} }
+func (removedSource) Close() error                { return nil }
+
+func TestDeviceRemoved(t *testing.T) {
+	events := make(chan Event, 2)
+	p := NewPort(removedSource{}, &Config{
+		OnEvent: func(e Event) { events <- e },
+	})
+
+	select {
+	case <-p.closeChan:
+	case <-time.After(time.Second):
+		t.Fatal("port was not closed on device removal")
+	}
+	require.Equal(t, removedError{}, p.Err())
+
+	e := <-events
+	require.Equal(t, EventDeviceRemoved, e.Type)
+}
+
+func TestCoalesceDataChunks(t *testing.T) {
+	c := &Config{CoalesceWindow: 50 * time.Millisecond}
+	c.setDefaults()
+	p := &Port{
+		config:             c,
+		closeChan:          make(chan struct{}),
+		writeDataChunkChan: make(chan writeChunk, defaultWriteQueueSize),
+	}
+
+	first := []byte{1}
+	p.writeDataChunkChan <- writeChunk{data: []byte{2, 3}}
+	p.writeDataChunkChan <- writeChunk{data: []byte{4}}
+
+	merged, chunks, next := p.coalesceDataChunks(first)
+	require.Equal(t, []byte{1, 2, 3, 4}, merged)
+	require.Equal(t, 3, chunks)
+	require.Nil(t, next)
+	require.Equal(t, []byte{1}, first)
+
+	// A data chunk exceeding the maximum size is transmitted next.
+	large := make([]byte, p.config.MaxMessageSize)
+	p.writeDataChunkChan <- writeChunk{data: large}
+
+	merged, chunks, next = p.coalesceDataChunks(first)
+	require.Equal(t, []byte{1}, merged)
+	require.Equal(t, 1, chunks)
+	require.Equal(t, large, next.data)
+
+	// A data chunk, which has to be confirmed, is transmitted next.
+	confirmed := writeChunk{data: []byte{2}, confirm: make(chan error, 1)}
+	p.writeDataChunkChan <- confirmed
+
+	merged, chunks, next = p.coalesceDataChunks(first)
+	require.Equal(t, []byte{1}, merged)
+	require.Equal(t, 1, chunks)
+	require.Equal(t, confirmed, *next)
+
+	// Urgent data chunks never wait for the coalesce window.
+	// They are transmitted before the merged data chunk.
+	a, b := net.Pipe()
+	pa, peer := NewPort(a, &Config{CoalesceWindow: 5 * time.Second}), NewPort(b)
+	defer pa.Close()
+	defer peer.Close()
+
+	// Wait until the write loop coalesces the data chunk.
+	start := time.Now()
+	require.NoError(t, pa.Write([]byte{1}))
+	require.Eventually(t, func() bool {
+		return pa.DebugState().WriteQueueLength == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, pa.WriteUrgent([]byte{2}))
+
+	data, err := peer.ReadUrgent(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, data)
+	data, err = peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, data)
+	require.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestWriteAndConfirm(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	// The peer acknowledges the data chunk.
+	require.NoError(t, p.WriteAndConfirm([]byte{1, 2, 3}, time.Second))
+
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, data)
+
+	// The sink never acknowledges the data chunk.
+	p = NewPort(sinkSource{}, &Config{
+		AckTimeout: 10 * time.Millisecond,
+		MaxRetries: 1,
+	})
+	defer p.Close()
+	require.Equal(t, ErrMaxRetriesReached, p.WriteAndConfirm([]byte{1}))
+
+	p = NewPort(sinkSource{})
+	defer p.Close()
+	require.Equal(t, ErrTimeout, p.WriteAndConfirm([]byte{1}, 20*time.Millisecond))
+}
+
+func TestTryWrite(t *testing.T) {
+	p := NewPort(sinkSource{}, &Config{WriteQueueSize: 1})
+	defer p.Close()
+
+	// The sink never acknowledges the first data chunk. It stays in flight.
+	require.NoError(t, p.TryWrite([]byte{1}))
+	require.Eventually(t, func() bool {
+		return len(p.writeDataChunkChan) == 0
+	}, time.Second, time.Millisecond)
+
+	// The second data chunk fills the write queue.
+	require.NoError(t, p.TryWrite([]byte{2}))
+	require.Equal(t, ErrWriteQueueFull, p.TryWrite([]byte{3}))
+	require.Equal(t, 2, p.PendingWrites())
+
+	p.Close()
+	require.Equal(t, ErrClosed, p.TryWrite([]byte{4}))
+}
+
+func TestStats(t *testing.T) {
+	p := NewPort(loopback.New())
+	defer p.Close()
+
+	before := p.Stats().Snapshot()
+
+	frame := p.newDataMessageFrame(1, 0, []byte{1, 2, 3})
+	body := unescapeDLE(frame[2 : len(frame)-2])
+	require.NoError(t, p.handleReceivedDataMessageBody(stx, body))
+
+	body[len(body)-1]++
+	require.Error(t, p.handleReceivedDataMessageBody(stx, body))
+
+	after := p.Stats().Snapshot()
+	d := after.Delta(before)
+	require.Equal(t, uint64(1), d.DataMessagesReceived)
+	require.Equal(t, uint64(1), d.ChecksumErrors)
+	require.True(t, d.Duration > 0)
+
+	// A reset starts from a clean baseline.
+	p.Stats().Reset()
+	s := p.Stats().Snapshot()
+	require.Equal(t, uint64(0), s.DataMessagesReceived)
+	require.Equal(t, uint64(0), s.ChecksumErrors)
+	require.Equal(t, s, s.Delta(after))
+}
+
+func TestDialPort(t *testing.T) {
+	dials := make(chan struct{}, 2)
+	transport := TransportFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		dials <- struct{}{}
+		if len(dials) == 1 {
+			return eofSource{}, nil
+		}
+		return loopback.New(), nil
+	})
+
+	// The transport is redialed after the end of file.
+	// The config of the caller is not modified.
+	config := &Config{EOFBehavior: EOFReconnect}
+	p, err := DialPort(context.Background(), transport, config)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Nil(t, config.transport)
+
+	require.Eventually(t, func() bool { return len(dials) == 2 }, time.Second, 10*time.Millisecond)
+	require.False(t, p.IsClosed())
+
+	// Dial errors are returned.
+	_, err = DialPort(context.Background(), TransportFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return nil, ErrTimeout
+	}))
+	require.Equal(t, ErrTimeout, err)
+}
+
+func TestTyped(t *testing.T) {
+	type reading struct {
+		Sensor string
+		Value  float64
+	}
+
+	p := NewPort(loopback.New())
+	defer p.Close()
+
+	tp := NewTyped[reading](p, JSONCodec[reading]{})
+	require.NoError(t, tp.Write(reading{Sensor: "temp", Value: 21.5}))
+
+	r, err := tp.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, reading{Sensor: "temp", Value: 21.5}, r)
+}
+
+type point struct{ X, Y byte }
+
+func (p point) MarshalBinary() ([]byte, error) { return []byte{p.X, p.Y}, nil }
+
+func (p *point) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return errors.New("invalid point")
+	}
+	p.X, p.Y = data[0], data[1]
+	return nil
+}
+
+func TestSendMsg(t *testing.T) {
+	type reading struct {
+		Sensor string
+		Value  float64
+	}
+
+	p := NewPort(loopback.New())
+	defer p.Close()
+
+	require.NoError(t, p.SendMsg(reading{Sensor: "temp", Value: 21.5}))
+
+	var r reading
+	require.NoError(t, p.RecvMsg(&r, time.Second))
+	require.Equal(t, reading{Sensor: "temp", Value: 21.5}, r)
+
+	// Invalid messages are reported.
+	require.NoError(t, p.Write([]byte("{")))
+	require.Error(t, p.RecvMsg(&r, time.Second))
+	require.Error(t, p.SendMsg(func() {}))
+
+	// Custom codec.
+	pb := NewPort(loopback.New(), &Config{MessageCodec: BinaryMessageCodec{}})
+	defer pb.Close()
+
+	require.NoError(t, pb.SendMsg(point{X: 1, Y: 2}))
+	var pt point
+	require.NoError(t, pb.RecvMsg(&pt, time.Second))
+	require.Equal(t, point{X: 1, Y: 2}, pt)
+	require.Error(t, pb.SendMsg(r))
+}
+
+type sinkSource struct{}
+
+// reconfigurableSource records the applied settings.
+type reconfigurableSource struct {
+	sinkSource
+	settings interface{}
+}
+
+func (s *reconfigurableSource) Reconfigure(settings interface{}) error {
+	if settings == nil {
+		return errors.New("no settings")
+	}
+	s.settings = settings
+	return nil
+}
+
+// modemSource records the modem control calls.
+type modemSource struct {
+	sinkSource
+	mutex sync.Mutex
+	calls []string
+}
+
+func (s *modemSource) record(call string) error {
+	s.mutex.Lock()
+	s.calls = append(s.calls, call)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *modemSource) SendBreak(d time.Duration) error { return s.record("break " + d.String()) }
+func (s *modemSource) SetDTR(on bool) error            { return s.record(fmt.Sprint("dtr ", on)) }
+func (s *modemSource) SetRTS(on bool) error            { return s.record(fmt.Sprint("rts ", on)) }
+
+func (s *modemSource) ModemLines() (cts, dsr, cd, ri bool, err error) {
+	return true, false, true, false, nil
+}
+
+func TestModemControl(t *testing.T) {
+	s := &modemSource{}
+	p := NewPort(s)
+
+	require.NoError(t, p.SetDTR(false))
+	require.NoError(t, p.SendBreak(10*time.Millisecond))
+	require.NoError(t, p.SetRTS(true))
+	require.Equal(t, []string{"dtr false", "break 10ms", "rts true"}, s.calls)
+
+	cts, dsr, cd, ri, err := p.ModemLines()
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, true, false}, []bool{cts, dsr, cd, ri})
+
+	p.Close()
+	require.Equal(t, ErrClosed, p.SetDTR(true))
+
+	p = NewPort(sinkSource{})
+	defer p.Close()
+	require.Equal(t, ErrNoModemControl, p.SendBreak(time.Millisecond))
+	_, _, _, _, err = p.ModemLines()
+	require.Equal(t, ErrNoModemControl, err)
+}
+
+func TestReconfigure(t *testing.T) {
+	s := &reconfigurableSource{}
+	p := NewPort(s)
+
+	require.NoError(t, p.Reconfigure(115200))
+	require.Equal(t, 115200, s.settings)
+	require.Error(t, p.Reconfigure(nil))
+
+	p.Close()
+	require.Equal(t, ErrClosed, p.Reconfigure(9600))
+
+	p = NewPort(sinkSource{})
+	defer p.Close()
+	require.Equal(t, ErrNotReconfigurable, p.Reconfigure(9600))
+}
+
+// failingSource fails the writes to the shared connection if failed is set.
+// Closing it keeps the connection open for the next source.
+type failingSource struct {
+	net.Conn
+	failed int32
+}
+
+func (s *failingSource) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&s.failed) != 0 {
+		return 0, errors.New("write failed")
+	}
+	return s.Conn.Write(p)
+}
+
+func (s *failingSource) Close() error { return nil }
+
+func TestResume(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	suspended := make(chan error, 1)
+	events := make(chan EventType, 4)
+	s := &failingSource{Conn: a}
+	pa := NewPort(s, &Config{
+		SuspendOnError: true,
+		OnSuspend:      func(err error) { suspended <- err },
+		OnEvent:        func(e Event) { events <- e.Type },
+	})
+	defer pa.Close()
+	pb := NewPort(b)
+	defer pb.Close()
+
+	require.Equal(t, ErrNotSuspended, pa.Resume(&failingSource{Conn: a}))
+
+	require.NoError(t, pa.Write([]byte("one")))
+	data, err := pb.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("one"), data)
+
+	// The failed write suspends the port instead of closing it.
+	atomic.StoreInt32(&s.failed, 1)
+	require.NoError(t, pa.Write([]byte("two")))
+	require.Error(t, <-suspended)
+	require.True(t, pa.IsSuspended())
+	require.True(t, pa.DebugState().IsSuspended)
+	require.False(t, pa.IsClosed())
+	require.Equal(t, EventSuspended, <-events)
+
+	// The data chunk is transmitted on the new source
+	// and continues the message sequence.
+	require.NoError(t, pa.Resume(&failingSource{Conn: a}))
+	require.False(t, pa.IsSuspended())
+	require.Equal(t, EventResumed, <-events)
+	data, err = pb.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("two"), data)
+
+	require.NoError(t, pa.Write([]byte("three")))
+	data, err = pb.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("three"), data)
+
+	pa.Close()
+	require.Equal(t, ErrClosed, pa.Resume(&failingSource{Conn: a}))
+}
+
+func (sinkSource) Read(p []byte) (int, error)  { return 0, nil }
+func (sinkSource) Write(p []byte) (int, error) { return len(p), nil }
+func (sinkSource) Close() error                { return nil }
+
+type shortSource struct {
+	io.ReadWriteCloser
+	max   int           // Maximum number of bytes accepted by a write.
+	delay time.Duration // Duration of a write.
+
+	mutex sync.Mutex
+	calls [][]byte
+}
+
+func (s *shortSource) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	s.calls = append(s.calls, append([]byte(nil), p...))
+	s.mutex.Unlock()
+
+	time.Sleep(s.delay)
+	if len(p) > s.max {
+		p = p[:s.max]
+	}
+	return s.ReadWriteCloser.Write(p)
+}
+
+func TestPartialWrite(t *testing.T) {
+	// The remaining bytes of short writes are written again.
+	a, b := net.Pipe()
+	p := NewPort(&shortSource{ReadWriteCloser: a, max: 4})
+	peer := NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	require.NoError(t, p.WriteAndConfirm([]byte("partially written"), time.Second))
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "partially written", string(data))
+
+	// Give up after the maximum retries and terminate the frame.
+	s := &shortSource{ReadWriteCloser: sinkSource{}}
+	p = NewPort(s)
+	defer p.Close()
+
+	require.NoError(t, p.writeToSource(p.newDataMessageFrame(1, 0, []byte{1, 2, 3})))
+	require.Len(t, s.calls, maxPartialWriteRetries+2)
+	require.Equal(t, p.codec.abortSequence(), s.calls[len(s.calls)-1])
+
+	// Give up if the deadline is reached.
+	s = &shortSource{ReadWriteCloser: sinkSource{}, max: 1, delay: partialWriteTimeout / 4}
+	p = NewPort(s)
+	defer p.Close()
+
+	start := time.Now()
+	require.NoError(t, p.writeToSource(p.newDataMessageFrame(1, 0, []byte{1, 2, 3})))
+	require.Less(t, time.Since(start), 2*partialWriteTimeout)
+	require.Less(t, len(s.calls), maxPartialWriteRetries)
+	require.Equal(t, p.codec.abortSequence(), s.calls[len(s.calls)-1])
+}
+
+func TestBreaker(t *testing.T) {
+	events := make(chan EventType, 4)
+	p := NewPort(sinkSource{}, &Config{
+		ARQStrategy:     giveUpStrategy{attempts: make(chan ARQAttempt, 3)},
+		BreakerFailures: 1,
+		BreakerCooldown: 20 * time.Millisecond,
+		OnEvent:         func(e Event) { events <- e.Type },
+	})
+	defer p.Close()
+
+	// The sink never acknowledges the data message.
+	require.NoError(t, p.Write([]byte{1}))
+	require.Equal(t, EventTransmissionFailed, <-events)
+	require.Equal(t, EventBreakerOpened, <-events)
+	require.Equal(t, ErrBreakerOpen, p.Write([]byte{2}))
+	require.Equal(t, ErrBreakerOpen, p.WriteUrgent([]byte{2}))
+
+	// Answer the link probe.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.handleReceivedPing([]byte{pingReply, 1})
+	}()
+
+	select {
+	case e := <-events:
+		require.Equal(t, EventBreakerClosed, e)
+	case <-time.After(time.Second):
+		t.Fatal("circuit breaker was not closed")
+	}
+	require.NoError(t, p.Write([]byte{3}))
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	c := &Config{BreakerFailureRate: 0.5, BreakerWindow: 4}
+	c.setDefaults()
+
+	p := &Port{config: c, log: c.Logger, closeChan: make(chan struct{})}
+	b := newBreaker(p)
+	defer close(p.closeChan)
+
+	for _, failed := range []bool{true, false, true} {
+		b.record(failed)
+		require.NoError(t, b.allow())
+	}
+	b.record(false)
+	require.Equal(t, ErrBreakerOpen, b.allow())
+}
+
+func TestTimestamps(t *testing.T) {
+	lb := loopback.New()
+	p := NewPort(lb, &Config{Timestamps: true})
+	defer p.Close()
+
+	// Transmit the frame in two parts with a gap.
+	frame := p.newDataMessageFrame(1, 0, []byte{1, 2, 3})
+	_, err := lb.Write(frame[:3])
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = lb.Write(frame[3:])
+	require.NoError(t, err)
+
+	m, err := p.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.False(t, m.FrameStart.IsZero())
+	require.True(t, m.FrameEnd.After(m.FrameStart))
+}
+
+func TestReadPollInterval(t *testing.T) {
+	c := &Config{}
+	c.setDefaults()
+	require.Equal(t, readWaitDuration, c.ReadPollInterval)
+
+	// Negative values disable the wait duration and survive repeated defaults.
+	c = &Config{ReadPollInterval: -1}
+	c.setDefaults()
+	c.setDefaults()
+	require.Equal(t, time.Duration(-1), c.ReadPollInterval)
+
+	lb := loopback.New()
+	p := NewPort(lb, &Config{ReadPollInterval: time.Millisecond})
+	defer p.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	_, err := lb.Write(p.newDataMessageFrame(1, 0, []byte{1}))
+	require.NoError(t, err)
+
+	_, err = p.Read(time.Second)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) < readWaitDuration)
+}
+
+func TestReadMessageTimeout(t *testing.T) {
+	c := &Config{}
+	c.setDefaults()
+	require.Equal(t, defaultReadMessageTimeout, c.ReadMessageTimeout)
+	require.Equal(t, defaultReadBufferSize, c.ReadBufferSize)
+
+	lb := loopback.New()
+	p := NewPort(lb, &Config{
+		ReadMessageTimeout: 20 * time.Millisecond,
+		ReadBufferSize:     1,
+	})
+	defer p.Close()
+
+	// The partially received message is discarded after the timeout.
+	frame := p.newDataMessageFrame(1, 0, []byte{1})
+	_, err := lb.Write(frame[:3])
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return p.DebugState().Decoder.StartCharacterFound
+	}, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		return !p.DebugState().Decoder.StartCharacterFound
+	}, time.Second, time.Millisecond)
+
+	// Complete messages are still read byte by byte.
+	_, err = lb.Write(frame)
+	require.NoError(t, err)
+
+	data, err := p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, data)
+}
+
+type lineErrorSource struct {
+	io.ReadWriteCloser
+	parity uint64
+}
+
+func (s *lineErrorSource) LineErrors() (parity, framing, overrun uint64, err error) {
+	s.parity++
+	return s.parity, 2, 0, nil
+}
+
+func TestLineErrors(t *testing.T) {
+	events := make(chan Event, 4)
+	p := NewPort(&lineErrorSource{ReadWriteCloser: loopback.New()}, &Config{
+		OnEvent: func(e Event) { events <- e },
+	})
+	defer p.Close()
+
+	select {
+	case e := <-events:
+		require.Equal(t, EventLineErrors, e.Type)
+	case <-time.After(time.Second):
+		t.Fatal("line errors were not reported")
+	}
+
+	s := p.Stats().Snapshot()
+	require.Equal(t, uint64(1), s.ParityErrors)
+	require.Equal(t, uint64(2), s.FramingErrors)
+	require.Equal(t, uint64(0), s.OverrunErrors)
+}
+
+func TestRedundantPort(t *testing.T) {
+	a0, b0 := net.Pipe()
+	a1, b1 := net.Pipe()
+	p0, p1 := NewPort(a0), NewPort(a1)
+	peer := NewRedundantPort(NewPort(b0), NewPort(b1), &RedundantConfig{DuplicateUrgent: true})
+	defer peer.Close()
+
+	failover := make(chan *Port, 1)
+	r := NewRedundantPort(p0, p1, &RedundantConfig{
+		OnFailover: func(active *Port) { failover <- active },
+	})
+	defer r.Close()
+	require.Equal(t, p0, r.Active())
+
+	// The copy received on the second link is discarded.
+	require.NoError(t, peer.WriteUrgent([]byte("cmd")))
+
+	data, err := r.ReadUrgent(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("cmd"), data)
+
+	_, err = r.ReadUrgent(200 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+
+	// Data chunks with identical content are not discarded.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, peer.Write([]byte("cmd")))
+		data, err = r.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte("cmd"), data)
+	}
+
+	// Fail over to the secondary link if the primary link is closed.
+	require.NoError(t, p0.Close())
+	require.Equal(t, p1, <-failover)
+	require.Equal(t, p1, r.Active())
+
+	require.NoError(t, r.Write([]byte("data")))
+	data, err = peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+}
+
+func TestPoller(t *testing.T) {
+	// The slaves 1 and 2 share the bus with the master. Slave 3 is absent.
+	bus := newBus(3)
+	for _, addr := range []byte{1, 2} {
+		addr := addr
+		slave := NewPort(bus[addr], &Config{
+			AddressingEnabled: true,
+			Address:           addr,
+			PeerAddress:       0,
+			ReadPollInterval:  time.Millisecond,
+			Responder: func(m *Message) []byte {
+				return append([]byte{addr}, m.Data...)
+			},
+		})
+		defer slave.Close()
+	}
+
+	_, err := NewPoller(bus[0], &PollerConfig{Slaves: []PollSlave{{Address: 1}, {Address: 1}}})
+	require.Error(t, err)
+
+	responses := make(chan []byte, 4)
+	errs := make(chan byte, 4)
+	pl, err := NewPoller(bus[0], &PollerConfig{
+		Slaves:   []PollSlave{{Address: 1}, {Address: 2}, {Address: 3, Timeout: 50 * time.Millisecond}},
+		Timeout:  time.Second,
+		Interval: time.Hour,
+		Request:  func(address byte) []byte { return []byte("poll") },
+		OnResponse: func(address byte, m *Message) {
+			responses <- m.Data
+		},
+		OnError: func(address byte, err error) {
+			require.Equal(t, ErrTimeout, err)
+			errs <- address
+		},
+		Port: &Config{AckTimeout: 20 * time.Millisecond, MaxRetries: 1, ReadPollInterval: time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer pl.Close()
+
+	// Poll one cycle.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- pl.Run(ctx)
+	}()
+	require.Equal(t, "\x01poll", string(<-responses))
+	require.Equal(t, "\x02poll", string(<-responses))
+	require.Equal(t, byte(3), <-errs)
+	cancel()
+	require.Equal(t, context.Canceled, <-done)
+
+	for _, addr := range []byte{1, 2} {
+		s, err := pl.Stats(addr)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), s.Polls)
+		require.Equal(t, uint64(1), s.Responses)
+		require.True(t, s.ResponseTime > 0)
+	}
+	s, err := pl.Stats(3)
+	require.NoError(t, err)
+	require.Equal(t, PollStats{Polls: 1, Timeouts: 1}, s)
+
+	// Poll a single slave.
+	m, err := pl.Poll(2)
+	require.NoError(t, err)
+	require.Equal(t, "\x02poll", string(m.Data))
+	_, err = pl.Poll(4)
+	require.Equal(t, ErrUnknownSlave, err)
+}
+
+func TestTransmitSchedule(t *testing.T) {
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &TransmitSchedule{
+		Period: 100 * time.Millisecond,
+		Slots: []TransmitSlot{
+			{Offset: 20 * time.Millisecond, Duration: 10 * time.Millisecond},
+			{Offset: 90 * time.Millisecond, Duration: 20 * time.Millisecond}, // Wraps into the next period.
+		},
+		Epoch: epoch,
+	}
+
+	at := func(d time.Duration) time.Time { return epoch.Add(time.Second + d) }
+
+	require.Equal(t, time.Duration(0), s.Wait(at(5*time.Millisecond)))
+	require.Equal(t, 10*time.Millisecond, s.Wait(at(10*time.Millisecond)))
+	require.Equal(t, time.Duration(0), s.Wait(at(25*time.Millisecond)))
+	require.Equal(t, 60*time.Millisecond, s.Wait(at(30*time.Millisecond)))
+	require.Equal(t, time.Duration(0), s.Wait(at(95*time.Millisecond)))
+
+	// Without a schedule the transmission is never restricted.
+	var none *TransmitSchedule
+	require.Equal(t, time.Duration(0), none.Wait(time.Now()))
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer peer.Close()
+
+	// Each data chunk is transmitted in a single data message.
+	n, err := p.ReadFrom(bytes.NewReader([]byte("stream data")))
+	require.NoError(t, err)
+	require.Equal(t, int64(11), n)
+
+	var buf bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = peer.WriteTo(&buf)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, peer.Close())
+	<-done
+
+	require.NoError(t, err)
+	require.Equal(t, int64(11), n)
+	require.Equal(t, "stream data", buf.String())
+	p.Close()
+}
+
+func TestFragmentation(t *testing.T) {
+	var progress []int
+	a, b := net.Pipe()
+	p := NewPort(a, &Config{
+		MaxMessageSize:  16,
+		OnWriteProgress: func(sent, total int) { progress = append(progress, sent) },
+	})
+	peer := NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	require.NoError(t, p.Write(data))
+
+	// The data chunk is reassembled from three data messages.
+	m, err := peer.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, data, m.Data)
+	require.Equal(t, 3, m.Fragments)
+
+	require.Eventually(t, func() bool {
+		return !p.hasPendingWrites()
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []int{16, 32, 40}, progress)
+}
+
+func TestUrgentInterleaving(t *testing.T) {
+	for _, window := range []int{0, 4} {
+		var p *Port
+		a, b := net.Pipe()
+		p = NewPort(a, &Config{
+			MaxMessageSize: 16,
+			SendWindow:     window,
+			OnWriteProgress: func(sent, total int) {
+				// Write the urgent data chunk in the middle of the transmission.
+				if sent == 16 {
+					require.NoError(t, p.WriteUrgent([]byte("stop")))
+				}
+			},
+		})
+		peer := NewPort(b)
+
+		data := make([]byte, 16*20)
+		require.NoError(t, p.Write(data))
+
+		// The urgent data chunk overtakes the remaining data messages.
+		u, err := peer.ReadUrgentMessage(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, "stop", string(u.Data))
+
+		m, err := peer.ReadMessage(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, data, m.Data)
+		require.Equal(t, 20, m.Fragments)
+		require.True(t, u.Time.Before(m.Time))
+
+		p.Close()
+		peer.Close()
+	}
+}
+
+func TestStream(t *testing.T) {
+	a, b := net.Pipe()
+	s, peer := NewPort(a).Stream(), NewPort(b).Stream()
+	defer s.Close()
+
+	_, err := s.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = s.Write([]byte("world"))
+	require.NoError(t, err)
+
+	// Partial reads keep the remaining bytes of the data chunk.
+	buf := make([]byte, 4)
+	n, err := peer.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hell", string(buf[:n]))
+
+	rest := make([]byte, 7)
+	_, err = io.ReadFull(peer, rest)
+	require.NoError(t, err)
+	require.Equal(t, "o world", string(rest))
+
+	// Reads return io.EOF once the port is closed.
+	require.NoError(t, peer.Close())
+	_, err = peer.Read(buf)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestControlMessages(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	// Each data message is acknowledged by the peer.
+	for i := byte(0); i < 3; i++ {
+		require.NoError(t, p.Write([]byte{i, dle, etx}))
+
+		data, err := peer.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte{i, dle, etx}, data)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(p.DebugState().InFlight) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// The peer replies to pings.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := p.Ping(ctx)
+	require.NoError(t, err)
+}
+
+// dropSource drops the nth write to the underlying source.
+type dropSource struct {
+	io.ReadWriteCloser
+
+	mutex  sync.Mutex
+	writes int
+	drop   int
+}
+
+func (s *dropSource) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	s.writes++
+	drop := s.writes == s.drop
+	s.mutex.Unlock()
+
+	if drop {
+		return len(p), nil
+	}
+	return s.ReadWriteCloser.Write(p)
+}
+
+func TestAbortTransfer(t *testing.T) {
+	a, b := net.Pipe()
+	sent := make(chan int, 4)
+
+	// The second data message is lost. The transfer stalls until it is aborted.
+	p := NewPort(&dropSource{ReadWriteCloser: a, drop: 2}, &Config{
+		MaxMessageSize:  8,
+		AckTimeout:      5 * time.Second,
+		OnWriteProgress: func(n, total int) { sent <- n },
+	})
+	peer := NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.WriteAndConfirm(bytes.Repeat([]byte{1}, 20), 10*time.Second)
+	}()
+	require.Equal(t, 8, <-sent)
+	require.NoError(t, p.AbortTransfer())
+	require.Equal(t, ErrAborted, <-done)
+
+	// The peer discarded the partially received binary data.
+	require.NoError(t, p.WriteAndConfirm([]byte("next"), time.Second))
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "next", string(data))
+
+	// The abort request never blocks, even if the transfer waits for the
+	// transmit rate. The transfer is aborted at the wait point.
+	a, b = net.Pipe()
+	p = NewPort(a, &Config{MaxMessageSize: 8, WriteRateLimit: 10})
+	peer = NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	go func() {
+		done <- p.WriteAndConfirm(bytes.Repeat([]byte{1}, 40), 10*time.Second)
+	}()
+	require.Eventually(t, func() bool {
+		return p.Stats().Snapshot().DataMessagesSent >= 1
+	}, time.Second, 10*time.Millisecond)
+	returned := make(chan error, 1)
+	go func() { returned <- p.AbortTransfer() }()
+	select {
+	case err = <-returned:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("abort request blocked")
+	}
+	select {
+	case err = <-done:
+		require.Equal(t, ErrAborted, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("transfer not aborted while waiting for the transmit rate")
+	}
+
+	// The abort targets the bulk transfer and not an interleaved urgent data chunk.
+	// The first transmission of the urgent data chunk is lost.
+	a, b = net.Pipe()
+	sent, proceed := make(chan int, 4), make(chan struct{})
+	p = NewPort(&dropSource{ReadWriteCloser: a, drop: 2}, &Config{
+		MaxMessageSize: 8,
+		AckTimeout:     100 * time.Millisecond,
+		OnWriteProgress: func(n, total int) {
+			sent <- n
+			<-proceed
+		},
+	})
+	peer = NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	go func() {
+		done <- p.WriteAndConfirm(bytes.Repeat([]byte{1}, 20), 10*time.Second)
+	}()
+	require.Equal(t, 8, <-sent)
+	require.NoError(t, p.WriteUrgent([]byte("urgent")))
+	require.NoError(t, p.AbortTransfer())
+	close(proceed)
+
+	data, err = peer.ReadUrgent(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "urgent", string(data))
+	require.Equal(t, ErrAborted, <-done)
+}
+
+func TestReassemblyTimeout(t *testing.T) {
+	pool := NewDecoderPool(1)
+	defer pool.Close()
+
+	// Both read routines discard the stale binary data.
+	for _, pool := range []*DecoderPool{nil, pool} {
+		a, b := net.Pipe()
+		events := make(chan Event, 4)
+
+		// The second data message is lost and the transmission stalls.
+		p := NewPort(&dropSource{ReadWriteCloser: a, drop: 2}, &Config{
+			MaxMessageSize: 8,
+			AckTimeout:     5 * time.Second,
+		})
+		peer := NewPort(b, &Config{
+			ReassemblyTimeout: 100 * time.Millisecond,
+			DecoderPool:       pool,
+			OnEvent: func(e Event) {
+				if e.Type == EventReassemblyTimeout {
+					events <- e
+				}
+			},
+		})
+
+		require.NoError(t, p.Write(bytes.Repeat([]byte{1}, 20)))
+
+		select {
+		case e := <-events:
+			require.Contains(t, e.Message, "discarded 8 bytes")
+		case <-time.After(time.Second):
+			t.Fatal("reassembly timeout not reached")
+		}
+
+		// The partially received binary data is discarded only once.
+		select {
+		case <-events:
+			t.Fatal("unexpected reassembly timeout")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		p.Close()
+		peer.Close()
+	}
+}
+
+// frameReader returns a function, which parses the next frame written to the port.
+func frameReader(t *testing.T, r io.Reader) func() *FrameInfo {
+	frames := bufio.NewScanner(r)
+	frames.Split(ScanFrames)
+
+	return func() *FrameInfo {
+		require.True(t, frames.Scan())
+		f, err := ParseFrame(frames.Bytes())
+		require.NoError(t, err)
+		return f
+	}
+}
+
+func TestSequenceGap(t *testing.T) {
+	a, b := loopback.Pipe()
+	p := NewPort(a)
+	defer p.Close()
+
+	next := frameReader(t, b)
+
+	// The data messages 2 and 3 got lost. Request their resend.
+	_, err := b.Write(p.newDataMessageFrame(1, 0, []byte{1}))
+	require.NoError(t, err)
+	_, err = b.Write(p.newDataMessageFrame(4, 0, []byte{4}))
+	require.NoError(t, err)
+
+	for _, want := range []struct {
+		typ byte
+		msn byte
+	}{{ack, 1}, {rsd, 2}, {rsd, 3}, {ack, 4}} {
+		f := next()
+		require.Equal(t, want.typ, f.StartCharacter)
+		require.Equal(t, want.msn, f.MSN)
+	}
+}
+
+func TestResendRequest(t *testing.T) {
+	a, b := loopback.Pipe()
+	p := NewPort(a, &Config{AckTimeout: 5 * time.Second})
+	defer p.Close()
+
+	next := frameReader(t, b)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.WriteAndConfirm([]byte("data"), 10*time.Second)
+	}()
+	f := next()
+	require.False(t, f.IsControlMessage)
+
+	// The requested data message is resent without waiting for the timeout.
+	start := time.Now()
+	_, err := b.Write(p.codec.encodeControlMessage(rsd, f.MSN, nil))
+	require.NoError(t, err)
+
+	r := next()
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, f.MSN, r.MSN)
+	require.Equal(t, f.Payload, r.Payload)
+
+	_, err = b.Write(p.codec.encodeControlMessage(ack, f.MSN, nil))
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	require.Equal(t, uint64(1), p.Stats().Snapshot().Retransmissions)
+}
+
+func TestPeerBufferStatus(t *testing.T) {
+	a, b := net.Pipe()
+	p := NewPort(a)
+	peer := NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	advertise := func(free uint16) {
+		payload := make([]byte, 2)
+		binary.LittleEndian.PutUint16(payload, free)
+		require.NoError(t, p.handleReceivedBufferStatus(payload))
+	}
+
+	// The data chunk fits into the advertised buffer space.
+	advertise(10)
+	require.NoError(t, p.Write(bytes.Repeat([]byte{1}, 8)))
+	_, err := peer.Read(time.Second)
+	require.NoError(t, err)
+
+	// The remaining buffer space is too small. Resume on the next update.
+	require.NoError(t, p.Write(bytes.Repeat([]byte{2}, 8)))
+	_, err = peer.Read(200 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+	advertise(100)
+	_, err = peer.Read(time.Second)
+	require.NoError(t, err)
+
+	// The buffer status update might get lost. Resume after the timeout.
+	advertise(0)
+	start := time.Now()
+	require.NoError(t, p.Write([]byte{3}))
+	_, err = peer.Read(2 * peerBufferWaitTimeout)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= peerBufferWaitTimeout)
+}
+
+func TestBufferStatusInterval(t *testing.T) {
+	a, b := net.Pipe()
+	p := NewPort(a)
+	peer := NewPort(b, &Config{BufferStatusInterval: 50 * time.Millisecond})
+	defer p.Close()
+	defer peer.Close()
+
+	// The peer advertises its free buffer space periodically.
+	require.NoError(t, p.handleReceivedBufferStatus([]byte{0, 0}))
+	require.NoError(t, p.Write([]byte{1}))
+	_, err := peer.Read(time.Second)
+	require.NoError(t, err)
+}
+
+func TestSendWindow(t *testing.T) {
+	a, b := net.Pipe()
+
+	// The second data message is lost and has to be resent.
+	p := NewPort(&dropSource{ReadWriteCloser: a, drop: 2}, &Config{
+		SendWindow:     4,
+		MaxMessageSize: 8,
+		AckTimeout:     time.Second,
+	})
+	peer := NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	for i := byte(0); i < 5; i++ {
+		require.NoError(t, p.Write(bytes.Repeat([]byte{i}, 10)))
+	}
+
+	// The data chunks are received in order.
+	for i := byte(0); i < 5; i++ {
+		data, err := peer.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte{i}, 10), data)
+	}
+
+	require.NoError(t, p.WriteAndConfirm([]byte{5}, time.Second))
+	require.Empty(t, p.DebugState().InFlight)
+	require.Equal(t, uint64(1), p.Stats().Snapshot().Retransmissions)
+}
+
+func TestSendWindowGiveUp(t *testing.T) {
+	p := NewPort(sinkSource{}, &Config{
+		SendWindow: 4,
+		AckTimeout: 10 * time.Millisecond,
+		MaxRetries: 1,
+	})
+	defer p.Close()
+
+	// Data chunks in flight are given up together.
+	require.NoError(t, p.Write([]byte{1}))
+	require.Equal(t, ErrMaxRetriesReached, p.WriteAndConfirm([]byte{2}, time.Second))
+	require.Empty(t, p.DebugState().InFlight)
+}
+
+func TestReorderDataMessages(t *testing.T) {
+	p := NewPort(sinkSource{})
+	defer p.Close()
+
+	receive := func(msn byte) {
+		frame := p.newDataMessageFrame(msn, flagPipelined, []byte{msn})
+		require.NoError(t, p.handleReceivedDataMessageBody(stx, unescapeDLE(frame[2:len(frame)-2])))
+	}
+
+	// The data messages 4 and 5 wait for the resend of the lost message 3.
+	receive(2)
+	receive(4)
+	receive(5)
+	receive(4)
+
+	data, err := p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, data)
+
+	_, err = p.Read(50 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+
+	receive(3)
+	receive(2)
+	for msn := byte(3); msn <= 5; msn++ {
+		data, err = p.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte{msn}, data)
+	}
+
+	_, err = p.Read(50 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+}
+
+func TestOnData(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	received := make(chan []byte, 3)
+	require.NoError(t, peer.OnData(func(data []byte) {
+		received <- data
+	}))
+
+	// The handler receives the data chunks in order.
+	for i := byte(0); i < 3; i++ {
+		require.NoError(t, p.Write([]byte{i}))
+	}
+	for i := byte(0); i < 3; i++ {
+		select {
+		case data := <-received:
+			require.Equal(t, []byte{i}, data)
+		case <-time.After(time.Second):
+			t.Fatal("handler not called")
+		}
+	}
+
+	// Read is usable again after the handler was unregistered.
+	require.NoError(t, peer.OnData(nil))
+	require.NoError(t, p.Write([]byte("read")))
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("read"), data)
+
+	// A responder owns the received data chunks.
+	r := NewPort(sinkSource{}, &Config{Responder: func(m *Message) []byte { return nil }})
+	defer r.Close()
+	require.Equal(t, ErrResponderMode, r.OnData(func(data []byte) {}))
+}
+
+func TestHandle(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	status, config := make(chan []byte, 1), make(chan []byte, 1)
+	require.NoError(t, peer.Handle(0x21, func(payload []byte) { status <- payload }))
+	require.NoError(t, peer.Handle(0x22, func(payload []byte) { config <- payload }))
+
+	// Unhandled message types and empty data chunks are discarded.
+	require.NoError(t, p.WriteType(0x23, []byte("unhandled")))
+	require.NoError(t, p.Write(nil))
+	require.NoError(t, p.WriteType(0x22, []byte("config")))
+	require.NoError(t, p.WriteType(0x21, nil))
+
+	select {
+	case payload := <-config:
+		require.Equal(t, []byte("config"), payload)
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+	}
+	select {
+	case payload := <-status:
+		require.Empty(t, payload)
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+	}
+
+	// Read is usable again after the last handler was unregistered.
+	require.NoError(t, peer.Handle(0x21, nil))
+	require.NoError(t, peer.Handle(0x22, nil))
+	require.NoError(t, p.WriteType(0x21, []byte("read")))
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("\x21read"), data)
+
+	r := NewPort(sinkSource{}, &Config{Responder: func(m *Message) []byte { return nil }})
+	defer r.Close()
+	require.Equal(t, ErrResponderMode, r.Handle(0x21, func(payload []byte) {}))
+}
+
+func TestOnError(t *testing.T) {
+	a, b := net.Pipe()
+
+	errChan := make(chan error, 1)
+	p := NewPort(a, &Config{
+		EOFBehavior: EOFClose,
+		OnError: func(err error) {
+			errChan <- err
+		},
+	})
+	defer p.Close()
+
+	// The cause is reported if the source fails.
+	require.NoError(t, b.Close())
+	select {
+	case err := <-errChan:
+		require.Equal(t, ErrSourceEOF, err)
+		require.Equal(t, ErrSourceEOF, p.Err())
+	case <-time.After(time.Second):
+		t.Fatal("OnError not called")
+	}
+
+	// Closing the port by the application is no error.
+	c, _ := net.Pipe()
+	p = NewPort(c, &Config{
+		OnError: func(err error) {
+			errChan <- err
+		},
+	})
+	require.NoError(t, p.Close())
+	require.Len(t, errChan, 0)
+}
+
+func TestReconnector(t *testing.T) {
+	sources := make(chan net.Conn, 1)
+	failures := 2
+	open := func() (io.ReadWriteCloser, error) {
+		// Fail the first attempts to test the backoff.
+		if failures > 0 {
+			failures--
+			return nil, errors.New("device not found")
+		}
+		a, b := net.Pipe()
+		sources <- b
+		return a, nil
+	}
+
+	disconnected := make(chan error, 1)
+	r := NewReconnector(open, &ReconnectConfig{
+		MinBackoff: time.Millisecond,
+		Replay:     true,
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	})
+	defer r.Close()
+
+	peer := NewPort(<-sources)
+	require.NoError(t, r.Write([]byte("first")))
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), data)
+
+	// Unplug the device, once the data chunk was acknowledged.
+	// Acknowledged data chunks are never replayed.
+	require.Eventually(t, func() bool { return r.Port().PendingWrites() == 0 }, time.Second, time.Millisecond)
+	require.NoError(t, peer.Close())
+	select {
+	case err := <-disconnected:
+		require.Equal(t, ErrSourceEOF, err)
+	case <-time.After(time.Second):
+		t.Fatal("disconnect not detected")
+	}
+
+	// The session is continued on the reopened source.
+	peer = NewPort(<-sources)
+	defer peer.Close()
+	require.NoError(t, r.Write([]byte("second")))
+	data, err = peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), data)
+
+	require.NoError(t, peer.Write([]byte("reply")))
+	data, err = r.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("reply"), data)
+
+	// Unplug the device in the middle of a transfer. The data chunks,
+	// which were queued or in flight, are replayed on the reopened source.
+	require.Eventually(t, func() bool { return r.Port().PendingWrites() == 0 }, time.Second, time.Millisecond)
+	chunks := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	for _, c := range chunks {
+		require.NoError(t, r.Write(c))
+	}
+	require.NoError(t, peer.Close())
+
+	peer = NewPort(<-sources)
+	defer peer.Close()
+	for _, c := range chunks {
+		data, err = peer.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, c, data)
+	}
+
+	// Writes fail after the reconnector was closed.
+	require.NoError(t, r.Close())
+	require.Equal(t, ErrClosed, r.Write([]byte("closed")))
+}
+
+func TestCall(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	// Calls fail without a handler on the peer.
+	_, err := p.Call([]byte("ping"), time.Second)
+	require.Equal(t, ErrCallUnhandled, err)
+
+	peer.OnCall(func(request []byte) []byte {
+		return append([]byte("re: "), request...)
+	})
+
+	// Concurrent calls receive their matching responses.
+	errChan := make(chan error, 5)
+	for i := byte(0); i < 5; i++ {
+		go func(i byte) {
+			response, err := p.Call([]byte{i}, time.Second)
+			if err == nil && !bytes.Equal([]byte{'r', 'e', ':', ' ', i}, response) {
+				err = fmt.Errorf("unexpected response %q", response)
+			}
+			errChan <- err
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, <-errChan)
+	}
+
+	// Calls are not returned by Read.
+	require.NoError(t, p.Write([]byte("data")))
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+
+	// A slow handler times out the call.
+	peer.OnCall(func(request []byte) []byte {
+		time.Sleep(100 * time.Millisecond)
+		return request
+	})
+	_, err = p.Call([]byte("slow"), 10*time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+}
+
+func TestCipher(t *testing.T) {
+	_, err := NewAESGCMCipher([]byte("short"))
+	require.Error(t, err)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	c, err := NewAESGCMCipher(key)
+	require.NoError(t, err)
+
+	a, b := net.Pipe()
+	p := NewPort(a, &Config{Cipher: c, MaxMessageSize: 64})
+	peer := NewPort(b, &Config{Cipher: c, MaxMessageSize: 64})
+	defer p.Close()
+	defer peer.Close()
+
+	// Encrypted data chunks are split and reassembled.
+	data := bytes.Repeat([]byte("ants"), 100)
+	require.NoError(t, p.Write(data))
+	received, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, data, received)
+
+	require.NoError(t, p.WriteUrgent([]byte("urgent")))
+	received, err = peer.ReadUrgent(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("urgent"), received)
+
+	// Data chunks of a peer with another key are discarded.
+	other, err := NewAESGCMCipher(bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, err)
+
+	for _, cipher := range []Cipher{other, nil} {
+		a, b = net.Pipe()
+		events := make(chan Event, 1)
+		p = NewPort(a, &Config{Cipher: cipher})
+		peer = NewPort(b, &Config{Cipher: c, OnEvent: func(e Event) {
+			if e.Type == EventAuthenticationFailed {
+				events <- e
+			}
+		}})
+
+		require.NoError(t, p.Write([]byte("tampered")))
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Fatal("authentication failure not reported")
+		}
+		_, err = peer.Read(10 * time.Millisecond)
+		require.Equal(t, ErrTimeout, err)
+
+		p.Close()
+		peer.Close()
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	var w replayWindow
+	require.True(t, w.check(100))
+	w.mark(100)
+	require.False(t, w.check(100))
+	w.mark(103)
+	require.True(t, w.check(101))
+	w.mark(101)
+	require.False(t, w.check(101))
+	w.unmark(101)
+	require.True(t, w.check(101))
+	w.mark(103 + replayWindowSize)
+	require.False(t, w.check(103))
+	require.True(t, w.check(104))
+
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+
+	// newPair connects a port with a peer, which reports the discarded data chunks.
+	// The transmitted data messages are collected.
+	newPair := func() (p, peer *Port, a net.Conn, frames chan []byte, events chan Event) {
+		frames = make(chan []byte, 8)
+		events = make(chan Event, 1)
+		a, b := net.Pipe()
+		p = NewPort(a, &Config{
+			Cipher:           c,
+			ReplayProtection: true,
+			Handshake:        true,
+			OnRawFrameSent: func(frame []byte) {
+				// DLE | STX/SOH
+				if frame[1] == soh || frame[1] == stx {
+					frames <- append([]byte(nil), frame...)
+				}
+			},
+		})
+		peer = NewPort(b, &Config{
+			Cipher:           c,
+			ReplayProtection: true,
+			OnEvent: func(e Event) {
+				if e.Type == EventAuthenticationFailed {
+					select {
+					case events <- e:
+					default:
+					}
+				}
+			},
+		})
+		return p, peer, a, frames, events
+	}
+
+	p, peer, a, frames, events := newPair()
+	defer p.Close()
+	defer peer.Close()
+
+	require.NoError(t, p.WriteNoAck([]byte("replay")))
+	received, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("replay"), received)
+
+	require.NoError(t, p.WriteUrgent([]byte("urgent")))
+	received, err = peer.ReadUrgent(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("urgent"), received)
+
+	// Replayed data messages are discarded.
+	_, err = a.Write(<-frames)
+	require.NoError(t, err)
+	select {
+	case e := <-events:
+		require.Contains(t, e.Message, errReplayedDataChunk.Error())
+	case <-time.After(time.Second):
+		t.Fatal("replayed data chunk not reported")
+	}
+	_, err = peer.Read(10 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+
+	// Later data chunks are still received.
+	require.NoError(t, p.Write([]byte("next")))
+	received, err = peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("next"), received)
+
+	// A restarted peer agrees on a new session. The captured data messages
+	// of the previous session are discarded, although the replay window of
+	// the new session is empty.
+	p2, peer2, a2, _, events2 := newPair()
+	defer p2.Close()
+	defer peer2.Close()
+
+	require.NoError(t, p2.Write([]byte("restarted")))
+	received, err = peer2.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("restarted"), received)
+
+	// Replay the last data message, so it is not suppressed as duplicate
+	// of the initial message sequence number.
+	var frame []byte
+	for len(frames) > 0 {
+		frame = <-frames
+	}
+	_, err = a2.Write(frame)
+	require.NoError(t, err)
+	select {
+	case e := <-events2:
+		require.Contains(t, e.Message, ErrAuthenticationFailed.Error())
+	case <-time.After(time.Second):
+		t.Fatal("data chunk of the previous session not reported")
+	}
+	_, err = peer2.Read(10 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+
+	// Ports without a session never transmit data chunks.
+	a, b := net.Pipe()
+	p3 := NewPort(a, &Config{Cipher: c, ReplayProtection: true})
+	peer3 := NewPort(b, &Config{Cipher: c, ReplayProtection: true})
+	defer p3.Close()
+	defer peer3.Close()
+
+	require.Equal(t, ErrNoSessionKey, p3.WriteAndConfirm([]byte("no session"), time.Second))
+}
+
+// busTap is a node on a simulated multi-drop bus.
+// Written bytes are received by all other nodes.
+type busTap struct {
+	io.ReadWriteCloser
+	bus []*busTap
+}
+
+func newBus(nodes int) []*busTap {
+	bus := make([]*busTap, nodes)
+	for i := range bus {
+		bus[i] = &busTap{ReadWriteCloser: loopback.New()}
+	}
+	for _, t := range bus {
+		t.bus = bus
+	}
+	return bus
+}
+
+func (t *busTap) Write(p []byte) (int, error) {
+	for _, other := range t.bus {
+		if other != t {
+			other.ReadWriteCloser.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func TestAddressing(t *testing.T) {
+	newNode := func(tap *busTap, address, peer byte) *Port {
+		return NewPort(tap, &Config{
+			AddressingEnabled: true,
+			Address:           address,
+			PeerAddress:       peer,
+			ReadPollInterval:  time.Millisecond,
+		})
+	}
+
+	// Nodes ignore messages, which are not addressed to them.
+	bus := newBus(3)
+	master, node2, node3 := newNode(bus[0], 1, 2), newNode(bus[1], 2, 1), newNode(bus[2], 3, 1)
+
+	require.NoError(t, master.Write([]byte("to 2")))
+	data, err := node2.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("to 2"), data)
+
+	_, err = node3.Read(50 * time.Millisecond)
+	require.Equal(t, ErrTimeout, err)
+
+	master.Close()
+	node2.Close()
+	node3.Close()
+
+	// Broadcast data messages are received by all nodes.
+	bus = newBus(3)
+	master, node2, node3 = newNode(bus[0], 1, BroadcastAddress), newNode(bus[1], 2, 1), newNode(bus[2], 3, 1)
+	defer master.Close()
+	defer node2.Close()
+	defer node3.Close()
+
+	require.NoError(t, master.Write([]byte("to all")))
+	for _, p := range []*Port{node2, node3} {
+		data, err = p.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte("to all"), data)
+	}
+
+	// The broadcasting node accepts the replies of all nodes.
+	require.NoError(t, node3.Write([]byte("from 3")))
+	data, err = master.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("from 3"), data)
+}
+
+func TestWriteNoAck(t *testing.T) {
+	bus := newBus(3)
+	p := NewPort(bus[0], &Config{MaxMessageSize: 2, DeltaEncoding: true})
+	defer p.Close()
+
+	// Multiple receivers on the shared bus. None of them replies.
+	var receivers []*Port
+	for _, s := range bus[1:] {
+		r := NewPort(s, &Config{DeltaEncoding: true})
+		defer r.Close()
+		receivers = append(receivers, r)
+	}
+
+	require.NoError(t, p.WriteNoAck([]byte("all")))
+	require.NoError(t, p.WriteNoAck([]byte("alt")))
+	for _, r := range receivers {
+		for _, expected := range []string{"all", "alt"} {
+			data, err := r.Read(time.Second)
+			require.NoError(t, err)
+			require.Equal(t, []byte(expected), data)
+		}
+		require.Zero(t, r.Stats().Snapshot().BytesSent)
+	}
+
+	// Both data chunks are split into two data messages, which are transmitted once.
+	require.Eventually(t, func() bool {
+		return p.Stats().Snapshot().DataMessagesSent == 4 && p.PendingWrites() == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestKeepalive(t *testing.T) {
+	c := &Config{KeepaliveInterval: time.Second}
+	c.setDefaults()
+	require.Equal(t, 3*time.Second, c.LinkTimeout)
+
+	c = &Config{
+		KeepaliveInterval: 10 * time.Millisecond,
+		LinkTimeout:       100 * time.Millisecond,
+	}
+	a, b := net.Pipe()
+	p, peer := NewPort(a, c), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	// The peer replies to the heartbeats on an idle link.
+	time.Sleep(200 * time.Millisecond)
+	require.True(t, p.IsLinkUp())
+
+	// The link goes down if the peer is silent, but the port stays open.
+	p = NewPort(sinkSource{}, c)
+	defer p.Close()
+
+	linkDown := make(chan struct{}, 1)
+	p.OnLinkDown(func() {
+		linkDown <- struct{}{}
+	})
+
+	select {
+	case <-linkDown:
+	case <-time.After(time.Second):
+		t.Fatal("link down not detected")
+	}
+	require.False(t, p.IsLinkUp())
+	require.False(t, p.IsClosed())
+}
+
+func TestHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	p := NewPort(a, &Config{
+		Handshake:      true,
+		DataMessageCRC: CRC32,
+		MaxMessageSize: 64,
+	})
+	peer := NewPort(b, &Config{
+		DataMessageCRC: CRC16,
+		MaxMessageSize: 32,
+		DeltaEncoding:  true,
+	})
+	defer p.Close()
+	defer peer.Close()
+
+	// The handshake is completed before the first data chunk.
+	require.NoError(t, p.Write(bytes.Repeat([]byte{1}, 100)))
+	m, err := peer.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Len(t, m.Data, 100)
+
+	// The data messages use the CRC type and the maximum size of the peer.
+	require.Equal(t, CRCType(CRC16), m.CRC)
+	require.Equal(t, 4, m.Fragments)
+
+	info, ok := p.PeerInfo()
+	require.True(t, ok)
+	require.Equal(t, PeerInfo{
+		Version:           ProtocolVersion,
+		DataMessageCRC:    CRC16,
+		ControlMessageCRC: CRC16,
+		MaxMessageSize:    32,
+		DeltaEncoding:     true,
+	}, info)
+
+	info, ok = peer.PeerInfo()
+	require.True(t, ok)
+	require.Equal(t, CRCType(CRC32), info.DataMessageCRC)
+	require.Equal(t, 64, info.MaxMessageSize)
+
+	// Both peers fall back to CRC-16 for the control messages,
+	// if their control message CRC types differ.
+	a, b = net.Pipe()
+	p = NewPort(a, &Config{Handshake: true, ControlMessageCRC: CRC32})
+	peer = NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	require.NoError(t, p.WriteAndConfirm([]byte("ping"), 2*time.Second))
+	require.NoError(t, peer.WriteAndConfirm([]byte("pong"), 2*time.Second))
+	require.True(t, p.codec.isControlMessageCRCFallback())
+	require.True(t, peer.codec.isControlMessageCRCFallback())
+
+	// Legacy peers never reply to the handshake.
+	s := NewPort(sinkSource{}, &Config{Handshake: true, HandshakeTimeout: time.Millisecond})
+	defer s.Close()
+	time.Sleep(20 * time.Millisecond)
+	_, ok = s.PeerInfo()
+	require.False(t, ok)
+}
+
+func TestKeyExchange(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(crand.Reader)
+	require.NoError(t, err)
+	peerKey, err := ecdh.X25519().GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	// newPair connects a port with a peer, which pinned their static keys.
+	newPair := func(config *Config) (p, peer *Port, a net.Conn) {
+		a, b := net.Pipe()
+		config.Handshake = true
+		config.MaxMessageSize = 64
+		config.KeyExchange = &KeyExchange{PrivateKey: key, PeerKeys: []*ecdh.PublicKey{peerKey.PublicKey()}}
+		p = NewPort(a, config)
+		peer = NewPort(b, &Config{
+			MaxMessageSize: 64,
+			KeyExchange:    &KeyExchange{PrivateKey: peerKey, PeerKeys: []*ecdh.PublicKey{key.PublicKey()}},
+		})
+		return p, peer, a
+	}
+
+	var mutex sync.Mutex
+	var frames [][]byte
+	p, peer, a := newPair(&Config{
+		OnRawFrameSent: func(frame []byte) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			frames = append(frames, append([]byte(nil), frame...))
+		},
+	})
+	defer p.Close()
+	defer peer.Close()
+
+	// The data chunks are encrypted with the agreed session key.
+	data := bytes.Repeat([]byte("ants"), 100)
+	require.NoError(t, p.Write(data))
+	m, err := peer.ReadMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, data, m.Data)
+
+	require.NoError(t, peer.Write([]byte("reply")))
+	received, err := p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("reply"), received)
+
+	info, ok := p.PeerInfo()
+	require.True(t, ok)
+	require.True(t, info.Encryption)
+	require.True(t, info.PublicKey.Equal(peerKey.PublicKey()))
+
+	// A replayed handshake request never re-keys the session of the peer.
+	// The first sent frame is the handshake request.
+	session, err := peer.currentSession()
+	require.NoError(t, err)
+	mutex.Lock()
+	request := frames[0]
+	mutex.Unlock()
+	_, err = a.Write(request)
+	require.NoError(t, err)
+
+	require.NoError(t, p.Write([]byte("same session")))
+	received, err = peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("same session"), received)
+	current, err := peer.currentSession()
+	require.NoError(t, err)
+	require.True(t, session == current)
+
+	// Each session agrees on a new session key.
+	p2, peer2, _ := newPair(&Config{})
+	defer p2.Close()
+	defer peer2.Close()
+
+	require.NoError(t, p2.Write([]byte("new session")))
+	received, err = peer2.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new session"), received)
+
+	session2, err := p2.currentSession()
+	require.NoError(t, err)
+	sealed, err := session.cipher.Seal([]byte("ants"), nil)
+	require.NoError(t, err)
+	_, err = session2.cipher.Open(sealed, nil)
+	require.Equal(t, ErrAuthenticationFailed, err)
+
+	// Both peers might start the handshake at the same time.
+	a, b := net.Pipe()
+	p3 := NewPort(a, &Config{Handshake: true, KeyExchange: &KeyExchange{PrivateKey: key, PeerKeys: []*ecdh.PublicKey{peerKey.PublicKey()}}})
+	peer3 := NewPort(b, &Config{Handshake: true, KeyExchange: &KeyExchange{PrivateKey: peerKey, PeerKeys: []*ecdh.PublicKey{key.PublicKey()}}})
+	defer p3.Close()
+	defer peer3.Close()
+
+	require.NoError(t, p3.Write([]byte("simultaneous")))
+	received, err = peer3.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("simultaneous"), received)
+	require.NoError(t, peer3.Write([]byte("simultaneous reply")))
+	received, err = p3.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("simultaneous reply"), received)
+
+	// Key exchanges without a static key or pinned peer keys are rejected.
+	a, b = net.Pipe()
+	p4 := NewPort(a, &Config{Handshake: true, KeyExchange: &KeyExchange{}})
+	peer4 := NewPort(b, &Config{KeyExchange: &KeyExchange{}})
+	defer p4.Close()
+	defer peer4.Close()
+
+	require.Equal(t, ErrNoSessionKey, p4.WriteAndConfirm([]byte("unauthenticated"), time.Second))
+
+	// Peers with a key, which is not pinned, are rejected.
+	unpinnedKey, err := ecdh.X25519().GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	a, b = net.Pipe()
+	events := make(chan Event, 1)
+	p5 := NewPort(a, &Config{
+		Handshake:        true,
+		HandshakeTimeout: 10 * time.Millisecond,
+		KeyExchange:      &KeyExchange{PrivateKey: unpinnedKey, PeerKeys: []*ecdh.PublicKey{peerKey.PublicKey()}},
+	})
+	peer5 := NewPort(b, &Config{
+		KeyExchange: &KeyExchange{PrivateKey: peerKey, PeerKeys: []*ecdh.PublicKey{key.PublicKey()}},
+		OnEvent: func(e Event) {
+			if e.Type == EventAuthenticationFailed {
+				select {
+				case events <- e:
+				default:
+				}
+			}
+		},
+	})
+	defer p5.Close()
+	defer peer5.Close()
+
+	require.Equal(t, ErrNoSessionKey, p5.WriteAndConfirm([]byte("rejected"), time.Second))
+	select {
+	case e := <-events:
+		require.Contains(t, e.Message, ErrPeerKeyRejected.Error())
+	case <-time.After(time.Second):
+		t.Fatal("rejected peer key not reported")
+	}
+	_, ok = p5.PeerInfo()
+	require.False(t, ok)
+}
+
+func TestRawFrameHooks(t *testing.T) {
+	a, b := net.Pipe()
+
+	// rawFrames collects the frames passed to a raw frame hook.
+	type rawFrames struct {
+		sync.Mutex
+		frames [][]byte
+	}
+	collect := func(r *rawFrames) func(frame []byte) {
+		return func(frame []byte) {
+			r.Lock()
+			defer r.Unlock()
+			r.frames = append(r.frames, append([]byte(nil), frame...))
+		}
+	}
+	get := func(r *rawFrames) [][]byte {
+		r.Lock()
+		defer r.Unlock()
+		return r.frames
+	}
+
+	var sentA, receivedA, sentB, receivedB rawFrames
+	pa := NewPort(a, &Config{
+		OnRawFrameSent:     collect(&sentA),
+		OnRawFrameReceived: collect(&receivedA),
+	})
+	defer pa.Close()
+	pb := NewPort(b, &Config{
+		OnRawFrameSent:     collect(&sentB),
+		OnRawFrameReceived: collect(&receivedB),
+	})
+	defer pb.Close()
+
+	// The payload contains the DLE character, which is escaped on the wire.
+	data := []byte{'a', dle, 'b', dle, dle, 'c'}
+	require.NoError(t, pa.Write(data))
+
+	buf, err := pb.Read()
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// The data message was acknowledged, so both directions carried frames.
+	require.NotEmpty(t, get(&sentA))
+	require.NotEmpty(t, get(&sentB))
+
+	// Each frame is passed escaped and complete.
+	for _, f := range append(get(&sentA), get(&sentB)...) {
+		require.True(t, len(f) >= 4)
+		require.Equal(t, byte(dle), f[0])
+		require.Equal(t, []byte{dle, etx}, f[len(f)-2:])
+	}
+	require.True(t, bytes.Contains(get(&sentA)[0], []byte{dle, dle}))
+
+	// The received frames match the transmitted frames byte by byte.
+	require.Equal(t, get(&sentA), get(&receivedB))
+	require.Eventually(t, func() bool {
+		return len(get(&receivedA)) == len(get(&sentB))
+	}, time.Second, time.Millisecond)
+	require.Equal(t, get(&sentB), get(&receivedA))
+}
+
+func TestParseFrame(t *testing.T) {
+	config := &Config{
+		DataMessageCRC:    CRC32,
+		FrameLayout:       FrameLayoutEnhanced,
+		AddressingEnabled: true,
+		Address:           1,
+		PeerAddress:       2,
+	}
+	p := NewPort(sinkSource{}, config)
+	defer p.Close()
+
+	// The binary data contains the DLE character, which is escaped.
+	data := []byte{'a', dle, 'b'}
+	frame := p.newDataMessageFrame(7, flagUrgent|flagService, data)
+
+	f, err := ParseFrame(frame, config)
+	require.NoError(t, err)
+	require.Equal(t, "DATA", f.Type)
+	require.True(t, f.Addressed)
+	require.Equal(t, byte(2), f.Destination)
+	require.Equal(t, byte(1), f.Source)
+	require.Equal(t, byte(7), f.MSN)
+	require.Equal(t, []string{"urgent", "service"}, f.FlagNames())
+	require.Equal(t, CRCType(CRC32), f.CRCType)
+	require.Equal(t, data, f.Payload)
+	require.True(t, f.CRCValid)
+	require.Equal(t, "DATA 1->2 MSN=7 flags=urgent,service CRC-32 ok len=3", f.String())
+
+	// Corrupted frames are decoded with an invalid checksum.
+	corrupt := append([]byte(nil), frame...)
+	corrupt[len(corrupt)-3] ^= 0x01
+	f, err = ParseFrame(corrupt, config)
+	require.NoError(t, err)
+	require.False(t, f.CRCValid)
+
+	// Control messages.
+	ctrl := p.newControlMessageFrame(ack, 7, nil)
+	f, err = ParseFrame(ctrl, config)
+	require.NoError(t, err)
+	require.Equal(t, "ACK", f.Type)
+	require.True(t, f.IsControlMessage)
+	require.Equal(t, byte(7), f.MSN)
+	require.True(t, f.CRCValid)
+
+	// Malformed frames.
+	_, err = ParseFrame([]byte{dle, stx, dle, etx})
+	require.Equal(t, ErrInvalidFrame, err)
+	_, err = ParseFrame([]byte("ants"))
+	require.Equal(t, ErrInvalidFrame, err)
+
+	// Scan the frames of a stream with garbage and an interrupted frame.
+	var stream []byte
+	stream = append(stream, 0xaa, dle, dle, stx)
+	stream = append(stream, frame...)
+	stream = append(stream, frame[:5]...)
+	stream = append(stream, ctrl...)
+	stream = append(stream, 0xbb)
+
+	s := bufio.NewScanner(iotest.OneByteReader(bytes.NewReader(stream)))
+	s.Split(ScanFrames)
+
+	var frames [][]byte
+	for s.Scan() {
+		frames = append(frames, append([]byte(nil), s.Bytes()...))
+	}
+	require.NoError(t, s.Err())
+	require.Equal(t, [][]byte{frame, ctrl}, frames)
+}
+
+func TestFrameCodec(t *testing.T) {
+	c := NewFrameCodec(&Config{
+		DataMessageCRC:    CRC32,
+		ControlMessageCRC: CRC32,
+	})
+
+	data := c.EncodeDataMessage(3, FlagAppendData, []byte{1, dle, 2})
+	ctrl, err := c.EncodeControlMessage(ControlNak, 3, nil)
+	require.NoError(t, err)
+	_, err = c.EncodeControlMessage(stx, 3, nil)
+	require.Equal(t, ErrInvalidMessageType, err)
+
+	// The frames are compatible with a port.
+	a, b := net.Pipe()
+	p := NewPort(a, &Config{DataMessageCRC: CRC32, ControlMessageCRC: CRC32})
+	defer p.Close()
+	go func() {
+		b.Write(c.EncodeDataMessage(1, 0, []byte("ants")))
+	}()
+	buf, err := p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ants"), buf)
+
+	// Decode a stream with garbage and a corrupted frame in arbitrary chunks.
+	corrupt := append([]byte(nil), data...)
+	corrupt[4] ^= 0x01
+
+	var stream []byte
+	stream = append(stream, 0xaa, 0xbb)
+	stream = append(stream, data...)
+	stream = append(stream, corrupt...)
+	stream = append(stream, ctrl...)
+
+	var frames []*FrameInfo
+	d := c.NewDecoder()
+	for len(stream) > 0 {
+		n := 3
+		if n > len(stream) {
+			n = len(stream)
+		}
+		d.Decode(stream[:n], func(f *FrameInfo, err error) {
+			require.NoError(t, err)
+
+			// Copy the payload, because the buffer is reused.
+			f.Payload = append([]byte(nil), f.Payload...)
+			frames = append(frames, f)
+		})
+		stream = stream[n:]
+	}
+
+	require.Len(t, frames, 3)
+	require.Equal(t, "DATA", frames[0].Type)
+	require.Equal(t, byte(3), frames[0].MSN)
+	require.Equal(t, []string{"append"}, frames[0].FlagNames())
+	require.Equal(t, []byte{1, dle, 2}, frames[0].Payload)
+	require.True(t, frames[0].CRCValid)
+	require.False(t, frames[1].CRCValid)
+	require.Equal(t, "NAK", frames[2].Type)
+	require.Equal(t, CRCType(CRC32), frames[2].CRCType)
+	require.True(t, frames[2].CRCValid)
+
+	// Reset discards the partial frame.
+	d.Decode(data[:5], func(*FrameInfo, error) { t.Fatal("unexpected frame") })
+	d.Reset()
+	d.Decode(data[5:], func(*FrameInfo, error) { t.Fatal("unexpected frame") })
+}
+
+func TestFramingCharacters(t *testing.T) {
+	chars := FramingCharacters{DLE: 0x7d, STX: 0x7e, ETX: 0x7f}
+	c := NewFrameCodec(&Config{FramingCharacters: chars})
+
+	// The default DLE character is not escaped anymore.
+	data := c.EncodeDataMessage(1, 0, []byte{dle, 0x7d})
+	require.Equal(t, []byte{0x7d, 0x7e, 0x01, flagCRC16, dle, 0x7d, 0x7d}, data[:7])
+	require.Equal(t, []byte{0x7d, 0x7f}, data[len(data)-2:])
+	ctrl, err := c.EncodeControlMessage(ControlAck, 1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x7d, ack}, ctrl[:2])
+
+	f, err := c.Parse(data)
+	require.NoError(t, err)
+	require.Equal(t, byte(stx), f.StartCharacter)
+	require.Equal(t, []byte{dle, 0x7d}, f.Payload)
+	require.True(t, f.CRCValid)
+	_, err = ParseFrame(data)
+	require.Equal(t, ErrInvalidFrame, err)
+
+	s := bufio.NewScanner(bytes.NewReader(append(append([]byte{0xaa, dle, stx}, data...), ctrl...)))
+	s.Split(c.ScanFrames)
+	require.True(t, s.Scan())
+	require.Equal(t, data, s.Bytes())
+	require.True(t, s.Scan())
+	require.Equal(t, ctrl, s.Bytes())
+	require.False(t, s.Scan())
+
+	// Both peers use the same characters.
+	a, b := net.Pipe()
+	pa := NewPort(a, &Config{FramingCharacters: chars})
+	defer pa.Close()
+	pb := NewPort(b, &Config{FramingCharacters: chars})
+	defer pb.Close()
+
+	payload := []byte{dle, stx, 0x7d, 0x7e, 0x7f}
+	require.NoError(t, pa.Write(payload))
+	buf, err := pb.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, payload, buf)
+
+	// Ambiguous characters fall back to the defaults and are logged.
+	var log bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&log, nil)))
+	config := &Config{Logger: logger, FramingCharacters: FramingCharacters{STX: 0x7e, ETX: 0x7e}}
+	config.setDefaults()
+	require.Equal(t, defaultFramingCharacters, config.FramingCharacters)
+	require.Contains(t, log.String(), "ambiguous control character 0x7e")
+	config = &Config{Logger: logger, FramingCharacters: FramingCharacters{ACK: can}}
+	config.setDefaults()
+	require.Equal(t, defaultFramingCharacters, config.FramingCharacters)
+	require.Contains(t, log.String(), "ambiguous control character 0x18")
+
+	// The frame codec reports them, too.
+	log.Reset()
+	NewFrameCodec(&Config{Logger: logger, FramingCharacters: FramingCharacters{NAK: wat}})
+	require.Contains(t, log.String(), "ambiguous control character 0x16")
+}
+
+func TestHDLCFraming(t *testing.T) {
+	config := &Config{Framing: FramingHDLC}
+	c := NewFrameCodec(config)
+
+	ctrl, err := c.EncodeControlMessage(ControlAck, 1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{hdlcFlag, ack, 0x01, 0xf1, 0xe1, hdlcFlag}, ctrl)
+
+	// The flag and the escape character are escaped. DLE is not.
+	data := c.EncodeDataMessage(2, 0, []byte{hdlcFlag, dle, hdlcEscape})
+	require.Equal(t, []byte{hdlcFlag, stx, 0x02, flagCRC16, 0x7d, 0x5e, dle, 0x7d, 0x5d}, data[:9])
+
+	f, err := ParseFrame(data, config)
+	require.NoError(t, err)
+	require.Equal(t, "DATA", f.Type)
+	require.Equal(t, []byte{hdlcFlag, dle, hdlcEscape}, f.Payload)
+	require.True(t, f.CRCValid)
+	_, err = ParseFrame([]byte{hdlcFlag, stx, hdlcEscape, hdlcFlag}, config)
+	require.Equal(t, ErrInvalidFrame, err)
+
+	// Decode a stream with garbage, shared flags and an aborted frame.
+	var stream []byte
+	stream = append(stream, 0xaa, hdlcFlag, hdlcFlag)
+	stream = append(stream, data[:6]...)
+	stream = append(stream, hdlcEscape, hdlcFlag)
+	stream = append(stream, data[1:]...)
+	stream = append(stream, ctrl[1:]...)
+
+	var events []decodeEvent
+	var frames []string
+	d := c.NewDecoder()
+	for _, b := range stream {
+		if e := d.decodeByte(b); e != decodeNone {
+			events = append(events, e)
+		}
+		if d.startCharacterFound || len(d.buf) == 0 {
+			continue
+		}
+		f, err := c.parseBody(d.startCharacter, d.buf)
+		require.NoError(t, err)
+		frames = append(frames, f.Type)
+		d.clearFrame()
+	}
+	require.Equal(t, []decodeEvent{decodeStarted, decodeAborted, decodeStarted, decodeEnded, decodeStarted, decodeEnded}, events)
+	require.Equal(t, []string{"DATA", "ACK"}, frames)
+
+	// Both peers use the HDLC framing.
+	var raw [][]byte
+	a, b := net.Pipe()
+	pa := NewPort(a, &Config{
+		Framing:        FramingHDLC,
+		OnRawFrameSent: func(frame []byte) { raw = append(raw, append([]byte(nil), frame...)) },
+	})
+	defer pa.Close()
+	pb := NewPort(b, &Config{Framing: FramingHDLC})
+	defer pb.Close()
+
+	payload := []byte{hdlcFlag, hdlcEscape, dle, etx}
+	require.NoError(t, pa.WriteAndConfirm(payload, time.Second))
+	buf, err := pb.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, payload, buf)
+	require.Equal(t, byte(hdlcFlag), raw[0][0])
+	require.Equal(t, byte(hdlcFlag), raw[0][len(raw[0])-1])
+}
+
+func TestCOBSFraming(t *testing.T) {
+	config := &Config{Framing: FramingCOBS}
+	c := NewFrameCodec(config)
+
+	ctrl, err := c.EncodeControlMessage(ControlAck, 1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x05, ack, 0x01, 0xf1, 0xe1, 0x00}, ctrl)
+
+	// The zero bytes are replaced by the block codes.
+	data := c.EncodeDataMessage(2, 0, []byte{0x00, 0x11, 0x00})
+	require.Equal(t, []byte{0x00, 0x04, stx, 0x02, flagCRC16, 0x02, 0x11}, data[:7])
+	require.NotContains(t, data[1:len(data)-1], byte(0x00))
+
+	f, err := ParseFrame(data, config)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x11, 0x00}, f.Payload)
+	require.True(t, f.CRCValid)
+	_, err = ParseFrame([]byte{0x00, 0x05, stx, 0x01, 0x00}, config)
+	require.Equal(t, ErrInvalidFrame, err)
+
+	// The overhead is bounded for any binary data.
+	for _, fill := range []byte{0x00, dle, 0xff} {
+		payload := bytes.Repeat([]byte{fill}, 1000)
+		frame := c.EncodeDataMessage(3, 0, payload)
+		require.True(t, len(frame) <= 1+1+2+1000+2+1+5, len(frame))
+
+		f, err := ParseFrame(frame, config)
+		require.NoError(t, err)
+		require.Equal(t, payload, f.Payload)
+
+		var decoded []byte
+		d := c.NewDecoder()
+		d.Decode(frame, func(f *FrameInfo, err error) {
+			require.NoError(t, err)
+			require.True(t, f.CRCValid)
+			decoded = append([]byte(nil), f.Payload...)
+		})
+		require.Equal(t, payload, decoded)
+	}
+
+	// Decode a stream with garbage, shared delimiters and a truncated frame.
+	var stream []byte
+	stream = append(stream, 0xaa, 0x00, 0x00)
+	stream = append(stream, data[:6]...)
+	stream = append(stream, data...)
+	stream = append(stream, ctrl[1:]...)
+
+	var events []decodeEvent
+	var frames []string
+	d := c.NewDecoder()
+	for _, b := range stream {
+		if e := d.decodeByte(b); e != decodeNone {
+			events = append(events, e)
+		}
+		if d.startCharacterFound || len(d.buf) == 0 {
+			continue
+		}
+		f, err := c.parseBody(d.startCharacter, d.buf)
+		require.NoError(t, err)
+		frames = append(frames, f.Type)
+		d.clearFrame()
+	}
+	require.Equal(t, []decodeEvent{decodeStarted, decodeAborted, decodeStarted, decodeEnded, decodeStarted, decodeEnded}, events)
+	require.Equal(t, []string{"DATA", "ACK"}, frames)
+
+	// Both peers use the COBS framing.
+	a, b := net.Pipe()
+	pa := NewPort(a, &Config{Framing: FramingCOBS})
+	defer pa.Close()
+	pb := NewPort(b, &Config{Framing: FramingCOBS})
+	defer pb.Close()
+
+	payload := []byte{0x00, dle, 0x00, 0x00, etx}
+	require.NoError(t, pa.WriteAndConfirm(payload, time.Second))
+	buf, err := pb.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, payload, buf)
+}
+
+func TestRSCodec(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, parity := range []int{1, 2, 8, 64} {
+		r := newRSCodec(parity)
+
+		for i := 0; i < 50; i++ {
+			msg := make([]byte, 1+rnd.Intn(1000))
+			rnd.Read(msg)
+
+			// The message is protected in place behind a prefix.
+			buf := r.encode(append([]byte{0xaa}, msg...), 1)
+			require.Equal(t, byte(0xaa), buf[0])
+			encoded := buf[1:]
+			require.Len(t, encoded, len(msg)+r.overhead(len(msg)))
+
+			// Corrupt up to parity/2 bytes of each block.
+			errs := 0
+			for start := 0; start < len(encoded); start += rsBlockSize {
+				end := start + rsBlockSize
+				if end > len(encoded) {
+					end = len(encoded)
+				}
+				for _, pos := range rnd.Perm(end - start)[:rnd.Intn(parity/2+1)] {
+					encoded[start+pos] ^= byte(1 + rnd.Intn(255))
+					errs++
+				}
+			}
+
+			decoded, corrected, failed := r.decode(encoded)
+			require.Equal(t, msg, decoded)
+			require.Equal(t, errs, corrected)
+			require.Zero(t, failed)
+		}
+	}
+
+	// Too many corrupted bytes are not corrected.
+	r := newRSCodec(2)
+	encoded := r.encode([]byte("ants"), 0)
+	encoded[0] ^= 0x01
+	encoded[1] ^= 0x01
+	_, corrected, failed := r.decode(encoded)
+	require.Zero(t, corrected)
+	require.Equal(t, 1, failed)
+}
+
+func TestFEC(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go io.Copy(io.Discard, a)
+
+	p := NewPort(b, &Config{FECParity: 8})
+	defer p.Close()
+
+	// The binary data contains no DLE character. Only the flags
+	// with the CRC-16 type are escaped. Each of the three blocks
+	// adds its parity bytes.
+	data := bytes.Repeat([]byte{'a'}, 600)
+	c := NewFrameCodec(&Config{FECParity: 8})
+	frame := c.EncodeDataMessage(initialMSN, 0, data)
+	require.Len(t, frame, 4+3+600+2+3*8)
+
+	// Corrupt four bytes of the first block and one of the last block.
+	for _, pos := range []int{2, 10, 100, 200, 600} {
+		frame[pos] ^= 0x01
+	}
+	f, err := c.Parse(frame)
+	require.NoError(t, err)
+	require.Equal(t, 5, f.Corrected)
+	require.True(t, f.CRCValid)
+	require.Equal(t, data, f.Payload)
+
+	_, err = a.Write(frame)
+	require.NoError(t, err)
+	buf, err := p.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	s := p.Stats().Snapshot()
+	require.Equal(t, uint64(5), s.FECCorrections)
+	require.Zero(t, s.ChecksumErrors)
+
+	// Five corrupted bytes of a block are detected by the checksum.
+	frame = c.EncodeDataMessage(initialMSN+1, 0, data)
+	for _, pos := range []int{2, 10, 100, 200, 250} {
+		frame[pos] ^= 0x01
+	}
+	_, err = a.Write(frame)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return p.Stats().Snapshot().ChecksumErrors == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestFrameBuffer(t *testing.T) {
+	b := &frameBuffer{}
+
+	// Encode the reference frames into the same reused buffer.
+	c := NewFrameCodec()
+	require.Equal(t, []byte{dle, stx, 0x01, dle, dle, 0x61, 0x6e, 0x74, 0x73, 0x55, 0x01, dle, etx},
+		c.encodeDataMessageInto(b, CRC16, 1, 0, []byte("ants")))
+	require.Equal(t, []byte{dle, ack, 0x01, 0xf1, 0xe1, dle, etx},
+		c.encodeControlMessageInto(b, ack, 1, nil))
+	require.Equal(t, []byte{dle, stx, dle, dle, 0x21, dle, dle, stx, dle, dle, 0xfb, 0xbe, 0x18, 0x40, dle, etx},
+		c.encodeDataMessageInto(b, CRC32, dle, flagAppendData, []byte{dle, stx, dle}))
+
+	c = NewFrameCodec(&Config{FrameLayout: FrameLayoutEnhanced})
+	require.Equal(t, []byte{dle, soh, 0x02, 0x12, 0x02, 0x00, 0x35, 0xc6, 0x68, 0x69, 0x8c, 0xa9, dle, etx},
+		c.encodeDataMessageInto(b, CRC16, 2, flagUrgent, []byte("hi")))
+
+	c = NewFrameCodec(&Config{AddressingEnabled: true, Address: 1, PeerAddress: 2})
+	require.Equal(t, []byte{dle, nak, 0x02, 0x01, 0x7e, 0x2d, 0x03, 0xe3, 0xc2, dle, etx},
+		c.encodeControlMessageInto(b, nak, 3, nil))
+	require.Equal(t, []byte{dle, stx, 0x02, 0x01, 0x7e, 0x2d, 0x03, dle, dle, 0xff, 0x41, 0xb3, dle, etx},
+		c.encodeDataMessageInto(b, CRC16, 3, 0, []byte{0xff}))
+
+	// Encoding into a warm buffer never allocates.
+	data := bytes.Repeat([]byte{dle, 1}, 512)
+	allocs := testing.AllocsPerRun(100, func() {
+		c.encodeDataMessageInto(b, CRC32, 1, 0, data)
+		c.encodeControlMessageInto(b, ack, 1, nil)
+	})
+	require.Zero(t, allocs)
+
+	frame, err := c.Parse(c.encodeDataMessageInto(b, CRC32, 1, 0, data))
+	require.NoError(t, err)
+	require.True(t, frame.CRCValid)
+	require.Equal(t, data, frame.Payload)
+}
+
+func TestThroughputMeter(t *testing.T) {
+	var m throughputMeter
+	start := time.Unix(100, 0)
+
+	// The rate covers the age of the meter within the first second.
+	m.add(start, 100, 0)
+	m.add(start.Add(500*time.Millisecond), 0, 50)
+	sent, received := m.rates(start.Add(500 * time.Millisecond))
+	require.Equal(t, 200.0, sent)
+	require.Equal(t, 100.0, received)
+
+	// The bytes leave the window after a second.
+	m.add(start.Add(1000*time.Millisecond), 90, 0)
+	sent, received = m.rates(start.Add(1050 * time.Millisecond))
+	require.InDelta(t, 90.0/0.95, sent, 0.001)
+	require.InDelta(t, 50.0/0.95, received, 0.001)
+
+	sent, received = m.rates(start.Add(10 * time.Second))
+	require.Zero(t, sent)
+	require.Zero(t, received)
+}
+
+func TestThroughput(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	require.NoError(t, p.WriteAndConfirm(make([]byte, 1000), time.Second))
+
+	sent, received := p.Throughput()
+	require.True(t, sent >= 1000, sent)
+	require.True(t, received > 0, received)
+
+	// The acknowledgement is counted after it was passed to the source.
+	require.Eventually(t, func() bool {
+		sent, received = peer.Throughput()
+		return sent > 0 && received >= 1000
+	}, time.Second, time.Millisecond)
+}
+
+func TestWriteBuffer(t *testing.T) {
+	a, b := net.Pipe()
+	p, peer := NewPort(a, &Config{CoalesceWindow: 20 * time.Millisecond}), NewPort(b)
+	defer p.Close()
+	defer peer.Close()
+
+	// Coalesced buffers are released as well.
+	for i := 0; i < 3; i++ {
+		buf := GetBuffer()
+		buf.B = append(buf.B, byte(i))
+		require.NoError(t, p.WriteBuffer(buf))
+	}
+
+	data, err := peer.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 1, 2}, data)
+}
+
+// benchSource serves the received bytes from memory and discards the written bytes.
+type benchSource struct {
+	r *bytes.Reader
+}
+
+func (s *benchSource) Read(p []byte) (int, error)  { return s.r.Read(p) }
+func (s *benchSource) Write(p []byte) (int, error) { return len(p), nil }
+func (s *benchSource) Close() error                { return nil }
+
+func benchmarkRead(b *testing.B, size int) {
+	// Encode the received data messages in advance.
+	codec := NewFrameCodec()
+	data := bytes.Repeat([]byte{0x55, dle}, size/2)
+	var stream []byte
+	msn := byte(0)
+	for i := 0; i < b.N; i++ {
+		msn = nextSequenceNumber(msn)
+		stream = append(stream, codec.EncodeDataMessage(msn, 0, data)...)
+	}
+
+	p := NewPort(&benchSource{r: bytes.NewReader(stream)})
+	defer p.Close()
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, size int) {
+	// Broadcast data messages are never acknowledged.
+	p := NewPort(sinkSource{}, &Config{
+		AddressingEnabled: true,
+		Address:           1,
+		PeerAddress:       BroadcastAddress,
+	})
+
+	data := bytes.Repeat([]byte{0x55, dle}, size/2)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf := GetBuffer()
+		buf.B = append(buf.B, data...)
+		if err := p.WriteBuffer(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := p.CloseGracefully(10 * time.Second); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchmarkEncode(b *testing.B, size int) {
+	codec := NewFrameCodec()
+	data := bytes.Repeat([]byte{0x55, dle}, size/2)
+	buf := getFrameBuffer()
+	defer buf.release()
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		codec.encodeDataMessageInto(buf, CRC16, 1, 0, data)
+	}
+}
+
+func benchmarkDecode(b *testing.B, size int) {
+	codec := NewFrameCodec()
+	frame := codec.EncodeDataMessage(1, 0, bytes.Repeat([]byte{0x55, dle}, size/2))
+	d := codec.NewDecoder()
+	handle := func(f *FrameInfo, err error) {
+		if err != nil || !f.CRCValid {
+			b.Fatal("invalid frame")
+		}
+	}
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		d.Decode(frame, handle)
+	}
+}
+
+func BenchmarkEncode64(b *testing.B)   { benchmarkEncode(b, 64) }
+func BenchmarkEncode1024(b *testing.B) { benchmarkEncode(b, 1024) }
+
+func BenchmarkDecode64(b *testing.B)   { benchmarkDecode(b, 64) }
+func BenchmarkDecode1024(b *testing.B) { benchmarkDecode(b, 1024) }
+
+func BenchmarkWrite64(b *testing.B)   { benchmarkWrite(b, 64) }
+func BenchmarkWrite1024(b *testing.B) { benchmarkWrite(b, 1024) }
+
+func BenchmarkRead64(b *testing.B)   { benchmarkRead(b, 64) }
+func BenchmarkRead1024(b *testing.B) { benchmarkRead(b, 1024) }
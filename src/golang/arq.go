@@ -0,0 +1,101 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"time"
+)
+
+//####################//
+//### ARQ Strategy ###//
+//####################//
+
+// ARQReason defines why a retransmission of a data message is considered.
+type ARQReason int
+
+const (
+	// ARQReasonNone is set for the first transmission of a data message.
+	ARQReasonNone ARQReason = iota
+
+	// ARQReasonNak is set if the peer responded with a negative acknowledge.
+	ARQReasonNak
+
+	// ARQReasonResendRequest is set if the peer requested a resend of the data message.
+	ARQReasonResendRequest
+
+	// ARQReasonTimeout is set if the peer did not respond in time.
+	ARQReasonTimeout
+)
+
+// An ARQAttempt describes the transmission state of a single data message.
+type ARQAttempt struct {
+	// MSN is the message sequence number of the data message.
+	MSN byte
+
+	// Transmissions is the number of transmissions done so far.
+	Transmissions int
+
+	// Reason is the reason of the latest retransmission decision.
+	Reason ARQReason
+
+	// NakReason is the reason of the peer, if the latest
+	// retransmission decision is a negative acknowledge.
+	NakReason NakReason
+
+	// Since is the time of the first transmission.
+	Since time.Time
+}
+
+// An ARQStrategy decides when a data message is retransmitted,
+// how long to wait for the response of the peer and when to give up.
+// The methods are only called by the write routine of a port.
+// Stateful strategies must not be shared between ports.
+type ARQStrategy interface {
+	// Timeout returns the duration to wait for the response of the peer
+	// after a transmission. A duration <= 0 waits forever.
+	Timeout(a ARQAttempt) time.Duration
+
+	// Retransmit returns true if the data message should be transmitted again.
+	// Return false to give up the transmission. The peer is then told
+	// to discard any partially received data.
+	Retransmit(a ARQAttempt) bool
+}
+
+// StopAndWait is the default ARQ strategy. Each data message is
+// retransmitted until it is acknowledged by the peer or the
+// maximum number of retransmissions is reached.
+type StopAndWait struct {
+	// ResendTimeout is the duration after which an unanswered
+	// data message is retransmitted. Zero waits forever.
+	ResendTimeout time.Duration
+
+	// MaxRetries is the maximum number of retransmissions.
+	// Zero retries forever.
+	MaxRetries int
+}
+
+// Timeout implements the ARQStrategy interface.
+func (s StopAndWait) Timeout(a ARQAttempt) time.Duration {
+	return s.ResendTimeout
+}
+
+// Retransmit implements the ARQStrategy interface.
+func (s StopAndWait) Retransmit(a ARQAttempt) bool {
+	return s.MaxRetries <= 0 || a.Transmissions <= s.MaxRetries
+}
@@ -0,0 +1,336 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package bench measures the link performance between two ANTS ports.
+// The results are returned as structured values, so CI jobs and acceptance
+// tests can assert on the minimum link performance.
+// Both ports must not be used by other routines during a measurement.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+const (
+	headerSize = 8 // Sequence number of the benchmark data chunk.
+
+	defaultMessages = 100
+	defaultSize     = 256
+	defaultTimeout  = 5 * time.Second
+)
+
+var (
+	// ErrMismatch is returned if a received data chunk
+	// does not match the transmitted one.
+	ErrMismatch = errors.New("received data chunk does not match the transmitted data chunk")
+)
+
+//###################//
+//### Config type ###//
+//###################//
+
+// A Config represents the benchmark configuration.
+type Config struct {
+	// Messages is the number of transmitted data chunks.
+	// The default is 100.
+	Messages int
+
+	// Size is the size of each data chunk in bytes. The minimum is 8 bytes.
+	// The default is 256 bytes.
+	Size int
+
+	// Timeout is the maximum duration to wait for each data chunk.
+	// The default is 5 seconds.
+	Timeout time.Duration
+}
+
+// setDefaults sets the default values for unset variables.
+func (c *Config) setDefaults() {
+	if c.Messages <= 0 {
+		c.Messages = defaultMessages
+	}
+	if c.Size < headerSize {
+		c.Size = defaultSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+}
+
+//###################//
+//### Result type ###//
+//###################//
+
+// A Result holds the measured link performance.
+type Result struct {
+	// Messages is the number of transmitted data chunks
+	// and Bytes the number of their transmitted data bytes.
+	Messages int
+	Bytes    int64
+
+	// Duration is the total duration of the measurement.
+	Duration time.Duration
+
+	// Throughput is the payload throughput in bytes per second.
+	Throughput float64
+
+	// Latency is the distribution of the durations between
+	// writing a data chunk and reading it on the peer.
+	Latency Distribution
+
+	// DataMessagesSent and Retransmissions are the data message
+	// transmissions of the sending port during the measurement.
+	DataMessagesSent uint64
+	Retransmissions  uint64
+
+	// RetransmitOverhead is the ratio of retransmitted data messages
+	// to all transmitted data messages.
+	RetransmitOverhead float64
+}
+
+// A Distribution is a latency distribution.
+type Distribution struct {
+	Min  time.Duration
+	Max  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+}
+
+//##############//
+//### Public ###//
+//##############//
+
+// Throughput measures the throughput from the sender to the receiver.
+// All data chunks are queued at once. The latencies include the queuing delay.
+// If the context is done before, then the context's error is returned.
+func Throughput(ctx context.Context, sender, receiver *ants.Port, config ...*Config) (*Result, error) {
+	c := getConfig(config)
+	m := newMeasurement(sender, c)
+
+	// Queue the data chunks.
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < c.Messages; i++ {
+			m.sent[i] = time.Now()
+			if err := sender.Write(m.payload(i)); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	for i := 0; i < c.Messages; i++ {
+		if err := m.receive(ctx, receiver, i); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := <-writeErr; err != nil {
+		return nil, fmt.Errorf("failed to write data chunk: %v", err)
+	}
+
+	return m.result(ctx)
+}
+
+// Latency measures the latency distribution from the sender to the receiver.
+// The data chunks are transmitted one after another, so the latencies
+// contain no queuing delay. If the context is done before, then the
+// context's error is returned.
+func Latency(ctx context.Context, sender, receiver *ants.Port, config ...*Config) (*Result, error) {
+	c := getConfig(config)
+	m := newMeasurement(sender, c)
+
+	for i := 0; i < c.Messages; i++ {
+		m.sent[i] = time.Now()
+		if err := sender.Write(m.payload(i)); err != nil {
+			return nil, fmt.Errorf("failed to write data chunk: %v", err)
+		}
+
+		if err := m.receive(ctx, receiver, i); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.result(ctx)
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// getConfig returns the passed config or a new default config.
+func getConfig(config []*Config) *Config {
+	c := &Config{}
+	if len(config) > 0 && config[0] != nil {
+		*c = *config[0]
+	}
+	c.setDefaults()
+	return c
+}
+
+// measurement holds the state of a running benchmark.
+type measurement struct {
+	config *Config
+	sender *ants.Port
+	start  time.Time
+	stats  ants.StatsSnapshot
+
+	// Write and read times of each data chunk.
+	sent     []time.Time
+	received []time.Time
+}
+
+func newMeasurement(sender *ants.Port, c *Config) *measurement {
+	return &measurement{
+		config:   c,
+		sender:   sender,
+		start:    time.Now(),
+		stats:    sender.Stats().Snapshot(),
+		sent:     make([]time.Time, c.Messages),
+		received: make([]time.Time, c.Messages),
+	}
+}
+
+// payload returns the data chunk with the sequence number i.
+func (m *measurement) payload(i int) []byte {
+	data := make([]byte, m.config.Size)
+	binary.LittleEndian.PutUint64(data, uint64(i))
+	for j := headerSize; j < len(data); j++ {
+		data[j] = byte(i + j)
+	}
+	return data
+}
+
+// receive reads and verifies the data chunk with the sequence number i.
+func (m *measurement) receive(ctx context.Context, receiver *ants.Port, i int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := receiver.Read(m.config.Timeout)
+	if err != nil {
+		return fmt.Errorf("failed to read data chunk %v: %v", i, err)
+	}
+	m.received[i] = time.Now()
+
+	if len(data) != m.config.Size || binary.LittleEndian.Uint64(data) != uint64(i) {
+		return ErrMismatch
+	}
+	for j := headerSize; j < len(data); j++ {
+		if data[j] != byte(i+j) {
+			return ErrMismatch
+		}
+	}
+
+	return nil
+}
+
+// waitForAcknowledges waits until the sender received the acknowledges
+// of all data chunks. The sender updates its statistics after a data
+// message was written, which might be after the peer read it.
+func (m *measurement) waitForAcknowledges(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	timeout := time.NewTimer(m.config.Timeout)
+	defer timeout.Stop()
+
+	for m.sender.PendingWrites() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("failed to wait for the acknowledges: %v", ants.ErrTimeout)
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// result evaluates the measurement, as soon as all data chunks were
+// acknowledged. If the context is done before, then the context's
+// error is returned.
+func (m *measurement) result(ctx context.Context) (*Result, error) {
+	// The measurement ends with the last received data chunk.
+	r := &Result{
+		Messages: m.config.Messages,
+		Bytes:    int64(m.config.Messages) * int64(m.config.Size),
+		Duration: m.received[len(m.received)-1].Sub(m.start),
+	}
+
+	if err := m.waitForAcknowledges(ctx); err != nil {
+		return nil, err
+	}
+
+	if r.Duration > 0 {
+		r.Throughput = float64(r.Bytes) / r.Duration.Seconds()
+	}
+
+	latencies := make([]time.Duration, len(m.sent))
+	for i := range m.sent {
+		latencies[i] = m.received[i].Sub(m.sent[i])
+	}
+	r.Latency = newDistribution(latencies)
+
+	d := m.sender.Stats().Snapshot().Delta(m.stats)
+	r.DataMessagesSent = d.DataMessagesSent
+	r.Retransmissions = d.Retransmissions
+	if d.DataMessagesSent > 0 {
+		r.RetransmitOverhead = float64(d.Retransmissions) / float64(d.DataMessagesSent)
+	}
+
+	return r, nil
+}
+
+// newDistribution computes the distribution of the latencies.
+func newDistribution(latencies []time.Duration) Distribution {
+	if len(latencies) == 0 {
+		return Distribution{}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+
+	return Distribution{
+		Min:  latencies[0],
+		Max:  latencies[len(latencies)-1],
+		Mean: sum / time.Duration(len(latencies)),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P99:  percentile(99),
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package bench
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDistribution(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	l := newDistribution(latencies)
+	require.Equal(t, time.Millisecond, l.Min)
+	require.Equal(t, 100*time.Millisecond, l.Max)
+	require.Equal(t, 50500*time.Microsecond, l.Mean)
+	require.Equal(t, 50*time.Millisecond, l.P50)
+	require.Equal(t, 90*time.Millisecond, l.P90)
+	require.Equal(t, 99*time.Millisecond, l.P99)
+}
+
+func TestLatency(t *testing.T) {
+	a, b := net.Pipe()
+	pa, pb := ants.NewPort(a), ants.NewPort(b)
+	defer pa.Close()
+	defer pb.Close()
+
+	r, err := Latency(context.Background(), pa, pb, &Config{Messages: 1, Size: 64, Timeout: time.Second})
+	require.NoError(t, err)
+	require.Equal(t, 1, r.Messages)
+	require.Equal(t, int64(64), r.Bytes)
+	require.True(t, r.Throughput > 0)
+	require.True(t, r.Latency.Max > 0)
+	require.Equal(t, uint64(1), r.DataMessagesSent)
+	require.Equal(t, 0.0, r.RetransmitOverhead)
+}
+
+// baud921600 is the byte rate of a 921600 baud serial line with 8N1 framing.
+const baud921600 = 921600 / 10
+
+func benchmarkThroughput(b *testing.B, link *testutil.Config, config *ants.Config) {
+	sa, sb := testutil.NewPipePair(link)
+	pa, pb := ants.NewPort(sa, config), ants.NewPort(sb, config)
+	defer pa.Close()
+	defer pb.Close()
+
+	b.SetBytes(1024)
+	b.ResetTimer()
+
+	r, err := Throughput(context.Background(), pa, pb, &Config{Messages: b.N, Size: 1024})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if link.Bandwidth > 0 {
+		b.ReportMetric(r.Throughput/float64(link.Bandwidth), "utilization")
+	}
+	b.ReportMetric(r.RetransmitOverhead, "retransmit-overhead")
+}
+
+// BenchmarkThroughput measures the end-to-end throughput over an unlimited
+// in-memory link and whether a 921600 baud link is saturated.
+func BenchmarkThroughput(b *testing.B) {
+	b.Run("Loopback", func(b *testing.B) {
+		benchmarkThroughput(b, &testutil.Config{}, &ants.Config{})
+	})
+	b.Run("921600/StopAndWait", func(b *testing.B) {
+		benchmarkThroughput(b, &testutil.Config{Bandwidth: baud921600, Latency: time.Millisecond}, &ants.Config{})
+	})
+	b.Run("921600/Window8", func(b *testing.B) {
+		benchmarkThroughput(b, &testutil.Config{Bandwidth: baud921600, Latency: time.Millisecond}, &ants.Config{SendWindow: 8})
+	})
+}
+
+// BenchmarkLatencyRetransmission measures the latency distribution
+// of a 921600 baud link, which corrupts one of 2000 bytes.
+func BenchmarkLatencyRetransmission(b *testing.B) {
+	sa, sb := testutil.NewPipePair(&testutil.Config{
+		Bandwidth: baud921600,
+		Latency:   time.Millisecond,
+		ErrorRate: 0.0005,
+		Seed:      1,
+	})
+	config := &ants.Config{AckTimeout: 20 * time.Millisecond}
+	pa, pb := ants.NewPort(sa, config), ants.NewPort(sb, config)
+	defer pa.Close()
+	defer pb.Close()
+
+	b.SetBytes(256)
+	b.ResetTimer()
+
+	r, err := Latency(context.Background(), pa, pb, &Config{Messages: b.N})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportMetric(float64(r.Latency.P50)/float64(time.Millisecond), "p50-ms")
+	b.ReportMetric(float64(r.Latency.P99)/float64(time.Millisecond), "p99-ms")
+	b.ReportMetric(r.RetransmitOverhead, "retransmit-overhead")
+}
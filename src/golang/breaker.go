@@ -0,0 +1,171 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerWindow   = 20
+	defaultBreakerCooldown = 10 * time.Second
+	breakerProbeTimeout    = 2 * time.Second
+)
+
+//####################//
+//### Breaker type ###//
+//####################//
+
+// breaker is a circuit breaker, which stops accepting writes after sustained
+// transmission failures. After a cool-down period the link is probed with a
+// ping before the writes are accepted again.
+type breaker struct {
+	port *Port
+
+	mutex       sync.Mutex
+	isOpen      bool
+	consecutive int    // Consecutive failed data chunks.
+	results     []bool // Ring buffer of the recent transmission results. True on failure.
+	resultsPos  int
+}
+
+// newBreaker returns nil if the circuit breaker is disabled.
+func newBreaker(p *Port) *breaker {
+	if p.config.BreakerFailures <= 0 && p.config.BreakerFailureRate <= 0 {
+		return nil
+	}
+
+	return &breaker{
+		port:    p,
+		results: make([]bool, 0, p.config.BreakerWindow),
+	}
+}
+
+// allow returns ErrBreakerOpen if the breaker is open.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	// Lock the mutex.
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.isOpen {
+		return ErrBreakerOpen
+	}
+	return nil
+}
+
+// record adds the result of a data chunk transmission
+// and opens the breaker if a threshold is exceeded.
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	// Lock the mutex.
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.isOpen {
+		return
+	}
+
+	// Update the consecutive failures.
+	if failed {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	// Update the ring buffer of the recent results.
+	if len(b.results) < cap(b.results) {
+		b.results = append(b.results, failed)
+	} else {
+		b.results[b.resultsPos] = failed
+		b.resultsPos = (b.resultsPos + 1) % len(b.results)
+	}
+
+	c := b.port.config
+	trip := c.BreakerFailures > 0 && b.consecutive >= c.BreakerFailures
+	if !trip && c.BreakerFailureRate > 0 && len(b.results) == cap(b.results) {
+		failures := 0
+		for _, f := range b.results {
+			if f {
+				failures++
+			}
+		}
+		trip = float64(failures)/float64(len(b.results)) >= c.BreakerFailureRate
+	}
+	if !trip {
+		return
+	}
+
+	// Open the breaker and reset the counters for the next period.
+	b.isOpen = true
+	b.consecutive = 0
+	b.results = b.results[:0]
+	b.resultsPos = 0
+
+	b.port.log.Warningf("circuit breaker: transmission failures exceeded the threshold: pausing writes for %v", c.BreakerCooldown)
+	b.port.emitEvent(EventBreakerOpened, "pausing writes for %v after sustained transmission failures", c.BreakerCooldown)
+
+	go b.probeLoop()
+}
+
+// probeLoop waits for the cool-down period and probes the link
+// until the peer responds. The breaker is closed afterwards.
+func (b *breaker) probeLoop() {
+	p := b.port
+	timer := time.NewTimer(p.config.BreakerCooldown)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.closeChan:
+			return
+		case <-timer.C:
+		}
+
+		// Probe the link.
+		ctx, cancel := context.WithTimeout(context.Background(), breakerProbeTimeout)
+		_, err := p.Ping(ctx)
+		cancel()
+
+		if err == ErrClosed {
+			return
+		} else if err != nil {
+			b.port.log.Debugf("circuit breaker: probe failed: %v", err)
+			timer.Reset(p.config.BreakerCooldown)
+			continue
+		}
+
+		// Lock the mutex.
+		b.mutex.Lock()
+		b.isOpen = false
+		b.mutex.Unlock()
+
+		b.port.log.Debugf("circuit breaker: probe succeeded: resuming writes")
+		p.emitEvent(EventBreakerClosed, "link probe succeeded: resuming writes")
+		return
+	}
+}
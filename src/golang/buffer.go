@@ -0,0 +1,127 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"sync"
+)
+
+const (
+	// maxPooledBufferSize is the maximum capacity of a buffer, which is
+	// returned to the pool. Larger buffers are left to the garbage collector.
+	maxPooledBufferSize = 64 * 1024
+)
+
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} { return new(Buffer) },
+	}
+
+	frameBufferPool = sync.Pool{
+		New: func() interface{} { return new(frameBuffer) },
+	}
+)
+
+//###################//
+//### Buffer type ###//
+//###################//
+
+// A Buffer is a reusable payload buffer. Obtain it with GetBuffer, append
+// the data chunk to B and pass it to Port.WriteBuffer, which returns the
+// buffer to the pool once the data chunk was written. High-rate senders
+// avoid an allocation per data chunk this way.
+type Buffer struct {
+	B []byte
+}
+
+// GetBuffer returns an empty buffer from the pool.
+func GetBuffer() *Buffer {
+	b := bufferPool.Get().(*Buffer)
+	b.B = b.B[:0]
+	return b
+}
+
+// Release returns the buffer to the pool.
+// The buffer must not be used afterwards.
+func (b *Buffer) Release() {
+	if b == nil {
+		return
+	}
+
+	if cap(b.B) > maxPooledBufferSize {
+		b.B = nil
+	}
+	bufferPool.Put(b)
+}
+
+//########################//
+//### frameBuffer type ###//
+//########################//
+
+// frameBuffer holds the unescaped message body followed by the escaped
+// frame of a message. It is reused to avoid allocations per message.
+type frameBuffer struct {
+	b []byte
+}
+
+// getFrameBuffer returns a frame buffer from the pool.
+func getFrameBuffer() *frameBuffer {
+	return frameBufferPool.Get().(*frameBuffer)
+}
+
+// release returns the frame buffer to the pool.
+// The encoded frame must not be used afterwards.
+func (b *frameBuffer) release() {
+	if b == nil {
+		return
+	}
+
+	if cap(b.b) > maxPooledBufferSize {
+		b.b = nil
+	}
+	frameBufferPool.Put(b)
+}
+
+// grow ensures the capacity for an unescaped message body of n bytes
+// and its escaped frame, so the encoding never reallocates.
+func (b *frameBuffer) grow(n int) {
+	// Each byte is escaped at most once. The frame adds four control characters.
+	n = 3*n + 4
+	if cap(b.b) < n {
+		b.b = make([]byte, 0, n)
+	}
+}
+
+// frame appends the escaped frame of the unescaped message body to the body.
+// The protocol start character is transmitted with the framing characters.
+// The body must be located at the start of the frame buffer.
+// Returns the frame, which is valid until the buffer is released.
+func (b *frameBuffer) frame(chars *FramingCharacters, startCharacter byte, body []byte) []byte {
+	// Prepend the escaped start control character.
+	buf := append(body, chars.DLE, chars.wire(startCharacter))
+
+	// Escape the message body.
+	buf = appendEscaped(buf, body, chars.DLE)
+
+	// Append the escaped ETX control character.
+	buf = append(buf, chars.DLE, chars.ETX)
+
+	b.b = buf
+	return buf[len(body):]
+}
@@ -0,0 +1,115 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package capture records the frames of an ANTS port with timestamps
+// for post-mortem analysis of field failures. Captures are written in the
+// pcapng file format with the user defined link type LinkType, so they can
+// be opened with Wireshark and decoded with a custom dissector.
+// The Reader decodes the recorded frames again.
+package capture
+
+import (
+	"errors"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+const (
+	// LinkType is the pcapng link type of the recorded frames.
+	// It is the first link type reserved for private use (LINKTYPE_USER0).
+	LinkType = 147
+)
+
+var (
+	// ErrInvalidFormat is returned if the capture is no valid pcapng file.
+	ErrInvalidFormat = errors.New("capture: invalid format")
+)
+
+//######################//
+//### Direction type ###//
+//######################//
+
+// A Direction defines whether a frame was sent or received.
+type Direction int
+
+const (
+	// DirectionUnknown is set if the capture contains no direction.
+	DirectionUnknown Direction = iota
+
+	// Received frames were read from the source.
+	Received
+
+	// Sent frames were written to the source.
+	Sent
+)
+
+// String returns the name of the direction.
+func (d Direction) String() string {
+	switch d {
+	case Received:
+		return "received"
+	case Sent:
+		return "sent"
+	default:
+		return "unknown"
+	}
+}
+
+//###################//
+//### Record type ###//
+//###################//
+
+// A Record is a captured frame.
+type Record struct {
+	// Time is the point in time the frame was captured.
+	Time time.Time
+
+	// Direction of the frame.
+	Direction Direction
+
+	// Frame is the escaped frame including the DLE control
+	// characters, the address header and the CRC checksum.
+	Frame []byte
+}
+
+//##############//
+//### Attach ###//
+//##############//
+
+// Attach sets the raw frame hooks of the port config to record all
+// sent and received frames with the writer. Already set hooks are
+// still called. Pass the config to ants.NewPort afterwards.
+// Write errors are returned by Writer.Err.
+func Attach(config *ants.Config, w *Writer) {
+	onSent := config.OnRawFrameSent
+	config.OnRawFrameSent = func(frame []byte) {
+		w.record(Sent, frame)
+		if onSent != nil {
+			onSent(frame)
+		}
+	}
+
+	onReceived := config.OnRawFrameReceived
+	config.OnRawFrameReceived = func(frame []byte) {
+		w.record(Received, frame)
+		if onReceived != nil {
+			onReceived(frame)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	require.NoError(t, err)
+
+	now := time.Unix(1444000000, 123456789)
+	records := []Record{
+		{Time: now, Direction: Sent, Frame: []byte{0x10, 0x02, 0x01, 0x10, 0x03}},
+		{Time: now.Add(time.Millisecond), Direction: Received, Frame: []byte{0x10, 0x06, 0x01, 0xaa, 0xbb, 0x10, 0x03}},
+		{Time: now.Add(time.Second), Frame: []byte{0x10, 0x15, 0x03}},
+	}
+	for _, rec := range records {
+		require.NoError(t, w.WriteRecord(rec))
+	}
+	require.Zero(t, buf.Len()%4)
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	for _, rec := range records {
+		got, err := r.Next()
+		require.NoError(t, err)
+		require.True(t, rec.Time.Equal(got.Time))
+		require.Equal(t, rec.Direction, got.Direction)
+		require.Equal(t, rec.Frame, got.Frame)
+	}
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Other files are rejected.
+	_, err = NewReader(bytes.NewReader([]byte("no pcapng file")))
+	require.Equal(t, ErrInvalidFormat, err)
+	_, err = NewReader(bytes.NewReader(nil))
+	require.Equal(t, ErrInvalidFormat, err)
+}
+
+func TestAttach(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ants.pcapng")
+	w, err := Create(name)
+	require.NoError(t, err)
+
+	a, b := net.Pipe()
+	config := &ants.Config{}
+	Attach(config, w)
+	pa := ants.NewPort(a, config)
+	pb := ants.NewPort(b)
+
+	// Exchange data messages in both directions.
+	require.NoError(t, pa.Write([]byte("ping")))
+	data, err := pb.Read()
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), data)
+
+	require.NoError(t, pb.Write([]byte("pong")))
+	data, err = pa.Read()
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), data)
+
+	require.NoError(t, pa.Close())
+	require.NoError(t, pb.Close())
+	require.NoError(t, w.Err())
+	require.NoError(t, w.Close())
+
+	// Both directions were recorded.
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := NewReader(f)
+	require.NoError(t, err)
+
+	count := map[Direction]int{}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, byte(0x10), rec.Frame[0])
+		count[rec.Direction]++
+	}
+	require.NotZero(t, count[Sent])
+	require.NotZero(t, count[Received])
+	require.Zero(t, count[DirectionUnknown])
+}
@@ -0,0 +1,283 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	// maxBlockLength limits the memory allocated for a single block.
+	maxBlockLength = 16 * 1024 * 1024
+
+	// defaultTSResol is the timestamp resolution of interfaces
+	// without a resolution option (10^-6 seconds).
+	defaultTSResol = 6
+)
+
+//###################//
+//### Reader type ###//
+//###################//
+
+// A Reader reads captured frames from a pcapng file.
+// Packets of interfaces with another link type than LinkType are skipped.
+type Reader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []readerInterface
+}
+
+// readerInterface is an interface described in the current section.
+type readerInterface struct {
+	linkType uint16
+	tsUnit   float64 // Duration of a timestamp unit in nanoseconds.
+}
+
+// NewReader creates a new capture reader and reads the pcapng file header.
+// Returns ErrInvalidFormat if the file is no pcapng file.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{
+		r: r,
+	}
+
+	// The file starts with a section header block.
+	blockType, _, err := cr.readBlock()
+	if err == io.EOF {
+		return nil, ErrInvalidFormat
+	} else if err != nil {
+		return nil, err
+	} else if blockType != blockSectionHeader {
+		return nil, ErrInvalidFormat
+	}
+	cr.startSection()
+
+	return cr, nil
+}
+
+// Next returns the next captured frame.
+// Returns io.EOF at the end of the capture.
+func (r *Reader) Next() (Record, error) {
+	for {
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return Record{}, err
+		}
+
+		switch blockType {
+		case blockSectionHeader:
+			r.startSection()
+
+		case blockInterfaceDescription:
+			if len(body) < 8 {
+				return Record{}, ErrInvalidFormat
+			}
+			r.interfaces = append(r.interfaces, r.parseInterface(body))
+
+		case blockEnhancedPacket:
+			rec, ok, err := r.parsePacket(body)
+			if err != nil {
+				return Record{}, err
+			} else if ok {
+				return rec, nil
+			}
+		}
+
+		// Skip all other blocks.
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// readBlock reads the next block and returns its type and body.
+// The byte order is detected by the section header blocks.
+func (r *Reader) readBlock() (blockType uint32, body []byte, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrInvalidFormat
+		}
+		return
+	}
+
+	// The block type of the section header block is a palindrome.
+	// Its byte order magic defines the byte order of the section.
+	if binary.LittleEndian.Uint32(header[:4]) == blockSectionHeader {
+		var magic [4]byte
+		if _, err = io.ReadFull(r.r, magic[:]); err != nil {
+			return 0, nil, ErrInvalidFormat
+		}
+
+		switch {
+		case binary.LittleEndian.Uint32(magic[:]) == byteOrderMagic:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic[:]) == byteOrderMagic:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, ErrInvalidFormat
+		}
+
+		body, err = r.readBlockBody(header[4:], 12)
+		return blockSectionHeader, body, err
+	} else if r.order == nil {
+		return 0, nil, ErrInvalidFormat
+	}
+
+	blockType = r.order.Uint32(header[:4])
+	body, err = r.readBlockBody(header[4:], 8)
+	return
+}
+
+// readBlockBody reads the remaining bytes of the block and validates the block length.
+// The read bytes are the number of already consumed bytes of the block.
+func (r *Reader) readBlockBody(rawLength []byte, read int) ([]byte, error) {
+	length := r.order.Uint32(rawLength)
+	if length < uint32(read)+4 || length%4 != 0 || length > maxBlockLength {
+		return nil, ErrInvalidFormat
+	}
+
+	buf := make([]byte, int(length)-read)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, ErrInvalidFormat
+	}
+
+	// The trailing block length must match.
+	pos := len(buf) - 4
+	if r.order.Uint32(buf[pos:]) != length {
+		return nil, ErrInvalidFormat
+	}
+
+	return buf[:pos], nil
+}
+
+// startSection starts a new section.
+// The interface IDs are scoped to a section.
+func (r *Reader) startSection() {
+	r.interfaces = r.interfaces[:0]
+}
+
+// parseInterface parses the body of an interface description block.
+func (r *Reader) parseInterface(body []byte) readerInterface {
+	i := readerInterface{
+		linkType: r.order.Uint16(body[0:2]),
+		tsUnit:   math.Pow10(9 - defaultTSResol),
+	}
+
+	r.forEachOption(body[8:], func(code uint16, value []byte) {
+		if code != optIfTSResol || len(value) < 1 {
+			return
+		}
+
+		// The most significant bit selects a power of two resolution.
+		// Otherwise it is a power of ten.
+		if v := value[0]; v&0x80 != 0 {
+			i.tsUnit = 1e9 / math.Pow(2, float64(v&0x7f))
+		} else {
+			i.tsUnit = 1e9 / math.Pow10(int(v))
+		}
+	})
+
+	return i
+}
+
+// parsePacket parses the body of an enhanced packet block.
+// Returns false if the packet was captured on an interface with another link type.
+func (r *Reader) parsePacket(body []byte) (rec Record, ok bool, err error) {
+	if len(body) < 20 {
+		return rec, false, ErrInvalidFormat
+	}
+
+	id := r.order.Uint32(body[0:4])
+	if id >= uint32(len(r.interfaces)) {
+		return rec, false, ErrInvalidFormat
+	}
+	iface := r.interfaces[id]
+	if iface.linkType != LinkType {
+		return rec, false, nil
+	}
+
+	ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+	capLen := int(r.order.Uint32(body[12:16]))
+	if capLen > len(body)-20 {
+		return rec, false, ErrInvalidFormat
+	}
+
+	// Convert the timestamp to nanoseconds.
+	// Skip the float conversion for the common resolutions to keep the precision.
+	var nsec int64
+	switch iface.tsUnit {
+	case 1:
+		nsec = int64(ts)
+	case 1e3:
+		nsec = int64(ts) * 1e3
+	default:
+		nsec = int64(float64(ts) * iface.tsUnit)
+	}
+
+	rec = Record{
+		Time:  time.Unix(0, nsec),
+		Frame: append([]byte(nil), body[20:20+capLen]...),
+	}
+
+	// The options follow the packet data padded to 32 bits.
+	if end := 20 + (capLen+3)&^3; end < len(body) {
+		r.forEachOption(body[end:], func(code uint16, value []byte) {
+			if code != optEPBFlags || len(value) < 4 {
+				return
+			}
+			switch r.order.Uint32(value) & epbDirectionMask {
+			case epbFlagInbound:
+				rec.Direction = Received
+			case epbFlagOutbound:
+				rec.Direction = Sent
+			}
+		})
+	}
+
+	return rec, true, nil
+}
+
+// forEachOption calls f for each option of the options field.
+// Malformed options end the iteration.
+func (r *Reader) forEachOption(b []byte, f func(code uint16, value []byte)) {
+	for len(b) >= 4 {
+		code := r.order.Uint16(b[0:2])
+		length := int(r.order.Uint16(b[2:4]))
+		if code == optEndOfOptions {
+			return
+		}
+
+		b = b[4:]
+		if length > len(b) {
+			return
+		}
+		f(code, b[:length])
+
+		// Skip the value padded to 32 bits.
+		length = (length + 3) &^ 3
+		if length > len(b) {
+			return
+		}
+		b = b[length:]
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// pcapng block types.
+	blockSectionHeader        = 0x0a0d0d0a
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	// byteOrderMagic of the section header block.
+	byteOrderMagic = 0x1a2b3c4d
+
+	// pcapng option codes.
+	optEndOfOptions = 0
+	optIfTSResol    = 9 // Interface description block.
+	optEPBFlags     = 2 // Enhanced packet block.
+
+	// tsResolNanoseconds is the timestamp resolution of the
+	// written captures (10^-9 seconds).
+	tsResolNanoseconds = 9
+
+	// Direction bits of the enhanced packet block flags.
+	epbFlagInbound   = 1
+	epbFlagOutbound  = 2
+	epbDirectionMask = 3
+)
+
+//###################//
+//### Writer type ###//
+//###################//
+
+// A Writer writes captured frames in the pcapng file format.
+// It is safe to use a writer from multiple goroutines.
+type Writer struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	buf    []byte
+	err    error
+}
+
+// NewWriter creates a new capture writer and writes the pcapng file header.
+func NewWriter(w io.Writer) (*Writer, error) {
+	cw := &Writer{
+		w: w,
+	}
+
+	// Write the section header block.
+	// The section length is unspecified (-1).
+	b := cw.beginBlock(blockSectionHeader)
+	b = binary.LittleEndian.AppendUint32(b, byteOrderMagic)
+	b = binary.LittleEndian.AppendUint16(b, 1) // Major version.
+	b = binary.LittleEndian.AppendUint16(b, 0) // Minor version.
+	b = binary.LittleEndian.AppendUint64(b, 0xffffffffffffffff)
+	b = endBlock(b)
+
+	// Write the interface description block.
+	// The timestamps are recorded in nanoseconds.
+	b = appendBlockHeader(b, blockInterfaceDescription)
+	start := len(b) - 8
+	b = binary.LittleEndian.AppendUint16(b, LinkType)
+	b = binary.LittleEndian.AppendUint16(b, 0) // Reserved.
+	b = binary.LittleEndian.AppendUint32(b, 0) // No snapshot length limit.
+	b = appendOption(b, optIfTSResol, []byte{tsResolNanoseconds})
+	b = appendOption(b, optEndOfOptions, nil)
+	b = finishBlock(b, start)
+
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("capture: write header: %v", err)
+	}
+
+	return cw, nil
+}
+
+// Create creates the capture file with the given name.
+// The file is closed by Writer.Close.
+func Create(name string) (*Writer, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.closer = f
+
+	return w, nil
+}
+
+// WriteRecord writes the captured frame.
+func (w *Writer) WriteRecord(r Record) error {
+	// Lock the mutex.
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var flags uint32
+	switch r.Direction {
+	case Received:
+		flags = epbFlagInbound
+	case Sent:
+		flags = epbFlagOutbound
+	}
+
+	ts := uint64(r.Time.UnixNano())
+
+	// Write the enhanced packet block.
+	// The packet data is padded to 32 bits.
+	b := w.beginBlock(blockEnhancedPacket)
+	b = binary.LittleEndian.AppendUint32(b, 0) // Interface ID.
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(r.Frame))) // Captured length.
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(r.Frame))) // Original length.
+	b = append(b, r.Frame...)
+	b = pad(b)
+	if flags != 0 {
+		b = appendOption(b, optEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+		b = appendOption(b, optEndOfOptions, nil)
+	}
+	b = endBlock(b)
+	w.buf = b
+
+	if _, err := w.w.Write(b); err != nil {
+		return fmt.Errorf("capture: write record: %v", err)
+	}
+
+	return nil
+}
+
+// Err returns the first error of the frames recorded by the hooks set with Attach.
+func (w *Writer) Err() error {
+	// Lock the mutex.
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.err
+}
+
+// Close the capture file, if it was created with Create.
+// Writers created with NewWriter do not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// record writes the frame captured by an attached port.
+// Nothing is written after the first error.
+func (w *Writer) record(d Direction, frame []byte) {
+	if w.Err() != nil {
+		return
+	}
+
+	err := w.WriteRecord(Record{
+		Time:      time.Now(),
+		Direction: d,
+		Frame:     frame,
+	})
+	if err != nil {
+		w.mutex.Lock()
+		w.err = err
+		w.mutex.Unlock()
+	}
+}
+
+// beginBlock returns the reused block buffer with the block header.
+// The writer mutex must be locked or the writer must not be shared yet.
+func (w *Writer) beginBlock(blockType uint32) []byte {
+	return appendBlockHeader(w.buf[:0], blockType)
+}
+
+// appendBlockHeader appends the block type and a placeholder for the block length.
+func appendBlockHeader(b []byte, blockType uint32) []byte {
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	return binary.LittleEndian.AppendUint32(b, 0)
+}
+
+// endBlock finishes the only block in the buffer.
+func endBlock(b []byte) []byte {
+	return finishBlock(b, 0)
+}
+
+// finishBlock appends the trailing block length and
+// sets the leading block length of the block starting at start.
+func finishBlock(b []byte, start int) []byte {
+	length := uint32(len(b) - start + 4)
+	binary.LittleEndian.PutUint32(b[start+4:], length)
+	return binary.LittleEndian.AppendUint32(b, length)
+}
+
+// appendOption appends the option with the value padded to 32 bits.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return pad(b)
+}
+
+// pad appends zero bytes up to the next 32 bit boundary.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,193 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Flags, which are authenticated as additional data of an encrypted data chunk.
+	cipherAuthenticatedFlags = flagUrgent | flagService | flagDelta
+)
+
+// Errors:
+var (
+	// ErrAuthenticationFailed is returned by Cipher.Open if the
+	// ciphertext was tampered with or encrypted with another key.
+	ErrAuthenticationFailed = errors.New("message authentication failed")
+)
+
+//###################//
+//### Cipher type ###//
+//###################//
+
+// A Cipher encrypts and authenticates the binary data of the data chunks.
+// The CRC checksums still detect transmission errors, so corrupted data
+// messages are retransmitted. The cipher adds confidentiality and
+// detects data chunks, which were tampered with on a shared bus.
+// Set the cipher with Config.Cipher. Both peers have to use the same cipher.
+type Cipher interface {
+	// Overhead returns the maximum difference between
+	// the length of a ciphertext and its plaintext.
+	Overhead() int
+
+	// Seal encrypts and authenticates the plaintext and
+	// authenticates the additional data.
+	Seal(plaintext, additionalData []byte) ([]byte, error)
+
+	// Open authenticates and decrypts the ciphertext and authenticates
+	// the additional data. ErrAuthenticationFailed is returned if the
+	// ciphertext or the additional data were tampered with.
+	Open(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// NewAESGCMCipher creates an AES-GCM cipher with the pre-shared key.
+// The key has to be 16, 24 or 32 bytes long to select AES-128, AES-192
+// or AES-256. A random nonce is prepended to each ciphertext.
+// Enable Config.ReplayProtection to detect replayed data chunks.
+func NewAESGCMCipher(key []byte) (Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM cipher: %v", err)
+	}
+
+	return aeadCipher{aead: aead}, nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// aeadCipher is a cipher of an AEAD with a random nonce:
+// Nonce | Ciphertext | Tag
+type aeadCipher struct {
+	aead cipher.AEAD
+}
+
+func (c aeadCipher) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+func (c aeadCipher) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.Overhead()+len(plaintext))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %v", err)
+	}
+
+	return c.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (c aeadCipher) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < c.Overhead() {
+		return nil, ErrAuthenticationFailed
+	}
+
+	nonceSize := c.aead.NonceSize()
+	plaintext, err := c.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return plaintext, nil
+}
+
+// sealDataChunk encrypts the payload of a data chunk if a cipher is configured.
+// The returned flags mark the payload as encrypted.
+func (p *Port) sealDataChunk(flags byte, payload []byte) (byte, []byte, error) {
+	s, err := p.currentSession()
+	if err != nil {
+		return flags, nil, err
+	} else if s == nil {
+		return flags, payload, nil
+	}
+
+	var sealed []byte
+	if p.config.ReplayProtection {
+		sealed, err = s.sealReplayCounter(flags&cipherAuthenticatedFlags, payload)
+	} else {
+		sealed, err = s.cipher.Seal(payload, []byte{flags & cipherAuthenticatedFlags})
+	}
+	if err != nil {
+		return flags, nil, fmt.Errorf("failed to encrypt data chunk: %v", err)
+	}
+
+	return flags | flagEncrypted, sealed, nil
+}
+
+// discardUnauthenticatedDataChunk logs and reports a received data chunk,
+// which could not be decrypted. This method must be only called by the
+// read messages loop.
+func (p *Port) discardUnauthenticatedDataChunk(flags byte, err error) {
+	p.log.Warningf("read data: %v: discarding data chunk", err)
+	p.emitEvent(EventAuthenticationFailed, "discarded data chunk: %v", err)
+
+	// The peer assumes a successful transmission.
+	// Following delta encoded data chunks can't be decoded anymore.
+	// Replayed data chunks were not transmitted by the peer.
+	if flags&flagUrgent == 0 && err != errReplayedDataChunk {
+		p.readDeltaBase = nil
+	}
+}
+
+// openDataChunk decrypts the received payload of a data chunk. Unencrypted
+// data chunks are rejected if a cipher is configured, because they might
+// be injected by a third party.
+func (p *Port) openDataChunk(flags byte, payload []byte) ([]byte, error) {
+	open := func(s *session) ([]byte, error) {
+		if s == nil {
+			if flags&flagEncrypted != 0 {
+				return nil, fmt.Errorf("encrypted data chunk, but no cipher configured")
+			}
+			return payload, nil
+		} else if flags&flagEncrypted == 0 {
+			return nil, fmt.Errorf("unencrypted data chunk rejected")
+		}
+
+		if p.config.ReplayProtection {
+			return s.openReplayCounter(flags&cipherAuthenticatedFlags, payload)
+		}
+		return s.cipher.Open(payload, []byte{flags & cipherAuthenticatedFlags})
+	}
+
+	s, err := p.currentSession()
+	if err == nil {
+		var data []byte
+		data, err = open(s)
+		if err == nil || err == errReplayedDataChunk {
+			return data, err
+		}
+	}
+
+	// The peer might use the pending session,
+	// if its confirmation got lost.
+	if data, ok := p.openPendingSession(open); ok {
+		return data, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,92 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"time"
+)
+
+//##################//
+//### Clock type ###//
+//##################//
+
+// A Clock provides the time to the protocol timeouts of the port. Set a
+// virtual clock with Config.Clock to test the timeout behavior without
+// sleeping. The sim package provides one.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a timer, which sends the time on its channel
+	// after the duration.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc creates a timer, which calls f in its own goroutine
+	// after the duration. The channel of the timer is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a single event timer of a Clock.
+// It behaves like a time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false
+	// if the timer already expired or was stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after the duration.
+	// It returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// realClock is the default clock, which uses the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// newStoppedTimer creates a timer of the clock in a stopped state.
+func newStoppedTimer(c Clock) Timer {
+	t := c.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
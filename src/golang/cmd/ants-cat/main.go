@@ -0,0 +1,318 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Command ants-cat opens a serial port with the ANTS protocol and bridges
+// it to stdin and stdout or to a TCP client. Each input line is transmitted
+// as one data chunk and each received data chunk is written to the output.
+//
+// Usage:
+//
+//	ants-cat -port /dev/ttyUSB0 -baud 115200
+//	ants-cat -port /dev/ttyUSB0 -hex
+//	ants-cat -port /dev/ttyUSB0 -listen :4000
+//
+// In hexdump mode the input lines are parsed as hexadecimal bytes,
+// for example "01 02 ff", and the received data chunks are printed
+// as hexdump.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/serial"
+	"github.com/desertbit/ants/src/golang/tcp"
+)
+
+const (
+	closeTimeout = 5 * time.Second
+)
+
+var (
+	flagPort       = flag.String("port", "", "serial port name or path")
+	flagBaud       = flag.Int("baud", 115200, "serial port baudrate")
+	flagCRC        = flag.Int("crc", 16, "CRC type of data messages: 16 or 32")
+	flagControlCRC = flag.Int("control-crc", 16, "CRC type of control messages: 16 or 32")
+	flagHex        = flag.Bool("hex", false, "hexdump mode: parse input lines as hex bytes and dump the received data")
+	flagListen     = flag.String("listen", "", "bridge to a TCP client on this address instead of stdin and stdout")
+	flagVerbose    = flag.Bool("v", false, "log the protocol messages to stderr")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "ants-cat: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *flagPort == "" {
+		return errors.New("no serial port specified: set the -port flag")
+	}
+
+	dataCRC, err := parseCRCType(*flagCRC)
+	if err != nil {
+		return err
+	}
+	controlCRC, err := parseCRCType(*flagControlCRC)
+	if err != nil {
+		return err
+	}
+
+	config := &ants.Config{
+		DataMessageCRC:    dataCRC,
+		ControlMessageCRC: controlCRC,
+	}
+	if *flagVerbose {
+		config.Logger = ants.NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	}
+
+	source, err := serial.OpenPort(&serial.Config{
+		Name: *flagPort,
+		Baud: *flagBaud,
+	})
+	if err != nil {
+		return fmt.Errorf("open serial port: %v", err)
+	}
+
+	p := ants.NewPort(source, config)
+	defer p.Close()
+
+	// Close the port on interrupts.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		p.Close()
+	}()
+
+	b := newBridge(p, *flagHex)
+	go b.readLoop()
+
+	if *flagListen == "" {
+		b.setOutput(os.Stdout)
+
+		// The port might be closed while waiting for input.
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- b.writeLoop(os.Stdin)
+		}()
+
+		select {
+		case <-b.done:
+			return p.Err()
+		case err = <-errChan:
+			if err != nil {
+				return err
+			}
+		}
+
+		// Transmit the queued data before exiting.
+		err = p.CloseGracefully(closeTimeout)
+		if err == ants.ErrTimeout {
+			return errors.New("close: the peer did not acknowledge all data")
+		}
+		return err
+	}
+
+	return b.serve(*flagListen)
+}
+
+//###################//
+//### Bridge type ###//
+//###################//
+
+// A bridge passes the data chunks between the port and the current output.
+type bridge struct {
+	port *ants.Port
+	hex  bool
+
+	done chan struct{} // Closed if the port is closed.
+
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func newBridge(p *ants.Port, hexMode bool) *bridge {
+	return &bridge{
+		port: p,
+		hex:  hexMode,
+		done: make(chan struct{}),
+	}
+}
+
+// setOutput sets the writer of the received data chunks.
+// Data chunks received without output are discarded.
+func (b *bridge) setOutput(w io.Writer) {
+	// Lock the mutex.
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.out = w
+}
+
+// readLoop writes the received data chunks to the output
+// until the port is closed.
+func (b *bridge) readLoop() {
+	defer close(b.done)
+
+	for {
+		data, err := b.port.Read()
+		if err != nil {
+			return
+		}
+
+		if b.hex {
+			data = []byte(hex.Dump(data))
+		}
+
+		b.mutex.Lock()
+		if b.out != nil {
+			// Write errors of a disconnected client are handled by the write loop.
+			b.out.Write(data)
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// writeLoop transmits each line read from r as one data chunk.
+// Returns nil if r reached the end.
+func (b *bridge) writeLoop(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if werr := b.write(line); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read input: %v", err)
+		}
+	}
+}
+
+// write transmits the input line.
+// Invalid hex lines are reported and skipped.
+func (b *bridge) write(line []byte) error {
+	if b.hex {
+		data, err := parseHex(string(line))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ants-cat: %v\n", err)
+			return nil
+		} else if len(data) == 0 {
+			return nil
+		}
+		line = data
+	}
+
+	err := b.port.Write(line)
+	if err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+
+	return nil
+}
+
+// serve bridges the port to one TCP client at a time.
+func (b *bridge) serve(address string) error {
+	l, err := tcp.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	defer l.Close()
+
+	// Stop listening and disconnect the client if the port is closed.
+	go func() {
+		<-b.done
+		l.Close()
+
+		b.mutex.Lock()
+		if c, ok := b.out.(io.Closer); ok {
+			c.Close()
+		}
+		b.mutex.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if b.port.IsClosed() {
+				return b.port.Err()
+			}
+			return fmt.Errorf("accept: %v", err)
+		}
+
+		b.setOutput(conn)
+		err = b.writeLoop(conn)
+		b.setOutput(nil)
+		conn.Close()
+
+		if err != nil && b.port.IsClosed() {
+			return b.port.Err()
+		}
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// parseCRCType returns the CRC type of the flag value.
+func parseCRCType(bits int) (ants.CRCType, error) {
+	switch bits {
+	case 16:
+		return ants.CRC16, nil
+	case 32:
+		return ants.CRC32, nil
+	default:
+		return 0, fmt.Errorf("invalid CRC type: %v: use 16 or 32", bits)
+	}
+}
+
+// parseHex parses the hexadecimal bytes of the line.
+// The bytes may be separated by whitespace.
+func parseHex(line string) ([]byte, error) {
+	s := strings.Join(strings.Fields(line), "")
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex input: %v", err)
+	}
+
+	return data, nil
+}
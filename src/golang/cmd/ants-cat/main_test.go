@@ -0,0 +1,73 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridge(t *testing.T) {
+	a, b := net.Pipe()
+	pa := ants.NewPort(a)
+	pb := ants.NewPort(b)
+	defer pb.Close()
+
+	br := newBridge(pa, true)
+	go br.readLoop()
+
+	// Input lines are parsed as hex bytes.
+	// Invalid and empty lines are skipped.
+	err := br.writeLoop(strings.NewReader("zz\n\n01 02 ff\n"))
+	require.NoError(t, err)
+
+	data, err := pb.Read()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x01, 0x02, 0xff}, data)
+
+	// Received data chunks are dumped to the output.
+	r, w := io.Pipe()
+	br.setOutput(w)
+	require.NoError(t, pb.Write([]byte("ants")))
+
+	dump := hex.Dump([]byte("ants"))
+	buf := make([]byte, len(dump))
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	require.Equal(t, dump, string(buf))
+
+	// The bridge is done if the port is closed.
+	require.NoError(t, pa.Close())
+	<-br.done
+}
+
+func TestParseCRCType(t *testing.T) {
+	crc, err := parseCRCType(32)
+	require.NoError(t, err)
+	require.Equal(t, ants.CRCType(ants.CRC32), crc)
+
+	_, err = parseCRCType(8)
+	require.Error(t, err)
+}
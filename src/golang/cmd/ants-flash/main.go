@@ -0,0 +1,308 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Command ants-flash updates the firmware of a device over a serial port
+// with the firmware update protocol of the ANTS library. It resets the
+// device into its bootloader, transfers the image, lets the device verify
+// and commit it and reboots the device into the new firmware. The progress
+// is written to stderr.
+//
+// Usage:
+//
+//	ants-flash -port /dev/ttyUSB0 -baud 115200 firmware.bin
+//	ants-flash -port /dev/ttyUSB0 -reset break -signature firmware.sig firmware.bin
+//
+// The device is reset with a pulse of the DTR line or with a break, if
+// requested. Otherwise it has to run its bootloader already and reboot
+// itself after the commit. The exit code reports the failed step, so
+// manufacturing lines can handle the failures:
+//
+//	0  The firmware was updated.
+//	1  The arguments are invalid.
+//	2  The serial port or the image could not be opened.
+//	3  The device did not enter the bootloader.
+//	4  The image transfer failed.
+//	5  The device rejected the image during the verification.
+//	6  The device failed to commit the image.
+//	7  The device could not be rebooted.
+//	8  The update was interrupted.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/dfu"
+	"github.com/desertbit/ants/src/golang/serial"
+	"github.com/desertbit/ants/src/golang/xfer"
+)
+
+// Exit codes:
+const (
+	exitOK          = 0
+	exitUsage       = 1
+	exitOpen        = 2
+	exitBootloader  = 3
+	exitTransfer    = 4
+	exitVerify      = 5
+	exitCommit      = 6
+	exitReboot      = 7
+	exitInterrupted = 8
+)
+
+const (
+	// statusTimeout is the response timeout of a bootloader probe.
+	statusTimeout = time.Second
+)
+
+var (
+	flagPort        = flag.String("port", "", "serial port name or path")
+	flagBaud        = flag.Int("baud", 115200, "serial port baudrate")
+	flagName        = flag.String("name", "", "name of the image announced to the device (default: image file name)")
+	flagSignature   = flag.String("signature", "", "file with the signature of the image, which is checked by the device")
+	flagReset       = flag.String("reset", "none", "reset method to enter the bootloader and to reboot: none, dtr or break")
+	flagResetPulse  = flag.Duration("reset-pulse", 100*time.Millisecond, "duration of the DTR pulse or the break")
+	flagBootTimeout = flag.Duration("boot-timeout", 10*time.Second, "maximum duration to wait for the bootloader")
+	flagTimeout     = flag.Duration("timeout", 30*time.Second, "maximum duration to wait for a response of the device")
+	flagRetries     = flag.Int("retries", 3, "number of times a failed transfer is resumed")
+	flagChunkSize   = flag.Int("chunk-size", 1024, "maximum size of the image data of a single transfer request")
+	flagVerbose     = flag.Bool("v", false, "log the protocol messages to stderr")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "ants-flash: %v\n", err)
+
+		code := exitUsage
+		var e *exitError
+		if errors.As(err, &e) {
+			code = e.code
+		}
+		os.Exit(code)
+	}
+}
+
+func run() error {
+	if *flagPort == "" {
+		return errors.New("no serial port specified: set the -port flag")
+	} else if flag.NArg() != 1 {
+		return errors.New("no image specified: pass the image file as argument")
+	} else if *flagReset != "none" && *flagReset != "dtr" && *flagReset != "break" {
+		return fmt.Errorf("invalid reset method: %v: use none, dtr or break", *flagReset)
+	}
+
+	path := flag.Arg(0)
+	img, err := os.Open(path)
+	if err != nil {
+		return &exitError{code: exitOpen, err: fmt.Errorf("open image: %v", err)}
+	}
+	defer img.Close()
+
+	stat, err := img.Stat()
+	if err != nil {
+		return &exitError{code: exitOpen, err: fmt.Errorf("open image: %v", err)}
+	}
+
+	var signature []byte
+	if *flagSignature != "" {
+		signature, err = os.ReadFile(*flagSignature)
+		if err != nil {
+			return &exitError{code: exitOpen, err: fmt.Errorf("open signature: %v", err)}
+		}
+	}
+
+	config := &ants.Config{}
+	if *flagVerbose {
+		config.Logger = ants.NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	}
+
+	source, err := serial.OpenPort(&serial.Config{
+		Name: *flagPort,
+		Baud: *flagBaud,
+	})
+	if err != nil {
+		return &exitError{code: exitOpen, err: fmt.Errorf("open serial port: %v", err)}
+	}
+
+	p := ants.NewPort(source, config)
+	defer p.Close()
+
+	// Close the port on interrupts.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		p.Close()
+	}()
+
+	name := *flagName
+	if name == "" {
+		name = filepath.Base(path)
+	}
+
+	f := &flasher{
+		port:        p,
+		out:         os.Stderr,
+		reset:       *flagReset,
+		resetPulse:  *flagResetPulse,
+		bootTimeout: *flagBootTimeout,
+		config: &dfu.Config{
+			Timeout:  *flagTimeout,
+			Retries:  *flagRetries,
+			Transfer: &xfer.Config{ChunkSize: *flagChunkSize},
+		},
+	}
+
+	err = f.flash(name, img, stat.Size(), signature)
+	if err != nil && ctx.Err() != nil {
+		return &exitError{code: exitInterrupted, err: errors.New("interrupted")}
+	}
+	return err
+}
+
+//#######################//
+//### Exit Error type ###//
+//#######################//
+
+// An exitError is an error with the exit code of the failed step.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+//####################//
+//### Flasher type ###//
+//####################//
+
+// A flasher runs the update sequence on the port.
+type flasher struct {
+	port        *ants.Port
+	out         io.Writer // Progress output.
+	reset       string    // Reset method: none, dtr or break.
+	resetPulse  time.Duration
+	bootTimeout time.Duration
+	config      *dfu.Config
+}
+
+// flash enters the bootloader, transfers, verifies and commits the
+// image and reboots the device. The error contains the exit code.
+func (f *flasher) flash(name string, img io.ReaderAt, size int64, signature []byte) error {
+	fmt.Fprintf(f.out, "entering bootloader\n")
+	if err := f.enterBootloader(); err != nil {
+		return &exitError{code: exitBootloader, err: fmt.Errorf("enter bootloader: %v", err)}
+	}
+
+	// Report the progress in steps of 10 percent.
+	lastPercent := -1
+	c := *f.config
+	transfer := *c.Transfer
+	transfer.OnProgress = func(_ xfer.File, transferred int64) {
+		percent := 100
+		if size > 0 {
+			percent = int(transferred * 100 / size)
+		}
+		if percent/10 != lastPercent/10 {
+			lastPercent = percent
+			fmt.Fprintf(f.out, "transfer: %3d%% (%d/%d bytes)\n", percent, transferred, size)
+		}
+	}
+	c.Transfer = &transfer
+
+	// The verification result of the device tells the failed step.
+	verified := false
+	var verifyErr error
+	c.OnVerify = func(_ xfer.File, err error) {
+		verified, verifyErr = true, err
+		if err == nil {
+			fmt.Fprintf(f.out, "verified: committing\n")
+		}
+	}
+
+	fmt.Fprintf(f.out, "transferring %s (%d bytes)\n", name, size)
+	err := dfu.UpdateSigned(f.port, name, img, size, signature, &c)
+	if err != nil {
+		switch {
+		case !verified:
+			return &exitError{code: exitTransfer, err: err}
+		case verifyErr != nil:
+			return &exitError{code: exitVerify, err: err}
+		default:
+			return &exitError{code: exitCommit, err: err}
+		}
+	}
+
+	fmt.Fprintf(f.out, "rebooting\n")
+	if err = f.pulseReset(); err != nil {
+		return &exitError{code: exitReboot, err: fmt.Errorf("reboot: %v", err)}
+	}
+
+	fmt.Fprintf(f.out, "done\n")
+	return nil
+}
+
+// enterBootloader resets the device and waits until its
+// bootloader answers the firmware update requests.
+func (f *flasher) enterBootloader() error {
+	if err := f.pulseReset(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(f.bootTimeout)
+	for {
+		_, err := dfu.Status(f.port, &dfu.Config{Timeout: statusTimeout, Retries: -1})
+		if err == nil {
+			return nil
+		} else if err == ants.ErrClosed || time.Now().After(deadline) {
+			return err
+		}
+	}
+}
+
+// pulseReset resets the device with the reset method.
+func (f *flasher) pulseReset() error {
+	switch f.reset {
+	case "dtr":
+		if err := f.port.SetDTR(true); err != nil {
+			return err
+		}
+		time.Sleep(f.resetPulse)
+		return f.port.SetDTR(false)
+
+	case "break":
+		return f.port.SendBreak(f.resetPulse)
+
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang/dfu"
+	"github.com/desertbit/ants/src/golang/testutil"
+	"github.com/desertbit/ants/src/golang/xfer"
+	"github.com/stretchr/testify/require"
+)
+
+// target is a firmware update target, which keeps the image in memory.
+type target struct {
+	image     bytes.Buffer
+	verifyErr error
+}
+
+func (t *target) Begin(img xfer.File) (io.Writer, error) {
+	t.image.Reset()
+	return &t.image, nil
+}
+
+func (t *target) Verify(img xfer.File) error { return t.verifyErr }
+func (t *target) Commit(img xfer.File) error { return nil }
+func (t *target) Abort(img xfer.File)        {}
+
+// newFlasher returns a flasher of a port, whose peer serves a device
+// of the target. The bootloader is probed until the device serves.
+func newFlasher(t *testing.T, tg dfu.Target) (*flasher, *bytes.Buffer) {
+	pa, pb := testutil.NewPortPair(t)
+	if tg != nil {
+		go dfu.NewDevice(tg).Serve(pb)
+	}
+
+	var out bytes.Buffer
+	return &flasher{
+		port:        pa,
+		out:         &out,
+		reset:       "none",
+		bootTimeout: 5 * time.Second,
+		config: &dfu.Config{
+			Timeout:  time.Second,
+			Transfer: &xfer.Config{ChunkSize: 256},
+		},
+	}, &out
+}
+
+func TestFlash(t *testing.T) {
+	img := bytes.Repeat([]byte("firmware"), 300)
+
+	tg := &target{}
+	f, out := newFlasher(t, tg)
+	require.NoError(t, f.flash("v1", bytes.NewReader(img), int64(len(img)), nil))
+	require.Equal(t, img, tg.image.Bytes())
+	require.Contains(t, out.String(), "transfer: 100% (2400/2400 bytes)\n")
+	require.Contains(t, out.String(), "verified: committing\n")
+
+	// The exit code reports the failed step.
+	var e *exitError
+	f, _ = newFlasher(t, &target{verifyErr: errors.New("invalid image")})
+	err := f.flash("v2", bytes.NewReader(img), int64(len(img)), nil)
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, exitVerify, e.code)
+
+	f, _ = newFlasher(t, nil)
+	f.bootTimeout = 0
+	err = f.flash("v3", bytes.NewReader(img), int64(len(img)), nil)
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, exitBootloader, e.code)
+}
@@ -0,0 +1,263 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Command ants-monitor passively taps serial lines or replays a capture
+// file and decodes the ANTS frames into human-readable output: the frame
+// type, the message sequence number, the flags, the CRC validity and a
+// hexdump of the payload. It never transmits.
+//
+// Usage:
+//
+//	ants-monitor -port /dev/ttyUSB0,/dev/ttyUSB1 -baud 115200
+//	ants-monitor -replay field-failure.pcapng
+//	ants-monitor -port /dev/ttyUSB0 -framing hdlc
+//
+// Tap each direction of a full-duplex line with its own serial port.
+// The output lines are labeled with the port name.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/capture"
+	"github.com/desertbit/ants/src/golang/serial"
+)
+
+const (
+	// maxFrameSize limits the size of a scanned frame.
+	maxFrameSize = 1024 * 1024
+)
+
+var (
+	flagPort       = flag.String("port", "", "comma-separated serial ports to tap")
+	flagBaud       = flag.Int("baud", 115200, "serial port baudrate")
+	flagReplay     = flag.String("replay", "", "decode the frames of a capture file")
+	flagCRC        = flag.Int("crc", 16, "CRC type of legacy data messages without CRC type flags: 16 or 32")
+	flagControlCRC = flag.Int("control-crc", 16, "CRC type of control messages: 16 or 32")
+	flagAddressing = flag.Bool("addressing", false, "the frames contain a multi-drop address header")
+	flagFraming    = flag.String("framing", "dle", "framing of the frames: dle, hdlc or cobs")
+	flagFEC        = flag.Int("fec", 0, "forward error correction parity bytes per block of data messages")
+	flagNoPayload  = flag.Bool("no-payload", false, "do not dump the payloads")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "ants-monitor: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	dataCRC, err := parseCRCType(*flagCRC)
+	if err != nil {
+		return err
+	}
+	controlCRC, err := parseCRCType(*flagControlCRC)
+	if err != nil {
+		return err
+	}
+	framing, err := parseFraming(*flagFraming)
+	if err != nil {
+		return err
+	}
+
+	m := &monitor{
+		out: os.Stdout,
+		config: &ants.Config{
+			DataMessageCRC:    dataCRC,
+			ControlMessageCRC: controlCRC,
+			AddressingEnabled: *flagAddressing,
+			Framing:           framing,
+			FECParity:         *flagFEC,
+		},
+		dumpPayload: !*flagNoPayload,
+	}
+
+	switch {
+	case *flagReplay != "":
+		return m.replay(*flagReplay)
+	case *flagPort != "":
+		return m.tap(strings.Split(*flagPort, ","), *flagBaud)
+	default:
+		return errors.New("nothing to monitor: set the -port or -replay flag")
+	}
+}
+
+//####################//
+//### Monitor type ###//
+//####################//
+
+// A monitor decodes and prints frames.
+type monitor struct {
+	config      *ants.Config
+	dumpPayload bool
+
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// replay prints the frames of the capture file.
+func (m *monitor) replay(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("read capture: %v", err)
+	}
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read capture: %v", err)
+		}
+
+		m.print(rec.Time, rec.Direction.String(), rec.Frame)
+	}
+}
+
+// tap prints the frames read from the serial ports until a port fails.
+func (m *monitor) tap(names []string, baud int) error {
+	errChan := make(chan error, len(names))
+
+	for _, name := range names {
+		source, err := serial.OpenPort(&serial.Config{
+			Name: name,
+			Baud: baud,
+		})
+		if err != nil {
+			return fmt.Errorf("open serial port: %v", err)
+		}
+		defer source.Close()
+
+		go func(name string, source io.Reader) {
+			errChan <- m.scan(name, &pollReader{r: source})
+		}(name, source)
+	}
+
+	return <-errChan
+}
+
+// scan prints the frames read from r labeled with the name.
+func (m *monitor) scan(name string, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxFrameSize)
+	s.Split(ants.NewFrameCodec(m.config).ScanFrames)
+
+	for s.Scan() {
+		m.print(time.Now(), name, s.Bytes())
+	}
+
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// print decodes and prints the frame.
+func (m *monitor) print(t time.Time, label string, frame []byte) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-8s ", t.Format("15:04:05.000000"), label)
+
+	f, err := ants.ParseFrame(frame, m.config)
+	if err != nil {
+		// Dump the raw frame to analyze the error.
+		fmt.Fprintf(&b, "%v: len=%v\n", err, len(frame))
+		b.WriteString(hex.Dump(frame))
+	} else {
+		b.WriteString(f.String() + "\n")
+		if m.dumpPayload && len(f.Payload) > 0 {
+			b.WriteString(hex.Dump(f.Payload))
+		}
+	}
+
+	// Lock the mutex.
+	// Never interleave the output of the tapped ports.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	io.WriteString(m.out, b.String())
+}
+
+//#######################//
+//### Poll reader type ###//
+//#######################//
+
+// A pollReader reads again if a serial port read timed out.
+// Serial ports return io.EOF or no data on a read timeout.
+type pollReader struct {
+	r io.Reader
+}
+
+func (p *pollReader) Read(b []byte) (int, error) {
+	for {
+		n, err := p.r.Read(b)
+		if n > 0 {
+			return n, nil
+		} else if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// parseCRCType returns the CRC type of the flag value.
+func parseCRCType(bits int) (ants.CRCType, error) {
+	switch bits {
+	case 16:
+		return ants.CRC16, nil
+	case 32:
+		return ants.CRC32, nil
+	default:
+		return 0, fmt.Errorf("invalid CRC type: %v: use 16 or 32", bits)
+	}
+}
+
+// parseFraming returns the framing of the flag value.
+func parseFraming(name string) (ants.Framing, error) {
+	switch name {
+	case "dle":
+		return ants.FramingDLE, nil
+	case "hdlc":
+		return ants.FramingHDLC, nil
+	case "cobs":
+		return ants.FramingCOBS, nil
+	default:
+		return 0, fmt.Errorf("invalid framing: %v: use dle, hdlc or cobs", name)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/capture"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ants.pcapng")
+	w, err := capture.Create(name)
+	require.NoError(t, err)
+
+	// Record a data message and its acknowledgement.
+	a, b := net.Pipe()
+	config := &ants.Config{}
+	capture.Attach(config, w)
+	pa := ants.NewPort(a, config)
+	pb := ants.NewPort(b)
+
+	require.NoError(t, pb.Write([]byte("ants")))
+	_, err = pa.Read()
+	require.NoError(t, err)
+	require.NoError(t, pa.Write([]byte("ping")))
+	_, err = pb.Read()
+	require.NoError(t, err)
+
+	require.NoError(t, pa.Close())
+	require.NoError(t, pb.Close())
+	require.NoError(t, w.Close())
+
+	var out bytes.Buffer
+	m := &monitor{
+		out:         &out,
+		config:      &ants.Config{},
+		dumpPayload: true,
+	}
+	require.NoError(t, m.replay(name))
+
+	s := out.String()
+	require.Regexp(t, `received DATA MSN=\d+ CRC-16 ok len=4\n`, s)
+	require.Regexp(t, `sent     ACK MSN=\d+ CRC-16 ok len=0\n`, s)
+	require.Regexp(t, `sent     DATA MSN=\d+ CRC-16 ok len=4\n`, s)
+	require.Contains(t, s, hex.Dump([]byte("ping")))
+}
+
+func TestScan(t *testing.T) {
+	var out bytes.Buffer
+	m := &monitor{
+		out:    &out,
+		config: &ants.Config{},
+	}
+
+	// Garbage is skipped and malformed frames are dumped.
+	stream := []byte{0xaa, 0x10, 0x06, 0x10, 0x03, 0xbb}
+	require.NoError(t, m.scan("tty", bytes.NewReader(stream)))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "tty      invalid frame: len=4")
+
+	// HDLC frames share their flags.
+	out.Reset()
+	m.config = &ants.Config{Framing: ants.FramingHDLC}
+	c := ants.NewFrameCodec(m.config)
+	ack, err := c.EncodeControlMessage(ants.ControlAck, 1, nil)
+	require.NoError(t, err)
+	nak, err := c.EncodeControlMessage(ants.ControlNak, 2, nil)
+	require.NoError(t, err)
+	stream = append(append([]byte{0xaa}, ack...), nak[1:]...)
+	require.NoError(t, m.scan("tty", bytes.NewReader(stream)))
+
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "ACK MSN=1 CRC-16 ok")
+	require.Contains(t, lines[1], "NAK MSN=2 CRC-16 ok")
+}
@@ -0,0 +1,194 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+const (
+	// cobsDelimiter delimits the COBS frames.
+	cobsDelimiter = 0x00
+
+	// cobsMaxCode is the code of a block with 254 data bytes,
+	// which is not followed by a zero byte.
+	cobsMaxCode = 0xff
+)
+
+//###############//
+//### Private ###//
+//###############//
+
+// cobsFrame appends the COBS frame of the unescaped message body to the body:
+// 0x00 | COBS (Type | Message) | 0x00
+// The body must be located at the start of the frame buffer.
+// Returns the frame, which is valid until the buffer is released.
+func (b *frameBuffer) cobsFrame(startCharacter byte, body []byte) []byte {
+	// The message type is the first byte of the first block.
+	// Start characters are never zero.
+	buf := append(body, cobsDelimiter, 0, startCharacter)
+	codePos := len(body) + 1
+	code := byte(2)
+
+	for _, c := range body {
+		// A zero byte closes the block. The code replaces it.
+		if c == cobsDelimiter {
+			buf[codePos] = code
+			codePos = len(buf)
+			buf = append(buf, 0)
+			code = 1
+			continue
+		}
+
+		buf = append(buf, c)
+		code++
+
+		// Close a full block.
+		if code == cobsMaxCode {
+			buf[codePos] = code
+			codePos = len(buf)
+			buf = append(buf, 0)
+			code = 1
+		}
+	}
+
+	// Close the last block and the frame.
+	buf[codePos] = code
+	buf = append(buf, cobsDelimiter)
+
+	b.b = buf
+	return buf[len(body):]
+}
+
+// decodeCOBS returns the decoded frame content without the delimiters.
+// Returns false if the content is malformed.
+func decodeCOBS(data []byte) ([]byte, bool) {
+	decoded := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); {
+		code := data[i]
+		if code == cobsDelimiter || i+int(code) > len(data) {
+			return nil, false
+		}
+
+		decoded = append(decoded, data[i+1:i+int(code)]...)
+		i += int(code)
+
+		// The last block is not followed by a zero byte.
+		if code != cobsMaxCode && i < len(data) {
+			decoded = append(decoded, 0)
+		}
+	}
+
+	return decoded, true
+}
+
+// parseCOBS decodes a complete COBS frame including both delimiters.
+func (c *FrameCodec) parseCOBS(frame []byte) (*FrameInfo, error) {
+	if len(frame) < 3 || frame[0] != cobsDelimiter || frame[len(frame)-1] != cobsDelimiter {
+		return nil, ErrInvalidFrame
+	}
+
+	content, ok := decodeCOBS(frame[1 : len(frame)-1])
+	if !ok || len(content) == 0 {
+		return nil, ErrInvalidFrame
+	}
+
+	return c.parseBody(content[0], content[1:])
+}
+
+// decodeCOBSByte passes a received byte of the COBS framing to the decoder.
+// A zero byte closes the current frame and opens the next one. Bytes
+// outside of frames are discarded.
+func (d *FrameDecoder) decodeCOBSByte(b byte) decodeEvent {
+	// Collect the encoded frame bytes.
+	if d.startCharacterFound && d.keepRaw {
+		d.raw = append(d.raw, b)
+	}
+
+	if b == cobsDelimiter {
+		started, complete := d.startCharacterFound, d.cobsRemaining == 0
+		d.flagFound = true
+		d.startCharacterFound = false
+		d.cobsCode, d.cobsRemaining = 0, 0
+
+		if !started {
+			return decodeNone
+		} else if !complete {
+			// The frame ended within a block.
+			d.clearFrame()
+			return decodeAborted
+		}
+		return decodeEnded
+	}
+
+	// Discard bytes outside of a frame.
+	if !d.flagFound {
+		return decodeNone
+	}
+
+	// The code byte of the next block.
+	if d.cobsRemaining == 0 {
+		// The previous block is followed by a zero byte,
+		// unless it is the last block of the frame.
+		prev := d.cobsCode
+		d.cobsCode, d.cobsRemaining = b, b-1
+
+		if prev == 0 || prev == cobsMaxCode {
+			return decodeNone
+		}
+		return d.decodeContentByte(0)
+	}
+
+	d.cobsRemaining--
+	event := d.decodeContentByte(b)
+
+	// Start collecting the encoded frame bytes.
+	if event == decodeStarted && d.keepRaw {
+		d.raw = append(d.raw[:0], cobsDelimiter, d.cobsCode, b)
+	}
+
+	return event
+}
+
+// scanCOBSFrames is the split function of ScanFrames for the COBS framing.
+// The returned frames include both delimiters. The closing delimiter is
+// not consumed, because it might open the next frame.
+func scanCOBSFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := -1
+
+	for i, b := range data {
+		if b != cobsDelimiter {
+			continue
+		}
+
+		// Return the frame, unless it is empty.
+		if start >= 0 && i > start+1 {
+			return i, data[start : i+1], nil
+		}
+		start = i
+	}
+
+	if atEOF {
+		return len(data), nil, nil
+	}
+
+	// Skip the bytes before the current frame
+	// and request more data.
+	if start >= 0 {
+		return start, nil, nil
+	}
+	return len(data), nil, nil
+}
@@ -0,0 +1,655 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+// Data message flags. Pass them to FrameCodec.EncodeDataMessage.
+// The CRC type field of the flags is always set by the codec.
+const (
+	FlagAppendData byte = flagAppendData
+	FlagUrgent     byte = flagUrgent
+	FlagDelta      byte = flagDelta
+	FlagService    byte = flagService
+	FlagPipelined  byte = flagPipelined
+	FlagEncrypted  byte = flagEncrypted
+)
+
+// Control message types. Pass them to FrameCodec.EncodeControlMessage.
+const (
+	ControlAck          byte = ack
+	ControlNak          byte = nak
+	ControlAbort        byte = can
+	ControlBufferStatus byte = bst
+	ControlResend       byte = rsd
+	ControlPing         byte = bel
+	ControlHandshake    byte = enq
+	ControlWait         byte = wat
+	ControlReady        byte = rdy
+)
+
+var (
+	// ErrInvalidMessageType is returned if a control message type is unknown.
+	ErrInvalidMessageType = errors.New("invalid message type")
+)
+
+//#######################//
+//### FrameCodec type ###//
+//#######################//
+
+// A FrameCodec encodes and decodes the frames of the wire format without
+// the port routines: the DLE escaping, the message layouts, the address
+// header and the CRC checksums. Use it to implement proxies or gateways.
+// The message sequencing and the acknowledges are left to the caller.
+// A FrameCodec is safe for concurrent use.
+type FrameCodec struct {
+	config *Config
+
+	chars           FramingCharacters
+	startCharacters [256]byte // Maps the received bytes to the start characters.
+
+	controlMessageCRCValidator CRCValidator
+	controlMessageCRCLength    int // Bytes counted.
+	dataMessageCRCValidator    CRCValidator
+	dataMessageCRCLength       int // Bytes counted.
+
+	// Set to 1 if the control messages use CRC-16, because the peer
+	// announced another control message CRC type during the handshake.
+	controlMessageCRCFallback int32
+
+	maxBodySize int // Maximum size of a received message body.
+
+	fec *rsCodec // Nil if the forward error correction is disabled.
+}
+
+// NewFrameCodec creates a new frame codec. Optionally pass a configuration.
+// The CRC types, the frame layout, the framing, the custom CRC, the forward
+// error correction, the maximum message size and the addressing options apply.
+// The config is not modified.
+func NewFrameCodec(config ...*Config) *FrameCodec {
+	// Get a copy of the config with the default values.
+	var c Config
+	if len(config) > 0 && config[0] != nil {
+		c = *config[0]
+	}
+	c.setDefaults()
+
+	return newFrameCodec(&c)
+}
+
+// EncodeDataMessage returns the escaped data message frame
+// with the configured data message CRC type:
+// DLE | STX | MSN | Flags | Binary Data | CRC | DLE | ETX
+func (c *FrameCodec) EncodeDataMessage(msn byte, flags byte, data []byte) []byte {
+	return c.encodeDataMessage(c.config.DataMessageCRC, msn, flags, data)
+}
+
+// EncodeControlMessage returns the escaped control message frame:
+// DLE | Type | MSN | Payload | CRC | DLE | ETX
+// Returns ErrInvalidMessageType if the type is no control message type.
+func (c *FrameCodec) EncodeControlMessage(ctrlType byte, msn byte, payload []byte) ([]byte, error) {
+	if !isControlCharacter(ctrlType) {
+		return nil, ErrInvalidMessageType
+	}
+	return c.encodeControlMessage(ctrlType, msn, payload), nil
+}
+
+// Parse decodes a complete escaped frame. Frames with invalid
+// checksums are decoded and reported by FrameInfo.CRCValid.
+// Returns ErrInvalidFrame if the frame is malformed.
+func (c *FrameCodec) Parse(frame []byte) (*FrameInfo, error) {
+	switch c.config.Framing {
+	case FramingHDLC:
+		return c.parseHDLC(frame)
+	case FramingCOBS:
+		return c.parseCOBS(frame)
+	}
+
+	// The frame is enclosed by the escaped start and end characters.
+	esc := c.chars.DLE
+	if len(frame) < 4 || frame[0] != esc || frame[len(frame)-2] != esc || frame[len(frame)-1] != c.chars.ETX {
+		return nil, ErrInvalidFrame
+	}
+
+	return c.parseBody(c.startCharacters[frame[1]], unescape(frame[2:len(frame)-2], esc))
+}
+
+// NewDecoder creates a new streaming decoder of received frames.
+func (c *FrameCodec) NewDecoder() *FrameDecoder {
+	return &FrameDecoder{
+		codec: c,
+	}
+}
+
+//#########################//
+//### FrameDecoder type ###//
+//#########################//
+
+// A FrameDecoder decodes the frames of a received byte stream.
+// Bytes outside of frames are discarded. A start character within
+// a frame discards the frame and starts a new one.
+// A FrameDecoder is not safe for concurrent use.
+type FrameDecoder struct {
+	codec *FrameCodec
+
+	buf            []byte // Unescaped message body.
+	raw            []byte // Escaped frame bytes. Only collected if keepRaw is set.
+	keepRaw        bool
+	startCharacter byte
+
+	// Flags:
+	isControlMessage    bool
+	flagFound           bool // The flag, which opens a HDLC or COBS frame, was found.
+	startCharacterFound bool
+	byteIsEscaped       bool
+
+	// COBS decoder state:
+	cobsCode      byte // Code byte of the current block.
+	cobsRemaining byte // Remaining data bytes of the current block.
+}
+
+// Decode passes the received bytes to the decoder and calls f for each
+// complete frame with the decoded frame or ErrInvalidFrame. Frames with
+// invalid checksums are passed with FrameInfo.CRCValid set to false.
+// The payload refers to the decoder buffer and is only valid during the call.
+func (d *FrameDecoder) Decode(data []byte, f func(frame *FrameInfo, err error)) {
+	for _, b := range data {
+		if d.decodeByte(b) != decodeEnded {
+			continue
+		}
+
+		f(d.codec.parseBody(d.startCharacter, d.buf))
+		d.clearFrame()
+	}
+}
+
+// Reset discards the partially received frame.
+// Call it if no frame was completed within a read timeout.
+func (d *FrameDecoder) Reset() {
+	d.isControlMessage = false
+	d.flagFound = false
+	d.startCharacterFound = false
+	d.byteIsEscaped = false
+	d.cobsCode = 0
+	d.cobsRemaining = 0
+	d.startCharacter = 0
+
+	d.clearFrame()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// A decodeEvent is the result of a decoded byte.
+type decodeEvent int
+
+const (
+	decodeNone       decodeEvent = iota
+	decodeStarted                // A start character was found.
+	decodeRestarted              // A start character within a frame discarded the frame.
+	decodeUnexpected             // Another byte than a start character was escaped outside of a frame.
+	decodeEnded                  // The end character was found. The buffer contains the message body.
+	decodeOverflow               // The maximum body size was reached. The bytes were discarded.
+	decodeAborted                // The frame was aborted by the sender or is malformed. The bytes were discarded.
+)
+
+// newFrameCodec creates a new frame codec, which uses the config.
+// The default config values must be set.
+func newFrameCodec(c *Config) *FrameCodec {
+	codec := &FrameCodec{
+		config:          c,
+		chars:           c.FramingCharacters,
+		startCharacters: c.FramingCharacters.startCharacters(),
+		maxBodySize:     minMessageBufferSize,
+	}
+
+	codec.dataMessageCRCValidator, codec.dataMessageCRCLength = getCRCValidator(c.DataMessageCRC, c.CustomCRC)
+	codec.controlMessageCRCValidator, codec.controlMessageCRCLength = getCRCValidator(c.ControlMessageCRC, c.CustomCRC)
+
+	// Accept data messages of the configured maximum size.
+	// Urgent data chunks are never split, so add the cipher overhead.
+	maxBodySize := c.MaxMessageSize + maxMessageOverhead
+	if c.Cipher != nil {
+		maxBodySize += c.Cipher.Overhead()
+	} else if c.KeyExchange != nil {
+		maxBodySize += sessionCipherOverhead
+	}
+	if c.ReplayProtection {
+		maxBodySize += replayCounterLength
+	}
+	if maxBodySize > codec.maxBodySize {
+		codec.maxBodySize = maxBodySize
+	}
+
+	// The parity bytes of the forward error correction are added.
+	if c.FECParity > 0 {
+		codec.fec = newRSCodec(c.FECParity)
+		codec.maxBodySize += codec.fec.overhead(codec.maxBodySize)
+	}
+
+	return codec
+}
+
+// encodeDataMessage returns a new complete escaped data message frame.
+func (c *FrameCodec) encodeDataMessage(crcType CRCType, msn byte, flags byte, data []byte) []byte {
+	b := getFrameBuffer()
+	defer b.release()
+
+	return append([]byte(nil), c.encodeDataMessageInto(b, crcType, msn, flags, data)...)
+}
+
+// encodeDataMessageInto encodes the complete escaped data message frame
+// into the frame buffer without allocations:
+// STX | MSN | Flags | Binary Data | CRC | ETX
+// or with the enhanced frame layout:
+// SOH | MSN | Flags | Length | Header CRC | Binary Data | CRC | ETX
+// The frame is valid until the buffer is released.
+func (c *FrameCodec) encodeDataMessageInto(b *frameBuffer, crcType CRCType, msn byte, flags byte, data []byte) []byte {
+	startCharacter := byte(stx)
+
+	// The flags always indicate the CRC type.
+	crcValidator, crcLength := getCRCValidator(crcType, c.config.CustomCRC)
+	flags = flags&^flagCRCMask | crcTypeFlag(crcType)
+	n := addressHeaderLength + enhancedHeaderLength + len(data) + crcLength
+	if c.fec != nil {
+		n += c.fec.overhead(n)
+	}
+	b.grow(n)
+
+	// Create the message body with the optional address header,
+	// the message sequence number and the flags.
+	body := c.appendAddressHeader(b.b[:0])
+	pos := len(body)
+	body = append(body, msn, flags)
+
+	// Add the binary data length and the header checksum for the enhanced layout.
+	if c.config.FrameLayout == FrameLayoutEnhanced {
+		startCharacter = soh
+
+		body = binary.LittleEndian.AppendUint16(body, uint16(len(data)))
+		body = getCRC16Validator().appendChecksum(body, body[pos:])
+	}
+
+	body = append(body, data...)
+
+	// Calculate the CRC checksum without the address header and append it.
+	body = appendChecksum(body, crcValidator, body[pos:])
+
+	// Protect the message without the address header with the forward error correction.
+	if c.fec != nil {
+		body = c.fec.encode(body, pos)
+	}
+
+	return c.frame(b, startCharacter, body)
+}
+
+// encodeControlMessage returns a new escaped control message frame.
+func (c *FrameCodec) encodeControlMessage(ctrlType byte, msn byte, payload []byte) []byte {
+	b := getFrameBuffer()
+	defer b.release()
+
+	return append([]byte(nil), c.encodeControlMessageInto(b, ctrlType, msn, payload)...)
+}
+
+// encodeControlMessageInto encodes the escaped control message frame
+// into the frame buffer without allocations:
+// DLE | Type | MSN | Payload | CRC | DLE | ETX
+// The frame is valid until the buffer is released.
+func (c *FrameCodec) encodeControlMessageInto(b *frameBuffer, ctrlType byte, msn byte, payload []byte) []byte {
+	crcValidator, crcLength := c.controlMessageCRC(ctrlType)
+	b.grow(addressHeaderLength + 1 + len(payload) + crcLength)
+
+	// Create the message body with the optional address header,
+	// the message sequence number and the payload.
+	body := c.appendAddressHeader(b.b[:0])
+	pos := len(body)
+	body = append(body, msn)
+	body = append(body, payload...)
+
+	// Calculate the CRC checksum without the address header and append it.
+	body = appendChecksum(body, crcValidator, body[pos:])
+
+	return c.frame(b, ctrlType, body)
+}
+
+// frame appends the frame of the unescaped message body with the configured
+// framing to the body. The body must be located at the start of the frame buffer.
+// Returns the frame, which is valid until the buffer is released.
+func (c *FrameCodec) frame(b *frameBuffer, startCharacter byte, body []byte) []byte {
+	switch c.config.Framing {
+	case FramingHDLC:
+		return b.hdlcFrame(startCharacter, body)
+	case FramingCOBS:
+		return b.cobsFrame(startCharacter, body)
+	default:
+		return b.frame(&c.chars, startCharacter, body)
+	}
+}
+
+// abortSequence returns the bytes, which terminate a partially
+// transmitted frame, so the peer discards it.
+func (c *FrameCodec) abortSequence() []byte {
+	switch c.config.Framing {
+	case FramingHDLC:
+		return []byte{hdlcEscape, hdlcFlag}
+	case FramingCOBS:
+		// The truncated frame is malformed or fails its checksum.
+		return []byte{cobsDelimiter}
+	default:
+		return []byte{c.chars.DLE, c.chars.ETX}
+	}
+}
+
+// appendAddressHeader appends the address header to the unescaped
+// message body if the addressing is enabled.
+func (c *FrameCodec) appendAddressHeader(body []byte) []byte {
+	if !c.config.AddressingEnabled {
+		return body
+	}
+
+	pos := len(body)
+	body = append(body, c.config.PeerAddress, c.config.Address)
+	return getCRC16Validator().appendChecksum(body, body[pos:])
+}
+
+// controlMessageCRC returns the validator and the checksum length of the
+// control message type. Handshake control messages always use CRC-16,
+// because they announce the CRC types.
+func (c *FrameCodec) controlMessageCRC(ctrlType byte) (CRCValidator, int) {
+	if ctrlType == enq || c.isControlMessageCRCFallback() {
+		return getCRC16Validator(), 2
+	}
+	return c.controlMessageCRCValidator, c.controlMessageCRCLength
+}
+
+// controlMessageCRCType returns the CRC type of the control message type.
+func (c *FrameCodec) controlMessageCRCType(ctrlType byte) CRCType {
+	if ctrlType == enq || c.isControlMessageCRCFallback() {
+		return CRC16
+	}
+	return c.config.ControlMessageCRC
+}
+
+// setControlMessageCRCFallback switches the control messages to CRC-16,
+// which all peers support, if the control message CRC types of both
+// peers differ. Both peers detect the mismatch during the handshake
+// and agree on CRC-16.
+func (c *FrameCodec) setControlMessageCRCFallback(fallback bool) {
+	var v int32
+	if fallback {
+		v = 1
+	}
+	atomic.StoreInt32(&c.controlMessageCRCFallback, v)
+}
+
+// isControlMessageCRCFallback returns true if the control messages use CRC-16
+// instead of the configured control message CRC type.
+func (c *FrameCodec) isControlMessageCRCFallback() bool {
+	return atomic.LoadInt32(&c.controlMessageCRCFallback) != 0
+}
+
+// dataMessageCRC returns the validator, the checksum length and the type
+// of the CRC indicated by the data message flags. Legacy peers don't set
+// the CRC type field. The configured CRC type is used then.
+// Custom checksums are only accepted if a custom validator is configured.
+func (c *FrameCodec) dataMessageCRC(flags byte) (CRCValidator, int, CRCType) {
+	switch flags & flagCRCMask {
+	case flagCRC16:
+		return getCRC16Validator(), 2, CRC16
+	case flagCRC32:
+		return getCRC32Validator(), 4, CRC32
+	case flagCRCCustom:
+		if c.config.CustomCRC == nil {
+			return c.dataMessageCRCValidator, c.dataMessageCRCLength, c.config.DataMessageCRC
+		}
+		validator, length := getCRCValidator(CRCCustom, c.config.CustomCRC)
+		return validator, length, CRCCustom
+	default:
+		return c.dataMessageCRCValidator, c.dataMessageCRCLength, c.config.DataMessageCRC
+	}
+}
+
+// parseBody decodes the unescaped message body of a frame.
+func (c *FrameCodec) parseBody(startCharacter byte, body []byte) (*FrameInfo, error) {
+	f := &FrameInfo{
+		StartCharacter:   startCharacter,
+		IsControlMessage: isControlCharacter(startCharacter),
+		CRCValid:         true,
+	}
+	if !f.IsControlMessage && !isDataMessageCharacter(startCharacter) {
+		return nil, ErrInvalidFrame
+	}
+	f.Type = frameTypeName(startCharacter)
+
+	// Extract the optional address header.
+	if c.config.AddressingEnabled {
+		if len(body) < addressHeaderLength {
+			return nil, ErrInvalidFrame
+		}
+
+		header := body[:addressHeaderLength-2]
+		if !getCRC16Validator().Validate(header, body[addressHeaderLength-2:addressHeaderLength]) {
+			f.CRCValid = false
+		}
+		f.Addressed = true
+		f.Destination, f.Source = header[0], header[1]
+		body = body[addressHeaderLength:]
+	}
+
+	if f.IsControlMessage {
+		return f, c.parseControlMessageBody(f, body)
+	}
+
+	// Correct the data message with the forward error correction.
+	if c.fec != nil {
+		body, f.Corrected, _ = c.fec.decode(body)
+	}
+	return f, c.parseDataMessageBody(f, body)
+}
+
+// parseDataMessageBody decodes the body of a data message without the address header.
+func (c *FrameCodec) parseDataMessageBody(f *FrameInfo, body []byte) error {
+	headerLength := 2
+	if f.StartCharacter == soh {
+		headerLength = enhancedHeaderLength
+	}
+
+	if len(body) < headerLength {
+		return ErrInvalidFrame
+	}
+	f.MSN, f.Flags = body[0], body[1]
+
+	// Validate the header checksum of the enhanced layout.
+	if f.StartCharacter == soh {
+		header := body[:enhancedHeaderLength-2]
+		if !getCRC16Validator().Validate(header, body[enhancedHeaderLength-2:enhancedHeaderLength]) {
+			f.CRCValid = false
+		}
+	}
+
+	// The flags indicate the CRC type.
+	validator, crcLength, crcType := c.dataMessageCRC(f.Flags)
+	f.CRCType = crcType
+
+	if len(body) < headerLength+crcLength {
+		return ErrInvalidFrame
+	}
+
+	pos := len(body) - crcLength
+	if !validator.Validate(body[:pos], body[pos:]) {
+		f.CRCValid = false
+	}
+	f.Payload = body[headerLength:pos]
+
+	return nil
+}
+
+// parseControlMessageBody decodes the body of a control message without the address header.
+func (c *FrameCodec) parseControlMessageBody(f *FrameInfo, body []byte) error {
+	validator, crcLength := c.controlMessageCRC(f.StartCharacter)
+	f.CRCType = c.controlMessageCRCType(f.StartCharacter)
+
+	if len(body) < 1+crcLength {
+		return ErrInvalidFrame
+	}
+
+	pos := len(body) - crcLength
+	if !validator.Validate(body[:pos], body[pos:]) {
+		f.CRCValid = false
+	}
+	f.MSN = body[0]
+	f.Payload = body[1:pos]
+
+	return nil
+}
+
+// decodeByte passes a received byte to the decoder.
+// After decodeEnded the buffer contains the unescaped message body.
+// Call clearFrame after the body was handled.
+func (d *FrameDecoder) decodeByte(b byte) decodeEvent {
+	switch d.codec.config.Framing {
+	case FramingHDLC:
+		return d.decodeHDLCByte(b)
+	case FramingCOBS:
+		return d.decodeCOBSByte(b)
+	}
+
+	// Hint: This protocol uses the Data Link Escape (DLE) character to
+	// differentiate between control characters and the binary data transmission.
+	// Control characters are preceded with the DLE character.
+	// Whenever the DLE character is encountered in the data, it is
+	// sent twice to prevent the byte that follows from being interpreted
+	// as a control character.
+	//
+	// Collect the escaped frame bytes.
+	if d.startCharacterFound && d.keepRaw {
+		d.raw = append(d.raw, b)
+	}
+
+	// Set the escaped flag.
+	chars := &d.codec.chars
+	if !d.byteIsEscaped && b == chars.DLE {
+		d.byteIsEscaped = true
+		return decodeNone
+	}
+
+	// Check for control characters. They have to be escaped.
+	if d.byteIsEscaped {
+		d.byteIsEscaped = false
+
+		// A start character starts a new message. A start character in
+		// the middle of a message discards it. Its end was lost.
+		if start := d.codec.startCharacters[b]; start != 0 {
+			event := decodeStarted
+			if d.startCharacterFound {
+				event = decodeRestarted
+			}
+
+			// Save the start character.
+			// It defines the message type and layout.
+			d.startCharacter = start
+			d.isControlMessage = isControlCharacter(start)
+			d.startCharacterFound = true
+			d.buf = d.buf[:0]
+
+			// Start collecting the escaped frame bytes.
+			if d.keepRaw {
+				d.raw = append(d.raw[:0], chars.DLE, b)
+			}
+
+			return event
+		}
+
+		// Discard the byte, if searching for a start character.
+		if !d.startCharacterFound {
+			return decodeUnexpected
+		}
+
+		// The end character completes the message body.
+		// The buffer is already unescaped, because escaped DLE
+		// characters are appended only once.
+		if b == chars.ETX {
+			d.startCharacterFound = false
+			return decodeEnded
+		}
+	}
+
+	// Discard bytes outside of a message.
+	if !d.startCharacterFound {
+		return decodeNone
+	}
+
+	// Append the new byte to the message buffer.
+	d.buf = append(d.buf, b)
+
+	// Check if the maximum buffer size is reached.
+	if len(d.buf) > d.codec.maxBodySize {
+		// Discard the received bytes and start over again.
+		d.buf = d.buf[:0]
+		d.raw = d.raw[:0]
+		return decodeOverflow
+	}
+
+	return decodeNone
+}
+
+// decodeContentByte passes an unescaped byte of a frame, which is delimited
+// by flags, to the decoder. The first byte after the opening flag is the
+// message type. Malformed and oversized frames are discarded until the next flag.
+func (d *FrameDecoder) decodeContentByte(b byte) decodeEvent {
+	if !d.startCharacterFound {
+		if !isDataMessageCharacter(b) && !isControlCharacter(b) {
+			// Wait for the next flag.
+			d.flagFound = false
+			return decodeUnexpected
+		}
+
+		d.startCharacter = b
+		d.isControlMessage = isControlCharacter(b)
+		d.startCharacterFound = true
+		d.buf = d.buf[:0]
+		return decodeStarted
+	}
+
+	// Append the new byte to the message buffer.
+	d.buf = append(d.buf, b)
+
+	// Check if the maximum buffer size is reached.
+	if len(d.buf) > d.codec.maxBodySize {
+		// Discard the frame and wait for the next flag.
+		d.flagFound = false
+		d.startCharacterFound = false
+		d.clearFrame()
+		return decodeOverflow
+	}
+
+	return decodeNone
+}
+
+// clearFrame clears the buffers of the handled frame.
+func (d *FrameDecoder) clearFrame() {
+	d.buf = d.buf[:0]
+	d.raw = d.raw[:0]
+	d.isControlMessage = false
+}
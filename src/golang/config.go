@@ -18,6 +18,11 @@
 
 package ants
 
+import (
+	"io"
+	"time"
+)
+
 //################//
 //### CRC type ###//
 //################//
@@ -27,6 +32,80 @@ type CRCType int
 const (
 	CRC16 = 1 << iota
 	CRC32 = 1 << iota
+
+	// CRCCustom uses the CRCValidator set by Config.CustomCRC.
+	CRCCustom = 1 << iota
+)
+
+//#########################//
+//### Frame layout type ###//
+//#########################//
+
+// FrameLayout defines the layout of transmitted data messages.
+type FrameLayout int
+
+const (
+	// FrameLayoutDefault is the default data message layout:
+	// STX | MSN | Flags | Binary Data | CRC | ETX
+	FrameLayoutDefault FrameLayout = iota
+
+	// FrameLayoutEnhanced prepends a header, which contains the binary
+	// data length and is covered by its own CRC-16 checksum:
+	// SOH | MSN | Flags | Length | Header CRC | Binary Data | CRC | ETX
+	// Corrupted flags or lengths are detected before the binary data is interpreted.
+	FrameLayoutEnhanced
+)
+
+//####################//
+//### Framing type ###//
+//####################//
+
+// Framing defines how the messages are delimited and escaped on the wire.
+// Both peers have to use the same framing.
+type Framing int
+
+const (
+	// FramingDLE is the default framing. The frames are enclosed by the
+	// escaped start and end characters and the DLE character is doubled:
+	// DLE | Type | Escaped Message | DLE | ETX
+	FramingDLE Framing = iota
+
+	// FramingHDLC is the asynchronous HDLC framing of RFC 1662 as used by
+	// PPP. The frames are delimited by the flag 0x7E. The flag and the
+	// escape character 0x7D are escaped with 0x7D followed by the byte
+	// XOR 0x20. The message type is the first byte of the frame:
+	// Flag | Escaped (Type | Message) | Flag
+	FramingHDLC
+
+	// FramingCOBS encodes the frames with the Consistent Overhead Byte
+	// Stuffing, which removes all zero bytes. The frames are delimited
+	// by zero bytes. Unlike the DLE framing, which doubles the size of
+	// binary data full of DLE characters, the overhead is bounded to one
+	// byte per 254 bytes. The message type is the first encoded byte:
+	// 0x00 | COBS (Type | Message) | 0x00
+	FramingCOBS
+)
+
+//########################//
+//### EOF behavior type ###//
+//########################//
+
+// EOFBehavior defines how the port handles an io.EOF returned by its source.
+type EOFBehavior int
+
+const (
+	// EOFRetry handles io.EOF as if no data was available and reads
+	// again after a short wait duration. This is the default and fits
+	// serial ports, which return io.EOF on a read timeout.
+	EOFRetry EOFBehavior = iota
+
+	// EOFClose handles io.EOF as link closure. The port is closed
+	// and Port.Err() returns ErrSourceEOF. Use this for TCP-backed sources.
+	EOFClose
+
+	// EOFReconnect closes the current source and calls the Config.OnEOF hook
+	// to obtain a new source. The port is closed if the hook fails.
+	EOFReconnect
 )
 
 //###################//
@@ -38,6 +117,395 @@ type Config struct {
 	// DataMessageCRCType specifies the used CRC checksum for data messages.
 	// The default is CRC16.
 	DataMessageCRC CRCType
+
+	// ControlMessageCRC specifies the used CRC checksum for control messages.
+	// Set it to the data message CRC type if the peer implements a single
+	// checksum routine. Both peers have to use the same type. If the types
+	// differ, then both peers fall back to CRC16 after the handshake.
+	// The default is CRC16.
+	ControlMessageCRC CRCType
+
+	// CustomCRC is the checksum implementation used by the CRCCustom type,
+	// for example to match a vendor device with a CRC-8 or a different
+	// CRC-16 polynomial. The checksum length is the length of the
+	// checksum returned for empty data.
+	CustomCRC CRCValidator
+
+	// FECParity enables the forward error correction of the data messages.
+	// The message sequence number, the flags, the binary data and the CRC
+	// checksum are protected with a Reed-Solomon code, which adds FECParity
+	// parity bytes per block of up to 255 bytes. Up to FECParity/2 corrupted
+	// bytes per block are corrected by the receiver instead of requesting
+	// a retransmission. The corrections are counted by the port statistics.
+	// Both peers have to use the same value. The maximum is 64.
+	// The default is 0 (disabled).
+	FECParity int
+
+	// Cipher encrypts and authenticates the binary data of the data chunks,
+	// for example with NewAESGCMCipher and a pre-shared key. Received data
+	// chunks, which are not encrypted or fail the authentication, are
+	// discarded. Both peers have to use the same cipher.
+	// Nil disables the encryption.
+	Cipher Cipher
+
+	// ReplayProtection prepends a monotonically increasing counter to the
+	// encrypted data chunks, which is authenticated by the cipher together
+	// with the session. Received data chunks with a counter, which was
+	// already received or is too old, are discarded. The session handshake
+	// agrees on a new session with random nonces, so data chunks of previous
+	// sessions are rejected and the counters start anew. Data chunks can't
+	// be transmitted before the handshake completed. It requires the Cipher
+	// or the KeyExchange. Both peers have to enable it. Enable the Handshake
+	// on both peers, so a restarted peer agrees on a new session.
+	ReplayProtection bool
+
+	// KeyExchange agrees on a new session key of the encryption with an
+	// authenticated ECDH exchange during each session handshake, instead of
+	// a pre-shared key. Enable the Handshake on at least one peer. Data
+	// chunks can't be transmitted before the handshake completed. The Cipher
+	// is ignored. Nil disables the key exchange.
+	KeyExchange *KeyExchange
+
+	// AddressingEnabled prepends an address header to all messages, so
+	// multiple nodes share one multi-drop bus like RS-485. Messages, which
+	// are not addressed to this node or not sent by the peer, are ignored.
+	// All nodes on the bus have to enable the addressing.
+	AddressingEnabled bool
+
+	// Address is the address of this node on the bus.
+	// It must not be the BroadcastAddress.
+	Address byte
+
+	// PeerAddress is the address of the peer node, which is the destination
+	// of all transmitted messages. Set the BroadcastAddress to transmit to
+	// all nodes. Broadcast data messages are never acknowledged, so they
+	// are transmitted only once without retransmissions.
+	PeerAddress byte
+
+	// Handshake enables the session handshake. The port announces its
+	// protocol version, CRC types, maximum message size and features to
+	// the peer, before the first data chunk is transmitted. Data messages
+	// are transmitted with the CRC type and maximum message size of the
+	// peer afterwards, if supported. Mismatches, which can't be resolved,
+	// are logged. Obtain the parameters of the peer with Port.PeerInfo.
+	// Peers always reply to handshakes, even if this is disabled.
+	Handshake bool
+
+	// HandshakeTimeout is the maximum duration to wait for the handshake
+	// reply of the peer. The handshake is sent three times, before the
+	// port continues with the configured parameters.
+	// The default is 1 second.
+	HandshakeTimeout time.Duration
+
+	// FrameLayout specifies the layout of transmitted data messages.
+	// Received data messages are always accepted in both layouts.
+	// The default is FrameLayoutDefault.
+	FrameLayout FrameLayout
+
+	// Framing specifies how the messages are delimited and escaped on the wire.
+	// The default is FramingDLE.
+	Framing Framing
+
+	// FramingCharacters replaces the control characters of the DLE framing
+	// to interoperate with devices, which use other control bytes.
+	// The default are the ANTS control characters.
+	FramingCharacters FramingCharacters
+
+	// EOFBehavior specifies how an io.EOF returned by the source is handled.
+	// The default is EOFRetry.
+	EOFBehavior EOFBehavior
+
+	// EOFRetryMaxBackoff is the maximum wait duration between two reads if
+	// the source returns io.EOF repeatedly and EOFBehavior is EOFRetry.
+	// The wait duration starts at 50 milliseconds and is doubled on each
+	// consecutive io.EOF up to this value.
+	// The default is 50 milliseconds (no backoff).
+	EOFRetryMaxBackoff time.Duration
+
+	// OnEOF is called if EOFBehavior is EOFReconnect and the source returned io.EOF.
+	// The returned source replaces the previous one, which is closed before.
+	// If an error is returned, then the port is closed with this error.
+	// Ports created with DialPort redial their transport if this hook is not set.
+	// Otherwise EOFBehavior falls back to EOFClose if this hook is not set.
+	OnEOF func() (io.ReadWriteCloser, error)
+
+	// SuspendOnError suspends the port instead of closing it, if a source
+	// read or write fails or the device was removed. The protocol state,
+	// the queued data chunks and a partially received transmission are kept.
+	// Pass a replacement source to Port.Resume to continue the session.
+	// The peer gives up its transmissions if the suspension outlasts its
+	// retries and a partial transmission is discarded after the
+	// ReassemblyTimeout, if set.
+	SuspendOnError bool
+
+	// transport is set by DialPort and redialed on reconnects.
+	transport Transport
+
+	// ReadPollInterval is the wait duration before the source is read again,
+	// if the previous read returned no data. Shorter intervals reduce the
+	// latency, longer intervals save CPU time on battery powered devices.
+	// Set a negative value to read again immediately. Use this only with
+	// sources, which block until data is available or a read timeout is reached.
+	// The default is 50 milliseconds.
+	ReadPollInterval time.Duration
+
+	// ReadMessageTimeout is the maximum duration to receive a single message
+	// after its start character. Partially received messages are discarded
+	// afterwards. Increase the timeout for low baud rates.
+	// The default is 5 seconds.
+	ReadMessageTimeout time.Duration
+
+	// ReadBufferSize is the size of the buffer passed to the source reads.
+	// The default is 512 bytes.
+	ReadBufferSize int
+
+	// KeepaliveInterval enables the heartbeats. A ping request control
+	// message is sent, if nothing was transmitted for this interval.
+	// The peer replies to it, so the link supervision of both peers
+	// sees traffic on an idle link. A responder never sends heartbeats.
+	// The heartbeats are disabled by default.
+	KeepaliveInterval time.Duration
+
+	// LinkTimeout enables the link supervision. If nothing was received
+	// from the peer for this period, then the link is considered down and
+	// the handlers registered with Port.OnLinkDown are called.
+	// The default is three times the keepalive interval if the heartbeats
+	// are enabled. Otherwise the link supervision is disabled by default.
+	LinkTimeout time.Duration
+
+	// IdleTimeout enables the idle mode for power-saving devices. If no
+	// data was received for this period, then the read routine is parked
+	// on a truly blocking read if the source implements the BlockingSource
+	// interface. Other sources are polled less frequently in idle mode.
+	// The idle mode is disabled by default.
+	IdleTimeout time.Duration
+
+	// EchoCancellation enables the remote-echo suppression for half-duplex
+	// buses like two-wire RS-485, where the transmitter hears its own bytes.
+	// Received bytes, which match the recently transmitted bytes, are discarded.
+	EchoCancellation bool
+
+	// EchoWindow is the maximum duration after a write within the echo of the
+	// transmitted bytes is expected. It has to cover the transmission time of
+	// a complete message at the used baud rate.
+	// The default is 100 milliseconds.
+	EchoWindow time.Duration
+
+	// Timestamps enables the recording of the arrival times of the received
+	// messages for bus timing analysis. The times are exposed with
+	// Message.FrameStart and Message.FrameEnd. Configure the source to
+	// return each byte as soon as possible for a precise resolution.
+	Timestamps bool
+
+	// Clock drives the acknowledgement timeouts, the retransmissions of the
+	// send window, the read message timeout and the reassembly timeout.
+	// Set a virtual clock to test them without sleeping.
+	// The default is the system clock.
+	Clock Clock
+
+	// Logger receives the log messages of the port.
+	// Use NewSlogLogger to pass them to the standard library logger.
+	// Log messages are discarded by default.
+	Logger Logger
+
+	// DecoderPool decodes the received messages on a shared pool of goroutines
+	// instead of an own goroutine per port. Use it if a process hosts many ports.
+	DecoderPool *DecoderPool
+
+	// ReassemblyTimeout is the maximum duration between two data messages
+	// of a multi-message transmission. If it is exceeded, then the partially
+	// received binary data is discarded and an EventReassemblyTimeout is emitted.
+	// The received message sequence of the peer expires after the same duration
+	// without data messages, so the first data message of a restarted peer is
+	// not discarded as a duplicate.
+	// The default is 30 seconds.
+	ReassemblyTimeout time.Duration
+
+	// MaxMessageSize is the maximum binary data size in bytes of a single data
+	// message. Larger data chunks are split into a multi-message transmission,
+	// which is reassembled by the peer. Urgent data chunks are never split.
+	// The peer has to accept data messages of this size. Data messages with
+	// up to 2 KiB are always accepted.
+	// The default is 1 KiB.
+	MaxMessageSize int
+
+	// ReassemblyBufferSize is the maximum size in bytes of the binary data
+	// buffered during a multi-message transmission. Transmissions exceeding
+	// this size are discarded.
+	// The default is 64 KiB.
+	ReassemblyBufferSize int
+
+	// BufferStatusInterval enables periodic buffer status control messages,
+	// which advertise the free reassembly buffer space to the peer.
+	// The peer pauses its transmission if the buffer is nearly full.
+	// Buffer status messages are disabled by default.
+	BufferStatusInterval time.Duration
+
+	// AckTimeout is the duration to wait for the acknowledgement of a data
+	// message before it is retransmitted. Zero waits forever.
+	// Only used by the default ARQ strategy.
+	AckTimeout time.Duration
+
+	// MaxRetries is the maximum number of retransmissions of an unacknowledged
+	// data message. Afterwards the data chunk is given up and the OnWriteError
+	// hook receives ErrMaxRetriesReached. Zero retries forever.
+	// Only used by the default ARQ strategy.
+	MaxRetries int
+
+	// SendWindow is the maximum number of data messages, which are in flight
+	// without an acknowledgement of the peer. This increases the throughput
+	// of high-latency links like radio modems. Lost data messages are
+	// retransmitted selectively and the peer restores their order. The
+	// results of the data chunks are reported in the order they were written.
+	// The peer has to support pipelined data messages. The maximum is 16.
+	// Zero or one sends stop-and-wait, which is the default.
+	SendWindow int
+
+	// ARQStrategy decides when unacknowledged data messages are retransmitted
+	// and when a transmission is given up.
+	// The default is the StopAndWait strategy with the AckTimeout and MaxRetries.
+	ARQStrategy ARQStrategy
+
+	// BreakerFailures enables the circuit breaker. If this number of consecutive
+	// data chunks was given up by the ARQ strategy, then the write methods fail
+	// fast with ErrBreakerOpen for the BreakerCooldown period. Afterwards the
+	// link is probed with a ping until the peer responds, before writes are
+	// accepted again. Already queued data chunks are still transmitted.
+	// Zero disables this threshold.
+	BreakerFailures int
+
+	// BreakerFailureRate opens the circuit breaker, if this ratio (0 to 1) of
+	// the last BreakerWindow data chunks was given up by the ARQ strategy.
+	// Zero disables this threshold.
+	BreakerFailureRate float64
+
+	// BreakerWindow is the number of recent data chunks evaluated
+	// for the BreakerFailureRate.
+	// The default is 20.
+	BreakerWindow int
+
+	// BreakerCooldown is the period without accepted writes after the
+	// circuit breaker opened and between two failed link probes.
+	// The default is 10 seconds.
+	BreakerCooldown time.Duration
+
+	// DeltaEncoding enables the delta encoding of transmitted bulk data chunks.
+	// Only the byte-level differences to the previous data chunk are
+	// transmitted, if both have the same size. This reduces the airtime
+	// of fixed-layout telemetry structures over slow links.
+	// Received delta encoded data chunks are always decoded.
+	DeltaEncoding bool
+
+	// DeltaKeyframeInterval is the maximum number of delta encoded data chunks
+	// before the complete data chunk is transmitted again.
+	// The default is 16.
+	DeltaKeyframeInterval int
+
+	// WriteQueueSize is the number of data chunks queued by Write.
+	// Write blocks and TryWrite returns ErrWriteQueueFull, as long as
+	// the write queue is full.
+	// The default is 5.
+	WriteQueueSize int
+
+	// CoalesceWindow enables the coalescing of tiny data chunks. Data chunks
+	// passed to Write within this window are merged into one data message of at
+	// most MaxMessageSize bytes, which reduces the acknowledge overhead of chatty
+	// applications.
+	// The peer receives the merged data chunk. Only use it if the application
+	// data is self-delimiting. Urgent and service data chunks are never merged.
+	// Coalescing is disabled by default.
+	CoalesceWindow time.Duration
+
+	// TransmitSchedule restricts the transmission of data messages to
+	// time slots. The write queue is held during the quiet periods.
+	// Choose an ARQ resend timeout, which covers the quiet periods of the peer.
+	// The transmission is not restricted by default.
+	TransmitSchedule *TransmitSchedule
+
+	// WriteRateLimit caps the transmitted data messages in bytes per second.
+	// Retransmissions count towards the limit, control messages do not.
+	// Zero disables the limit.
+	WriteRateLimit int
+
+	// ReadRateLimit caps in bytes per second how fast received data chunks
+	// are released to Read and ReadMessage. Urgent data chunks are not limited.
+	// The peer is slowed down, as soon as the read queue is full.
+	// Zero disables the limit.
+	ReadRateLimit int
+
+	// Responder enables the responder mode. The port never initiates a
+	// transmission and only replies to received data chunks. Each received
+	// data chunk is passed to the hook. A returned non-nil response is
+	// transmitted to the peer. Return nil to only acknowledge the data chunk.
+	// Urgent data chunks are answered with an urgent response.
+	// Read, ReadUrgent, Write and WriteUrgent return ErrResponderMode.
+	// The hook is called from an internal port routine.
+	Responder func(m *Message) []byte
+
+	// MessageCodec encodes the values passed to Port.SendMsg and decodes
+	// the values returned by Port.RecvMsg. Both peers have to use the same codec.
+	// The default is JSONMessageCodec.
+	MessageCodec MessageCodec
+
+	// DataHandlerWorkers sets the number of goroutines, which call the
+	// handler registered with Port.OnData. The default of one worker passes
+	// the data chunks in order. More workers call the handler concurrently.
+	DataHandlerWorkers int
+
+	// OnWriteProgress is called each time a data message of a data chunk passed
+	// to Write was acknowledged by the peer. It receives the number of
+	// transmitted bytes and the total size of the data chunk.
+	// The hook is called from the internal port routines and must not block.
+	OnWriteProgress func(sent, total int)
+
+	// OnWriteError is called if a data chunk passed to one of the write methods
+	// could not be transmitted, because the peer never acknowledged it.
+	// It receives the data chunk and ErrMaxRetriesReached.
+	// The hook is called from the internal write routine and must not block.
+	OnWriteError func(data []byte, err error)
+
+	// OnReadProgress is called each time a data message of a data chunk was received.
+	// It receives the number of bytes received so far and the total size of the
+	// data chunk. The total size is -1 as long as the data chunk is incomplete,
+	// because it is unknown to the receiver.
+	// The hook is called from the internal port routines and must not block.
+	OnReadProgress func(received, total int)
+
+	// OnEvent is called for each diagnostic event of the port.
+	// The hook is called from the internal port routines and must not block.
+	OnEvent func(e Event)
+
+	// OnError is called once if the port was closed because of an error,
+	// for example a failed source read or write, a panic of the source,
+	// a removed device or ErrSourceEOF. It receives the same error as
+	// Port.Err(). The hook is not called if the port is closed by the
+	// application. Use it to trigger reconnection logic.
+	// The hook is called from an internal port routine.
+	OnError func(err error)
+
+	// OnSuspend is called each time the port was suspended, because
+	// SuspendOnError is set and the source failed. It receives the source
+	// error. Call Port.Resume with a replacement source.
+	// The hook is called from an internal port routine and must not block.
+	OnSuspend func(err error)
+
+	// OnRawFrameSent is called with each frame written to the source.
+	// The frame is passed exactly as transmitted: escaped and including
+	// the DLE control characters, the address header and the CRC checksum.
+	// Frames are passed in transmission order. The hook must not modify
+	// or retain the frame. Copy it if required.
+	// The hook is called from the internal port routines and must not block.
+	OnRawFrameSent func(frame []byte)
+
+	// OnRawFrameReceived is called with each complete frame read from the
+	// source. The frame is passed exactly as received: escaped and including
+	// the DLE control characters, the address header and the CRC checksum.
+	// The frame is passed before it is validated, so corrupt frames and
+	// frames addressed to other nodes are included. Discarded partial frames
+	// are not passed. The hook must not modify or retain the frame.
+	// Copy it if required.
+	// The hook is called from the internal read routine and must not block.
+	OnRawFrameReceived func(frame []byte)
 }
 
 //###############//
@@ -46,7 +514,140 @@ type Config struct {
 
 // setDefaults sets the default values for unset variables.
 func (c *Config) setDefaults() {
-	if c.DataMessageCRC != CRC16 && c.DataMessageCRC != CRC32 {
+	if c.Logger == nil {
+		c.Logger = NopLogger{}
+	}
+
+	if c.Clock == nil {
+		c.Clock = realClock{}
+	}
+
+	if !c.isValidCRCType(c.DataMessageCRC) {
 		c.DataMessageCRC = CRC16
 	}
+	if !c.isValidCRCType(c.ControlMessageCRC) {
+		c.ControlMessageCRC = CRC16
+	}
+	if !c.isEncrypted() {
+		c.ReplayProtection = false
+	}
+	if c.FECParity < 0 {
+		c.FECParity = 0
+	} else if c.FECParity > maxFECParity {
+		c.FECParity = maxFECParity
+	}
+
+	if c.FrameLayout != FrameLayoutDefault && c.FrameLayout != FrameLayoutEnhanced {
+		c.FrameLayout = FrameLayoutDefault
+	}
+	if c.Framing != FramingDLE && c.Framing != FramingHDLC && c.Framing != FramingCOBS {
+		c.Framing = FramingDLE
+	}
+	if err := c.FramingCharacters.setDefaults(); err != nil {
+		c.Logger.Errorf("%v", err)
+	}
+
+	if c.EOFBehavior != EOFRetry && c.EOFBehavior != EOFClose && c.EOFBehavior != EOFReconnect {
+		c.EOFBehavior = EOFRetry
+	}
+	if c.EOFBehavior == EOFReconnect && c.OnEOF == nil && c.transport == nil {
+		c.EOFBehavior = EOFClose
+	}
+
+	if c.ReadPollInterval == 0 {
+		c.ReadPollInterval = readWaitDuration
+	}
+
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	if c.ReadMessageTimeout <= 0 {
+		c.ReadMessageTimeout = defaultReadMessageTimeout
+	}
+
+	if c.MessageCodec == nil {
+		c.MessageCodec = JSONMessageCodec{}
+	}
+
+	if c.ReadBufferSize <= 0 {
+		c.ReadBufferSize = defaultReadBufferSize
+	}
+
+	if c.WriteQueueSize <= 0 {
+		c.WriteQueueSize = defaultWriteQueueSize
+	}
+
+	if c.EOFRetryMaxBackoff < readWaitDuration {
+		c.EOFRetryMaxBackoff = readWaitDuration
+	}
+
+	if c.EchoWindow <= 0 {
+		c.EchoWindow = defaultEchoWindow
+	}
+
+	if c.KeepaliveInterval < 0 {
+		c.KeepaliveInterval = 0
+	}
+	if c.LinkTimeout <= 0 {
+		c.LinkTimeout = defaultLinkTimeoutFactor * c.KeepaliveInterval
+	}
+
+	if c.ReassemblyTimeout <= 0 {
+		c.ReassemblyTimeout = defaultReassemblyTimeout
+	}
+
+	// Broadcast data messages are never acknowledged.
+	if c.AddressingEnabled && c.PeerAddress == BroadcastAddress {
+		c.SendWindow = 0
+	}
+
+	if c.SendWindow < 0 {
+		c.SendWindow = 0
+	} else if c.SendWindow > maxSendWindow {
+		c.SendWindow = maxSendWindow
+	}
+
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = defaultMaxMessageSize
+	}
+
+	if c.ReassemblyBufferSize <= 0 {
+		c.ReassemblyBufferSize = defaultReassemblyBufferSize
+	}
+
+	if c.DeltaKeyframeInterval <= 0 {
+		c.DeltaKeyframeInterval = defaultDeltaKeyframeInterval
+	}
+
+	if c.DataHandlerWorkers <= 0 {
+		c.DataHandlerWorkers = 1
+	}
+
+	if c.WriteRateLimit < 0 {
+		c.WriteRateLimit = 0
+	}
+	if c.ReadRateLimit < 0 {
+		c.ReadRateLimit = 0
+	}
+
+	if c.BreakerWindow <= 0 {
+		c.BreakerWindow = defaultBreakerWindow
+	}
+	if c.BreakerCooldown <= 0 {
+		c.BreakerCooldown = defaultBreakerCooldown
+	}
+
+	if c.ARQStrategy == nil {
+		c.ARQStrategy = StopAndWait{
+			ResendTimeout: c.AckTimeout,
+			MaxRetries:    c.MaxRetries,
+		}
+	}
+}
+
+// isValidCRCType returns true if the CRC type is supported.
+// The custom CRC type requires a custom validator.
+func (c *Config) isValidCRCType(t CRCType) bool {
+	return t == CRC16 || t == CRC32 || (t == CRCCustom && c.CustomCRC != nil)
 }
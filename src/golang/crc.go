@@ -38,14 +38,58 @@ var (
 )
 
 //##############################//
-//### crcValidator interface ###//
+//### CRCValidator interface ###//
 //##############################//
 
-type crcValidator interface {
+// A CRCValidator computes and validates the checksums of messages.
+// Set a custom implementation with Config.CustomCRC.
+type CRCValidator interface {
+	// Validate returns true if rawCRC is the checksum of data.
 	Validate(data []byte, rawCRC []byte) bool
+
+	// Checksum returns the checksum of data. The length
+	// of the checksum must not depend on the data.
 	Checksum(data []byte) (rawCRC []byte)
 }
 
+// getCRCValidator returns the validator and the checksum length in bytes
+// for the CRC type.
+func getCRCValidator(t CRCType, custom CRCValidator) (CRCValidator, int) {
+	switch t {
+	case CRC32:
+		return getCRC32Validator(), 4
+	case CRCCustom:
+		return custom, len(custom.Checksum(nil))
+	default:
+		return getCRC16Validator(), 2
+	}
+}
+
+// appendChecksum appends the checksum of data to dst.
+// The built-in validators never allocate.
+func appendChecksum(dst []byte, v CRCValidator, data []byte) []byte {
+	switch v := v.(type) {
+	case *crc16Validator:
+		return v.appendChecksum(dst, data)
+	case *crc32Validator:
+		return v.appendChecksum(dst, data)
+	default:
+		return append(dst, v.Checksum(data)...)
+	}
+}
+
+// crcTypeFlag returns the CRC type field of the data message flags.
+func crcTypeFlag(t CRCType) byte {
+	switch t {
+	case CRC32:
+		return flagCRC32
+	case CRCCustom:
+		return flagCRCCustom
+	default:
+		return flagCRC16
+	}
+}
+
 //#############################//
 //### CRC-16 implementation ###//
 //#############################//
@@ -84,14 +128,12 @@ func (c *crc16Validator) Validate(data []byte, rawCRC []byte) bool {
 }
 
 func (c *crc16Validator) Checksum(data []byte) (rawCRC []byte) {
-	// Calculate the CRC checksum of data.
-	crc := crc16.Checksum(data, c.table)
-
-	// Transform to a byte slice.
-	rawCRC = make([]byte, 2)
-	binary.LittleEndian.PutUint16(rawCRC, crc)
+	return c.appendChecksum(make([]byte, 0, 2), data)
+}
 
-	return rawCRC
+// appendChecksum appends the checksum of data to dst.
+func (c *crc16Validator) appendChecksum(dst []byte, data []byte) []byte {
+	return binary.LittleEndian.AppendUint16(dst, crc16.Checksum(data, c.table))
 }
 
 //#############################//
@@ -132,12 +174,10 @@ func (c *crc32Validator) Validate(data []byte, rawCRC []byte) bool {
 }
 
 func (c *crc32Validator) Checksum(data []byte) (rawCRC []byte) {
-	// Calculate the CRC checksum of data.
-	crc := crc32.Checksum(data, c.table)
-
-	// Transform to a byte slice.
-	rawCRC = make([]byte, 4)
-	binary.LittleEndian.PutUint32(rawCRC, crc)
+	return c.appendChecksum(make([]byte, 0, 4), data)
+}
 
-	return rawCRC
+// appendChecksum appends the checksum of data to dst.
+func (c *crc32Validator) appendChecksum(dst []byte, data []byte) []byte {
+	return binary.LittleEndian.AppendUint32(dst, crc32.Checksum(data, c.table))
 }
@@ -0,0 +1,230 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"time"
+)
+
+//########################//
+//### Debug State type ###//
+//########################//
+
+// A DebugState is a snapshot of the internal protocol state machine of a port.
+// Dump it if a link appears to be wedged.
+type DebugState struct {
+	// IsClosed, IsSuspended and Err describe the port state.
+	IsClosed    bool
+	IsSuspended bool
+	Err         error
+
+	// MSN is the current message sequence number.
+	MSN byte
+
+	// PeerMSN is the last received peer message sequence number.
+	// It is the unknown message sequence number (0) if nothing was received yet.
+	PeerMSN byte
+
+	// InFlight contains the data messages, which are waiting
+	// for an acknowledgement of the peer.
+	InFlight []InFlightFrame
+
+	// ReassemblyBufferSize is the size of the partially received
+	// binary data of a multi-message transmission in bytes.
+	ReassemblyBufferSize int
+
+	// PeerFreeBuffer is the free reassembly buffer space advertised
+	// by the peer. It is -1 if unknown.
+	PeerFreeBuffer int
+
+	// PeerWaiting is set if the peer asked to pause the
+	// transmission with a wait control message.
+	PeerWaiting bool
+
+	// Decoder is the state of the received message decoder.
+	Decoder DecoderState
+
+	// Number of queued items of the internal channels.
+	WriteQueueLength          int
+	UrgentWriteQueueLength    int
+	ReadQueueLength           int
+	UrgentReadQueueLength     int
+	ControlMessageQueueLength int
+
+	// Capacities of the internal channels. Together with the
+	// queue lengths they describe the buffer fill levels.
+	WriteQueueCapacity          int
+	UrgentWriteQueueCapacity    int
+	ReadQueueCapacity           int
+	UrgentReadQueueCapacity     int
+	ControlMessageQueueCapacity int
+}
+
+// An InFlightFrame is a transmitted data message, which was not acknowledged yet.
+type InFlightFrame struct {
+	MSN     byte
+	Urgent  bool
+	Size    int // Binary data size in bytes.
+	Retries int
+	Since   time.Time
+}
+
+// A DecoderState is the state of the received message decoder.
+type DecoderState struct {
+	StartCharacterFound bool
+	StartCharacter      byte
+	IsControlMessage    bool
+	ByteIsEscaped       bool
+	BufferedBytes       int
+}
+
+// DebugState returns a snapshot of the internal protocol state.
+// It is safe to call this method even if the port routines are blocked.
+func (p *Port) DebugState() DebugState {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	s := DebugState{
+		IsClosed:                  p.IsClosed(),
+		IsSuspended:               p.IsSuspended(),
+		Err:                       p.Err(),
+		MSN:                       p.msn,
+		PeerMSN:                   p.readDebugInfo.PeerMSN,
+		ReassemblyBufferSize:      p.readDebugInfo.ReassemblyBufferSize,
+		Decoder:                   p.readDebugInfo.Decoder,
+		WriteQueueLength:          len(p.writeDataChunkChan),
+		UrgentWriteQueueLength:    len(p.writeUrgentChunkChan),
+		ReadQueueLength:           len(p.readDataChunkChan),
+		UrgentReadQueueLength:     len(p.readUrgentChunkChan),
+		ControlMessageQueueLength: len(p.readControlMessageChan),
+
+		WriteQueueCapacity:          cap(p.writeDataChunkChan),
+		UrgentWriteQueueCapacity:    cap(p.writeUrgentChunkChan),
+		ReadQueueCapacity:           cap(p.readDataChunkChan),
+		UrgentReadQueueCapacity:     cap(p.readUrgentChunkChan),
+		ControlMessageQueueCapacity: cap(p.readControlMessageChan),
+	}
+
+	if p.inFlight != nil {
+		s.InFlight = []InFlightFrame{*p.inFlight}
+	} else if len(p.inFlightFrames) > 0 {
+		s.InFlight = append([]InFlightFrame(nil), p.inFlightFrames...)
+	}
+
+	p.peerBufferMutex.Lock()
+	s.PeerFreeBuffer = p.peerFreeBuffer
+	s.PeerWaiting = p.peerWaiting
+	p.peerBufferMutex.Unlock()
+
+	return s
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// readDebugInfo is the debug state published by the read messages loop.
+type readDebugInfo struct {
+	PeerMSN              byte
+	ReassemblyBufferSize int
+	Decoder              DecoderState
+}
+
+// publishDecoderState publishes the read state for DebugState.
+// This method must be only called by the read messages routine.
+func (p *Port) publishDecoderState() {
+	d := p.decoder.frame
+
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	p.readDebugInfo.Decoder = DecoderState{
+		StartCharacterFound: d.startCharacterFound,
+		StartCharacter:      d.startCharacter,
+		IsControlMessage:    d.isControlMessage,
+		ByteIsEscaped:       d.byteIsEscaped,
+		BufferedBytes:       len(d.buf),
+	}
+	p.readDebugInfo.ReassemblyBufferSize = len(p.readBinaryDataBuffer)
+
+	if p.readLastPMSNValid {
+		p.readDebugInfo.PeerMSN = p.readLastPMSN
+	}
+}
+
+// currentMSN returns the current message sequence number.
+func (p *Port) currentMSN() byte {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	return p.msn
+}
+
+// setInFlight sets the data message, which waits for an acknowledgement.
+// Pass nil if no data message is in flight.
+func (p *Port) setInFlight(f *InFlightFrame) {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	p.inFlight = f
+}
+
+// setInFlightFrames sets the data messages of the send window,
+// which wait for an acknowledgement.
+func (p *Port) setInFlightFrames(frames []InFlightFrame) {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	p.inFlightFrames = frames
+}
+
+// setInFlightRetries updates the retry count of the data message in flight.
+func (p *Port) setInFlightRetries(retries int) {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if p.inFlight != nil {
+		p.inFlight.Retries = retries
+	}
+}
+
+// addPendingWrites adds delta to the number of data chunks,
+// which were passed to Write or WriteUrgent and are not written yet.
+func (p *Port) addPendingWrites(delta int) {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	p.pendingWrites += delta
+}
+
+// hasPendingWrites returns true if data chunks are queued or in flight.
+func (p *Port) hasPendingWrites() bool {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	return p.pendingWrites > 0
+}
@@ -0,0 +1,189 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package debug serves the live state of an ANTS port over HTTP for
+// the introspection of a stuck link in the field. Mount the handler on
+// a debug HTTP server or publish the state with the expvar package:
+//
+//	frames := debug.NewFrameLog(0)
+//	config := &ants.Config{}
+//	frames.Attach(config)
+//	p := ants.NewPort(source, config)
+//	http.Handle("/debug/ants", debug.Handler(p, frames))
+package debug
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//##################//
+//### State type ###//
+//##################//
+
+// A State is the live state of a port served by the handler.
+type State struct {
+	// Time when the state was taken.
+	Time time.Time
+
+	// IsClosed and Err describe the port state.
+	// Err is the message of the last port error.
+	IsClosed bool
+	Err      string
+
+	// PendingWrites is the number of not yet written data chunks.
+	PendingWrites int
+
+	// Peer contains the handshake result, if the handshake succeeded.
+	Peer *ants.PeerInfo
+
+	// Protocol is the internal protocol state including the buffer fill levels.
+	// Its Err field is cleared, because it is not serializable.
+	Protocol ants.DebugState
+
+	// Stats are the traffic counters of the port.
+	Stats ants.StatsSnapshot
+
+	// BytesSentPerSecond and BytesReceivedPerSecond are the recent throughputs.
+	BytesSentPerSecond     float64
+	BytesReceivedPerSecond float64
+
+	// Frames are the recently sent and received frames, oldest first.
+	// It is empty if no frame log was passed.
+	Frames []Frame
+}
+
+// A Frame is a recorded frame of the frame log.
+type Frame struct {
+	Time      time.Time
+	Direction string
+
+	// Info is the one-line summary of the decoded frame
+	// or the error, if the frame is malformed.
+	Info string
+
+	// Raw is the escaped frame as hex string.
+	Raw string
+}
+
+// GetState returns the current state of the port.
+// The frame log is optional and might be nil.
+func GetState(p *ants.Port, frames *FrameLog) State {
+	s := State{
+		Time:          time.Now(),
+		IsClosed:      p.IsClosed(),
+		PendingWrites: p.PendingWrites(),
+		Protocol:      p.DebugState(),
+		Stats:         p.Stats().Snapshot(),
+	}
+
+	if err := p.Err(); err != nil {
+		s.Err = err.Error()
+	}
+	s.Protocol.Err = nil
+
+	if info, ok := p.PeerInfo(); ok {
+		s.Peer = &info
+	}
+
+	s.BytesSentPerSecond, s.BytesReceivedPerSecond = p.Throughput()
+
+	if frames != nil {
+		s.Frames = frames.frames()
+	}
+
+	return s
+}
+
+//###############//
+//### Handler ###//
+//###############//
+
+// Handler returns a HTTP handler, which serves the current state of
+// the port as JSON document. The frame log is optional and might be nil.
+func Handler(p *ants.Port, frames *FrameLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := json.MarshalIndent(GetState(p, frames), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(data)
+	})
+}
+
+// Publish publishes the state of the port with the expvar package
+// under the name. It panics if the name is already registered.
+// The frame log is optional and might be nil.
+func Publish(name string, p *ants.Port, frames *FrameLog) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return GetState(p, frames)
+	}))
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// frames returns the decoded frames of the frame log.
+func (l *FrameLog) frames() []Frame {
+	config := l.getConfig()
+	records := l.Records()
+
+	frames := make([]Frame, len(records))
+	for i, r := range records {
+		f := Frame{
+			Time:      r.Time,
+			Direction: r.Direction.String(),
+			Raw:       hex.EncodeToString(r.Frame),
+		}
+
+		var (
+			info *ants.FrameInfo
+			err  error
+		)
+		if config != nil {
+			info, err = ants.ParseFrame(r.Frame, config)
+		} else {
+			info, err = ants.ParseFrame(r.Frame)
+		}
+		if err != nil {
+			f.Info = err.Error()
+		} else {
+			f.Info = info.String()
+		}
+
+		frames[i] = f
+	}
+
+	return frames
+}
@@ -0,0 +1,104 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package debug
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/capture"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameLog(t *testing.T) {
+	l := NewFrameLog(3)
+	require.Empty(t, l.Records())
+
+	for i := byte(0); i < 5; i++ {
+		l.record(capture.Sent, []byte{i})
+	}
+
+	records := l.Records()
+	require.Len(t, records, 3)
+	for i, r := range records {
+		require.Equal(t, capture.Sent, r.Direction)
+		require.Equal(t, []byte{byte(i + 2)}, r.Frame)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	a, b := net.Pipe()
+
+	frames := NewFrameLog(0)
+	config := &ants.Config{}
+	frames.Attach(config)
+	pa, pb := ants.NewPort(a, config), ants.NewPort(b)
+	defer pb.Close()
+
+	require.NoError(t, pa.Write([]byte("ants")))
+	data, err := pb.Read()
+	require.NoError(t, err)
+	require.Equal(t, []byte("ants"), data)
+
+	server := httptest.NewServer(Handler(pa, frames))
+	defer server.Close()
+
+	get := func() State {
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		var s State
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+		return s
+	}
+
+	s := get()
+	require.False(t, s.IsClosed)
+	require.Empty(t, s.Err)
+	require.Equal(t, uint64(1), s.Stats.DataMessagesSent)
+	require.NotZero(t, s.Protocol.WriteQueueCapacity)
+
+	var sent, received bool
+	for _, f := range s.Frames {
+		require.NotEmpty(t, f.Raw)
+		if f.Direction == "sent" && strings.HasPrefix(f.Info, "DATA") {
+			sent = true
+		} else if f.Direction == "received" && strings.HasPrefix(f.Info, "ACK") {
+			received = true
+		}
+	}
+	require.True(t, sent)
+	require.True(t, received)
+
+	require.NoError(t, pa.Close())
+	require.True(t, get().IsClosed)
+
+	resp, err := http.Post(server.URL, "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
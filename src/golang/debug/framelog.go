@@ -0,0 +1,128 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package debug
+
+import (
+	"sync"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/capture"
+)
+
+const (
+	// DefaultFrameLogSize is the number of frames kept by a frame
+	// log if no size is passed to NewFrameLog.
+	DefaultFrameLogSize = 64
+)
+
+//######################//
+//### Frame log type ###//
+//######################//
+
+// A FrameLog keeps the most recently sent and received frames of a port
+// in a ring buffer. It is safe to use a frame log from multiple goroutines.
+type FrameLog struct {
+	mutex   sync.Mutex
+	config  *ants.Config
+	records []capture.Record
+	next    int
+	full    bool
+}
+
+// NewFrameLog creates a new frame log, which keeps the last size frames.
+func NewFrameLog(size int) *FrameLog {
+	if size <= 0 {
+		size = DefaultFrameLogSize
+	}
+
+	return &FrameLog{
+		records: make([]capture.Record, size),
+	}
+}
+
+// Attach sets the raw frame hooks of the port config to record all
+// sent and received frames. Already set hooks are still called.
+// Pass the config to ants.NewPort afterwards.
+func (l *FrameLog) Attach(config *ants.Config) {
+	l.mutex.Lock()
+	l.config = config
+	l.mutex.Unlock()
+
+	onSent := config.OnRawFrameSent
+	config.OnRawFrameSent = func(frame []byte) {
+		l.record(capture.Sent, frame)
+		if onSent != nil {
+			onSent(frame)
+		}
+	}
+
+	onReceived := config.OnRawFrameReceived
+	config.OnRawFrameReceived = func(frame []byte) {
+		l.record(capture.Received, frame)
+		if onReceived != nil {
+			onReceived(frame)
+		}
+	}
+}
+
+// Records returns a copy of the kept frames, oldest first.
+func (l *FrameLog) Records() []capture.Record {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.full {
+		return append([]capture.Record(nil), l.records[:l.next]...)
+	}
+
+	records := make([]capture.Record, 0, len(l.records))
+	records = append(records, l.records[l.next:]...)
+	return append(records, l.records[:l.next]...)
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+func (l *FrameLog) record(d capture.Direction, frame []byte) {
+	// The frame buffer is reused by the port.
+	frame = append([]byte(nil), frame...)
+	now := time.Now()
+
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.records[l.next] = capture.Record{Time: now, Direction: d, Frame: frame}
+	l.next++
+	if l.next == len(l.records) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// getConfig returns the config the frame log was attached to.
+func (l *FrameLog) getConfig() *ants.Config {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.config
+}
@@ -0,0 +1,174 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//######################//
+//### Delta Encoding ###//
+//######################//
+
+const (
+	// Unchanged gaps up to this size are included in a run,
+	// because a new run header costs at least two bytes.
+	deltaMaxGap = 2
+
+	defaultDeltaKeyframeInterval = 16
+)
+
+var (
+	errDeltaNoBase  = errors.New("delta encoded data chunk without base data chunk")
+	errDeltaCorrupt = errors.New("delta encoded data is corrupt")
+)
+
+// encodeDelta returns the byte-level differences of data to the base data chunk.
+// The delta is a sequence of runs: Skip (uvarint) | Length (uvarint) | Bytes.
+// Skip is the number of unchanged bytes since the end of the previous run.
+// Returns false if both data chunks differ in size
+// or if the delta is not smaller than the data chunk.
+func encodeDelta(base, data []byte) ([]byte, bool) {
+	if len(base) != len(data) {
+		return nil, false
+	}
+
+	delta := make([]byte, 0, len(data))
+	var tmp [binary.MaxVarintLen64]byte
+	pos := 0
+
+	for i := 0; i < len(data); {
+		// Skip unchanged bytes.
+		if base[i] == data[i] {
+			i++
+			continue
+		}
+
+		// Find the end of the changed run.
+		// Small unchanged gaps are included.
+		end := i + 1
+		for gap := 0; end < len(data) && gap <= deltaMaxGap; end++ {
+			if base[end] == data[end] {
+				gap++
+			} else {
+				gap = 0
+			}
+		}
+		for base[end-1] == data[end-1] {
+			end--
+		}
+
+		// Append the run.
+		delta = append(delta, tmp[:binary.PutUvarint(tmp[:], uint64(i-pos))]...)
+		delta = append(delta, tmp[:binary.PutUvarint(tmp[:], uint64(end-i))]...)
+		delta = append(delta, data[i:end]...)
+
+		// Abort if the delta is not worth it.
+		if len(delta) >= len(data) {
+			return nil, false
+		}
+
+		pos = end
+		i = end
+	}
+
+	return delta, true
+}
+
+// decodeDelta applies the delta to a copy of the base data chunk.
+func decodeDelta(base, delta []byte) ([]byte, error) {
+	if base == nil {
+		return nil, errDeltaNoBase
+	}
+
+	data := append([]byte(nil), base...)
+	pos := 0
+
+	for len(delta) > 0 {
+		skip, n := binary.Uvarint(delta)
+		if n <= 0 {
+			return nil, errDeltaCorrupt
+		}
+		delta = delta[n:]
+
+		length, n := binary.Uvarint(delta)
+		if n <= 0 || length == 0 {
+			return nil, errDeltaCorrupt
+		}
+		delta = delta[n:]
+
+		if skip > uint64(len(data)-pos) || length > uint64(len(data)-pos)-skip || length > uint64(len(delta)) {
+			return nil, errDeltaCorrupt
+		}
+
+		pos += int(skip)
+		pos += copy(data[pos:], delta[:length])
+		delta = delta[length:]
+	}
+
+	return data, nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// encodeDataChunk delta encodes the bulk data chunk if enabled.
+// Every keyframe interval, the complete data chunk is transmitted.
+// This method must be only called by the write loop.
+func (p *Port) encodeDataChunk(flags byte, data []byte) (byte, []byte) {
+	if !p.config.DeltaEncoding || flags&(flagUrgent|flagService) != 0 || p.writeDeltaBase == nil {
+		return flags, data
+	}
+	if !p.peerDeltaEncoding() {
+		return flags, data
+	}
+	if p.writeDeltaCount >= p.config.DeltaKeyframeInterval {
+		return flags, data
+	}
+
+	delta, ok := encodeDelta(p.writeDeltaBase, data)
+	if !ok {
+		return flags, data
+	}
+
+	return flags | flagDelta, delta
+}
+
+// setWriteDeltaBase updates the base data chunk after a successful transmission.
+// Pass nil to force a keyframe.
+// This method must be only called by the write loop.
+func (p *Port) setWriteDeltaBase(flags byte, data []byte) {
+	if !p.config.DeltaEncoding || flags&(flagUrgent|flagService) != 0 {
+		return
+	}
+
+	if data == nil || flags&flagDelta == 0 {
+		p.writeDeltaCount = 0
+	} else {
+		p.writeDeltaCount++
+	}
+
+	// Copy the data, because the caller might reuse it.
+	p.writeDeltaBase = append(p.writeDeltaBase[:0], data...)
+	if data == nil {
+		p.writeDeltaBase = nil
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+//#####################//
+//### Removed Error ###//
+//#####################//
+
+// A RemovedError is an optional interface of errors returned by the source,
+// which signals the removal of the device, for example an unplugged USB adapter.
+// The port is closed with the unwrapped error and emits an EventDeviceRemoved,
+// unless Config.SuspendOnError is set.
+// The serial package returns serial.ErrDeviceRemoved.
+type RemovedError interface {
+	error
+
+	// DeviceRemoved returns true if the device was removed.
+	DeviceRemoved() bool
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// isDeviceRemoved returns true if the error signals the removal of the device.
+func isDeviceRemoved(err error) bool {
+	re, ok := err.(RemovedError)
+	return ok && re.DeviceRemoved()
+}
+
+// handleDeviceRemoved closes the port with the source error, which signals
+// the removal of the device. Port.Err() returns the unwrapped error, so
+// applications can distinguish an unplugged device from other failures.
+func (p *Port) handleDeviceRemoved(err error) {
+	// Only report the first detection. Both loop routines might detect it.
+	if p.IsClosed() {
+		return
+	}
+
+	p.log.Errorf("source device removed: %v", err)
+	p.emitEvent(EventDeviceRemoved, "source device removed: %v", err)
+	p.closeAndLogError(err)
+}
@@ -0,0 +1,334 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package dfu
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/xfer"
+)
+
+var errUnexpectedImage = errors.New("unexpected image")
+
+//###################//
+//### Target type ###//
+//###################//
+
+// A Target is the device-side implementation of the firmware update,
+// for example the driver of the update slot of a flash memory.
+// The methods are called from the internal routines of the device.
+type Target interface {
+	// Begin prepares the update slot for the image and returns
+	// the sink of the image content.
+	Begin(img xfer.File) (io.Writer, error)
+
+	// Verify checks the completely received image. The size, the checksum
+	// and the signature of the image were already verified.
+	Verify(img xfer.File) error
+
+	// Commit activates the verified image, for example by marking
+	// the update slot as bootable.
+	Commit(img xfer.File) error
+
+	// Abort discards the partially received or not committed image.
+	Abort(img xfer.File)
+}
+
+//###################//
+//### Device type ###//
+//###################//
+
+// A Device answers the firmware update requests of the host and passes
+// the image to the target. It implements the update state machine.
+// This implementation is thread-safe.
+type Device struct {
+	target   Target
+	config   *Config
+	receiver *xfer.Receiver
+
+	mutex        sync.Mutex
+	state        State
+	image        xfer.File
+	sink         io.Writer
+	digest       hash.Hash // SHA-256 digest of the received image.
+	lastResponse []byte    // Sent again for a duplicated request.
+}
+
+// NewDevice creates a new firmware update device for the target.
+// Optionally pass a configuration.
+func NewDevice(t Target, config ...*Config) *Device {
+	d := &Device{
+		target: t,
+		config: getConfig(config),
+		digest: sha256.New(),
+	}
+
+	// Route the image transfer to the target.
+	var c xfer.Config
+	if d.config.Transfer != nil {
+		c = *d.config.Transfer
+	}
+	onComplete := c.OnComplete
+	c.OnComplete = func(f xfer.File, err error) {
+		d.transferred(f, err)
+		if onComplete != nil {
+			onComplete(f, err)
+		}
+	}
+	d.receiver = xfer.NewReceiver(d.open, &c)
+
+	return d
+}
+
+// State returns the current update state.
+func (d *Device) State() State {
+	// Lock the mutex.
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.state
+}
+
+// Serve answers the update and image transfer requests of the host
+// until the port is closed. Returns the port's read or write error.
+// Call it again with the new port after a reconnect to resume the update.
+func (d *Device) Serve(p *ants.Port) error {
+	go d.receiver.Serve(p)
+
+	service := p.Service(ants.ServiceDFU)
+	for {
+		req, err := service.Read()
+		if err != nil {
+			return err
+		}
+
+		// Skip invalid requests.
+		if len(req) < 2 {
+			continue
+		}
+
+		if err = service.Write(d.handle(req)); err != nil {
+			return err
+		}
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// handle processes the request and returns the response.
+// Only called by the serve routine.
+func (d *Device) handle(req []byte) []byte {
+	op, id, payload := req[0], req[1], req[2:]
+
+	// Answer a duplicated request with the same response.
+	// The host resent it, because the response got lost.
+	if d.lastResponse != nil && d.lastResponse[0] == op && d.lastResponse[1] == id {
+		return d.lastResponse
+	}
+
+	var status byte
+	var resp []byte
+
+	switch op {
+	case opBegin:
+		status, resp = d.begin(payload)
+	case opVerify:
+		status, resp = d.verify(payload)
+	case opCommit:
+		status, resp = d.commit()
+	case opAbort:
+		d.abort()
+	case opStatus:
+		resp = []byte{byte(d.State())}
+	default:
+		status = statusInvalidRequest
+	}
+
+	// Response: Operation | Request ID | Status | Payload
+	d.lastResponse = append([]byte{op, id, status}, resp...)
+	return d.lastResponse
+}
+
+// begin prepares the target for the image.
+// A partially received image is resumed.
+func (d *Device) begin(payload []byte) (byte, []byte) {
+	img, ok := decodeImage(payload)
+	if !ok {
+		return statusInvalidRequest, nil
+	}
+
+	if d.State() == StateReceiving && d.image == img {
+		return statusOK, nil
+	}
+
+	// Discard the previous update.
+	d.abort()
+
+	sink, err := d.target.Begin(img)
+	if err != nil {
+		return statusFailed, []byte(err.Error())
+	}
+
+	d.mutex.Lock()
+	d.image, d.sink = img, sink
+	d.mutex.Unlock()
+
+	d.setState(StateReceiving)
+	return statusOK, nil
+}
+
+// verify checks the signature of the received image and lets the target
+// check it. The result is reported to the host and to the hook.
+func (d *Device) verify(signature []byte) (byte, []byte) {
+	if d.State() != StateReceived {
+		return statusInvalidState, nil
+	}
+
+	status, err := d.verifyImage(signature)
+	if d.config.OnVerify != nil {
+		d.config.OnVerify(d.image, err)
+	}
+	if err != nil {
+		d.abort()
+		return status, []byte(err.Error())
+	}
+
+	d.setState(StateVerified)
+	return statusOK, nil
+}
+
+// verifyImage checks the signature and lets the target check the image.
+// The status of the failed verification is returned.
+func (d *Device) verifyImage(signature []byte) (byte, error) {
+	if d.config.Verifier != nil {
+		// Lock the mutex.
+		d.mutex.Lock()
+		digest := d.digest.Sum(nil)
+		d.mutex.Unlock()
+
+		if err := d.config.Verifier.Verify(digest, signature); err != nil {
+			return statusInvalidSig, err
+		}
+	}
+
+	if err := d.target.Verify(d.image); err != nil {
+		return statusFailed, err
+	}
+	return statusOK, nil
+}
+
+// commit lets the target activate the verified image.
+func (d *Device) commit() (byte, []byte) {
+	if d.State() != StateVerified {
+		return statusInvalidState, nil
+	}
+
+	if err := d.target.Commit(d.image); err != nil {
+		d.abort()
+		return statusFailed, []byte(err.Error())
+	}
+
+	d.setState(StateCommitted)
+	return statusOK, nil
+}
+
+// abort discards the current update and returns to the idle state.
+func (d *Device) abort() {
+	// Lock the mutex.
+	d.mutex.Lock()
+	state, img := d.state, d.image
+	d.state, d.sink = StateIdle, nil
+	d.mutex.Unlock()
+
+	// Discard the partially received image. The transfer
+	// is ignored, because the state is idle already.
+	d.receiver.Abort()
+
+	if state == StateIdle || state == StateCommitted {
+		return
+	}
+
+	d.target.Abort(img)
+	d.notifyState(StateIdle)
+}
+
+// open returns the sink of the announced image to the receiver.
+func (d *Device) open(f xfer.File) (io.Writer, error) {
+	// Lock the mutex.
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.state != StateReceiving || f != d.image {
+		return nil, errUnexpectedImage
+	}
+
+	// The image is received from the beginning.
+	// Digest it for the signature verification.
+	d.digest.Reset()
+
+	// The multi writer hides the io.Closer of the sink. The target owns it.
+	return io.MultiWriter(d.sink, d.digest), nil
+}
+
+// transferred handles the end of an image transfer.
+func (d *Device) transferred(f xfer.File, err error) {
+	// Lock the mutex.
+	d.mutex.Lock()
+	if d.state != StateReceiving || f != d.image {
+		d.mutex.Unlock()
+		return
+	}
+
+	state := StateReceived
+	if err != nil {
+		state = StateIdle
+		d.sink = nil
+	}
+	d.state = state
+	d.mutex.Unlock()
+
+	if err != nil {
+		d.target.Abort(f)
+	}
+	d.notifyState(state)
+}
+
+// setState sets the update state and reports the change.
+func (d *Device) setState(s State) {
+	// Lock the mutex.
+	d.mutex.Lock()
+	d.state = s
+	d.mutex.Unlock()
+
+	d.notifyState(s)
+}
+
+// notifyState passes the changed state to the hook.
+func (d *Device) notifyState(s State) {
+	if d.config.OnStateChange != nil {
+		d.config.OnStateChange(s)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package dfu implements the standardized firmware update protocol of the
+// ANTS library. The host updates the firmware of the peer device in four
+// phases: begin, transfer, verify and commit. The image is transferred with
+// the file transfer protocol of the xfer package, so interrupted transfers
+// are resumed. The device side is a state machine, which passes the image
+// to a Target implementation.
+package dfu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/desertbit/ants/src/golang/xfer"
+)
+
+//#################//
+//### Constants ###//
+//#################//
+
+// Operations:
+const (
+	opBegin  byte = 1
+	opVerify byte = 2
+	opCommit byte = 3
+	opAbort  byte = 4
+	opStatus byte = 5
+)
+
+// Status codes:
+const (
+	statusOK             byte = 0
+	statusInvalidRequest byte = 1
+	statusInvalidState   byte = 2
+	statusFailed         byte = 3
+	statusInvalidSig     byte = 4
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	defaultRetries = 3
+
+	// imageHeaderLength is the length of the begin request payload without the name.
+	imageHeaderLength = 12
+)
+
+//#################//
+//### Variables ###//
+//#################//
+
+// Errors:
+var (
+	// ErrInvalidResponse is returned if the response of the peer could not be parsed.
+	ErrInvalidResponse = errors.New("invalid response")
+
+	// ErrInvalidState is returned if the device is not in the state
+	// required by the operation, for example if the update was aborted.
+	ErrInvalidState = errors.New("invalid update state")
+)
+
+//##################//
+//### State type ###//
+//##################//
+
+// State is the state of the device-side update state machine:
+//
+//	Idle ──Begin──> Receiving ──transfer──> Received ──Verify──> Verified ──Commit──> Committed
+//
+// Begin is accepted in any state and restarts the update. Abort, a
+// failed transfer, a failed verification and a failed commit return to Idle.
+type State byte
+
+// Update states:
+const (
+	StateIdle State = iota
+	StateReceiving
+	StateReceived
+	StateVerified
+	StateCommitted
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateReceiving:
+		return "receiving"
+	case StateReceived:
+		return "received"
+	case StateVerified:
+		return "verified"
+	case StateCommitted:
+		return "committed"
+	default:
+		return fmt.Sprintf("State(%d)", byte(s))
+	}
+}
+
+//###################//
+//### Config type ###//
+//###################//
+
+// A Config represents the configuration of a firmware update.
+type Config struct {
+	// Timeout is the maximum duration to wait for a response of the device.
+	// Preparing, verifying and committing an image might take a while.
+	// The default is 30 seconds.
+	Timeout time.Duration
+
+	// Retries is the number of times a failed transfer is resumed.
+	// A corrupt image is transferred again from the beginning.
+	// The default is 3.
+	Retries int
+
+	// Transfer is the configuration of the image transfer.
+	// Its progress callbacks are called on the respective side.
+	Transfer *xfer.Config
+
+	// OnStateChange is called by the device each time the update state changed.
+	// The hook is called from the internal routines and must not block.
+	OnStateChange func(s State)
+
+	// Verifier checks the signature of the received image on the device,
+	// before the target verifies it. Images without a valid signature are
+	// discarded. Pass the signature to the host with UpdateSigned.
+	// Nil disables the signature verification.
+	Verifier Verifier
+
+	// OnVerify is called with the verification result of the image.
+	// The device passes its own result and the host the result reported
+	// by the device. Nil is passed if the image was verified.
+	// The hook is called from the internal routines and must not block.
+	OnVerify func(img xfer.File, err error)
+}
+
+// setDefaults sets the default values for unset variables.
+func (c *Config) setDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+
+	if c.Retries < 0 {
+		c.Retries = 0
+	} else if c.Retries == 0 {
+		c.Retries = defaultRetries
+	}
+}
+
+// getConfig returns a copy of the optional config with the default values.
+func getConfig(config []*Config) *Config {
+	var c Config
+	if len(config) > 0 && config[0] != nil {
+		c = *config[0]
+	}
+	c.setDefaults()
+
+	return &c
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// encodeImage encodes the begin request payload:
+// Size (8 Bytes) | Checksum (4 Bytes) | Name
+func encodeImage(img xfer.File) []byte {
+	buf := make([]byte, imageHeaderLength, imageHeaderLength+len(img.Name))
+	binary.LittleEndian.PutUint64(buf, uint64(img.Size))
+	binary.LittleEndian.PutUint32(buf[8:], img.Checksum)
+	return append(buf, img.Name...)
+}
+
+// decodeImage decodes the begin request payload.
+func decodeImage(payload []byte) (img xfer.File, ok bool) {
+	if len(payload) < imageHeaderLength {
+		return img, false
+	}
+
+	img.Size = int64(binary.LittleEndian.Uint64(payload))
+	img.Checksum = binary.LittleEndian.Uint32(payload[8:])
+	img.Name = string(payload[imageHeaderLength:])
+
+	return img, img.Size >= 0
+}
+
+// statusError returns the error of the response status.
+func statusError(status byte, payload []byte) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusInvalidState:
+		return ErrInvalidState
+	case statusInvalidSig:
+		return ErrInvalidSignature
+	case statusFailed:
+		return fmt.Errorf("peer failed: %s", payload)
+	default:
+		return ErrInvalidResponse
+	}
+}
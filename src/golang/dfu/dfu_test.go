@@ -0,0 +1,225 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package dfu
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang/testutil"
+	"github.com/desertbit/ants/src/golang/xfer"
+	"github.com/stretchr/testify/require"
+)
+
+// target records the image and the calls of the device.
+type target struct {
+	mutex     sync.Mutex
+	image     bytes.Buffer
+	calls     []string
+	verifyErr error
+}
+
+func (t *target) record(call string) {
+	t.mutex.Lock()
+	t.calls = append(t.calls, call)
+	t.mutex.Unlock()
+}
+
+func (t *target) Begin(img xfer.File) (io.Writer, error) {
+	t.record("begin")
+	t.image.Reset()
+	return &t.image, nil
+}
+
+func (t *target) Verify(img xfer.File) error {
+	t.record("verify")
+	return t.verifyErr
+}
+
+func (t *target) Commit(img xfer.File) error {
+	t.record("commit")
+	return nil
+}
+
+func (t *target) Abort(img xfer.File) {
+	t.record("abort")
+}
+
+func (t *target) Calls() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string(nil), t.calls...)
+}
+
+func TestUpdate(t *testing.T) {
+	pa, pb := testutil.NewPortPair(t)
+
+	img := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(img)
+
+	var mutex sync.Mutex
+	var states []State
+	tg := &target{}
+	d := NewDevice(tg, &Config{
+		OnStateChange: func(s State) {
+			mutex.Lock()
+			states = append(states, s)
+			mutex.Unlock()
+		},
+	})
+	go d.Serve(pb)
+
+	err := Update(pa, "v1.2.0", bytes.NewReader(img), int64(len(img)), &Config{
+		Transfer: &xfer.Config{ChunkSize: 512},
+	})
+	require.NoError(t, err)
+	require.Equal(t, img, tg.image.Bytes())
+	require.Equal(t, []string{"begin", "verify", "commit"}, tg.Calls())
+	require.Equal(t, StateCommitted, d.State())
+
+	mutex.Lock()
+	require.Equal(t, []State{StateReceiving, StateReceived, StateVerified, StateCommitted}, states)
+	mutex.Unlock()
+
+	s, err := Status(pa)
+	require.NoError(t, err)
+	require.Equal(t, StateCommitted, s)
+}
+
+func TestUpdateVerifyFailed(t *testing.T) {
+	pa, pb := testutil.NewPortPair(t)
+
+	tg := &target{verifyErr: errors.New("invalid signature")}
+	d := NewDevice(tg)
+	go d.Serve(pb)
+
+	err := Update(pa, "v2", bytes.NewReader([]byte("image")), 5)
+	require.EqualError(t, err, "verify: peer failed: invalid signature")
+	require.Equal(t, []string{"begin", "verify", "abort"}, tg.Calls())
+	require.Equal(t, StateIdle, d.State())
+}
+
+func TestUpdateSigned(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	require.NoError(t, err)
+
+	img := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(img)
+	digest, err := Digest(bytes.NewReader(img), int64(len(img)))
+	require.NoError(t, err)
+	rsaSig, err := rsa.SignPKCS1v15(crand.Reader, rsaKey, crypto.SHA256, digest)
+	require.NoError(t, err)
+
+	tests := []struct {
+		verifier  Verifier
+		signature []byte
+	}{
+		{NewEd25519Verifier(edPub), ed25519.Sign(edKey, digest)},
+		{NewRSAVerifier(&rsaKey.PublicKey), rsaSig},
+	}
+	for _, test := range tests {
+		pa, pb := testutil.NewPortPair(t)
+
+		var mutex sync.Mutex
+		var results []error
+		onVerify := func(img xfer.File, err error) {
+			mutex.Lock()
+			results = append(results, err)
+			mutex.Unlock()
+		}
+
+		tg := &target{}
+		d := NewDevice(tg, &Config{Verifier: test.verifier, OnVerify: onVerify})
+		go d.Serve(pb)
+
+		// The device verifies the signature of the received image.
+		// Resend the first request soon, if the device registered its
+		// service after it was received.
+		config := &Config{Timeout: time.Second, Transfer: &xfer.Config{ChunkSize: 512}, OnVerify: onVerify}
+		err = UpdateSigned(pa, "v1", bytes.NewReader(img), int64(len(img)), test.signature, config)
+		require.NoError(t, err)
+		require.Equal(t, []string{"begin", "verify", "commit"}, tg.Calls())
+
+		// Images with a missing or foreign signature are discarded.
+		err = Update(pa, "v2", bytes.NewReader(img), int64(len(img)), config)
+		require.EqualError(t, err, "verify: "+ErrInvalidSignature.Error())
+		err = UpdateSigned(pa, "v3", bytes.NewReader(img[1:]), int64(len(img)-1), test.signature, config)
+		require.EqualError(t, err, "verify: "+ErrInvalidSignature.Error())
+		require.Equal(t, []string{"begin", "verify", "commit", "begin", "abort", "begin", "abort"}, tg.Calls())
+		require.Equal(t, StateIdle, d.State())
+
+		// Both sides report the verification results.
+		mutex.Lock()
+		require.Equal(t, []error{nil, nil, ErrInvalidSignature, ErrInvalidSignature, ErrInvalidSignature, ErrInvalidSignature}, results)
+		mutex.Unlock()
+	}
+}
+
+func TestDeviceRequests(t *testing.T) {
+	tg := &target{}
+	d := NewDevice(tg)
+	img := xfer.File{Name: "v1", Size: 4, Checksum: 1}
+
+	// Only a received image can be verified.
+	resp := d.handle([]byte{opVerify, 1})
+	require.Equal(t, []byte{opVerify, 1, statusInvalidState}, resp)
+	require.Equal(t, ErrInvalidState, statusError(resp[2], resp[3:]))
+
+	resp = d.handle(append([]byte{opBegin, 2}, encodeImage(img)...))
+	require.Equal(t, []byte{opBegin, 2, statusOK}, resp)
+	require.Equal(t, StateReceiving, d.State())
+
+	// The same image is resumed.
+	resp = d.handle(append([]byte{opBegin, 3}, encodeImage(img)...))
+	require.Equal(t, []byte{opBegin, 3, statusOK}, resp)
+	require.Equal(t, []string{"begin"}, tg.Calls())
+
+	// The transfer of another image is rejected.
+	_, err := d.open(xfer.File{Name: "v0"})
+	require.Error(t, err)
+
+	resp = d.handle([]byte{opCommit, 4})
+	require.Equal(t, []byte{opCommit, 4, statusInvalidState}, resp)
+
+	resp = d.handle([]byte{opStatus, 5})
+	require.Equal(t, []byte{opStatus, 5, statusOK, byte(StateReceiving)}, resp)
+
+	// A new image discards the partial one.
+	resp = d.handle(append([]byte{opBegin, 6}, encodeImage(xfer.File{Name: "v2"})...))
+	require.Equal(t, []byte{opBegin, 6, statusOK}, resp)
+	require.Equal(t, []string{"begin", "abort", "begin"}, tg.Calls())
+
+	d.handle([]byte{opAbort, 7})
+	require.Equal(t, StateIdle, d.State())
+	require.Equal(t, []string{"begin", "abort", "begin", "abort"}, tg.Calls())
+
+	resp = d.handle([]byte{0xff, 8})
+	require.Equal(t, []byte{0xff, 8, statusInvalidRequest}, resp)
+}
@@ -0,0 +1,155 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package dfu
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/xfer"
+)
+
+//##############//
+//### Public ###//
+//##############//
+
+// Update updates the firmware of the peer device with size bytes of the
+// image r. The name identifies the image, for example by its version.
+// Optionally pass a configuration. An interrupted transfer is resumed and
+// a corrupt image is transferred again, until the retries are exhausted.
+// The update is aborted on failure. Call Update again with the same image
+// to resume it, for example on the port of a reconnector.
+// The peer has to serve a Device.
+func Update(p *ants.Port, name string, r io.ReaderAt, size int64, config ...*Config) error {
+	return UpdateSigned(p, name, r, size, nil, config...)
+}
+
+// UpdateSigned updates the firmware of the peer device like Update and
+// passes the signature of the image to the device. The device checks it
+// with its verifier, before the image is committed. Create the signature
+// over the digest returned by Digest. ErrInvalidSignature is passed to
+// the OnVerify hook, if the device rejected the signature.
+func UpdateSigned(p *ants.Port, name string, r io.ReaderAt, size int64, signature []byte, config ...*Config) (err error) {
+	h := newHost(p, config)
+
+	checksum, err := xfer.Checksum(r, size)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %v", err)
+	}
+	img := xfer.File{Name: name, Size: size, Checksum: checksum}
+
+	// Let the device discard the partial update on failure.
+	// Don't wait for the response of the unresponsive device.
+	defer func() {
+		if err != nil {
+			_ = h.service.Notify(opAbort, nil)
+		}
+	}()
+
+	for restarts := 0; ; restarts++ {
+		// Let the device prepare the update.
+		// A partially transferred image is resumed.
+		if err = h.call(opBegin, encodeImage(img)); err != nil {
+			return fmt.Errorf("begin: %v", err)
+		}
+
+		err = h.transfer(img, r)
+		if err == nil {
+			break
+		} else if err != xfer.ErrChecksumMismatch || restarts >= h.config.Retries {
+			return fmt.Errorf("transfer: %v", err)
+		}
+	}
+
+	// Report the verification result of the device.
+	err = h.call(opVerify, signature)
+	if h.config.OnVerify != nil {
+		h.config.OnVerify(img, err)
+	}
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+
+	if err = h.call(opCommit, nil); err != nil {
+		return fmt.Errorf("commit: %v", err)
+	}
+
+	return nil
+}
+
+// Status returns the update state of the peer device.
+// Optionally pass a configuration.
+func Status(p *ants.Port, config ...*Config) (State, error) {
+	status, resp, err := newHost(p, config).request(opStatus, nil)
+	if err != nil {
+		return 0, err
+	} else if err = statusError(status, resp); err != nil {
+		return 0, err
+	} else if len(resp) != 1 {
+		return 0, ErrInvalidResponse
+	}
+
+	return State(resp[0]), nil
+}
+
+//#################//
+//### host type ###//
+//#################//
+
+type host struct {
+	port    *ants.Port
+	service *ants.Service
+	config  *Config
+}
+
+func newHost(p *ants.Port, config []*Config) *host {
+	return &host{
+		port:    p,
+		service: p.Service(ants.ServiceDFU),
+		config:  getConfig(config),
+	}
+}
+
+// transfer sends the image to the device. Interrupted transfers are
+// resumed until the retries are exhausted. A corrupt image was
+// discarded by the device and returns xfer.ErrChecksumMismatch.
+func (h *host) transfer(img xfer.File, r io.ReaderAt) (err error) {
+	for retries := 0; ; retries++ {
+		err = xfer.Send(h.port, img.Name, r, img.Size, h.config.Transfer)
+		if err == nil || err == ants.ErrClosed || err == xfer.ErrChecksumMismatch || retries >= h.config.Retries {
+			return err
+		}
+	}
+}
+
+// call sends the request and returns the error of the response status.
+func (h *host) call(op byte, payload []byte) error {
+	status, resp, err := h.request(op, payload)
+	if err != nil {
+		return err
+	}
+	return statusError(status, resp)
+}
+
+// request sends the request and waits for its response. The device
+// answers duplicated requests with the same response.
+func (h *host) request(op byte, payload []byte) (status byte, resp []byte, err error) {
+	return h.service.Request(op, payload, h.config.Timeout, h.config.Retries)
+}
@@ -0,0 +1,97 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package dfu
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors:
+var (
+	// ErrInvalidSignature is reported if the signature of the image
+	// is missing or was not created by the trusted key.
+	ErrInvalidSignature = errors.New("invalid image signature")
+)
+
+//#####################//
+//### Verifier type ###//
+//#####################//
+
+// A Verifier checks the signature of a received image, before the device
+// is told to commit it. The signature is created over the SHA-256 digest
+// of the image, which is returned by Digest. Set the verifier of the
+// device with Config.Verifier.
+type Verifier interface {
+	// Verify returns ErrInvalidSignature if the signature
+	// does not match the digest of the image.
+	Verify(digest, signature []byte) error
+}
+
+// NewEd25519Verifier creates a verifier of Ed25519 signatures,
+// which were created with the private key of the public key.
+func NewEd25519Verifier(key ed25519.PublicKey) Verifier {
+	return ed25519Verifier{key: key}
+}
+
+// NewRSAVerifier creates a verifier of RSA PKCS #1 v1.5 signatures with
+// SHA-256, which were created with the private key of the public key.
+func NewRSAVerifier(key *rsa.PublicKey) Verifier {
+	return rsaVerifier{key: key}
+}
+
+// Digest returns the SHA-256 digest of the image, which is signed.
+func Digest(r io.ReaderAt, size int64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	return h.Sum(nil), nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+type ed25519Verifier struct {
+	key ed25519.PublicKey
+}
+
+func (v ed25519Verifier) Verify(digest, signature []byte) error {
+	if !ed25519.Verify(v.key, digest, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type rsaVerifier struct {
+	key *rsa.PublicKey
+}
+
+func (v rsaVerifier) Verify(digest, signature []byte) error {
+	if rsa.VerifyPKCS1v15(v.key, crypto.SHA256, digest, signature) != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
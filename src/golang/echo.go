@@ -0,0 +1,108 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"sync"
+	"time"
+)
+
+//######################//
+//### Echo canceller ###//
+//######################//
+
+// echoCanceller discards the echo of transmitted bytes on half-duplex
+// buses, where the transmitter hears its own bytes.
+type echoCanceller struct {
+	mutex    sync.Mutex
+	window   time.Duration
+	pending  []byte    // Transmitted bytes, which were not echoed yet.
+	deadline time.Time // The pending bytes are dropped after this point in time.
+}
+
+// newEchoCanceller returns nil if the echo cancellation is disabled.
+func newEchoCanceller(window time.Duration) *echoCanceller {
+	if window <= 0 {
+		return nil
+	}
+
+	return &echoCanceller{
+		window: window,
+	}
+}
+
+// expect registers bytes, which are going to be transmitted.
+// Call it before the bytes are written, because the echo might
+// arrive before the write call returns.
+func (e *echoCanceller) expect(data []byte) {
+	if e == nil {
+		return
+	}
+
+	// Lock the mutex.
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// Drop expired bytes, which were never echoed.
+	now := time.Now()
+	if now.After(e.deadline) {
+		e.pending = e.pending[:0]
+	}
+
+	e.pending = append(e.pending, data...)
+	e.deadline = now.Add(e.window)
+}
+
+// filter removes the echoed bytes from the received data and returns the remaining bytes.
+// The second return value is false if the received data did not match the
+// transmitted bytes. The echo cancellation is stopped for the pending bytes then.
+func (e *echoCanceller) filter(data []byte) ([]byte, bool) {
+	if e == nil {
+		return data, true
+	}
+
+	// Lock the mutex.
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// Nothing to cancel if no echo is expected.
+	if len(e.pending) == 0 {
+		return data, true
+	}
+	if time.Now().After(e.deadline) {
+		e.pending = e.pending[:0]
+		return data, true
+	}
+
+	// Skip the matching bytes.
+	n := 0
+	for n < len(data) && n < len(e.pending) && data[n] == e.pending[n] {
+		n++
+	}
+
+	// A mismatch is either a collision on the bus or data of the peer.
+	// Pass the bytes to the decoder, which detects corrupted messages.
+	if n < len(data) && n < len(e.pending) {
+		e.pending = e.pending[:0]
+		return data[n:], false
+	}
+
+	e.pending = e.pending[:copy(e.pending, e.pending[n:])]
+	return data[n:], true
+}
@@ -0,0 +1,167 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"fmt"
+	"time"
+)
+
+//##################//
+//### Event type ###//
+//##################//
+
+// EventType defines the type of a diagnostic port event.
+type EventType int
+
+const (
+	// EventReassemblyTimeout is emitted if the partially received binary data
+	// of a multi-message transmission was discarded, because the transmission stalled.
+	EventReassemblyTimeout EventType = iota
+
+	// EventTransmissionFailed is emitted if the ARQ strategy gave up
+	// the transmission of a data message.
+	EventTransmissionFailed
+
+	// EventEchoMismatch is emitted if the echo cancellation received bytes,
+	// which did not match the transmitted bytes. This indicates a collision
+	// on a half-duplex bus.
+	EventEchoMismatch
+
+	// EventDeviceRemoved is emitted if the source reported the removal
+	// of its device. The port is closed afterwards.
+	EventDeviceRemoved
+
+	// EventBreakerOpened is emitted if the circuit breaker paused the
+	// transmission after sustained failures.
+	EventBreakerOpened
+
+	// EventBreakerClosed is emitted if the link probe succeeded
+	// and the circuit breaker resumed the transmission.
+	EventBreakerClosed
+
+	// EventLineErrors is emitted if the source reported new hardware
+	// parity, framing or overrun errors.
+	EventLineErrors
+
+	// EventAuthenticationFailed is emitted if a received data chunk was
+	// discarded, because the cipher could not authenticate it, or if the
+	// key exchange rejected the public key of the peer.
+	EventAuthenticationFailed
+
+	// EventLinkDown is emitted if nothing was received from the peer
+	// within the link timeout.
+	EventLinkDown
+
+	// EventLinkUp is emitted if data was received again after the link went down.
+	EventLinkUp
+
+	// EventSuspended is emitted if the port was suspended,
+	// because the source failed and SuspendOnError is set.
+	EventSuspended
+
+	// EventResumed is emitted if the suspended port was resumed with a new source.
+	EventResumed
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventReassemblyTimeout:
+		return "reassembly timeout"
+	case EventTransmissionFailed:
+		return "transmission failed"
+	case EventEchoMismatch:
+		return "echo mismatch"
+	case EventDeviceRemoved:
+		return "device removed"
+	case EventBreakerOpened:
+		return "breaker opened"
+	case EventBreakerClosed:
+		return "breaker closed"
+	case EventLineErrors:
+		return "line errors"
+	case EventAuthenticationFailed:
+		return "authentication failed"
+	case EventLinkDown:
+		return "link down"
+	case EventLinkUp:
+		return "link up"
+	case EventSuspended:
+		return "suspended"
+	case EventResumed:
+		return "resumed"
+	default:
+		return fmt.Sprintf("unknown event type %d", int(t))
+	}
+}
+
+// An Event is a diagnostic event emitted by a port.
+// Register a handler with the Config.OnEvent hook.
+type Event struct {
+	// Type of the event.
+	Type EventType
+
+	// Time when the event occurred.
+	Time time.Time
+
+	// Message is a human readable description of the event.
+	Message string
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// emitEvent calls the OnEvent hook and the internal event listeners.
+func (p *Port) emitEvent(t EventType, format string, args ...interface{}) {
+	p.eventMutex.Lock()
+	listeners := p.eventListeners
+	p.eventMutex.Unlock()
+
+	if p.config.OnEvent == nil && len(listeners) == 0 {
+		return
+	}
+
+	e := Event{
+		Type:    t,
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	if p.config.OnEvent != nil {
+		p.config.OnEvent(e)
+	}
+	for _, f := range listeners {
+		f(e)
+	}
+}
+
+// addEventListener registers an internal event listener.
+// Listeners are called from the internal port routines and must not block.
+func (p *Port) addEventListener(f func(e Event)) {
+	// Lock the mutex.
+	p.eventMutex.Lock()
+	defer p.eventMutex.Unlock()
+
+	// Never modify the slice, which might be iterated by emitEvent.
+	listeners := make([]func(e Event), 0, len(p.eventListeners)+1)
+	listeners = append(listeners, p.eventListeners...)
+	p.eventListeners = append(listeners, f)
+}
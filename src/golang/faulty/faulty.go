@@ -0,0 +1,276 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package faulty wraps the source of an ANTS port and injects transmission
+// faults at configurable probabilities. It simulates broken cables and
+// noisy links to verify the CRC rejection and retransmission behavior.
+package faulty
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//###################//
+//### Config type ###//
+//###################//
+
+// Faults defines the fault probabilities of one direction.
+// The probabilities range from 0 to 1. Zero disables the fault.
+type Faults struct {
+	// CorruptRate is the probability that a byte is corrupted
+	// by flipping one of its bits.
+	CorruptRate float64
+
+	// DropRate is the probability that a byte is dropped.
+	DropRate float64
+
+	// DuplicateRate is the probability that a read or written
+	// data chunk is transmitted twice.
+	DuplicateRate float64
+
+	// StallRate is the probability that a read or write call
+	// is delayed by the stall duration.
+	StallRate float64
+
+	// StallDuration is the delay of a stalled call.
+	StallDuration time.Duration
+}
+
+// Config defines the faults of a faulty source.
+type Config struct {
+	// Read faults are applied to the data read from the wrapped source.
+	Read Faults
+
+	// Write faults are applied to the data written to the wrapped source.
+	Write Faults
+
+	// Seed of the pseudo-random fault injection. Zero seeds with the current time.
+	Seed int64
+}
+
+//##################//
+//### Stats type ###//
+//##################//
+
+// Stats counts the injected faults.
+type Stats struct {
+	Corrupted  int // Corrupted bytes.
+	Dropped    int // Dropped bytes.
+	Duplicated int // Duplicated data chunks.
+	Stalled    int // Stalled calls.
+}
+
+//###################//
+//### Source type ###//
+//###################//
+
+// A Source wraps a source and injects faults.
+type Source struct {
+	source io.ReadWriteCloser
+	config Config
+
+	mutex   sync.Mutex
+	rand    *rand.Rand
+	stats   Stats
+	pending []byte // Duplicated read data, which is returned by the next reads.
+}
+
+// New wraps the source. Optionally pass a config.
+// Without a config no faults are injected.
+func New(source io.ReadWriteCloser, config ...*Config) *Source {
+	// Get the config.
+	var c Config
+	if len(config) > 0 && config[0] != nil {
+		c = *config[0]
+	}
+
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &Source{
+		source: source,
+		config: c,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Transport wraps each source dialed by the transport.
+// The sources share the config, but count their faults separately.
+func Transport(t ants.Transport, config ...*Config) ants.Transport {
+	return ants.TransportFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		source, err := t.Dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return New(source, config...), nil
+	})
+}
+
+// Stats returns the number of injected faults.
+func (s *Source) Stats() Stats {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stats
+}
+
+// Read from the wrapped source and inject the read faults.
+func (s *Source) Read(p []byte) (int, error) {
+	// Return the duplicated data first.
+	if n := s.readPending(p); n > 0 {
+		return n, nil
+	}
+
+	s.stall(&s.config.Read)
+
+	for {
+		n, err := s.source.Read(p)
+		if n == 0 || err != nil {
+			return n, err
+		}
+
+		// Read again if all bytes were dropped.
+		data := s.inject(&s.config.Read, p[:n])
+		if len(data) == 0 {
+			continue
+		}
+		n = copy(p, data)
+
+		// Return the data again with the next read.
+		if s.chance(s.config.Read.DuplicateRate) {
+			s.mutex.Lock()
+			s.pending = append(s.pending, p[:n]...)
+			s.stats.Duplicated++
+			s.mutex.Unlock()
+		}
+
+		return n, nil
+	}
+}
+
+// Write to the wrapped source and inject the write faults.
+// The dropped bytes are reported as written.
+func (s *Source) Write(p []byte) (int, error) {
+	s.stall(&s.config.Write)
+
+	// Never modify the passed slice.
+	data := s.inject(&s.config.Write, append([]byte(nil), p...))
+	if len(data) == 0 {
+		return len(p), nil
+	}
+
+	if _, err := s.source.Write(data); err != nil {
+		return 0, err
+	}
+
+	if s.chance(s.config.Write.DuplicateRate) {
+		s.mutex.Lock()
+		s.stats.Duplicated++
+		s.mutex.Unlock()
+
+		if _, err := s.source.Write(data); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close the wrapped source.
+func (s *Source) Close() error {
+	return s.source.Close()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// chance returns true with the probability.
+func (s *Source) chance(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.rand.Float64() < probability
+}
+
+// stall delays the call with the stall probability.
+func (s *Source) stall(f *Faults) {
+	if f.StallDuration <= 0 || !s.chance(f.StallRate) {
+		return
+	}
+
+	s.mutex.Lock()
+	s.stats.Stalled++
+	s.mutex.Unlock()
+
+	time.Sleep(f.StallDuration)
+}
+
+// inject corrupts and drops the bytes of the data in place.
+// Returns the remaining bytes.
+func (s *Source) inject(f *Faults, data []byte) []byte {
+	if f.CorruptRate <= 0 && f.DropRate <= 0 {
+		return data
+	}
+
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := data[:0]
+	for _, b := range data {
+		if f.DropRate > 0 && s.rand.Float64() < f.DropRate {
+			s.stats.Dropped++
+			continue
+		}
+		if f.CorruptRate > 0 && s.rand.Float64() < f.CorruptRate {
+			b ^= 1 << uint(s.rand.Intn(8))
+			s.stats.Corrupted++
+		}
+		out = append(out, b)
+	}
+
+	return out
+}
+
+// readPending copies the duplicated read data to p.
+// Returns the number of copied bytes.
+func (s *Source) readPending(p []byte) int {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+
+	return n
+}
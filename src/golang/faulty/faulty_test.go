@@ -0,0 +1,94 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package faulty
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaults(t *testing.T) {
+	l := loopback.New()
+	s := New(l, &Config{
+		Write: Faults{DropRate: 1},
+	})
+
+	// Dropped bytes are reported as written.
+	n, err := s.Write([]byte("ants"))
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Equal(t, 4, s.Stats().Dropped)
+
+	// Duplicated data chunks are read twice.
+	s = New(l, &Config{
+		Read: Faults{DuplicateRate: 1},
+	})
+	_, err = s.Write([]byte("ants"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 8)
+	n, err = s.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ants"), buf[:n])
+	n, err = s.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ants"), buf[:n])
+	require.Equal(t, 1, s.Stats().Duplicated)
+
+	// Corrupted bytes differ in one bit.
+	s = New(l, &Config{
+		Write: Faults{CorruptRate: 1},
+	})
+	_, err = s.Write([]byte{0})
+	require.NoError(t, err)
+	n, err = s.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Contains(t, []byte{1, 2, 4, 8, 16, 32, 64, 128}, buf[0])
+}
+
+func TestRetransmission(t *testing.T) {
+	a, b := net.Pipe()
+	faults := &Config{
+		Write: Faults{CorruptRate: 0.01, DuplicateRate: 0.05},
+		Seed:  1,
+	}
+	sa, sb := New(a, faults), New(b, faults)
+
+	c := &ants.Config{AckTimeout: 50 * time.Millisecond}
+	p, peer := ants.NewPort(sa, c), ants.NewPort(sb, c)
+	defer p.Close()
+	defer peer.Close()
+
+	// The faulty data messages are rejected and retransmitted.
+	for i := byte(0); i < 10; i++ {
+		data := bytes.Repeat([]byte{i}, 16)
+		require.NoError(t, p.Write(data))
+
+		received, err := peer.Read(5 * time.Second)
+		require.NoError(t, err)
+		require.Equal(t, data, received)
+	}
+}
@@ -0,0 +1,343 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+const (
+	// maxFECParity is the maximum number of Reed-Solomon parity bytes per block.
+	maxFECParity = 64
+
+	// rsBlockSize is the maximum size of a Reed-Solomon code word in bytes.
+	rsBlockSize = 255
+
+	// gfPolynomial is the primitive polynomial of the Galois field GF(2^8):
+	// x^8 + x^4 + x^3 + x^2 + 1
+	gfPolynomial = 0x11d
+)
+
+// Exponential and logarithm tables of the Galois field.
+// The exponential table is doubled to skip the modulo of multiplications.
+var gfExp, gfLog = newGFTables()
+
+//###############################//
+//### Reed-Solomon codec type ###//
+//###############################//
+
+// A rsCodec protects messages with a systematic Reed-Solomon code over GF(2^8).
+// Messages are split into blocks of up to 255 bytes including the parity bytes.
+// Each block corrects up to half as many corrupted bytes as parity bytes.
+// The last block is shortened. A rsCodec is safe for concurrent use.
+type rsCodec struct {
+	parity    int
+	blockData int    // Data bytes of a full block.
+	generator []byte // Generator polynomial, highest degree first.
+}
+
+// newRSCodec creates a new Reed-Solomon codec with the number of parity bytes per block.
+func newRSCodec(parity int) *rsCodec {
+	// g(x) = (x - a^0)(x - a^1)...(x - a^(parity-1))
+	g := []byte{1}
+	for i := 0; i < parity; i++ {
+		next := make([]byte, len(g)+1)
+		root := gfExp[i]
+		for j, c := range g {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, root)
+		}
+		g = next
+	}
+
+	return &rsCodec{
+		parity:    parity,
+		blockData: rsBlockSize - parity,
+		generator: g,
+	}
+}
+
+// overhead returns the number of parity bytes added to a message of n bytes.
+func (r *rsCodec) overhead(n int) int {
+	return r.parity * ((n + r.blockData - 1) / r.blockData)
+}
+
+// encode inserts the parity bytes after each block of the message, which
+// starts at the position pos of buf. The capacity of buf should include
+// the overhead to prevent a reallocation.
+func (r *rsCodec) encode(buf []byte, pos int) []byte {
+	m := len(buf) - pos
+	blocks := (m + r.blockData - 1) / r.blockData
+	buf = append(buf, make([]byte, r.overhead(m))...)
+
+	// Move the blocks to their final positions, the last first,
+	// so no data is overwritten.
+	for i := blocks - 1; i > 0; i-- {
+		src := pos + i*r.blockData
+		dst := pos + i*(r.blockData+r.parity)
+		copy(buf[dst:], buf[src:src+r.blockLength(m, i)])
+	}
+
+	for i := 0; i < blocks; i++ {
+		start := pos + i*(r.blockData+r.parity)
+		end := start + r.blockLength(m, i)
+		r.computeParity(buf[start:end], buf[end:end+r.parity])
+	}
+
+	return buf
+}
+
+// decode corrects the blocks of the protected message and removes the parity
+// bytes in place. Returns the message, the number of corrected bytes and the
+// number of blocks, which could not be corrected. Uncorrectable blocks are
+// returned unchanged and are detected by the message checksum.
+func (r *rsCodec) decode(data []byte) (msg []byte, corrected int, failed int) {
+	msg = data[:0]
+
+	for start := 0; start < len(data); start += rsBlockSize {
+		end := start + rsBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		block := data[start:end]
+		if len(block) <= r.parity {
+			// The message was truncated.
+			return msg, corrected, failed + 1
+		}
+
+		n, ok := r.correct(block)
+		if ok {
+			corrected += n
+		} else {
+			failed++
+		}
+
+		// The message precedes the block in the same array.
+		msg = append(msg, block[:len(block)-r.parity]...)
+	}
+
+	return msg, corrected, failed
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// correctDataMessageBody corrects the received data message body with the
+// forward error correction and removes the parity bytes.
+// This method must be only called by the read messages routine.
+func (p *Port) correctDataMessageBody(body []byte) []byte {
+	body, corrected, failed := p.codec.fec.decode(body)
+	if corrected == 0 && failed == 0 {
+		return body
+	}
+
+	p.stats.update(func(c *StatsSnapshot) {
+		c.FECCorrections += uint64(corrected)
+		c.FECFailures += uint64(failed)
+	})
+
+	if failed > 0 {
+		p.log.Debugf("read data: forward error correction: %v blocks with too many errors", failed)
+	} else {
+		p.log.Debugf("read data: forward error correction: corrected %v bytes", corrected)
+	}
+
+	return body
+}
+
+// blockLength returns the data length of the i-th block of a message of m bytes.
+func (r *rsCodec) blockLength(m int, i int) int {
+	if l := m - i*r.blockData; l < r.blockData {
+		return l
+	}
+	return r.blockData
+}
+
+// computeParity writes the parity bytes of the block data to parity.
+// It is the remainder of the division of data(x) * x^parity by g(x).
+func (r *rsCodec) computeParity(data []byte, parity []byte) {
+	for i := range parity {
+		parity[i] = 0
+	}
+
+	for _, b := range data {
+		coef := b ^ parity[0]
+		copy(parity, parity[1:])
+		parity[len(parity)-1] = 0
+
+		if coef != 0 {
+			for j := range parity {
+				parity[j] ^= gfMul(r.generator[j+1], coef)
+			}
+		}
+	}
+}
+
+// correct corrects the code word in place. Returns the number of
+// corrected bytes and false if the errors could not be corrected.
+// The first byte is the coefficient of the highest degree.
+func (r *rsCodec) correct(block []byte) (int, bool) {
+	// Evaluate the code word at the roots of the generator polynomial.
+	var syndromes [maxFECParity]byte
+	s := syndromes[:r.parity]
+	hasErrors := false
+	for i := range s {
+		root := gfExp[i]
+		var v byte
+		for _, b := range block {
+			v = gfMul(v, root) ^ b
+		}
+		s[i] = v
+		hasErrors = hasErrors || v != 0
+	}
+	if !hasErrors {
+		return 0, true
+	}
+
+	// Find the error locator polynomial with the Berlekamp-Massey
+	// algorithm. The polynomials are stored lowest degree first.
+	locator := []byte{1}
+	prev := []byte{1}
+	errs, shift, prevDiscrepancy := 0, 1, byte(1)
+
+	for n := 0; n < len(s); n++ {
+		d := s[n]
+		for i := 1; i <= errs && i < len(locator); i++ {
+			d ^= gfMul(locator[i], s[n-i])
+		}
+
+		if d == 0 {
+			shift++
+			continue
+		}
+
+		// locator(x) -= d / prevDiscrepancy * x^shift * prev(x)
+		coef := gfDiv(d, prevDiscrepancy)
+		next := locator
+		if l := len(prev) + shift; l > len(next) {
+			next = append(append([]byte(nil), locator...), make([]byte, l-len(locator))...)
+		} else {
+			next = append([]byte(nil), locator...)
+		}
+		for i, c := range prev {
+			next[i+shift] ^= gfMul(coef, c)
+		}
+
+		if 2*errs <= n {
+			errs = n + 1 - errs
+			prev = locator
+			prevDiscrepancy = d
+			shift = 1
+		} else {
+			shift++
+		}
+		locator = next
+	}
+
+	if 2*errs > r.parity {
+		return 0, false
+	}
+
+	// Find the error positions with the Chien search. The byte at the
+	// index i is the coefficient of x^(len(block)-1-i). The locator has
+	// a root at the inverse of each error location.
+	positions := make([]int, 0, errs)
+	for i := range block {
+		power := len(block) - 1 - i
+		if gfEval(locator, gfExp[(rsBlockSize-power)%rsBlockSize]) == 0 {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) != errs {
+		return 0, false
+	}
+
+	// Calculate the error magnitudes with the Forney algorithm.
+	// The evaluator is syndromes(x) * locator(x) mod x^parity.
+	evaluator := make([]byte, r.parity)
+	for i, c := range locator {
+		for j := 0; i+j < r.parity; j++ {
+			evaluator[i+j] ^= gfMul(c, s[j])
+		}
+	}
+
+	// The formal derivative keeps the odd powers in GF(2^8).
+	derivative := make([]byte, len(locator)/2+1)
+	for i := 1; i < len(locator); i += 2 {
+		derivative[i/2] = locator[i]
+	}
+
+	for _, i := range positions {
+		power := len(block) - 1 - i
+		x := gfExp[power]
+		xInv := gfExp[(rsBlockSize-power)%rsBlockSize]
+
+		// The derivative contains the even powers of xInv.
+		denominator := gfEval(derivative, gfMul(xInv, xInv))
+		if denominator == 0 {
+			return 0, false
+		}
+		block[i] ^= gfMul(x, gfDiv(gfEval(evaluator, xInv), denominator))
+	}
+
+	return errs, true
+}
+
+// newGFTables creates the exponential and logarithm tables of GF(2^8).
+func newGFTables() (exp [2 * rsBlockSize]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < rsBlockSize; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+
+	for i := rsBlockSize; i < len(exp); i++ {
+		exp[i] = exp[i-rsBlockSize]
+	}
+
+	return exp, log
+}
+
+// gfMul multiplies two elements of the Galois field.
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfDiv divides two elements of the Galois field. b must not be zero.
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+rsBlockSize-int(gfLog[b])]
+}
+
+// gfEval evaluates the polynomial, which is stored lowest degree first, at x.
+func gfEval(p []byte, x byte) byte {
+	var v byte
+	for i := len(p) - 1; i >= 0; i-- {
+		v = gfMul(v, x) ^ p[i]
+	}
+	return v
+}
@@ -0,0 +1,252 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidFrame is returned by ParseFrame if the frame is malformed.
+	ErrInvalidFrame = errors.New("invalid frame")
+)
+
+//#######################//
+//### Frame info type ###//
+//#######################//
+
+// A FrameInfo describes a frame decoded by ParseFrame.
+// It is intended for diagnostic tools, which inspect the frames
+// passed to the raw frame hooks or captured from a serial line.
+type FrameInfo struct {
+	// Type is the name of the message type, for example DATA or ACK.
+	Type string
+
+	// StartCharacter is the control character, which starts the frame.
+	// Replaced framing characters are reported with their protocol value.
+	StartCharacter byte
+
+	// IsControlMessage is true for control messages.
+	IsControlMessage bool
+
+	// Addressed is true if the frame contains an address header.
+	// Destination and Source are the node addresses of the header.
+	Addressed   bool
+	Destination byte
+	Source      byte
+
+	// MSN is the message sequence number of a data message or the
+	// peer message sequence number a control message refers to.
+	MSN byte
+
+	// Flags are the flags of a data message.
+	Flags byte
+
+	// CRCType is the type of the message CRC checksum.
+	CRCType CRCType
+
+	// Payload is the binary data of a data message or the payload
+	// of a control message. Encrypted binary data is not decrypted.
+	Payload []byte
+
+	// CRCValid is true if all checksums of the frame are valid.
+	CRCValid bool
+
+	// Corrected is the number of bytes of a data message, which were
+	// corrected by the forward error correction.
+	Corrected int
+}
+
+// FlagNames returns the names of the set data message flags.
+func (f *FrameInfo) FlagNames() []string {
+	var names []string
+	for _, n := range flagNames {
+		if f.Flags&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+// String returns a one-line summary of the frame.
+func (f *FrameInfo) String() string {
+	var b strings.Builder
+	b.WriteString(f.Type)
+
+	if f.Addressed {
+		fmt.Fprintf(&b, " %v->%v", f.Source, f.Destination)
+	}
+
+	fmt.Fprintf(&b, " MSN=%v", f.MSN)
+
+	if f.StartCharacter == nak && len(f.Payload) > 0 {
+		fmt.Fprintf(&b, " reason=%v", NakReason(f.Payload[0]))
+	}
+
+	if !f.IsControlMessage {
+		if names := f.FlagNames(); len(names) > 0 {
+			b.WriteString(" flags=" + strings.Join(names, ","))
+		}
+	}
+
+	switch f.CRCType {
+	case CRC32:
+		b.WriteString(" CRC-32")
+	case CRCCustom:
+		b.WriteString(" CRC-custom")
+	default:
+		b.WriteString(" CRC-16")
+	}
+	if f.CRCValid {
+		b.WriteString(" ok")
+	} else {
+		b.WriteString(" invalid")
+	}
+
+	fmt.Fprintf(&b, " len=%v", len(f.Payload))
+
+	return b.String()
+}
+
+//###################//
+//### Parse frame ###//
+//###################//
+
+// ParseFrame decodes a complete escaped frame, as passed to the raw frame
+// hooks or returned by ScanFrames. The config defines the CRC types and
+// whether the frames contain an address header. It is not modified.
+// Frames with invalid checksums are decoded and reported by FrameInfo.CRCValid.
+// Returns ErrInvalidFrame if the frame is malformed.
+func ParseFrame(frame []byte, config ...*Config) (*FrameInfo, error) {
+	return NewFrameCodec(config...).Parse(frame)
+}
+
+//###################//
+//### Scan frames ###//
+//###################//
+
+// ScanFrames is a split function for a bufio.Scanner, which returns
+// the complete escaped frames of a raw byte stream, for example of a
+// passively tapped serial line. Bytes outside of frames are skipped.
+// A frame interrupted by the start of a new frame is discarded.
+// The default framing characters are expected. Use FrameCodec.ScanFrames
+// for other framing characters.
+func ScanFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return defaultFrameCodec.ScanFrames(data, atEOF)
+}
+
+// ScanFrames is a split function for a bufio.Scanner like the package
+// function ScanFrames, which expects the configured framing characters.
+func (c *FrameCodec) ScanFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	switch c.config.Framing {
+	case FramingHDLC:
+		return scanHDLCFrames(data, atEOF)
+	case FramingCOBS:
+		return scanCOBSFrames(data, atEOF)
+	}
+
+	start := -1
+	scanned := len(data)
+
+	for i := 0; i < len(data); i++ {
+		if data[i] != c.chars.DLE {
+			continue
+		}
+
+		// The escaped byte is required.
+		if i+1 >= len(data) {
+			scanned = i
+			break
+		}
+		b := data[i+1]
+
+		switch {
+		case c.startCharacters[b] != 0:
+			// A start character in the middle of a frame starts a new frame.
+			start = i
+
+		case b == c.chars.ETX && start >= 0:
+			return i + 2, data[start : i+2], nil
+		}
+
+		// Skip the escaped byte.
+		i++
+	}
+
+	if atEOF {
+		return len(data), nil, nil
+	}
+
+	// Skip the bytes before the current frame
+	// and request more data.
+	if start >= 0 {
+		return start, nil, nil
+	}
+	return scanned, nil, nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// defaultFrameCodec decodes the frames of the default configuration.
+var defaultFrameCodec = NewFrameCodec()
+
+// flagNames are the names of the data message flags.
+var flagNames = []struct {
+	flag byte
+	name string
+}{
+	{flagAppendData, "append"},
+	{flagUrgent, "urgent"},
+	{flagDelta, "delta"},
+	{flagService, "service"},
+	{flagPipelined, "pipelined"},
+	{flagEncrypted, "encrypted"},
+}
+
+// frameTypeName returns the name of the message type of the start character.
+func frameTypeName(startCharacter byte) string {
+	switch startCharacter {
+	case stx, soh:
+		return "DATA"
+	case ack:
+		return "ACK"
+	case nak:
+		return "NAK"
+	case can:
+		return "CAN"
+	case bst:
+		return "BST"
+	case rsd:
+		return "RSD"
+	case bel:
+		return "BEL"
+	case enq:
+		return "ENQ"
+	case wat:
+		return "WAIT"
+	case rdy:
+		return "READY"
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import "fmt"
+
+//###############################//
+//### Framing characters type ###//
+//###############################//
+
+// FramingCharacters are the control characters of the DLE framing.
+// Set them to interoperate with legacy devices, which use the same frame
+// structure with other control bytes, for example the HDLC flag 0x7E as
+// start character and 0x7D as escape character. Unset characters keep
+// their default value. All characters have to be distinct from each other
+// and from the remaining control characters SOH (0x01), ENQ (0x05),
+// BEL (0x07), DC2 (0x12), DC4 (0x14), SYN (0x16), ETB (0x17) and
+// CAN (0x18). Otherwise an error is logged and the default characters
+// are used. Both peers have to use the same characters.
+type FramingCharacters struct {
+	// DLE escapes the control characters within the frames.
+	// The default is 0x10.
+	DLE byte
+
+	// STX starts a data message. The default is 0x02.
+	STX byte
+
+	// ETX ends a frame. The default is 0x03.
+	ETX byte
+
+	// ACK starts an acknowledgement. The default is 0x06.
+	ACK byte
+
+	// NAK starts a negative acknowledgement. The default is 0x15.
+	NAK byte
+}
+
+// defaultFramingCharacters are the control characters of the ANTS protocol.
+var defaultFramingCharacters = FramingCharacters{
+	DLE: dle,
+	STX: stx,
+	ETX: etx,
+	ACK: ack,
+	NAK: nak,
+}
+
+// setDefaults sets the default values for unset characters and falls
+// back to the defaults if the characters are ambiguous. The returned
+// error reports the ambiguous character.
+func (f *FramingCharacters) setDefaults() error {
+	if f.DLE == 0 {
+		f.DLE = dle
+	}
+	if f.STX == 0 {
+		f.STX = stx
+	}
+	if f.ETX == 0 {
+		f.ETX = etx
+	}
+	if f.ACK == 0 {
+		f.ACK = ack
+	}
+	if f.NAK == 0 {
+		f.NAK = nak
+	}
+
+	if err := f.validate(); err != nil {
+		*f = defaultFramingCharacters
+		return err
+	}
+	return nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// validate returns an error if the control characters are not distinct.
+func (f *FramingCharacters) validate() error {
+	var seen [256]bool
+	for _, b := range []byte{f.DLE, f.STX, f.ETX, f.ACK, f.NAK, soh, enq, bel, bst, rsd, can, wat, rdy} {
+		if seen[b] {
+			return fmt.Errorf("framing characters: ambiguous control character 0x%02x: using the default characters", b)
+		}
+		seen[b] = true
+	}
+	return nil
+}
+
+// wire returns the transmitted byte of the protocol start character.
+func (f *FramingCharacters) wire(startCharacter byte) byte {
+	switch startCharacter {
+	case stx:
+		return f.STX
+	case ack:
+		return f.ACK
+	case nak:
+		return f.NAK
+	default:
+		return startCharacter
+	}
+}
+
+// startCharacters returns the lookup table, which maps the received
+// bytes to the protocol start characters. Other bytes map to zero.
+func (f *FramingCharacters) startCharacters() (t [256]byte) {
+	for _, c := range []byte{stx, soh, ack, nak, can, bst, rsd, bel, enq, wat, rdy} {
+		t[f.wire(c)] = c
+	}
+	return t
+}
@@ -0,0 +1,162 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+//####################//
+//### Data Handler ###//
+//####################//
+
+// OnData registers the handler, which is called for each received data chunk
+// as an alternative to Read. The handler is called from a managed pool of
+// Config.DataHandlerWorkers goroutines until the port is closed.
+// Registering another handler replaces the previous one. Pass nil to
+// unregister the handler. Don't call Read or ReadMessage while a handler
+// is registered. Urgent data chunks are still returned by ReadUrgent.
+// ErrResponderMode is returned if the port runs in responder mode.
+func (p *Port) OnData(f func(data []byte)) error {
+	if p.config.Responder != nil {
+		return ErrResponderMode
+	}
+
+	// Lock the mutex.
+	p.dataHandlerMutex.Lock()
+	defer p.dataHandlerMutex.Unlock()
+
+	// Stop the workers of the previous handler.
+	if p.dataHandlerStopChan != nil {
+		close(p.dataHandlerStopChan)
+		p.dataHandlerStopChan = nil
+	}
+
+	if f == nil {
+		return nil
+	}
+
+	// Start the workers of the new handler.
+	stopChan := make(chan struct{})
+	p.dataHandlerStopChan = stopChan
+
+	for i := 0; i < p.config.DataHandlerWorkers; i++ {
+		go p.dataHandlerLoop(f, stopChan)
+	}
+
+	return nil
+}
+
+//#######################//
+//### Type Dispatcher ###//
+//#######################//
+
+// Handle registers the handler for the message type. Each received data
+// chunk starts with a one byte message type, which selects the handler.
+// The handler receives the remaining payload. Data chunks of message types
+// without a handler are discarded. The handlers are called like the handler
+// registered with OnData, which is replaced by the dispatcher as long as any
+// message type handler is registered. Pass nil to unregister the handler.
+// Send typed data chunks with WriteType.
+// ErrResponderMode is returned if the port runs in responder mode.
+func (p *Port) Handle(msgType byte, f func(payload []byte)) error {
+	if p.config.Responder != nil {
+		return ErrResponderMode
+	}
+
+	// Lock the mutex.
+	p.typeHandlersMutex.Lock()
+	defer p.typeHandlersMutex.Unlock()
+
+	wasEmpty := len(p.typeHandlers) == 0
+
+	if f == nil {
+		delete(p.typeHandlers, msgType)
+	} else {
+		if p.typeHandlers == nil {
+			p.typeHandlers = make(map[byte]func(payload []byte))
+		}
+		p.typeHandlers[msgType] = f
+	}
+
+	// Start the dispatcher with the first handler
+	// and stop it with the last one.
+	if wasEmpty && len(p.typeHandlers) > 0 {
+		return p.OnData(p.dispatchType)
+	} else if !wasEmpty && len(p.typeHandlers) == 0 {
+		return p.OnData(nil)
+	}
+
+	return nil
+}
+
+// WriteType writes the payload prefixed with the message type as one
+// data chunk to the port like Write. The peer dispatches it to the
+// handler registered with Handle.
+// This method blocks as long as the write queue is full.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) WriteType(msgType byte, payload []byte) error {
+	b := GetBuffer()
+	b.B = append(append(b.B, msgType), payload...)
+	return p.WriteBuffer(b)
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// dispatchType passes the payload of the data chunk
+// to the handler of its message type.
+func (p *Port) dispatchType(data []byte) {
+	if len(data) == 0 {
+		p.log.Debugf("dispatch: discarding empty data chunk")
+		return
+	}
+
+	// Lock the mutex.
+	p.typeHandlersMutex.RLock()
+	f := p.typeHandlers[data[0]]
+	p.typeHandlersMutex.RUnlock()
+
+	if f == nil {
+		p.log.Debugf("dispatch: discarding data chunk of unhandled message type 0x%02x", data[0])
+		return
+	}
+
+	f(data[1:])
+}
+
+// dataHandlerLoop passes the received data chunks to the handler
+// until the port is closed or the handler is replaced.
+func (p *Port) dataHandlerLoop(f func(data []byte), stopChan chan struct{}) {
+	for {
+		// Release the data chunks at the configured pace. They stay
+		// queued until the rate limiter lets the next one pass.
+		if p.readRateLimiter.waitUntilReady(p.closeChan, stopChan) != nil {
+			return
+		}
+
+		select {
+		case <-p.closeChan:
+			// Just release this goroutine if the port is closed.
+			return
+		case <-stopChan:
+			return
+		case m := <-p.readDataChunkChan:
+			p.readRateLimiter.take(len(m.Data))
+			f(m.Data)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"crypto/ecdh"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// ProtocolVersion is the major version of the ANTS protocol,
+	// which is exchanged by the session handshake.
+	ProtocolVersion = 1
+
+	handshakeRequest = 0
+	handshakeReply   = 1
+	handshakeConfirm = 2
+
+	// Payload length of a handshake control message:
+	// Kind | Version | Data CRC | Control CRC | Max Message Size | Features
+	handshakePayloadLength = 1 + 1 + 1 + 1 + 2 + 1
+
+	// Feature bits of the handshake.
+	featureDeltaEncoding = 1 << 0
+	featureEncryption    = 1 << 1
+	featureKeyExchange   = 1 << 2
+	featureReplayCounter = 1 << 3
+
+	defaultHandshakeTimeout = 1 * time.Second
+	handshakeAttempts       = 3
+
+	// Nonce of the ping, which replaces the handshake request of a probe.
+	probeNonce = 0xfe
+)
+
+//######################//
+//### Peer Info type ###//
+//######################//
+
+// PeerInfo contains the parameters announced by the peer during the
+// session handshake. Enable the handshake with Config.Handshake.
+type PeerInfo struct {
+	// Version is the protocol version of the peer.
+	Version byte
+
+	// DataMessageCRC is the CRC type the peer transmits its data
+	// messages with. The own data messages are transmitted with
+	// this CRC type, if it is supported.
+	DataMessageCRC CRCType
+
+	// ControlMessageCRC is the CRC type of the peer's control messages.
+	// It has to match the own type.
+	ControlMessageCRC CRCType
+
+	// MaxMessageSize is the maximum binary data size of the peer's data
+	// messages. The smaller maximum size of both peers is used.
+	MaxMessageSize int
+
+	// DeltaEncoding is set if the peer enabled the delta encoding.
+	// Data chunks are only delta encoded if both peers enabled it.
+	DeltaEncoding bool
+
+	// Encryption is set if the peer encrypts the data chunks.
+	// It has to match the own setting.
+	Encryption bool
+
+	// ReplayProtection is set if the peer prepends replay counters to the
+	// encrypted data chunks. It has to match the own setting.
+	ReplayProtection bool
+
+	// PublicKey is the static X25519 public key of the peer, if it enabled
+	// the key exchange. Only pinned keys are accepted.
+	PublicKey *ecdh.PublicKey
+}
+
+// PeerInfo returns the parameters of the peer, which were exchanged
+// during the session handshake. False is returned if the handshake
+// is disabled, not completed yet or the peer does not support it.
+func (p *Port) PeerInfo() (PeerInfo, bool) {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if p.peerInfo == nil {
+		return PeerInfo{}, false
+	}
+	return *p.peerInfo, true
+}
+
+// ProbeHandshake sends handshake requests on the source and waits for the
+// reply of an ANTS peer without creating a port. Use it to verify the
+// connection settings, for example the baudrate of a serial line, before
+// the port is created. Optionally pass the configuration of the port.
+// Peers with a session handshake reject unauthenticated requests, so they
+// are pinged instead. The source has to return from Read within the
+// handshake timeout, like a serial port with a read timeout.
+// Returns ErrNoHandshakeReply if the peer never replied.
+func ProbeHandshake(source io.ReadWriter, config ...*Config) error {
+	// Get a copy of the config with the default values.
+	var c Config
+	if len(config) > 0 && config[0] != nil {
+		c = *config[0]
+	}
+	c.setDefaults()
+
+	codec := newFrameCodec(&c)
+	decoder := codec.NewDecoder()
+
+	var request []byte
+	if c.hasSessionHandshake() {
+		request = codec.encodeControlMessage(bel, umsn, []byte{pingRequest, probeNonce})
+	} else {
+		request = codec.encodeControlMessage(enq, umsn, newHandshakePayload(&c, handshakeRequest))
+	}
+
+	buf := make([]byte, 512)
+	for i := 0; i < handshakeAttempts; i++ {
+		if _, err := source.Write(request); err != nil {
+			return fmt.Errorf("failed to write handshake request: %v", err)
+		}
+
+		deadline := c.Clock.Now().Add(c.HandshakeTimeout)
+		for c.Clock.Now().Before(deadline) {
+			n, err := source.Read(buf)
+			if err != nil {
+				return fmt.Errorf("failed to read handshake reply: %v", err)
+			}
+
+			replied := false
+			decoder.Decode(buf[:n], func(f *FrameInfo, err error) {
+				replied = replied || (err == nil && isProbeReply(f))
+			})
+			if replied {
+				return nil
+			}
+		}
+	}
+
+	return ErrNoHandshakeReply
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// handshake announces the own parameters to the peer and waits for its
+// reply. Legacy peers never reply, so the port continues with the
+// configured parameters after the last attempt.
+// This method must be only called by the write loop.
+func (p *Port) handshake() {
+	request := newHandshakePayload(p.config, handshakeRequest)
+
+	// All attempts of the session handshake send the same nonce.
+	if p.config.hasSessionHandshake() {
+		request = p.newSessionRequest()
+		if request == nil {
+			return
+		}
+
+		defer func() {
+			// Lock the mutex.
+			p.stateMutex.Lock()
+			defer p.stateMutex.Unlock()
+
+			p.sessionInitiator = nil
+		}()
+	}
+
+	for i := 0; i < handshakeAttempts; i++ {
+		p.writeControlMessage(enq, umsn, request...)
+
+		if p.waitForHandshakeReply() {
+			return
+		}
+	}
+
+	p.log.Warningf("handshake: no reply from the peer: continuing with the configured parameters")
+}
+
+// waitForHandshakeReply waits for the reply of the peer until the handshake
+// timeout is reached. Returns true if the peer replied or the port was closed.
+// This method must be only called by the write loop.
+func (p *Port) waitForHandshakeReply() bool {
+	timer := time.NewTimer(p.config.HandshakeTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.closeChan:
+			return true
+		case <-p.handshakeChan:
+			return true
+		case <-p.abortChan:
+			// No transfer is in progress, but the peer might still
+			// hold partial data of a previous transmission.
+			p.writeControlMessage(can, p.currentMSN())
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// newHandshakePayload creates the payload of a handshake control message
+// with the parameters of the config.
+func newHandshakePayload(c *Config, kind byte) []byte {
+	var features byte
+	if c.DeltaEncoding {
+		features |= featureDeltaEncoding
+	}
+	if c.isEncrypted() {
+		features |= featureEncryption
+	}
+	if c.ReplayProtection {
+		features |= featureReplayCounter
+	}
+	if c.KeyExchange != nil {
+		features |= featureKeyExchange
+	}
+
+	payload := make([]byte, handshakePayloadLength, handshakePayloadLength+keyExchangeFieldsLength)
+	payload[0] = kind
+	payload[1] = ProtocolVersion
+	payload[2] = crcTypeFlag(c.DataMessageCRC) >> 4
+	payload[3] = crcTypeFlag(c.ControlMessageCRC) >> 4
+	binary.LittleEndian.PutUint16(payload[4:6], uint16(c.MaxMessageSize))
+	payload[6] = features
+
+	return payload
+}
+
+// isProbeReply returns true if the frame proves, that an ANTS peer
+// received the probe: a handshake message or the reply to the ping.
+func isProbeReply(f *FrameInfo) bool {
+	if !f.CRCValid || !f.IsControlMessage {
+		return false
+	}
+
+	switch f.StartCharacter {
+	case enq:
+		return len(f.Payload) > 0
+	case bel:
+		return len(f.Payload) == 2 && f.Payload[0] == pingReply && f.Payload[1] == probeNonce
+	}
+	return false
+}
+
+// handleReceivedHandshake records the parameters of the peer and
+// replies to handshake requests.
+// This method must be only called by the read messages loop.
+func (p *Port) handleReceivedHandshake(payload []byte) error {
+	// The confirmation of the session handshake only carries its tag.
+	if len(payload) > 0 && payload[0] == handshakeConfirm && p.config.hasSessionHandshake() {
+		return p.handleReceivedHandshakeConfirm(payload[1:])
+	} else if len(payload) < handshakePayloadLength {
+		return fmt.Errorf("invalid handshake control message payload")
+	}
+
+	// Newer protocol versions might append further parameters.
+	info := &PeerInfo{
+		Version:           payload[1],
+		DataMessageCRC:    crcTypeOfField(payload[2]),
+		ControlMessageCRC: crcTypeOfField(payload[3]),
+		MaxMessageSize:    int(binary.LittleEndian.Uint16(payload[4:6])),
+		DeltaEncoding:     payload[6]&featureDeltaEncoding != 0,
+		Encryption:        payload[6]&featureEncryption != 0,
+		ReplayProtection:  payload[6]&featureReplayCounter != 0,
+	}
+	if info.MaxMessageSize == 0 {
+		return fmt.Errorf("invalid handshake control message: maximum message size is zero")
+	}
+
+	if payload[0] != handshakeRequest && payload[0] != handshakeReply {
+		return fmt.Errorf("invalid handshake control message kind: %v", payload[0])
+	}
+
+	// The session only changes with authenticated handshakes.
+	// Unauthenticated requests never reset the sequence.
+	if p.config.hasSessionHandshake() {
+		return p.handleReceivedSessionHandshake(payload, info)
+	}
+
+	if payload[0] == handshakeRequest {
+		// The peer starts a new session with a new message sequence.
+		// Its partially received binary data is stale.
+		p.resetReadSequence()
+		p.resetBinaryDataBuffer()
+		p.writeControlMessage(enq, umsn, newHandshakePayload(p.config, handshakeReply)...)
+		p.setPeerInfo(info)
+		return nil
+	}
+
+	p.setPeerInfo(info)
+
+	// Never block the read routine. Nobody is waiting for a late reply.
+	select {
+	case p.handshakeChan <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// setPeerInfo records the parameters of the peer.
+func (p *Port) setPeerInfo(info *PeerInfo) {
+	// Both peers fall back to CRC-16 for the control messages, if their
+	// control message CRC types differ. Otherwise no acknowledge would
+	// pass the CRC validation.
+	fallback := info.ControlMessageCRC != p.config.ControlMessageCRC
+	if fallback {
+		p.log.Warningf("handshake: control message CRC type mismatch: own %v, peer %v: falling back to CRC-16", p.config.ControlMessageCRC, info.ControlMessageCRC)
+	}
+	p.codec.setControlMessageCRCFallback(fallback)
+
+	// Report the parameters, which can't be negotiated.
+	if info.Encryption != p.config.isEncrypted() {
+		p.log.Errorf("handshake: encryption mismatch: own %v, peer %v", p.config.isEncrypted(), info.Encryption)
+	}
+	if info.ReplayProtection != p.config.ReplayProtection {
+		p.log.Errorf("handshake: replay protection mismatch: own %v, peer %v", p.config.ReplayProtection, info.ReplayProtection)
+	}
+
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	p.peerInfo = info
+}
+
+// maxMessageSize returns the maximum binary data size of the transmitted
+// data messages. The smaller maximum size of both peers is used.
+func (p *Port) maxMessageSize() int {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if p.peerInfo != nil && p.peerInfo.MaxMessageSize < p.config.MaxMessageSize {
+		return p.peerInfo.MaxMessageSize
+	}
+	return p.config.MaxMessageSize
+}
+
+// dataMessageCRCType returns the CRC type of the transmitted data messages.
+// The type requested by the peer is used if it is supported.
+func (p *Port) dataMessageCRCType() CRCType {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if p.peerInfo != nil && p.config.isValidCRCType(p.peerInfo.DataMessageCRC) {
+		return p.peerInfo.DataMessageCRC
+	}
+	return p.config.DataMessageCRC
+}
+
+// peerDeltaEncoding returns false if the peer disabled the delta encoding.
+func (p *Port) peerDeltaEncoding() bool {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	return p.peerInfo == nil || p.peerInfo.DeltaEncoding
+}
+
+// crcTypeOfField returns the CRC type of the CRC type field value.
+func crcTypeOfField(v byte) CRCType {
+	switch v << 4 {
+	case flagCRC32:
+		return CRC32
+	case flagCRCCustom:
+		return CRCCustom
+	default:
+		return CRC16
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+const (
+	// HDLC framing characters (RFC 1662).
+	hdlcFlag   = 0x7e
+	hdlcEscape = 0x7d
+	hdlcXOR    = 0x20 // Escaped bytes are transmitted XOR this value.
+)
+
+//###############//
+//### Private ###//
+//###############//
+
+// hdlcFrame appends the HDLC frame of the unescaped message body to the body:
+// Flag | Escaped (Type | Message) | Flag
+// The body must be located at the start of the frame buffer.
+// Returns the frame, which is valid until the buffer is released.
+func (b *frameBuffer) hdlcFrame(startCharacter byte, body []byte) []byte {
+	// The message type is the first byte of the frame.
+	// The start characters never have to be escaped.
+	buf := append(body, hdlcFlag, startCharacter)
+
+	// Escape the message body.
+	buf = appendHDLCEscaped(buf, body)
+
+	// Close the frame.
+	buf = append(buf, hdlcFlag)
+
+	b.b = buf
+	return buf[len(body):]
+}
+
+// appendHDLCEscaped appends the HDLC escaped data to dst.
+// The data may precede the appended bytes in the same array.
+func appendHDLCEscaped(dst []byte, data []byte) []byte {
+	for _, b := range data {
+		if b == hdlcFlag || b == hdlcEscape {
+			dst = append(dst, hdlcEscape, b^hdlcXOR)
+		} else {
+			dst = append(dst, b)
+		}
+	}
+
+	return dst
+}
+
+// unescapeHDLC returns the unescaped frame content without the flags.
+// Returns false if the content contains an incomplete escape sequence.
+func unescapeHDLC(data []byte) ([]byte, bool) {
+	unescapedData := make([]byte, 0, len(data))
+	isEscaped := false
+
+	for _, b := range data {
+		if isEscaped {
+			unescapedData = append(unescapedData, b^hdlcXOR)
+			isEscaped = false
+		} else if b == hdlcEscape {
+			isEscaped = true
+		} else {
+			unescapedData = append(unescapedData, b)
+		}
+	}
+
+	return unescapedData, !isEscaped
+}
+
+// parseHDLC decodes a complete HDLC frame including both flags.
+func (c *FrameCodec) parseHDLC(frame []byte) (*FrameInfo, error) {
+	if len(frame) < 3 || frame[0] != hdlcFlag || frame[len(frame)-1] != hdlcFlag {
+		return nil, ErrInvalidFrame
+	}
+
+	content, ok := unescapeHDLC(frame[1 : len(frame)-1])
+	if !ok || len(content) == 0 {
+		return nil, ErrInvalidFrame
+	}
+
+	return c.parseBody(content[0], content[1:])
+}
+
+// decodeHDLCByte passes a received byte of the HDLC framing to the decoder.
+// A flag closes the current frame and opens the next one. The message
+// type is the first byte after the opening flag. An escaped flag aborts
+// the frame. Bytes outside of frames are discarded.
+func (d *FrameDecoder) decodeHDLCByte(b byte) decodeEvent {
+	// Collect the escaped frame bytes.
+	if d.startCharacterFound && d.keepRaw {
+		d.raw = append(d.raw, b)
+	}
+
+	if b == hdlcFlag {
+		started, aborted := d.startCharacterFound, d.byteIsEscaped
+		d.flagFound = true
+		d.startCharacterFound = false
+		d.byteIsEscaped = false
+
+		if !started {
+			return decodeNone
+		} else if aborted {
+			d.clearFrame()
+			return decodeAborted
+		}
+		return decodeEnded
+	}
+
+	// Discard bytes outside of a frame.
+	if !d.flagFound {
+		return decodeNone
+	}
+
+	// Unescape the next byte.
+	if !d.byteIsEscaped && b == hdlcEscape {
+		d.byteIsEscaped = true
+		return decodeNone
+	} else if d.byteIsEscaped {
+		d.byteIsEscaped = false
+		b ^= hdlcXOR
+	}
+
+	event := d.decodeContentByte(b)
+
+	// Start collecting the escaped frame bytes.
+	if event == decodeStarted && d.keepRaw {
+		d.raw = append(d.raw[:0], hdlcFlag, b)
+	}
+
+	return event
+}
+
+// scanHDLCFrames is the split function of ScanFrames for the HDLC framing.
+// The returned frames include both flags. The closing flag is not consumed,
+// because it might open the next frame.
+func scanHDLCFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := -1
+
+	for i, b := range data {
+		if b != hdlcFlag {
+			continue
+		}
+
+		// Return the frame, unless it is empty or aborted.
+		if start >= 0 && i > start+1 && data[i-1] != hdlcEscape {
+			return i, data[start : i+1], nil
+		}
+		start = i
+	}
+
+	if atEOF {
+		return len(data), nil, nil
+	}
+
+	// Skip the bytes before the current frame
+	// and request more data.
+	if start >= 0 {
+		return start, nil, nil
+	}
+	return len(data), nil, nil
+}
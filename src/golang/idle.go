@@ -0,0 +1,65 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"io"
+)
+
+//###################//
+//### Idle Source ###//
+//###################//
+
+// A BlockingSource is an optional interface of a port source, which
+// supports to switch to truly blocking reads. It is used by the idle mode
+// to park the read routine instead of polling the source.
+// Read calls blocked in blocking mode must return as soon as the source is closed.
+type BlockingSource interface {
+	io.ReadWriteCloser
+
+	// SetBlocking switches between reads, which return after a short timeout
+	// if no data is available, and reads, which block until data is available.
+	SetBlocking(blocking bool) error
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// setSourceBlocking switches the blocking mode of the source if supported.
+// Returns false if the source does not support a blocking mode.
+func (p *Port) setSourceBlocking(source io.ReadWriteCloser, blocking bool) bool {
+	bs, ok := source.(BlockingSource)
+	if !ok {
+		return false
+	}
+
+	if err := bs.SetBlocking(blocking); err != nil {
+		p.log.Warningf("read data from source: failed to set blocking mode to %v: %v", blocking, err)
+		return false
+	}
+
+	if blocking {
+		p.log.Debugf("read data from source: no traffic for %v: entering idle mode", p.config.IdleTimeout)
+	} else {
+		p.log.Debugf("read data from source: traffic received: leaving idle mode")
+	}
+
+	return true
+}
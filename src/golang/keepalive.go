@@ -0,0 +1,120 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The link timeout defaults to a multiple of the keepalive interval,
+	// so single lost heartbeats are tolerated.
+	defaultLinkTimeoutFactor = 3
+
+	// Number of link checks within the link timeout.
+	linkChecksPerTimeout = 4
+
+	// Nonce of the ping requests, which are sent as heartbeats.
+	// Ping never uses this nonce.
+	heartbeatNonce = 0
+)
+
+//#################//
+//### Keepalive ###//
+//#################//
+
+// OnLinkDown registers a handler, which is called if no bytes were received
+// from the peer within the link timeout. This detects a silently unplugged
+// cable without waiting for the next write to fail. The port stays open.
+// Enable the link supervision with Config.LinkTimeout or Config.KeepaliveInterval.
+// The handler is called from an internal port routine and must not block.
+func (p *Port) OnLinkDown(f func()) {
+	p.addEventListener(func(e Event) {
+		if e.Type == EventLinkDown {
+			f()
+		}
+	})
+}
+
+// IsLinkUp returns false if the link supervision detected a silent link.
+// It always returns true if the link supervision is disabled.
+func (p *Port) IsLinkUp() bool {
+	return atomic.LoadInt32(&p.linkDown) == 0
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// markReceived records the arrival of bytes from the peer.
+func (p *Port) markReceived() {
+	atomic.StoreInt64(&p.lastReceived, time.Now().UnixNano())
+}
+
+// markTransmitted records the transmission of bytes to the peer.
+func (p *Port) markTransmitted() {
+	atomic.StoreInt64(&p.lastTransmitted, time.Now().UnixNano())
+}
+
+// keepaliveLoop sends the heartbeats and supervises the link.
+func (p *Port) keepaliveLoop() {
+	interval := p.config.KeepaliveInterval
+	if check := p.config.LinkTimeout / linkChecksPerTimeout; p.config.LinkTimeout > 0 && (interval <= 0 || check < interval) {
+		interval = check
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closeChan:
+			// Just release this goroutine if the port is closed.
+			return
+		case <-ticker.C:
+		}
+
+		// Send a heartbeat if nothing was transmitted for the keepalive interval.
+		// The peer replies to the ping request, even if its keepalive is disabled.
+		if p.config.KeepaliveInterval > 0 && p.config.Responder == nil &&
+			time.Since(time.Unix(0, atomic.LoadInt64(&p.lastTransmitted))) >= p.config.KeepaliveInterval {
+			p.writeControlMessage(bel, umsn, pingRequest, heartbeatNonce)
+		}
+
+		if p.config.LinkTimeout > 0 {
+			p.checkLink()
+		}
+	}
+}
+
+// checkLink emits the link events if the link state changed.
+func (p *Port) checkLink() {
+	silence := time.Since(time.Unix(0, atomic.LoadInt64(&p.lastReceived)))
+
+	if silence > p.config.LinkTimeout {
+		if atomic.CompareAndSwapInt32(&p.linkDown, 0, 1) {
+			p.log.Warningf("link supervision: nothing received for %v: link down", silence.Round(time.Millisecond))
+			p.emitEvent(EventLinkDown, "nothing received for %v", silence.Round(time.Millisecond))
+		}
+	} else if atomic.CompareAndSwapInt32(&p.linkDown, 1, 0) {
+		p.log.Debugf("link supervision: link up")
+		p.emitEvent(EventLinkUp, "received data from the peer")
+	}
+}
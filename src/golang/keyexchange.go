@@ -0,0 +1,129 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Length of an X25519 public key.
+	keyExchangePublicKeyLength = 32
+
+	// Overhead of the AES-GCM session cipher: Nonce | Tag
+	sessionCipherOverhead = 12 + 16
+
+	// Length of the key exchange fields of a handshake request:
+	// Static Public Key | Ephemeral Public Key
+	// The handshake reply appends the authentication tag.
+	keyExchangeFieldsLength = 2 * keyExchangePublicKeyLength
+)
+
+// Errors:
+var (
+	// ErrNoSessionKey is the write error of data chunks, if the key exchange
+	// or the replay protection is enabled, but no session was agreed with
+	// the peer yet.
+	ErrNoSessionKey = errors.New("no session key: session handshake not completed")
+
+	// ErrPeerKeyRejected is reported if the public key of the peer is not pinned.
+	ErrPeerKeyRejected = errors.New("peer public key rejected")
+)
+
+//########################//
+//### KeyExchange type ###//
+//########################//
+
+// A KeyExchange configures the agreement of the session key during the
+// session handshake, so no shared secret has to be distributed. Each
+// handshake exchanges new ephemeral X25519 keys, which are authenticated
+// with the static keys of the peers, so each session uses a new
+// AES-256-GCM session key. The static keys are never used to encrypt
+// data chunks. Set it with Config.KeyExchange.
+type KeyExchange struct {
+	// PrivateKey is the static X25519 key of this node, for example created
+	// with ecdh.X25519().GenerateKey. Its public key is pinned by the peers.
+	// It is required.
+	PrivateKey *ecdh.PrivateKey
+
+	// PeerKeys are the pinned static public keys of the accepted peers.
+	// Handshakes with other public keys or without the proof of the
+	// private key are rejected. At least one key is required.
+	PeerKeys []*ecdh.PublicKey
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// validate returns an error if the key exchange can't authenticate the peers.
+func (kx *KeyExchange) validate() error {
+	if kx.PrivateKey == nil {
+		return fmt.Errorf("key exchange: no private key configured")
+	} else if len(kx.PeerKeys) == 0 {
+		return fmt.Errorf("key exchange: no peer keys pinned")
+	}
+	return nil
+}
+
+// isPinned returns a boolean whenever the public key of the peer is accepted.
+func (kx *KeyExchange) isPinned(key *ecdh.PublicKey) bool {
+	for _, k := range kx.PeerKeys {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveSessionCipher derives the session cipher from the shared secrets
+// of the ephemeral and static keys and the transcript of the handshake.
+func (kx *KeyExchange) deriveSessionCipher(transcript []byte, ephemeral *ecdh.PrivateKey, f sessionFields, initiator bool) (Cipher, error) {
+	// Both peers compute the shared secrets in the same order: Both ephemeral
+	// keys, the static key of the initiator and the ephemeral key of the
+	// responder, the ephemeral key of the initiator and the static key of
+	// the responder.
+	own := []*ecdh.PrivateKey{ephemeral, ephemeral, kx.PrivateKey}
+	peer := []*ecdh.PublicKey{f.ephemeralKey, f.staticKey, f.ephemeralKey}
+	if initiator {
+		own = []*ecdh.PrivateKey{ephemeral, kx.PrivateKey, ephemeral}
+		peer = []*ecdh.PublicKey{f.ephemeralKey, f.ephemeralKey, f.staticKey}
+	}
+
+	h := sha256.New()
+	h.Write([]byte("ants session key"))
+	for i := range own {
+		secret, err := own[i].ECDH(peer[i])
+		if err != nil {
+			return nil, fmt.Errorf("key exchange failed: %v", err)
+		}
+		h.Write(secret)
+	}
+	h.Write(transcript)
+
+	return NewAESGCMCipher(h.Sum(nil))
+}
+
+// isEncrypted returns a boolean whenever the data chunks are encrypted.
+func (c *Config) isEncrypted() bool {
+	return c.Cipher != nil || c.KeyExchange != nil
+}
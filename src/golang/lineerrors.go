@@ -0,0 +1,102 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	lineErrorsPollInterval = 1 * time.Second
+)
+
+//#########################//
+//### Line Error Source ###//
+//#########################//
+
+// A LineErrorSource is an optional interface of a port source, which
+// reports the hardware error counters of the line. The counters are merged
+// into the port statistics, so line-level problems are distinguishable
+// from protocol-level checksum errors. The serial package implements it
+// where the operating system exposes the counters.
+type LineErrorSource interface {
+	io.ReadWriteCloser
+
+	// LineErrors returns the cumulative counts of the
+	// parity, framing and overrun errors.
+	LineErrors() (parity, framing, overrun uint64, err error)
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// lineErrorState holds the last polled line error counters.
+// It is only used by the read routine.
+type lineErrorState struct {
+	counts     [3]uint64
+	lastPoll   time.Time
+	isDisabled bool
+}
+
+// pollLineErrors merges new line errors of the source into the statistics
+// and emits an EventLineErrors. The source is polled at most once per interval.
+func (p *Port) pollLineErrors(source io.ReadWriteCloser) {
+	s := &p.lineErrors
+	if s.isDisabled || time.Since(s.lastPoll) < lineErrorsPollInterval {
+		return
+	}
+	s.lastPoll = time.Now()
+
+	les, ok := source.(LineErrorSource)
+	if !ok {
+		s.isDisabled = true
+		return
+	}
+
+	parity, framing, overrun, err := les.LineErrors()
+	if err != nil {
+		p.log.Debugf("read data from source: disabling line error counters: %v", err)
+		s.isDisabled = true
+		return
+	}
+
+	// The counters restart at zero if the source was replaced.
+	var delta [3]uint64
+	for i, c := range [3]uint64{parity, framing, overrun} {
+		if c >= s.counts[i] {
+			delta[i] = c - s.counts[i]
+		} else {
+			delta[i] = c
+		}
+		s.counts[i] = c
+	}
+
+	if delta == [3]uint64{} {
+		return
+	}
+
+	p.stats.update(func(c *StatsSnapshot) {
+		c.ParityErrors += delta[0]
+		c.FramingErrors += delta[1]
+		c.OverrunErrors += delta[2]
+	})
+	p.emitEvent(EventLineErrors, "line errors: %v parity, %v framing, %v overrun", delta[0], delta[1], delta[2])
+}
@@ -19,18 +19,58 @@
 package ants
 
 import (
-	"github.com/Sirupsen/logrus"
+	"fmt"
+	"log/slog"
 )
 
-var (
-	// Log backend used by this library.
-	// Use the logrus Log value to adapt the log formatting
-	// or log levels if required...
-	Log = logrus.New()
-)
+//########################//
+//### Logger interface ###//
+//########################//
+
+// A Logger receives the log messages of a port.
+// Set a logger per port with Config.Logger.
+// The methods are called from the internal port routines and must not block.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NopLogger discards all log messages. This is the default logger.
+type NopLogger struct{}
+
+// Debugf implements the Logger interface.
+func (NopLogger) Debugf(format string, args ...interface{}) {}
+
+// Warningf implements the Logger interface.
+func (NopLogger) Warningf(format string, args ...interface{}) {}
+
+// Errorf implements the Logger interface.
+func (NopLogger) Errorf(format string, args ...interface{}) {}
+
+//###################//
+//### Slog logger ###//
+//###################//
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a logger, which passes the log messages
+// to the standard library structured logger.
+// Add attributes with slog.Logger.With to separate the ports.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{logger: l}
+}
+
+func (l slogLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l slogLogger) Warningf(format string, args ...interface{}) {
+	l.logger.Warn(fmt.Sprintf(format, args...))
+}
 
-func init() {
-	// Set the default log options.
-	Log.Formatter = new(logrus.TextFormatter)
-	Log.Level = logrus.DebugLevel
+func (l slogLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, args...))
 }
@@ -17,7 +17,7 @@
  */
 
 // Package loopback is a small wrapper to provide an io.ReadWriteCloser interface
-// which writes read data back.
+// which writes read data back. Pipe connects two io.ReadWriteClosers instead.
 package loopback
 
 import (
@@ -33,11 +33,34 @@ var (
 type loopback struct {
 	buffer   []byte
 	mutex    sync.Mutex
+	cond     *sync.Cond
 	isClosed bool
+	blocking bool
 }
 
 func New() io.ReadWriteCloser {
-	return &loopback{}
+	l := &loopback{}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// SetBlocking switches between reads, which return immediately
+// if no data is available, and reads, which block until data is available.
+func (l *loopback) SetBlocking(blocking bool) error {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Check if closed.
+	if l.isClosed {
+		return ErrIsClosed
+	}
+
+	// Update the flag and wake up blocked readers.
+	l.blocking = blocking
+	l.cond.Broadcast()
+
+	return nil
 }
 
 func (l *loopback) Read(p []byte) (n int, err error) {
@@ -45,6 +68,11 @@ func (l *loopback) Read(p []byte) (n int, err error) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
+	// Wait for data in blocking mode.
+	for l.blocking && !l.isClosed && len(l.buffer) == 0 {
+		l.cond.Wait()
+	}
+
 	// Check if closed.
 	if l.isClosed {
 		return 0, ErrIsClosed
@@ -83,8 +111,9 @@ func (l *loopback) Write(p []byte) (n int, err error) {
 		return 0, ErrIsClosed
 	}
 
-	// Add the bytes to the buffer.
+	// Add the bytes to the buffer and wake up blocked readers.
 	l.buffer = append(l.buffer, p...)
+	l.cond.Broadcast()
 
 	return len(p), nil
 }
@@ -99,8 +128,9 @@ func (l *loopback) Close() error {
 		return ErrIsClosed
 	}
 
-	// Update the flag.
+	// Update the flag and wake up blocked readers.
 	l.isClosed = true
+	l.cond.Broadcast()
 
 	return nil
 }
@@ -19,6 +19,7 @@
 package loopback
 
 import (
+	"io"
 	"sync"
 	"testing"
 	"time"
@@ -99,3 +100,77 @@ func TestLoopback(t *testing.T) {
 
 	}
 }
+
+func TestLoopbackBlocking(t *testing.T) {
+	l := New().(*loopback)
+	require.NoError(t, l.SetBlocking(true))
+
+	// A blocking read returns as soon as data is written.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.Write([]byte{1})
+	}()
+
+	buf := make([]byte, 8)
+	n, err := l.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// A blocking read returns as soon as the loopback is closed.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.Close()
+	}()
+
+	_, err = l.Read(buf)
+	require.Equal(t, ErrIsClosed, err)
+}
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+
+	// Writes are buffered until the other end reads them.
+	for i := byte(0); i < 10; i++ {
+		n, err := a.Write([]byte{i})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+	_, err := b.Write([]byte("ants"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 64)
+	n, err := b.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, buf[:n])
+
+	n, err = a.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ants", string(buf[:n]))
+
+	// A blocking read returns as soon as data is written.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		a.Write([]byte{1})
+	}()
+	n, err = b.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// The other end reads the remaining data before the end of file.
+	_, err = b.Write([]byte{2})
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+	require.Equal(t, ErrIsClosed, b.Close())
+
+	n, err = a.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, buf[:n])
+	_, err = a.Read(buf)
+	require.Equal(t, io.EOF, err)
+
+	_, err = a.Write([]byte{3})
+	require.Equal(t, io.ErrClosedPipe, err)
+	_, err = b.Read(buf)
+	require.Equal(t, io.ErrClosedPipe, err)
+	require.NoError(t, a.Close())
+}
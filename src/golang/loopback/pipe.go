@@ -0,0 +1,165 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package loopback
+
+import (
+	"io"
+	"sync"
+)
+
+//##############//
+//### Public ###//
+//##############//
+
+// Pipe creates two connected ends of a duplex pipe. The data written to one
+// end is read from the other end. Unlike net.Pipe, writes never block,
+// because the written data is buffered until the other end reads it.
+// Reads block until data is available. If one end is closed, then the
+// other end reads the remaining buffered data followed by io.EOF.
+func Pipe() (io.ReadWriteCloser, io.ReadWriteCloser) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return &pipeEnd{rx: a, tx: b}, &pipeEnd{rx: b, tx: a}
+}
+
+//#####################//
+//### Pipe End type ###//
+//#####################//
+
+type pipeEnd struct {
+	rx *pipeBuffer // Data written by the other end.
+	tx *pipeBuffer // Data read by the other end.
+
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+func (e *pipeEnd) Read(p []byte) (int, error) {
+	n, err := e.rx.read(p)
+	if e.closed() {
+		return 0, io.ErrClosedPipe
+	}
+	return n, err
+}
+
+func (e *pipeEnd) Write(p []byte) (int, error) {
+	if e.closed() {
+		return 0, io.ErrClosedPipe
+	}
+	return e.tx.write(p)
+}
+
+func (e *pipeEnd) Close() error {
+	// Lock the mutex.
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// Check if closed.
+	if e.isClosed {
+		return ErrIsClosed
+	}
+	e.isClosed = true
+
+	// Close both directions and wake up blocked readers.
+	e.rx.close()
+	e.tx.close()
+
+	return nil
+}
+
+func (e *pipeEnd) closed() bool {
+	// Lock the mutex.
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.isClosed
+}
+
+//########################//
+//### Pipe Buffer type ###//
+//########################//
+
+// pipeBuffer is a single direction of a pipe.
+type pipeBuffer struct {
+	buffer   []byte
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	isClosed bool
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// read blocks until data is available or the buffer is closed.
+// Returns io.EOF if the buffer is closed and all data was read.
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	// Lock the mutex.
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Wait for data.
+	for !b.isClosed && len(b.buffer) == 0 {
+		b.cond.Wait()
+	}
+
+	// The pipe was closed and all data was read.
+	if len(b.buffer) == 0 {
+		return 0, io.EOF
+	}
+
+	// Read the bytes and remove them from the buffer.
+	n := copy(p, b.buffer)
+	b.buffer = b.buffer[n:]
+
+	// Release memory of the drained buffer.
+	if len(b.buffer) == 0 {
+		b.buffer = nil
+	}
+
+	return n, nil
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	// Lock the mutex.
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Check if closed.
+	if b.isClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	// Add the bytes to the buffer and wake up blocked readers.
+	b.buffer = append(b.buffer, p...)
+	b.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (b *pipeBuffer) close() {
+	// Lock the mutex.
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Update the flag and wake up blocked readers.
+	b.isClosed = true
+	b.cond.Broadcast()
+}
@@ -0,0 +1,90 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"time"
+)
+
+//####################//
+//### Message type ###//
+//####################//
+
+// A Message is a received data chunk including its reception metadata.
+// Use Port.ReadMessage to obtain it.
+type Message struct {
+	// Data is the binary data of the data chunk.
+	Data []byte
+
+	// Time is the reception time of the last data message of the data chunk.
+	Time time.Time
+
+	// MSN is the peer message sequence number of the last data message of the data chunk.
+	MSN byte
+
+	// Fragments is the number of data messages the data chunk was transmitted with.
+	Fragments int
+
+	// CRC is the checksum type, which verified the data messages.
+	CRC CRCType
+
+	// Urgent is true if the data chunk was sent with WriteUrgent.
+	Urgent bool
+
+	// FrameStart is the arrival time of the start character of the first
+	// data message and FrameEnd the arrival time of the end character of the
+	// last data message of the data chunk. Both are only set if
+	// Config.Timestamps is enabled. Their resolution is limited by the
+	// read granularity of the source.
+	FrameStart time.Time
+	FrameEnd   time.Time
+
+	// DuplicatesSuppressed is true if duplicate data messages
+	// of the data chunk were received and discarded.
+	DuplicatesSuppressed bool
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// newMessage creates a new message with the reception metadata of the port.
+// This method must be only called by the read messages routine.
+func (p *Port) newMessage(pmsn byte, crcType CRCType, urgent bool, data []byte, fragments int) *Message {
+	m := &Message{
+		Data:      data,
+		Time:      time.Now(),
+		MSN:       pmsn,
+		Fragments: fragments,
+		CRC:       crcType,
+		Urgent:    urgent,
+	}
+
+	// Urgent data chunks are never split, but might arrive
+	// in the middle of a multi-message transmission.
+	if p.config.Timestamps {
+		m.FrameStart = p.decoder.startTime
+		if !urgent && fragments > 1 {
+			m.FrameStart = p.readBinaryDataStart
+		}
+		m.FrameEnd = p.decoder.endTime
+	}
+
+	return m
+}
@@ -0,0 +1,117 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"io"
+	"time"
+)
+
+//############################//
+//### Modem Control Source ###//
+//############################//
+
+// A ModemControlSource is an optional interface of a port source, which
+// controls the break condition and the modem lines, for example of a serial
+// port. Some devices require a break or a DTR toggle to reset, before the
+// communication starts. The serial package implements it.
+type ModemControlSource interface {
+	io.ReadWriteCloser
+
+	// SendBreak holds the transmit line low for the duration.
+	SendBreak(d time.Duration) error
+
+	// SetDTR sets or clears the data terminal ready line.
+	SetDTR(on bool) error
+
+	// SetRTS sets or clears the request to send line.
+	SetRTS(on bool) error
+
+	// ModemLines returns the states of the clear to send, data set ready,
+	// carrier detect and ring indicator lines.
+	ModemLines() (cts, dsr, cd, ri bool, err error)
+}
+
+// SendBreak sends a break for the duration. No frame is written during the break.
+// ErrNoModemControl is returned if the source does not support it.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) SendBreak(d time.Duration) error {
+	// Don't interrupt the transmission of a frame.
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	mcs, err := p.getModemControlSource()
+	if err != nil {
+		return err
+	}
+	return mcs.SendBreak(d)
+}
+
+// SetDTR sets or clears the data terminal ready line of the source.
+// ErrNoModemControl is returned if the source does not support it.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) SetDTR(on bool) error {
+	mcs, err := p.getModemControlSource()
+	if err != nil {
+		return err
+	}
+	return mcs.SetDTR(on)
+}
+
+// SetRTS sets or clears the request to send line of the source.
+// ErrNoModemControl is returned if the source does not support it.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) SetRTS(on bool) error {
+	mcs, err := p.getModemControlSource()
+	if err != nil {
+		return err
+	}
+	return mcs.SetRTS(on)
+}
+
+// ModemLines returns the states of the clear to send, data set ready,
+// carrier detect and ring indicator lines of the source.
+// ErrNoModemControl is returned if the source does not support it.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) ModemLines() (cts, dsr, cd, ri bool, err error) {
+	mcs, err := p.getModemControlSource()
+	if err != nil {
+		return false, false, false, false, err
+	}
+	return mcs.ModemLines()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// getModemControlSource returns the current source
+// if it supports the modem control.
+func (p *Port) getModemControlSource() (ModemControlSource, error) {
+	if p.IsClosed() {
+		return nil, ErrClosed
+	}
+
+	mcs, ok := p.getSource().(ModemControlSource)
+	if !ok {
+		return nil, ErrNoModemControl
+	}
+
+	return mcs, nil
+}
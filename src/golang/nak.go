@@ -0,0 +1,166 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"errors"
+	"fmt"
+)
+
+//#######################//
+//### NAK Reason type ###//
+//#######################//
+
+// NakReason is the reason of a negative acknowledge, which the peer sends
+// in the payload of the negative acknowledge control message.
+type NakReason byte
+
+const (
+	// NakReasonUnspecified is set if the peer did not send a reason.
+	// Legacy peers send negative acknowledges without a payload.
+	NakReasonUnspecified NakReason = iota
+
+	// NakReasonCRCError is set if the data message was corrupted on the line.
+	NakReasonCRCError
+
+	// NakReasonBufferOverflow is set if the reassembly buffer of the peer
+	// overflowed. The peer discarded the complete transmission.
+	NakReasonBufferOverflow
+
+	// NakReasonUnsupportedVersion is set if the peer does not support
+	// the format of the data message, e.g. a custom CRC type.
+	NakReasonUnsupportedVersion
+
+	// NakReasonBusy is set if the peer could not accept the data message
+	// at the moment. The data message is resent after the resend timeout.
+	NakReasonBusy
+
+	// NakReasonDeltaMismatch is set if the peer could not decode the delta
+	// encoded data chunk, because its base data chunk differs. The peer
+	// discarded the transmission. The data chunk is resent as keyframe.
+	NakReasonDeltaMismatch
+)
+
+// String returns the name of the reason.
+func (r NakReason) String() string {
+	switch r {
+	case NakReasonUnspecified:
+		return "unspecified"
+	case NakReasonCRCError:
+		return "crc error"
+	case NakReasonBufferOverflow:
+		return "buffer overflow"
+	case NakReasonUnsupportedVersion:
+		return "unsupported version"
+	case NakReasonBusy:
+		return "busy"
+	case NakReasonDeltaMismatch:
+		return "delta mismatch"
+	default:
+		return fmt.Sprintf("unknown (%v)", byte(r))
+	}
+}
+
+// err returns the error of a rejection, which can't be resolved by
+// retransmissions of the data message. Otherwise nil is returned.
+func (r NakReason) err() error {
+	switch r {
+	case NakReasonBufferOverflow:
+		return ErrPeerBufferOverflow
+	case NakReasonUnsupportedVersion:
+		return ErrPeerUnsupportedVersion
+	case NakReasonDeltaMismatch:
+		return ErrPeerDeltaMismatch
+	default:
+		return nil
+	}
+}
+
+//#################//
+//### Variables ###//
+//#################//
+
+var (
+	// ErrPeerBufferOverflow is returned by the write methods if the peer
+	// discarded the transmission, because its reassembly buffer overflowed.
+	ErrPeerBufferOverflow = errors.New("peer reassembly buffer overflow")
+
+	// ErrPeerUnsupportedVersion is returned by the write methods if
+	// the peer does not support the format of the data messages.
+	ErrPeerUnsupportedVersion = errors.New("data message format not supported by the peer")
+
+	// ErrPeerBusy is returned by the write methods if the peer was busy
+	// and the ARQ strategy gave up the transmission.
+	ErrPeerBusy = errors.New("peer is busy")
+
+	// ErrPeerDeltaMismatch is returned by the write methods if the peer
+	// could not decode a delta encoded data chunk, which was transmitted
+	// within the send window. Other data chunks are resent as keyframe.
+	ErrPeerDeltaMismatch = errors.New("delta encoded data chunk not decoded by the peer")
+)
+
+// Errors of received data messages, which are rejected
+// with a specific negative acknowledge reason.
+var (
+	errReassemblyOverflow = errors.New("reassembly buffer overflow: transmission discarded")
+	errUnsupportedCRC     = errors.New("custom CRC type is not supported")
+	errServiceBusy        = errors.New("service is busy")
+	errReadQueueFull      = errors.New("read queue is full")
+	errDeltaMismatch      = errors.New("failed to decode delta encoded data chunk: base data chunk differs")
+)
+
+//###############//
+//### Private ###//
+//###############//
+
+// nakReasonOf returns the negative acknowledge reason of the error,
+// which rejected a received data message.
+func nakReasonOf(err error) NakReason {
+	switch err {
+	case errReassemblyOverflow:
+		return NakReasonBufferOverflow
+	case errUnsupportedCRC:
+		return NakReasonUnsupportedVersion
+	case errServiceBusy, errReadQueueFull:
+		return NakReasonBusy
+	case errDeltaMismatch:
+		return NakReasonDeltaMismatch
+	default:
+		return NakReasonCRCError
+	}
+}
+
+// countNak updates the negative acknowledge counters of the stats.
+func (p *Port) countNak(reason NakReason) {
+	p.stats.update(func(c *StatsSnapshot) {
+		c.NaksReceived++
+		switch reason {
+		case NakReasonCRCError:
+			c.NakCRCErrors++
+		case NakReasonBufferOverflow:
+			c.NakBufferOverflows++
+		case NakReasonUnsupportedVersion:
+			c.NakUnsupportedVersions++
+		case NakReasonBusy:
+			c.NakBusy++
+		case NakReasonDeltaMismatch:
+			c.NakDeltaMismatches++
+		}
+	})
+}
@@ -0,0 +1,103 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	pingRequest = 0
+	pingReply   = 1
+)
+
+//############//
+//### Ping ###//
+//############//
+
+// Ping sends a lightweight probe control message and measures the
+// round trip time until the peer replied. The probe is independent
+// of the data traffic. Concurrent pings are sent one after another.
+// If the context is done before, then the context's error is returned.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) Ping(ctx context.Context) (time.Duration, error) {
+	// Lock the mutex.
+	p.pingMutex.Lock()
+	defer p.pingMutex.Unlock()
+
+	// The heartbeats use a reserved nonce.
+	p.pingNonce++
+	if p.pingNonce == heartbeatNonce {
+		p.pingNonce++
+	}
+	nonce := p.pingNonce
+	start := time.Now()
+
+	p.writeControlMessage(bel, umsn, pingRequest, nonce)
+
+	// Wait for the matching reply. Discard replies of previous pings.
+	for {
+		select {
+		case <-p.closeChan:
+			return 0, ErrClosed
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case n := <-p.pingReplyChan:
+			if n == nonce {
+				return time.Since(start), nil
+			}
+		}
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// handleReceivedPing replies to ping requests and passes replies to Ping.
+// Payload: Kind (1 Byte) | Nonce (1 Byte)
+func (p *Port) handleReceivedPing(payload []byte) error {
+	if len(payload) != 2 {
+		return fmt.Errorf("invalid ping control message payload")
+	}
+
+	switch payload[0] {
+	case pingRequest:
+		p.writeControlMessage(bel, umsn, pingReply, payload[1])
+
+	case pingReply:
+		// The heartbeat replies only prove, that the link is alive.
+		if payload[1] == heartbeatNonce {
+			return nil
+		}
+
+		// Never block the read routine. Nobody is waiting for a late reply.
+		select {
+		case p.pingReplyChan <- payload[1]:
+		default:
+		}
+
+	default:
+		return fmt.Errorf("invalid ping control message kind: %v", payload[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,514 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollTimeout   = 1 * time.Second
+	sharedReadBufferSize = 1024
+)
+
+// Errors:
+var (
+	// ErrUnknownSlave is returned by the Poller methods
+	// if the address is not one of the polled slaves.
+	ErrUnknownSlave = errors.New("unknown slave address")
+)
+
+//#########################//
+//### PollerConfig type ###//
+//#########################//
+
+// A PollSlave is a slave node polled by a Poller.
+type PollSlave struct {
+	// Address is the address of the slave node on the bus.
+	Address byte
+
+	// Timeout is the maximum duration to wait for the response of the slave.
+	// Slow slaves might require a longer timeout than the others.
+	// The default is the timeout of the poller.
+	Timeout time.Duration
+}
+
+// A PollerConfig represents the configuration of a poller.
+type PollerConfig struct {
+	// Address is the address of the master node on the bus.
+	Address byte
+
+	// Slaves are the polled slave nodes in the polling order.
+	Slaves []PollSlave
+
+	// Timeout is the maximum duration to wait for the response of a slave.
+	// The default is 1 second.
+	Timeout time.Duration
+
+	// Interval is the minimum duration of a polling cycle. The default
+	// of zero starts the next polling cycle right away.
+	Interval time.Duration
+
+	// Request returns the poll request for the slave.
+	// The default sends an empty data chunk.
+	Request func(address byte) []byte
+
+	// OnResponse is called with the response of a slave.
+	// The hook is called from the routine, which called Run.
+	OnResponse func(address byte, m *Message)
+
+	// OnError is called if a slave did not respond. A missing response
+	// is reported with ErrTimeout. The hook is called from the routine,
+	// which called Run.
+	OnError func(address byte, err error)
+
+	// Port is the configuration of the ports of the slaves.
+	// The poller enables the addressing and sets the addresses of a copy.
+	// Use a short AckTimeout and a few MaxRetries, so absent slaves don't
+	// delay the polling cycle.
+	Port *Config
+}
+
+// setDefaults sets the default values for unset variables.
+func (c *PollerConfig) setDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultPollTimeout
+	}
+
+	if c.Request == nil {
+		c.Request = func(byte) []byte { return []byte{} }
+	}
+}
+
+//######################//
+//### PollStats type ###//
+//######################//
+
+// PollStats are the polling statistics of a slave.
+type PollStats struct {
+	// Polls is the number of sent poll requests.
+	Polls uint64
+
+	// Responses is the number of received responses.
+	Responses uint64
+
+	// Timeouts is the number of poll requests without a response.
+	Timeouts uint64
+
+	// Errors is the number of poll requests, which failed otherwise.
+	Errors uint64
+
+	// LastResponse is the reception time of the last response.
+	LastResponse time.Time
+
+	// ResponseTime is the duration between the last
+	// poll request and the reception of its response.
+	ResponseTime time.Duration
+}
+
+//###################//
+//### Poller type ###//
+//###################//
+
+// A Poller is the master of a multi-drop bus like RS-485. It cycles through
+// the slave addresses, sends a poll request to each slave and collects the
+// responses with a timeout per slave. Each slave is served by an own port,
+// which shares the source of the bus and ignores the messages of the other
+// slaves by their address header. The slaves answer the poll requests, for
+// example with the Responder hook. This implementation is thread-safe.
+type Poller struct {
+	config *PollerConfig
+	source *sharedSource
+	slaves []*pollSlave
+
+	closeMutex sync.Mutex
+	isClosed   bool
+	closeChan  chan struct{}
+}
+
+// NewPoller creates a new poller on the source of the bus.
+// The poller takes over the source.
+func NewPoller(source io.ReadWriteCloser, config *PollerConfig) (*Poller, error) {
+	config.setDefaults()
+
+	// Validate the addresses.
+	seen := map[byte]bool{config.Address: true}
+	if config.Address == BroadcastAddress {
+		return nil, fmt.Errorf("invalid master address: %v", config.Address)
+	}
+	for _, s := range config.Slaves {
+		if s.Address == BroadcastAddress || seen[s.Address] {
+			return nil, fmt.Errorf("invalid slave address: %v", s.Address)
+		}
+		seen[s.Address] = true
+	}
+
+	// The ports read from the shared source.
+	pollInterval := readWaitDuration
+	if config.Port != nil && config.Port.ReadPollInterval != 0 {
+		pollInterval = config.Port.ReadPollInterval
+	}
+
+	pl := &Poller{
+		config:    config,
+		source:    newSharedSource(source, pollInterval),
+		closeChan: make(chan struct{}),
+	}
+
+	for _, s := range config.Slaves {
+		var c Config
+		if config.Port != nil {
+			c = *config.Port
+		}
+		c.AddressingEnabled = true
+		c.Address = config.Address
+		c.PeerAddress = s.Address
+
+		timeout := s.Timeout
+		if timeout <= 0 {
+			timeout = config.Timeout
+		}
+
+		pl.slaves = append(pl.slaves, &pollSlave{
+			address: s.Address,
+			timeout: timeout,
+			port:    NewPort(pl.source.tap(), &c),
+		})
+	}
+
+	go pl.source.readLoop()
+
+	return pl, nil
+}
+
+// Run polls the slaves cycle by cycle until the context is done or the
+// poller is closed. Returns the error of the context or ErrClosed.
+func (pl *Poller) Run(ctx context.Context) error {
+	for {
+		start := time.Now()
+
+		for _, s := range pl.slaves {
+			m, err := pl.poll(s)
+			if err == ErrClosed && pl.closed() {
+				return err
+			} else if err != nil {
+				if pl.config.OnError != nil {
+					pl.config.OnError(s.address, err)
+				}
+			} else if pl.config.OnResponse != nil {
+				pl.config.OnResponse(s.address, m)
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+
+		// Wait for the next polling cycle.
+		timer := time.NewTimer(pl.config.Interval - time.Since(start))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-pl.closeChan:
+			timer.Stop()
+			return ErrClosed
+		case <-timer.C:
+		}
+	}
+}
+
+// Poll sends a poll request to the slave and waits for its response.
+// Stale responses of previously timed out poll requests are discarded.
+// If the slave did not respond within its timeout, then ErrTimeout is returned.
+// If the poller is closed, then ErrClosed is returned.
+func (pl *Poller) Poll(address byte) (*Message, error) {
+	s := pl.slave(address)
+	if s == nil {
+		return nil, ErrUnknownSlave
+	}
+	return pl.poll(s)
+}
+
+// Stats returns the polling statistics of the slave.
+func (pl *Poller) Stats(address byte) (PollStats, error) {
+	s := pl.slave(address)
+	if s == nil {
+		return PollStats{}, ErrUnknownSlave
+	}
+
+	// Lock the mutex.
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	return s.stats, nil
+}
+
+// Port returns the port of the slave, for example to write
+// commands to the slave or to obtain its transmission statistics.
+// Don't read from the port while the slave is polled.
+func (pl *Poller) Port(address byte) (*Port, error) {
+	s := pl.slave(address)
+	if s == nil {
+		return nil, ErrUnknownSlave
+	}
+	return s.port, nil
+}
+
+// Close closes the ports of all slaves and the source of the bus.
+func (pl *Poller) Close() error {
+	// Lock the mutex.
+	pl.closeMutex.Lock()
+	if pl.isClosed {
+		pl.closeMutex.Unlock()
+		return nil
+	}
+	pl.isClosed = true
+	close(pl.closeChan)
+	pl.closeMutex.Unlock()
+
+	for _, s := range pl.slaves {
+		_ = s.port.Close()
+	}
+
+	return pl.source.source.Close()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+type pollSlave struct {
+	address byte
+	timeout time.Duration
+	port    *Port
+
+	pollMutex sync.Mutex // Only one poll request of the slave is pending.
+
+	statsMutex sync.Mutex
+	stats      PollStats
+}
+
+// slave returns the polled slave with the address or nil.
+func (pl *Poller) slave(address byte) *pollSlave {
+	for _, s := range pl.slaves {
+		if s.address == address {
+			return s
+		}
+	}
+	return nil
+}
+
+// closed returns a boolean whenever the poller is closed.
+func (pl *Poller) closed() bool {
+	// Lock the mutex.
+	pl.closeMutex.Lock()
+	defer pl.closeMutex.Unlock()
+
+	return pl.isClosed
+}
+
+// poll sends a poll request to the slave and waits for its response.
+func (pl *Poller) poll(s *pollSlave) (m *Message, err error) {
+	// Lock the mutex.
+	s.pollMutex.Lock()
+	defer s.pollMutex.Unlock()
+
+	// Discard stale responses of timed out poll requests.
+	for drained := false; !drained; {
+		select {
+		case <-s.port.readDataChunkChan:
+		default:
+			drained = true
+		}
+	}
+
+	start := time.Now()
+	err = s.port.Write(pl.config.Request(s.address))
+	if err == nil {
+		m, err = s.port.ReadMessage(s.timeout)
+	}
+
+	// Update the statistics.
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	s.stats.Polls++
+	switch err {
+	case nil:
+		s.stats.Responses++
+		s.stats.LastResponse = m.Time
+		s.stats.ResponseTime = m.Time.Sub(start)
+	case ErrTimeout:
+		s.stats.Timeouts++
+	default:
+		s.stats.Errors++
+	}
+
+	return m, err
+}
+
+//#########################//
+//### sharedSource type ###//
+//#########################//
+
+// A sharedSource shares the source of a multi-drop bus between multiple
+// ports. The frames of the ports are written to the source one at a time.
+// The received bytes are passed to all ports.
+type sharedSource struct {
+	source       io.ReadWriteCloser
+	pollInterval time.Duration // Wait duration if a read returned no data.
+	writeMutex   sync.Mutex
+
+	tapsMutex sync.Mutex
+	taps      []*sourceTap
+}
+
+func newSharedSource(source io.ReadWriteCloser, pollInterval time.Duration) *sharedSource {
+	return &sharedSource{source: source, pollInterval: pollInterval}
+}
+
+// tap returns a new source for a port on the shared source.
+func (s *sharedSource) tap() *sourceTap {
+	t := &sourceTap{shared: s}
+	t.cond = sync.NewCond(&t.mutex)
+
+	// Lock the mutex.
+	s.tapsMutex.Lock()
+	s.taps = append(s.taps, t)
+	s.tapsMutex.Unlock()
+
+	return t
+}
+
+// readLoop passes the received bytes to all taps until the source fails.
+func (s *sharedSource) readLoop() {
+	buf := make([]byte, sharedReadBufferSize)
+
+	for {
+		n, err := s.source.Read(buf)
+		if n == 0 && err == nil {
+			// Don't spin on sources, which return no data instead of blocking.
+			if s.pollInterval > 0 {
+				time.Sleep(s.pollInterval)
+			}
+			continue
+		}
+
+		s.tapsMutex.Lock()
+		taps := s.taps
+		s.tapsMutex.Unlock()
+
+		for _, t := range taps {
+			t.push(buf[:n], err)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// A sourceTap is the source of a port on the shared source.
+type sourceTap struct {
+	shared *sharedSource
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	buffer   []byte
+	err      error // The read error of the source, which is returned after the buffered bytes.
+	isClosed bool
+}
+
+// push appends the received bytes and the read error of the source.
+func (t *sourceTap) push(data []byte, err error) {
+	// Lock the mutex.
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.buffer = append(t.buffer, data...)
+	if err != nil {
+		t.err = err
+	}
+	t.cond.Broadcast()
+}
+
+func (t *sourceTap) Read(p []byte) (int, error) {
+	// Lock the mutex.
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for len(t.buffer) == 0 && t.err == nil && !t.isClosed {
+		t.cond.Wait()
+	}
+
+	if t.isClosed {
+		return 0, io.ErrClosedPipe
+	} else if len(t.buffer) == 0 {
+		return 0, t.err
+	}
+
+	n := copy(p, t.buffer)
+	t.buffer = t.buffer[n:]
+	return n, nil
+}
+
+func (t *sourceTap) Write(p []byte) (int, error) {
+	// Lock the mutex.
+	t.mutex.Lock()
+	closed := t.isClosed
+	t.mutex.Unlock()
+
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	// Never interleave the frames of the ports.
+	t.shared.writeMutex.Lock()
+	defer t.shared.writeMutex.Unlock()
+
+	var written int
+	for written < len(p) {
+		n, err := t.shared.source.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		} else if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
+}
+
+// Close closes the tap. The shared source is not closed.
+func (t *sourceTap) Close() error {
+	// Lock the mutex.
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.isClosed = true
+	t.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,220 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	decoderPoolQueueSize = 1024
+	poolJobChanSize      = 8
+
+	// A job, which runs longer, stalls. The worker is replaced by a new one.
+	poolStallTimeout = 50 * time.Millisecond
+)
+
+//#########################//
+//### Decoder Pool type ###//
+//#########################//
+
+// A DecoderPool decodes the received data of many ports with a bounded
+// number of goroutines. Without a pool, each port runs its own decoder
+// goroutine. This wastes scheduler overhead if a process hosts many ports.
+// The decoder state is kept separately per port and the received data of
+// a port is always decoded in order by one goroutine at a time. A port,
+// which stalls its worker, e.g. because nobody reads its received data,
+// never stops the other ports. A new worker takes over the pool.
+// Set the pool with Config.DecoderPool.
+type DecoderPool struct {
+	queue     chan *Port
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDecoderPool creates a new decoder pool with the number of worker goroutines.
+func NewDecoderPool(workers int) *DecoderPool {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	dp := &DecoderPool{
+		queue:     make(chan *Port, decoderPoolQueueSize),
+		closeChan: make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		go dp.workerLoop()
+	}
+
+	return dp
+}
+
+// Close stops the worker goroutines.
+// Close the ports of the pool first.
+func (dp *DecoderPool) Close() {
+	dp.closeOnce.Do(func() {
+		close(dp.closeChan)
+	})
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+func (dp *DecoderPool) workerLoop() {
+	w := &poolWorker{pool: dp}
+	w.stallTimer = time.AfterFunc(time.Hour, w.handOff)
+	w.stallTimer.Stop()
+	defer w.stallTimer.Stop()
+
+	for {
+		select {
+		case <-dp.closeChan:
+			return
+		case p := <-dp.queue:
+			p.runPoolJobs(w)
+
+			// A new worker took over the pool, because a job of the port stalled.
+			if atomic.LoadInt32(&w.detached) != 0 {
+				return
+			}
+		}
+	}
+}
+
+//########################//
+//### Pool Worker type ###//
+//########################//
+
+type poolWorker struct {
+	pool       *DecoderPool
+	stallTimer *time.Timer // Fires if a job stalls.
+	detached   int32       // Atomic flag. Set if a new worker took over the pool.
+}
+
+// handOff starts a new worker, which takes over the pool, because a job
+// blocks the current worker. The current worker finishes the jobs of its
+// port and exits afterwards.
+func (w *poolWorker) handOff() {
+	if atomic.CompareAndSwapInt32(&w.detached, 0, 1) {
+		go w.pool.workerLoop()
+	}
+}
+
+// submitPoolJob queues a job of the read messages routine of the port.
+// The jobs of a port are executed in order by one worker at a time.
+// Returns false if the port was closed.
+func (p *Port) submitPoolJob(job func()) bool {
+	dp := p.config.DecoderPool
+
+	select {
+	case <-p.closeChan:
+		return false
+	case p.poolJobChan <- job:
+	}
+
+	// Schedule the port if no worker is running its jobs.
+	if atomic.CompareAndSwapInt32(&p.poolScheduled, 0, 1) {
+		select {
+		case <-p.closeChan:
+			return false
+		case <-dp.closeChan:
+			return false
+		case dp.queue <- p:
+		}
+	}
+
+	return true
+}
+
+// runPoolJobs runs the queued jobs of the port until none are left.
+// Jobs might block, e.g. if the received data is not read. The worker
+// is handed off, if a job stalls.
+func (p *Port) runPoolJobs(w *poolWorker) {
+	for {
+		// Run all queued jobs.
+	Loop:
+		for {
+			select {
+			case <-p.closeChan:
+				return
+			case job := <-p.poolJobChan:
+				w.stallTimer.Reset(poolStallTimeout)
+				job()
+				w.stallTimer.Stop()
+			default:
+				break Loop
+			}
+		}
+
+		// Publish the current read state for debugging purposes.
+		p.publishDecoderState()
+
+		// Release the port. Check again for jobs, which were queued in the meantime.
+		atomic.StoreInt32(&p.poolScheduled, 0)
+		if len(p.poolJobChan) == 0 || !atomic.CompareAndSwapInt32(&p.poolScheduled, 0, 1) {
+			return
+		}
+	}
+}
+
+// decodePoolData decodes the received chunk on the decoder pool.
+// Returns false if the port was closed.
+func (p *Port) decodePoolData(c receivedChunk) bool {
+	return p.submitPoolJob(func() {
+		// Discard a timed out message. There is no timer on the pool,
+		// so check the deadline as soon as new data arrives.
+		if !p.decoder.deadline.IsZero() && p.config.Clock.Now().After(p.decoder.deadline) {
+			p.resetDecoder()
+		}
+
+		p.decodeChunk(c)
+		p.releaseReadBuffer(c)
+	})
+}
+
+// startPoolTimers starts the timers of the read messages routine on the decoder pool.
+func (p *Port) startPoolTimers() {
+	// The reassembly timer submits a job to discard stale binary data.
+	p.reassemblyTimer = p.config.Clock.AfterFunc(p.config.ReassemblyTimeout, func() {
+		p.submitPoolJob(func() {
+			if len(p.readBinaryDataBuffer) > 0 && p.config.Clock.Now().Sub(p.readBinaryDataTime) >= p.config.ReassemblyTimeout {
+				p.discardStaleBinaryData()
+			}
+		})
+	})
+	p.reassemblyTimer.Stop()
+
+	// Advertise the free reassembly buffer space periodically if enabled.
+	// A responder never initiates a transmission.
+	if p.config.BufferStatusInterval > 0 && p.config.Responder == nil {
+		// Start the timer after it was assigned, because the function resets it.
+		var timer *time.Timer
+		timer = time.AfterFunc(time.Hour, func() {
+			if p.submitPoolJob(p.writeBufferStatus) {
+				timer.Reset(p.config.BufferStatusInterval)
+			}
+		})
+		timer.Stop()
+		timer.Reset(p.config.BufferStatusInterval)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//#################//
+//### Variables ###//
+//#################//
+
+// Errors:
+var (
+	// ErrPoolExhausted is returned by Pool.Open if the resource budget
+	// is exhausted and queueing is disabled.
+	ErrPoolExhausted = errors.New("port pool resource budget exhausted")
+
+	// ErrPoolClosed is returned by Pool.Open if the pool is closed.
+	ErrPoolClosed = errors.New("port pool closed")
+)
+
+//#################//
+//### Pool type ###//
+//#################//
+
+// A PoolConfig defines the resource budget of a port pool.
+// Zero values do not limit the resource.
+type PoolConfig struct {
+	// MaxPorts is the maximum number of open ports and
+	// therefore open sources (usually file descriptors).
+	MaxPorts int
+
+	// MaxGoroutines is the maximum number of goroutines of all ports.
+	// The decoder workers are not included.
+	MaxGoroutines int
+
+	// MaxBufferMemory is the maximum sum of the reassembly buffer sizes
+	// of all ports in bytes.
+	MaxBufferMemory int
+
+	// DecoderWorkers enables a shared decoder pool with the number of
+	// worker goroutines for all ports. This saves one goroutine per port.
+	DecoderWorkers int
+
+	// Queue lets Open wait for released resources instead of
+	// returning ErrPoolExhausted.
+	Queue bool
+}
+
+// A Pool manages many ports within a resource budget.
+// This is required for multi-tenant gateways, which must stay
+// within cgroup limits. This implementation is thread-safe.
+type Pool struct {
+	config      PoolConfig
+	decoderPool *DecoderPool
+
+	mutex        sync.Mutex
+	isClosed     bool
+	ports        int
+	goroutines   int
+	bufferMemory int
+	releaseChan  chan struct{} // Closed and replaced on each release.
+}
+
+// NewPool creates a new port pool.
+func NewPool(config PoolConfig) *Pool {
+	pl := &Pool{
+		config:      config,
+		releaseChan: make(chan struct{}),
+	}
+
+	if config.DecoderWorkers > 0 {
+		pl.decoderPool = NewDecoderPool(config.DecoderWorkers)
+	}
+
+	return pl
+}
+
+// Open reserves the resources of a new port, opens the source with the
+// open function and creates the port. The resources are released as soon
+// as the port is closed. Optionally pass a port config.
+// If the budget is exhausted, then Open either waits until the context is
+// done or returns ErrPoolExhausted, depending on the pool config.
+func (pl *Pool) Open(ctx context.Context, open func() (io.ReadWriteCloser, error), config ...*Config) (*Port, error) {
+	// Get a copy of the config. The shared decoder pool is set on the copy,
+	// so the config of the caller can be reused with other pools.
+	c := new(Config)
+	if len(config) > 0 {
+		*c = *config[0]
+	}
+
+	if pl.decoderPool != nil {
+		c.DecoderPool = pl.decoderPool
+	}
+	c.setDefaults()
+
+	// Calculate the resources of the port.
+	goroutines := 2
+	if c.DecoderPool == nil {
+		goroutines++
+	}
+	if c.Responder != nil {
+		goroutines++
+	}
+	if c.KeepaliveInterval > 0 || c.LinkTimeout > 0 {
+		goroutines++
+	}
+
+	// Reserve the resources.
+	if err := pl.reserve(ctx, goroutines, c.ReassemblyBufferSize); err != nil {
+		return nil, err
+	}
+
+	source, err := open()
+	if err != nil {
+		pl.release(goroutines, c.ReassemblyBufferSize)
+		return nil, fmt.Errorf("failed to open port source: %v", err)
+	}
+
+	p := NewPort(source, c)
+
+	// Release the resources once the port is closed.
+	p.closeMutex.Lock()
+	released := p.isClosed
+	if !released {
+		p.onClose = func() {
+			pl.release(goroutines, c.ReassemblyBufferSize)
+		}
+	}
+	p.closeMutex.Unlock()
+
+	if released {
+		pl.release(goroutines, c.ReassemblyBufferSize)
+	}
+
+	return p, nil
+}
+
+// Close the pool. Further calls to Open fail with ErrPoolClosed.
+// The shared decoder pool is stopped, so close all ports first.
+func (pl *Pool) Close() {
+	// Lock the mutex.
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	if pl.isClosed {
+		return
+	}
+	pl.isClosed = true
+
+	// Wake up queued calls to Open.
+	close(pl.releaseChan)
+
+	if pl.decoderPool != nil {
+		pl.decoderPool.Close()
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// reserve reserves the resources of a port.
+func (pl *Pool) reserve(ctx context.Context, goroutines, bufferMemory int) error {
+	for {
+		pl.mutex.Lock()
+
+		if pl.isClosed {
+			pl.mutex.Unlock()
+			return ErrPoolClosed
+		}
+
+		c := &pl.config
+		if (c.MaxPorts <= 0 || pl.ports+1 <= c.MaxPorts) &&
+			(c.MaxGoroutines <= 0 || pl.goroutines+goroutines <= c.MaxGoroutines) &&
+			(c.MaxBufferMemory <= 0 || pl.bufferMemory+bufferMemory <= c.MaxBufferMemory) {
+			pl.ports++
+			pl.goroutines += goroutines
+			pl.bufferMemory += bufferMemory
+			pl.mutex.Unlock()
+			return nil
+		}
+
+		releaseChan := pl.releaseChan
+		pl.mutex.Unlock()
+
+		if !c.Queue {
+			return ErrPoolExhausted
+		}
+
+		// Wait until resources are released.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-releaseChan:
+		}
+	}
+}
+
+// release releases the resources of a port.
+func (pl *Pool) release(goroutines, bufferMemory int) {
+	// Lock the mutex.
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	pl.ports--
+	pl.goroutines -= goroutines
+	pl.bufferMemory -= bufferMemory
+
+	// Wake up queued calls to Open.
+	if !pl.isClosed {
+		close(pl.releaseChan)
+		pl.releaseChan = make(chan struct{})
+	}
+}
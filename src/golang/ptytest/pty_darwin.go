@@ -0,0 +1,58 @@
+//go:build darwin
+// +build darwin
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ptytest
+
+import (
+	"bytes"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	getTermiosRequest = unix.TIOCGETA
+	setTermiosRequest = unix.TIOCSETA
+)
+
+// unlockPTY grants and unlocks the tty of the pseudo terminal
+// and returns its path.
+func unlockPTY(fd int) (string, error) {
+	if err := unix.IoctlSetInt(fd, unix.TIOCPTYGRANT, 0); err != nil {
+		return "", err
+	}
+
+	if err := unix.IoctlSetInt(fd, unix.TIOCPTYUNLK, 0); err != nil {
+		return "", err
+	}
+
+	// The name is returned in a buffer of 128 bytes.
+	var name [128]byte
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TIOCPTYGNAME, uintptr(unsafe.Pointer(&name[0])))
+	if errno != 0 {
+		return "", errno
+	}
+
+	if i := bytes.IndexByte(name[:], 0); i >= 0 {
+		return string(name[:i]), nil
+	}
+	return string(name[:]), nil
+}
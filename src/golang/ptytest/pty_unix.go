@@ -0,0 +1,97 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ptytest
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+//###############//
+//### Private ###//
+//###############//
+
+// openPTY opens the master side of a new pseudo terminal
+// and returns it with the path of the tty.
+func openPTY() (master *os.File, name string, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("ptytest: failed to open pseudo terminal: %v", err)
+	}
+
+	// Don't call Fd, which switches the file to blocking mode.
+	// Close would not release blocked reads anymore.
+	rc, err := master.SyscallConn()
+	if err == nil {
+		cerr := rc.Control(func(fd uintptr) {
+			name, err = unlockPTY(int(fd))
+		})
+		if err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("ptytest: failed to unlock pseudo terminal: %v", err)
+	}
+
+	return master, name, nil
+}
+
+// openRaw opens the tty and switches it to the raw mode,
+// so the line discipline passes the bytes unchanged.
+func openRaw(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("ptytest: failed to open tty: %v", err)
+	}
+
+	rc, err := f.SyscallConn()
+	if err == nil {
+		cerr := rc.Control(func(fd uintptr) {
+			var t *unix.Termios
+			t, err = unix.IoctlGetTermios(int(fd), getTermiosRequest)
+			if err != nil {
+				return
+			}
+
+			t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+			t.Oflag &^= unix.OPOST
+			t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+			t.Cflag &^= unix.CSIZE | unix.PARENB
+			t.Cflag |= unix.CS8
+
+			err = unix.IoctlSetTermios(int(fd), setTermiosRequest, t)
+		})
+		if err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("ptytest: failed to set tty raw mode: %v", err)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,165 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package ptytest creates virtual serial port pairs, so the complete
+// ANTS port over the serial package is tested against a real tty layer
+// instead of the in-memory loopback.
+//
+// On Linux and macOS the pairs are backed by pseudo terminals. Windows has
+// no pseudo terminals. Install a virtual null-modem driver like com0com
+// and set the PairEnv environment variable to its port names instead,
+// for example ANTS_PTYTEST_PAIR=COM10,COM11. The variable also selects
+// two real serial ports connected with a null-modem cable on all platforms.
+package ptytest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// PairEnv is the environment variable, which names the two connected
+	// serial ports separated by a comma. It takes precedence over the
+	// pseudo terminals.
+	PairEnv = "ANTS_PTYTEST_PAIR"
+)
+
+var (
+	// ErrUnsupported is returned if pseudo terminals are not supported on
+	// this platform and PairEnv is not set. Skip the test in this case.
+	ErrUnsupported = errors.New("ptytest: pseudo terminals are not supported on this platform: set " + PairEnv)
+)
+
+//################//
+//### PTY type ###//
+//################//
+
+// A PTY is the master side of a pseudo terminal. The bytes written to
+// it are received by the tty named Name and vice versa. Open the tty like
+// a serial device, for example with serial.OpenPort.
+type PTY struct {
+	// Name is the path of the tty.
+	Name string
+
+	master *os.File
+	slave  *os.File // Keeps the line up while the tty is reopened.
+}
+
+// Open creates a new pseudo terminal in raw mode.
+// ErrUnsupported is returned if this platform has no pseudo terminals.
+func Open() (*PTY, error) {
+	master, name, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+
+	slave, err := openRaw(name)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	return &PTY{
+		Name:   name,
+		master: master,
+		slave:  slave,
+	}, nil
+}
+
+// Read reads the bytes written to the tty.
+func (p *PTY) Read(b []byte) (int, error) {
+	return p.master.Read(b)
+}
+
+// Write passes the bytes to the reader of the tty.
+func (p *PTY) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+// Close the pseudo terminal.
+func (p *PTY) Close() error {
+	err := p.master.Close()
+	if e := p.slave.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+//#################//
+//### Pair type ###//
+//#################//
+
+// A Pair is a virtual null-modem cable. The bytes written to
+// the serial port A are received by the serial port B and vice versa.
+type Pair struct {
+	// A and B are the names of the connected serial ports.
+	A, B string
+
+	closeOnce sync.Once
+	ptys      []*PTY
+}
+
+// NewPair creates a new virtual serial port pair. The serial ports named
+// by PairEnv are returned if set. Otherwise two pseudo terminals are connected.
+// ErrUnsupported is returned if this platform has no pseudo terminals.
+func NewPair() (*Pair, error) {
+	if names := os.Getenv(PairEnv); names != "" {
+		parts := strings.Split(names, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("ptytest: invalid %s value: %q", PairEnv, names)
+		}
+		return &Pair{A: strings.TrimSpace(parts[0]), B: strings.TrimSpace(parts[1])}, nil
+	}
+
+	a, err := Open()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := Open()
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	// Connect the master sides.
+	go io.Copy(a, b)
+	go io.Copy(b, a)
+
+	return &Pair{
+		A:    a.Name,
+		B:    b.Name,
+		ptys: []*PTY{a, b},
+	}, nil
+}
+
+// Close the pair. The serial ports named by PairEnv are not affected.
+func (p *Pair) Close() (err error) {
+	p.closeOnce.Do(func() {
+		for _, pty := range p.ptys {
+			if e := pty.Close(); err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
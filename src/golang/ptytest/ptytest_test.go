@@ -0,0 +1,145 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ptytest
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/serial"
+	"github.com/stretchr/testify/require"
+)
+
+func openSerial(t *testing.T, name string) io.ReadWriteCloser {
+	s, err := serial.OpenPort(&serial.Config{
+		Name:        name,
+		Baud:        115200,
+		ReadTimeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func TestPTY(t *testing.T) {
+	p, err := Open()
+	if err == ErrUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	defer p.Close()
+
+	s := openSerial(t, p.Name)
+	defer s.Close()
+
+	// The bytes pass the line discipline unchanged.
+	data := []byte{0x00, 0x03, 0x0a, 0x0d, 0x10, 0x11, 0x13, 0x7f, 0xff}
+	_, err = p.Write(data)
+	require.NoError(t, err)
+
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(s, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	_, err = s.Write(data)
+	require.NoError(t, err)
+	_, err = io.ReadFull(p, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+}
+
+func TestPortOverSerial(t *testing.T) {
+	pair, err := NewPair()
+	if err == ErrUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	defer pair.Close()
+
+	a := ants.NewPort(openSerial(t, pair.A))
+	defer a.Close()
+	b := ants.NewPort(openSerial(t, pair.B))
+	defer b.Close()
+
+	// A multi-message data chunk in both directions.
+	data := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	require.NoError(t, a.WriteAndConfirm(data, 5*time.Second))
+	received, err := b.Read(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, data, received)
+
+	require.NoError(t, b.Write([]byte("pong")))
+	received, err = a.Read(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), received)
+
+	// Both sides switch the baudrate at the same time.
+	// The pseudo terminals ignore the baudrate.
+	if len(pair.ptys) > 0 {
+		require.NoError(t, a.Reconfigure(&serial.Config{Baud: 9600}))
+		require.NoError(t, b.Reconfigure(&serial.Config{Baud: 9600}))
+		require.NoError(t, a.Write([]byte("slow")))
+		received, err = b.Read(5 * time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte("slow"), received)
+	}
+}
+
+func TestBaudCandidates(t *testing.T) {
+	pair, err := NewPair()
+	if err == ErrUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	defer pair.Close()
+
+	config := &serial.Config{
+		Name:           pair.A,
+		Baud:           115200,
+		BaudCandidates: []int{9600, 57600},
+		ReadTimeout:    50 * time.Millisecond,
+		PortConfig:     &ants.Config{HandshakeTimeout: 200 * time.Millisecond},
+	}
+
+	// Nobody replies to the ANTS handshake, so all baudrates are tried.
+	_, err = serial.OpenPort(config)
+	require.Error(t, err)
+	for _, baud := range []string{"115200 baud", "9600 baud", "57600 baud"} {
+		require.Contains(t, err.Error(), baud)
+	}
+
+	// The ANTS port of the peer replies to the handshake.
+	b := ants.NewPort(openSerial(t, pair.B))
+	defer b.Close()
+
+	s, err := serial.OpenPort(config)
+	require.NoError(t, err)
+	a := ants.NewPort(s, config.PortConfig)
+	defer a.Close()
+
+	require.NoError(t, a.WriteAndConfirm([]byte("probe"), 5*time.Second))
+	received, err := b.Read(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("probe"), received)
+}
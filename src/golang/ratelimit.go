@@ -0,0 +1,155 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"sync"
+	"time"
+)
+
+//#########################//
+//### Rate Limiter type ###//
+//#########################//
+
+// rateLimiter is a simple token bucket, which limits a byte rate.
+// The bucket holds at most the tokens of one second. Chunks larger than
+// the bucket are allowed to drain it below zero. Subsequent calls
+// wait until the debt is paid off.
+type rateLimiter struct {
+	rate   int // Bytes per second.
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// newRateLimiter returns a new rate limiter or nil if the rate is not limited.
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may pass the rate limiter.
+// Returns ErrClosed if the close channel was closed and ErrAborted if an
+// abort was requested on the optional abort channel in the meantime.
+// A nil rate limiter never blocks.
+func (r *rateLimiter) wait(n int, closeChan, abortChan <-chan struct{}) error {
+	if r == nil {
+		return nil
+	}
+
+	for {
+		d := r.reserve(n)
+		if d <= 0 {
+			return nil
+		}
+
+		select {
+		case <-closeChan:
+			return ErrClosed
+		case <-abortChan:
+			return ErrAborted
+		case <-time.After(d):
+		}
+	}
+}
+
+// waitUntilReady blocks until the debt of the rate limiter is paid off,
+// so the next bytes may pass. Consume them with take afterwards.
+// Returns ErrClosed if the close channel was closed and ErrTimeout
+// if the timeout channel was closed in the meantime.
+// A nil rate limiter never blocks.
+func (r *rateLimiter) waitUntilReady(closeChan, timeoutChan <-chan struct{}) error {
+	if r == nil {
+		return nil
+	}
+
+	for {
+		// Lock the mutex.
+		r.mutex.Lock()
+		d := r.debt()
+		r.mutex.Unlock()
+
+		if d <= 0 {
+			return nil
+		}
+
+		select {
+		case <-closeChan:
+			return ErrClosed
+		case <-timeoutChan:
+			return ErrTimeout
+		case <-time.After(d):
+		}
+	}
+}
+
+// take consumes n tokens, even if the bucket gets into debt.
+// A nil rate limiter is ignored.
+func (r *rateLimiter) take(n int) {
+	if r == nil {
+		return
+	}
+
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.tokens -= float64(n)
+}
+
+// reserve consumes n tokens if the bucket is not in debt.
+// Otherwise the duration to wait until the debt is paid off is returned.
+func (r *rateLimiter) reserve(n int) time.Duration {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Wait until the debt is paid off.
+	if d := r.debt(); d > 0 {
+		return d
+	}
+
+	r.tokens -= float64(n)
+	return 0
+}
+
+// debt refills the bucket and returns the duration to wait until
+// its debt is paid off. Zero is returned if the bucket is not in debt.
+// The mutex must be locked.
+func (r *rateLimiter) debt() time.Duration {
+	// Refill the bucket.
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.rate)
+	r.last = now
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+
+	if r.tokens < 0 {
+		return time.Duration(-r.tokens / float64(r.rate) * float64(time.Second))
+	}
+	return 0
+}
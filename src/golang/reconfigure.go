@@ -0,0 +1,70 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"fmt"
+	"io"
+)
+
+//#############################//
+//### Reconfigurable Source ###//
+//#############################//
+
+// A ReconfigurableSource is an optional interface of a port source, which
+// supports to change its line parameters while it is open, for example
+// the baudrate of a serial port. The serial package implements it.
+type ReconfigurableSource interface {
+	io.ReadWriteCloser
+
+	// Reconfigure applies the source-specific settings, for example a
+	// *serial.Config. Already written bytes have to be transmitted with
+	// the previous settings.
+	Reconfigure(settings interface{}) error
+}
+
+// Reconfigure changes the line parameters of the open source without
+// closing the port, for example to switch a device, which boots at 9600 baud,
+// to 115200 baud after a handshake. The settings are passed to the
+// ReconfigurableSource, for example a *serial.Config. No frame is written
+// while the source is reconfigured. Make sure the peer switches at the same
+// time, for example by reconfiguring after WriteAndConfirm returned.
+// A source reopened on a reconnect uses its original settings.
+// ErrNotReconfigurable is returned if the source does not support it.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) Reconfigure(settings interface{}) error {
+	if p.IsClosed() {
+		return ErrClosed
+	}
+
+	// Don't interrupt the transmission of a frame.
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	rs, ok := p.getSource().(ReconfigurableSource)
+	if !ok {
+		return ErrNotReconfigurable
+	}
+
+	if err := rs.Reconfigure(settings); err != nil {
+		return fmt.Errorf("failed to reconfigure source: %v", err)
+	}
+
+	return nil
+}
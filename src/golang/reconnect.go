@@ -0,0 +1,496 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReconnectMinBackoff = 100 * time.Millisecond
+	defaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// Errors:
+var (
+	// ErrNotConnected is returned by the write methods of a reconnector
+	// if no port is connected and replay is disabled.
+	ErrNotConnected = errors.New("port not connected")
+)
+
+//############################//
+//### ReconnectConfig type ###//
+//############################//
+
+// A ReconnectConfig represents the configuration of a reconnector.
+type ReconnectConfig struct {
+	// Port is the configuration of the created ports.
+	// The EOF behavior is always set to EOFClose, so a source,
+	// which reached the end of file, is reopened.
+	Port *Config
+
+	// MinBackoff is the wait duration after the first failed attempt to
+	// open the source. It is doubled on each consecutive failure.
+	// The default is 100 milliseconds.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the maximum wait duration between two attempts.
+	// The default is 30 seconds.
+	MaxBackoff time.Duration
+
+	// Replay lets the write methods wait until a port is connected.
+	// Data chunks passed to Write, which were queued or in flight and not
+	// acknowledged before the port failed, are written again to the
+	// reopened port in their original order. The peer might receive a
+	// replayed data chunk twice, if only its acknowledge got lost.
+	// Urgent data chunks are only written again, if the port failed before
+	// they were queued. If replay is disabled, then the write methods
+	// return ErrNotConnected while disconnected.
+	Replay bool
+
+	// OnConnect is called each time the source was opened.
+	// It receives the new port.
+	// The hook is called from the internal reconnect routine and must not block.
+	OnConnect func(p *Port)
+
+	// OnDisconnect is called each time the port failed.
+	// It receives the error, which caused the port to close.
+	// The hook is called from the internal reconnect routine and must not block.
+	OnDisconnect func(err error)
+}
+
+// setDefaults sets the default values for unset variables.
+func (c *ReconnectConfig) setDefaults() {
+	if c.Port == nil {
+		c.Port = new(Config)
+	}
+	c.Port.EOFBehavior = EOFClose
+	c.Port.setDefaults()
+
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = defaultReconnectMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = defaultReconnectMaxBackoff
+		if c.MaxBackoff < c.MinBackoff {
+			c.MaxBackoff = c.MinBackoff
+		}
+	}
+}
+
+//########################//
+//### Reconnector type ###//
+//########################//
+
+// A Reconnector keeps an ANTS session alive over an unreliable source,
+// for example an USB-serial adapter, which gets unplugged. It opens the
+// source with the open function and reopens it with an exponential
+// backoff as soon as the port failed. The message sequence number is
+// continued on the new port, so the peer does not discard the next
+// data messages as duplicates. Read and write from the reconnector
+// instead of the current port.
+type Reconnector struct {
+	config *ReconnectConfig
+	open   func() (io.ReadWriteCloser, error)
+	log    Logger
+
+	mutex       sync.Mutex
+	port        *Port
+	changedChan chan struct{} // Closed and replaced on each port change.
+	isClosed    bool
+	closeChan   chan struct{}
+
+	pending []*replayChunk // Data chunks, which were not acknowledged yet. Protected by the mutex.
+
+	readChan       chan *Message
+	readUrgentChan chan *Message
+}
+
+// replayChunk is a data chunk, which is written again to
+// the reopened port, unless it was acknowledged.
+type replayChunk struct {
+	data    []byte
+	confirm chan error // Transmission result of the current port. Nil if not transmitted.
+}
+
+// NewReconnector creates a new reconnector, which opens the source
+// with the open function in the background.
+// Optionally pass a configuration.
+func NewReconnector(open func() (io.ReadWriteCloser, error), config ...*ReconnectConfig) *Reconnector {
+	// Get the config.
+	var c *ReconnectConfig
+	if len(config) > 0 {
+		c = config[0]
+	} else {
+		c = new(ReconnectConfig)
+	}
+	c.setDefaults()
+
+	r := &Reconnector{
+		config:         c,
+		open:           open,
+		log:            c.Port.Logger,
+		changedChan:    make(chan struct{}),
+		closeChan:      make(chan struct{}),
+		readChan:       make(chan *Message, readDataChunkChanSize),
+		readUrgentChan: make(chan *Message, readUrgentChunkChanSize),
+	}
+
+	go r.reconnectLoop()
+
+	return r
+}
+
+// Port returns the connected port or nil if disconnected.
+func (r *Reconnector) Port() *Port {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.port
+}
+
+// Read a verified data chunk from the connected port.
+// Optionally pass a timeout duration.
+// If the timeout is reached, then ErrTimeout is returned.
+// If the reconnector is closed, then ErrClosed is returned.
+func (r *Reconnector) Read(timeout ...time.Duration) ([]byte, error) {
+	m, err := r.ReadMessage(timeout...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// ReadMessage reads a verified data chunk from the connected port including its reception metadata.
+func (r *Reconnector) ReadMessage(timeout ...time.Duration) (*Message, error) {
+	return r.readChunk(r.readChan, timeout...)
+}
+
+// ReadUrgent reads an urgent data chunk from the connected port.
+func (r *Reconnector) ReadUrgent(timeout ...time.Duration) ([]byte, error) {
+	m, err := r.ReadUrgentMessage(timeout...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// ReadUrgentMessage reads an urgent data chunk from the connected port including its reception metadata.
+func (r *Reconnector) ReadUrgentMessage(timeout ...time.Duration) (*Message, error) {
+	return r.readChunk(r.readUrgentChan, timeout...)
+}
+
+// Write a data chunk to the connected port.
+// If replay is enabled, then the data chunk is written again
+// to the reopened port, if it was not acknowledged before
+// the port failed.
+func (r *Reconnector) Write(data []byte) error {
+	if r.config.Replay {
+		return r.writeReplayed(data)
+	}
+	return r.write(data, (*Port).Write)
+}
+
+// WriteUrgent writes an urgent data chunk to the connected port.
+func (r *Reconnector) WriteUrgent(data []byte) error {
+	return r.write(data, (*Port).WriteUrgent)
+}
+
+// Close the reconnector and the connected port.
+func (r *Reconnector) Close() error {
+	// Lock the mutex.
+	r.mutex.Lock()
+	if r.isClosed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeChan)
+	p := r.port
+	r.mutex.Unlock()
+
+	if p == nil {
+		return nil
+	}
+	return p.Close()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// reconnectLoop opens the source and waits until the port failed.
+func (r *Reconnector) reconnectLoop() {
+	msn := byte(initialMSN)
+	backoff := r.config.MinBackoff
+
+	for {
+		source, err := r.open()
+		if err != nil {
+			r.log.Warningf("reconnector: failed to open source: retrying in %v: %v", backoff, err)
+
+			select {
+			case <-r.closeChan:
+				return
+			case <-time.After(backoff):
+			}
+
+			// Double the wait duration on each consecutive failure.
+			backoff *= 2
+			if backoff > r.config.MaxBackoff {
+				backoff = r.config.MaxBackoff
+			}
+			continue
+		} else if source == nil {
+			r.log.Errorf("reconnector: open returned a nil source")
+			return
+		}
+		backoff = r.config.MinBackoff
+
+		// Continue the message sequence of the previous port.
+		p := NewPort(source, r.config.Port)
+		p.stateMutex.Lock()
+		p.msn = msn
+		p.stateMutex.Unlock()
+
+		// Replay the unacknowledged data chunks before new data chunks are written.
+		r.replayPending(p)
+
+		if !r.setPort(p) {
+			// The reconnector was closed in the meantime.
+			p.Close()
+			return
+		}
+
+		if r.config.OnConnect != nil {
+			r.config.OnConnect(p)
+		}
+
+		go r.readLoop(p.ReadMessage, r.readChan)
+		go r.readLoop(p.ReadUrgentMessage, r.readUrgentChan)
+
+		// Wait until the port failed.
+		select {
+		case <-r.closeChan:
+			return
+		case <-p.closeChan:
+		}
+
+		msn = p.currentMSN()
+		if !r.setPort(nil) {
+			return
+		}
+
+		err = p.Err()
+		r.log.Warningf("reconnector: port failed: reopening source: %v", err)
+		if r.config.OnDisconnect != nil {
+			r.config.OnDisconnect(err)
+		}
+	}
+}
+
+// setPort replaces the connected port and wakes up the waiting writers.
+// Returns false if the reconnector is closed.
+func (r *Reconnector) setPort(p *Port) bool {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.isClosed {
+		return false
+	}
+
+	r.port = p
+	close(r.changedChan)
+	r.changedChan = make(chan struct{})
+
+	return true
+}
+
+// waitForPort returns the connected port. If replay is enabled, then
+// it waits until a port is connected. Otherwise ErrNotConnected is returned.
+func (r *Reconnector) waitForPort() (*Port, error) {
+	for {
+		// Lock the mutex.
+		r.mutex.Lock()
+		isClosed := r.isClosed
+		p := r.port
+		changedChan := r.changedChan
+		r.mutex.Unlock()
+
+		if isClosed {
+			return nil, ErrClosed
+		} else if p != nil && !p.IsClosed() {
+			return p, nil
+		} else if !r.config.Replay {
+			return nil, ErrNotConnected
+		}
+
+		select {
+		case <-r.closeChan:
+			return nil, ErrClosed
+		case <-changedChan:
+		}
+	}
+}
+
+// write writes the data chunk to the connected port
+// and replays it on port failures if enabled.
+func (r *Reconnector) write(data []byte, write func(p *Port, data []byte) error) error {
+	for {
+		p, err := r.waitForPort()
+		if err != nil {
+			return err
+		}
+
+		err = write(p, data)
+		if err != ErrClosed || !r.config.Replay {
+			return err
+		}
+	}
+}
+
+// writeReplayed writes the data chunk to the connected port and tracks
+// it until it was acknowledged. The reconnect routine replays it, if the
+// port failed before.
+func (r *Reconnector) writeReplayed(data []byte) error {
+	c := &replayChunk{data: data}
+
+	for {
+		p, err := r.waitForPort()
+		if err != nil {
+			return err
+		}
+
+		// Lock the mutex.
+		r.mutex.Lock()
+		if r.port != p {
+			// The port changed in the meantime.
+			r.mutex.Unlock()
+			continue
+		}
+		r.prunePending()
+		c.confirm = make(chan error, 1)
+		r.pending = append(r.pending, c)
+		r.mutex.Unlock()
+
+		// The write routine never blocks on the buffered confirm channel.
+		err = p.queueDataChunk(writeChunk{data: data, confirm: c.confirm}, true)
+		if err == ErrClosed {
+			// The data chunk is pending and replayed on the reopened port.
+			return nil
+		} else if err != nil {
+			// Never replay rejected data chunks.
+			c.confirm <- err
+		}
+		return err
+	}
+}
+
+// prunePending removes the pending data chunks, which were acknowledged
+// or failed permanently. The mutex must be locked.
+func (r *Reconnector) prunePending() {
+	pending := r.pending[:0]
+	for _, c := range r.pending {
+		select {
+		case err := <-c.confirm:
+			if err != ErrClosed {
+				if err != nil {
+					r.log.Warningf("reconnector: data chunk not transmitted: %v", err)
+				}
+				continue
+			}
+			c.confirm = nil
+		default:
+		}
+		pending = append(pending, c)
+	}
+
+	// Release the references of the removed data chunks.
+	for i := len(pending); i < len(r.pending); i++ {
+		r.pending[i] = nil
+	}
+	r.pending = pending
+}
+
+// replayPending writes the pending data chunks, which were queued or in
+// flight, when the previous port failed, to the new port in their order.
+func (r *Reconnector) replayPending(p *Port) {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.prunePending()
+	if len(r.pending) == 0 {
+		return
+	}
+	r.log.Debugf("reconnector: replaying %v unacknowledged data chunks", len(r.pending))
+
+	for _, c := range r.pending {
+		// The previous port never confirms the data chunk anymore.
+		c.confirm = make(chan error, 1)
+		err := p.queueDataChunk(writeChunk{data: c.data, confirm: c.confirm}, true)
+		if err == ErrClosed {
+			// Replay the remaining data chunks on the next port.
+			c.confirm = nil
+		} else if err != nil {
+			c.confirm <- err
+		}
+	}
+}
+
+// readLoop passes the received data chunks of the port to the channel.
+func (r *Reconnector) readLoop(read func(timeout ...time.Duration) (*Message, error), c chan *Message) {
+	for {
+		m, err := read()
+		if err != nil {
+			// The port was closed.
+			return
+		}
+
+		select {
+		case <-r.closeChan:
+			return
+		case c <- m:
+		}
+	}
+}
+
+// readChunk reads a data chunk from the channel.
+func (r *Reconnector) readChunk(c chan *Message, timeout ...time.Duration) (*Message, error) {
+	var timeoutChan <-chan time.Time
+	if len(timeout) > 0 && timeout[0] > 0 {
+		timer := time.NewTimer(timeout[0])
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	select {
+	case <-r.closeChan:
+		return nil, ErrClosed
+	case <-timeoutChan:
+		return nil, ErrTimeout
+	case m := <-c:
+		return m, nil
+	}
+}
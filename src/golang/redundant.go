@@ -0,0 +1,376 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDedupWindow = 1 * time.Second
+
+	// Length of the sequence number, which is prepended to each data chunk.
+	redundantSequenceLength = 4
+)
+
+//############################//
+//### RedundantConfig type ###//
+//############################//
+
+// A RedundantConfig represents the configuration of a redundant port.
+type RedundantConfig struct {
+	// DuplicateUrgent transmits urgent data chunks on both links,
+	// so critical commands are delivered even if the active link fails
+	// in the middle of the transmission.
+	DuplicateUrgent bool
+
+	// DedupWindow is the maximum duration between the reception of the
+	// copies of a data chunk on both links, within the later copies are
+	// discarded. The copies are identified by their sequence number, so
+	// data chunks with identical content are never discarded.
+	// The default is 1 second.
+	DedupWindow time.Duration
+
+	// OnFailover is called if the transmission switched to the other link.
+	// It receives the new active port.
+	// The hook is called from the internal port routines and must not block.
+	OnFailover func(active *Port)
+}
+
+// setDefaults sets the default values for unset variables.
+func (c *RedundantConfig) setDefaults() {
+	if c.DedupWindow <= 0 {
+		c.DedupWindow = defaultDedupWindow
+	}
+}
+
+//##########################//
+//### RedundantPort type ###//
+//##########################//
+
+// A RedundantPort transmits over two physical links, for example two cables
+// or a cable and a radio link. Data chunks are transmitted on the active link,
+// starting with the primary one. The redundant port fails over to the other
+// link if the active link is dead: the port was closed, the device was removed,
+// a transmission was given up or the circuit breaker opened. Data chunks
+// are received from both links. The redundant port takes over both ports,
+// don't read from them directly.
+//
+// Each data chunk is prefixed with a sequence number, which is shared by
+// its copies on both links, so the receiver discards the later copies.
+// The peer has to use a redundant port as well:
+//
+//	Sequence Number (4 bytes, little-endian) | Data
+type RedundantPort struct {
+	config *RedundantConfig
+	links  [2]*Port
+
+	writeSequence uint32 // Atomic sequence number of the last written data chunk.
+
+	mutex     sync.Mutex
+	active    int
+	dead      [2]bool
+	recent    []recentChunk // Recently received data chunks for the deduplication.
+	isClosed  bool
+	closeChan chan struct{}
+
+	readChan       chan *Message
+	readUrgentChan chan *Message
+}
+
+// NewRedundantPort creates a redundant port of the primary and the secondary port.
+// Optionally pass a configuration.
+func NewRedundantPort(primary, secondary *Port, config ...*RedundantConfig) *RedundantPort {
+	// Get the config.
+	var c *RedundantConfig
+	if len(config) > 0 {
+		c = config[0]
+	} else {
+		c = new(RedundantConfig)
+	}
+	c.setDefaults()
+
+	// The sequence numbers start at a random value, so a restarted
+	// redundant port does not repeat the recent sequence numbers.
+	r := &RedundantPort{
+		config:         c,
+		links:          [2]*Port{primary, secondary},
+		writeSequence:  uint32(time.Now().UnixNano()),
+		closeChan:      make(chan struct{}),
+		readChan:       make(chan *Message, readDataChunkChanSize),
+		readUrgentChan: make(chan *Message, readUrgentChunkChanSize),
+	}
+
+	for i, p := range r.links {
+		i := i
+		p.addEventListener(func(e Event) {
+			switch e.Type {
+			case EventDeviceRemoved, EventTransmissionFailed, EventBreakerOpened:
+				r.setDead(i)
+			}
+		})
+
+		go r.readLoop(i, p.ReadMessage, r.readChan)
+		go r.readLoop(i, p.ReadUrgentMessage, r.readUrgentChan)
+	}
+
+	return r
+}
+
+// Active returns the port of the active link.
+func (r *RedundantPort) Active() *Port {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.links[r.active]
+}
+
+// Read a verified data chunk from any link.
+// Duplicates received on both links are discarded.
+// Optionally pass a timeout duration.
+// If the timeout is reached, then ErrTimeout is returned.
+// If the redundant port is closed, then ErrClosed is returned.
+func (r *RedundantPort) Read(timeout ...time.Duration) ([]byte, error) {
+	m, err := r.ReadMessage(timeout...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// ReadMessage reads a verified data chunk from any link including its reception metadata.
+func (r *RedundantPort) ReadMessage(timeout ...time.Duration) (*Message, error) {
+	return r.readChunk(r.readChan, timeout...)
+}
+
+// ReadUrgent reads an urgent data chunk from any link.
+func (r *RedundantPort) ReadUrgent(timeout ...time.Duration) ([]byte, error) {
+	m, err := r.ReadUrgentMessage(timeout...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// ReadUrgentMessage reads an urgent data chunk from any link including its reception metadata.
+func (r *RedundantPort) ReadUrgentMessage(timeout ...time.Duration) (*Message, error) {
+	return r.readChunk(r.readUrgentChan, timeout...)
+}
+
+// Write a data chunk to the active link. If the active link
+// is dead, then the data chunk is written to the other link.
+// If both links are dead, then the error of the last link is returned.
+func (r *RedundantPort) Write(data []byte) error {
+	return r.write(r.newChunk(data), (*Port).Write)
+}
+
+// WriteUrgent writes an urgent data chunk to the active link.
+// If DuplicateUrgent is set, then the data chunk is written to both links.
+func (r *RedundantPort) WriteUrgent(data []byte) error {
+	data = r.newChunk(data)
+	if !r.config.DuplicateUrgent {
+		return r.write(data, (*Port).WriteUrgent)
+	}
+
+	// The data chunk is delivered if any link accepted it.
+	var err error
+	written := false
+	for _, p := range r.links {
+		if e := p.WriteUrgent(data); e == nil {
+			written = true
+		} else {
+			err = e
+		}
+	}
+	if written {
+		return nil
+	}
+	return err
+}
+
+// Close closes both links.
+func (r *RedundantPort) Close() error {
+	// Lock the mutex.
+	r.mutex.Lock()
+	if r.isClosed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeChan)
+	r.mutex.Unlock()
+
+	err := r.links[0].Close()
+	if e := r.links[1].Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// recentChunk is a received data chunk in the deduplication window.
+type recentChunk struct {
+	sequence uint32
+	time     time.Time
+}
+
+// newChunk prefixes the data chunk with the next sequence number.
+// All copies and failover retries of the data chunk share it.
+func (r *RedundantPort) newChunk(data []byte) []byte {
+	chunk := make([]byte, redundantSequenceLength, redundantSequenceLength+len(data))
+	binary.LittleEndian.PutUint32(chunk, atomic.AddUint32(&r.writeSequence, 1))
+	return append(chunk, data...)
+}
+
+// write writes the data chunk to the active link and fails over on errors.
+func (r *RedundantPort) write(data []byte, write func(p *Port, data []byte) error) (err error) {
+	for i := 0; i < len(r.links); i++ {
+		link, p := r.activeLink()
+		if err = write(p, data); err == nil {
+			return nil
+		} else if err != ErrClosed && err != ErrBreakerOpen {
+			return err
+		}
+
+		r.setDead(link)
+	}
+
+	return err
+}
+
+// activeLink returns the index and the port of the active link.
+func (r *RedundantPort) activeLink() (int, *Port) {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.active, r.links[r.active]
+}
+
+// setDead marks the link as dead and fails over to the other link, if it is alive.
+func (r *RedundantPort) setDead(link int) {
+	// Lock the mutex.
+	r.mutex.Lock()
+
+	r.dead[link] = true
+
+	other := 1 - link
+	if r.active != link || r.dead[other] || r.links[other].IsClosed() {
+		r.mutex.Unlock()
+		return
+	}
+
+	// The new active link starts with a clean state.
+	r.active = other
+	r.dead[other] = false
+	p := r.links[other]
+	r.mutex.Unlock()
+
+	p.log.Warningf("redundant port: link %v is dead: failing over to link %v", link, other)
+	if r.config.OnFailover != nil {
+		r.config.OnFailover(p)
+	}
+}
+
+// readLoop passes the received data chunks of the link to the channel.
+func (r *RedundantPort) readLoop(link int, read func(timeout ...time.Duration) (*Message, error), c chan *Message) {
+	for {
+		m, err := read()
+		if err != nil {
+			// The port was closed.
+			r.setDead(link)
+			return
+		}
+
+		// Data chunks without a sequence number were not
+		// transmitted by a redundant port.
+		if len(m.Data) < redundantSequenceLength {
+			r.links[link].log.Warningf("redundant port: discarding data chunk without sequence number")
+			continue
+		}
+
+		sequence := binary.LittleEndian.Uint32(m.Data)
+		if r.isDuplicate(sequence) {
+			continue
+		}
+		m.Data = m.Data[redundantSequenceLength:]
+
+		select {
+		case <-r.closeChan:
+			return
+		case c <- m:
+		}
+	}
+}
+
+// isDuplicate returns true if a data chunk with the same sequence
+// number was received within the deduplication window.
+func (r *RedundantPort) isDuplicate(sequence uint32) bool {
+	now := time.Now()
+
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Remove expired data chunks.
+	n := 0
+	for _, rc := range r.recent {
+		if now.Sub(rc.time) <= r.config.DedupWindow {
+			r.recent[n] = rc
+			n++
+		}
+	}
+	r.recent = r.recent[:n]
+
+	for _, rc := range r.recent {
+		if rc.sequence == sequence {
+			return true
+		}
+	}
+
+	r.recent = append(r.recent, recentChunk{sequence: sequence, time: now})
+	return false
+}
+
+// readChunk reads a data chunk from the channel.
+func (r *RedundantPort) readChunk(c chan *Message, timeout ...time.Duration) (*Message, error) {
+	var timeoutChan <-chan time.Time
+	if len(timeout) > 0 && timeout[0] > 0 {
+		timer := time.NewTimer(timeout[0])
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	select {
+	case <-r.closeChan:
+		return nil, ErrClosed
+	case <-timeoutChan:
+		return nil, ErrTimeout
+	case m := <-c:
+		return m, nil
+	}
+}
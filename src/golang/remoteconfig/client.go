@@ -0,0 +1,113 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remoteconfig
+
+import (
+	"sync"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//###################//
+//### Client type ###//
+//###################//
+
+// A Client reads and writes the parameters of the peer device.
+// This implementation is thread-safe. Requests are processed one at a time.
+type Client struct {
+	service *ants.Service
+	timeout time.Duration
+
+	mutex sync.Mutex
+}
+
+// NewClient creates a new remote configuration client on the port.
+// The timeout is the maximum duration to wait for a response.
+func NewClient(p *ants.Port, timeout time.Duration) *Client {
+	return &Client{
+		service: p.Service(ants.ServiceConfig),
+		timeout: timeout,
+	}
+}
+
+// Get reads the parameter value of the peer.
+// The value is of type bool, int64, float64, string or []byte.
+func (c *Client) Get(name string) (interface{}, error) {
+	req, err := encodeName(nil, name)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := c.request(opGet, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeValue(payload)
+}
+
+// Set stages the parameter value on the peer. The value has to be of
+// the same type as the parameter. Call Commit to apply all staged values.
+func (c *Client) Set(name string, value interface{}) error {
+	req, err := encodeName(nil, name)
+	if err != nil {
+		return err
+	}
+
+	req, err = encodeValue(req, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.request(opSet, req)
+	return err
+}
+
+// Commit applies all staged values on the peer atomically.
+func (c *Client) Commit() error {
+	_, err := c.request(opCommit, nil)
+	return err
+}
+
+// Discard drops all staged values on the peer.
+func (c *Client) Discard() error {
+	_, err := c.request(opDiscard, nil)
+	return err
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// request sends the request and waits for the matching response.
+func (c *Client) request(op byte, payload []byte) ([]byte, error) {
+	// Lock the mutex.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	status, resp, err := c.service.Request(op, payload, c.timeout, 0)
+	if err != nil {
+		return nil, err
+	} else if err = statusError(status, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,211 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package remoteconfig implements the standardized remote configuration
+// protocol of the ANTS library. It reads and writes named parameters
+// of the peer device. Written parameters are staged and applied
+// atomically with a commit.
+package remoteconfig
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+//#################//
+//### Constants ###//
+//#################//
+
+// Operations:
+const (
+	opGet     byte = 1
+	opSet     byte = 2
+	opCommit  byte = 3
+	opDiscard byte = 4
+)
+
+// Response status codes:
+const (
+	statusOK               byte = 0
+	statusUnknownParameter byte = 1
+	statusTypeMismatch     byte = 2
+	statusInvalidRequest   byte = 3
+	statusFailed           byte = 4
+)
+
+// Value types:
+const (
+	typeBool   byte = 1
+	typeInt    byte = 2
+	typeFloat  byte = 3
+	typeString byte = 4
+	typeBytes  byte = 5
+)
+
+//#################//
+//### Variables ###//
+//#################//
+
+// Errors:
+var (
+	// ErrUnknownParameter is returned if the parameter does not exist.
+	ErrUnknownParameter = errors.New("unknown parameter")
+
+	// ErrTypeMismatch is returned if the value type does not match the parameter type.
+	ErrTypeMismatch = errors.New("parameter type mismatch")
+
+	// ErrInvalidRequest is returned if the peer could not parse the request.
+	ErrInvalidRequest = errors.New("invalid request")
+
+	// ErrUnsupportedType is returned if a value is not of a supported type.
+	// Supported types are bool, int64, float64, string and []byte.
+	ErrUnsupportedType = errors.New("unsupported value type")
+)
+
+//###############//
+//### Private ###//
+//###############//
+
+// encodeName encodes a parameter name: Length (1 Byte) | Name.
+func encodeName(buf []byte, name string) ([]byte, error) {
+	if len(name) == 0 || len(name) > math.MaxUint8 {
+		return nil, fmt.Errorf("invalid parameter name length: %v", len(name))
+	}
+
+	buf = append(buf, byte(len(name)))
+	return append(buf, name...), nil
+}
+
+// decodeName decodes a parameter name and returns the remaining data.
+func decodeName(data []byte) (string, []byte, error) {
+	if len(data) == 0 || int(data[0]) == 0 || len(data) < 1+int(data[0]) {
+		return "", nil, ErrInvalidRequest
+	}
+
+	l := 1 + int(data[0])
+	return string(data[1:l]), data[l:], nil
+}
+
+// encodeValue encodes a value: Type (1 Byte) | Value.
+// The value is always the last element of a message.
+func encodeValue(buf []byte, v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case bool:
+		buf = append(buf, typeBool)
+		if t {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+
+	case int64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(t))
+		return append(append(buf, typeInt), b[:]...), nil
+
+	case float64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(t))
+		return append(append(buf, typeFloat), b[:]...), nil
+
+	case string:
+		return append(append(buf, typeString), t...), nil
+
+	case []byte:
+		return append(append(buf, typeBytes), t...), nil
+
+	default:
+		return nil, ErrUnsupportedType
+	}
+}
+
+// decodeValue decodes a value.
+func decodeValue(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidRequest
+	}
+
+	t, data := data[0], data[1:]
+
+	switch t {
+	case typeBool:
+		if len(data) != 1 {
+			return nil, ErrInvalidRequest
+		}
+		return data[0] != 0, nil
+
+	case typeInt:
+		if len(data) != 8 {
+			return nil, ErrInvalidRequest
+		}
+		return int64(binary.LittleEndian.Uint64(data)), nil
+
+	case typeFloat:
+		if len(data) != 8 {
+			return nil, ErrInvalidRequest
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+
+	case typeString:
+		return string(data), nil
+
+	case typeBytes:
+		return append([]byte(nil), data...), nil
+
+	default:
+		return nil, ErrUnsupportedType
+	}
+}
+
+// sameType returns true if both values are of the same type.
+func sameType(a, b interface{}) bool {
+	return fmt.Sprintf("%T", a) == fmt.Sprintf("%T", b)
+}
+
+// statusError converts a response status to an error.
+func statusError(status byte, payload []byte) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusUnknownParameter:
+		return ErrUnknownParameter
+	case statusTypeMismatch:
+		return ErrTypeMismatch
+	case statusInvalidRequest:
+		return ErrInvalidRequest
+	default:
+		return fmt.Errorf("remote config: %s", payload)
+	}
+}
+
+// errorStatus converts an error to a response status.
+func errorStatus(err error) byte {
+	switch err {
+	case nil:
+		return statusOK
+	case ErrUnknownParameter:
+		return statusUnknownParameter
+	case ErrTypeMismatch:
+		return statusTypeMismatch
+	case ErrInvalidRequest, ErrUnsupportedType:
+		return statusInvalidRequest
+	default:
+		return statusFailed
+	}
+}
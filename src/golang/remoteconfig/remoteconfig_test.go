@@ -0,0 +1,93 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remoteconfig
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/stretchr/testify/require"
+)
+
+type mapStore map[string]interface{}
+
+func (s mapStore) Get(name string) (interface{}, error) {
+	v, ok := s[name]
+	if !ok {
+		return nil, ErrUnknownParameter
+	}
+	return v, nil
+}
+
+func (s mapStore) Commit(values map[string]interface{}) error {
+	for k, v := range values {
+		s[k] = v
+	}
+	return nil
+}
+
+func TestValueEncoding(t *testing.T) {
+	for _, v := range []interface{}{true, int64(-42), 3.5, "name", []byte{1, 2}} {
+		data, err := encodeValue(nil, v)
+		require.NoError(t, err)
+
+		d, err := decodeValue(data)
+		require.NoError(t, err)
+		require.Equal(t, v, d)
+	}
+
+	_, err := encodeValue(nil, 42)
+	require.Equal(t, ErrUnsupportedType, err)
+}
+
+func TestServer(t *testing.T) {
+	store := mapStore{"baud": int64(9600)}
+	s := &Server{store: store, staged: make(map[string]interface{})}
+
+	req, _ := encodeName(nil, "baud")
+	req, _ = encodeValue(req, "fast")
+	_, err := s.handle(opSet, req)
+	require.Equal(t, ErrTypeMismatch, err)
+
+	req, _ = encodeName(nil, "baud")
+	req, _ = encodeValue(req, int64(115200))
+	_, err = s.handle(opSet, req)
+	require.NoError(t, err)
+
+	// Staged values are applied with the commit.
+	require.Equal(t, int64(9600), store["baud"])
+	_, err = s.handle(opCommit, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(115200), store["baud"])
+}
+
+func TestClientGet(t *testing.T) {
+	a, b := net.Pipe()
+	pa, pb := ants.NewPort(a), ants.NewPort(b)
+	defer pa.Close()
+	defer pb.Close()
+
+	go NewServer(pb, mapStore{"name": "sensor"}).Serve()
+
+	v, err := NewClient(pa, time.Second).Get("name")
+	require.NoError(t, err)
+	require.Equal(t, "sensor", v)
+}
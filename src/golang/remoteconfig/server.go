@@ -0,0 +1,146 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remoteconfig
+
+import (
+	"github.com/desertbit/ants/src/golang"
+)
+
+//##################//
+//### Store type ###//
+//##################//
+
+// A Store holds the parameters of a device.
+type Store interface {
+	// Get returns the current parameter value. The value has to be of
+	// type bool, int64, float64, string or []byte.
+	// Return ErrUnknownParameter if the parameter does not exist.
+	Get(name string) (interface{}, error)
+
+	// Commit applies all staged values atomically.
+	// Either all or none of the values have to be applied.
+	Commit(values map[string]interface{}) error
+}
+
+//###################//
+//### Server type ###//
+//###################//
+
+// A Server answers the remote configuration requests of the peer.
+// Use it to implement devices and device simulators.
+type Server struct {
+	service *ants.Service
+	store   Store
+	staged  map[string]interface{}
+}
+
+// NewServer creates a new remote configuration server on the port.
+func NewServer(p *ants.Port, store Store) *Server {
+	return &Server{
+		service: p.Service(ants.ServiceConfig),
+		store:   store,
+		staged:  make(map[string]interface{}),
+	}
+}
+
+// Serve answers the requests until the port is closed.
+// Returns the port's read or write error.
+func (s *Server) Serve() error {
+	for {
+		req, err := s.service.Read()
+		if err != nil {
+			return err
+		}
+
+		// Skip requests without header.
+		if len(req) < 2 {
+			continue
+		}
+
+		resp := []byte{req[0], req[1]}
+		payload, err := s.handle(req[0], req[2:])
+		resp = append(resp, errorStatus(err))
+		if err != nil && errorStatus(err) == statusFailed {
+			resp = append(resp, err.Error()...)
+		} else {
+			resp = append(resp, payload...)
+		}
+
+		if err = s.service.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// handle processes a single request and returns the response payload.
+func (s *Server) handle(op byte, data []byte) ([]byte, error) {
+	switch op {
+	case opGet:
+		name, _, err := decodeName(data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Staged values are not visible until they are committed.
+		v, err := s.store.Get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeValue(nil, v)
+
+	case opSet:
+		name, data, err := decodeName(data)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := decodeValue(data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Validate the parameter and its type.
+		cur, err := s.store.Get(name)
+		if err != nil {
+			return nil, err
+		} else if !sameType(cur, v) {
+			return nil, ErrTypeMismatch
+		}
+
+		s.staged[name] = v
+		return nil, nil
+
+	case opCommit:
+		err := s.store.Commit(s.staged)
+		s.staged = make(map[string]interface{})
+		return nil, err
+
+	case opDiscard:
+		s.staged = make(map[string]interface{})
+		return nil, nil
+
+	default:
+		return nil, ErrInvalidRequest
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remotelog
+
+import (
+	"sync"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//###################//
+//### Client type ###//
+//###################//
+
+// A Client retrieves the buffered log records of the peer device.
+// This implementation is thread-safe. Requests are processed one at a time.
+type Client struct {
+	service *ants.Service
+	timeout time.Duration
+
+	mutex sync.Mutex
+}
+
+// NewClient creates a new remote log client on the port.
+// The timeout is the maximum duration to wait for a response.
+func NewClient(p *ants.Port, timeout time.Duration) *Client {
+	return &Client{
+		service: p.Service(ants.ServiceLog),
+		timeout: timeout,
+	}
+}
+
+// Fetch retrieves and removes up to max buffered log records of the peer.
+// The peer might return less records to keep the response small.
+// More is true if the peer has more records buffered.
+func (c *Client) Fetch(max int) (records []Record, more bool, err error) {
+	if max <= 0 || max > 255 {
+		max = 255
+	}
+
+	// Lock the mutex.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Request: Max Records
+	// Response: Flags | Records
+	flags, resp, err := c.service.Request(opFetch, []byte{byte(max)}, c.timeout, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	records, err = decodeRecords(resp)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return records, flags&flagMore != 0, nil
+}
+
+// Dump retrieves all buffered log records of the peer and passes them to f.
+// The records are fetched batch by batch.
+func (c *Client) Dump(f func(r Record)) error {
+	for {
+		records, more, err := c.Fetch(0)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			f(r)
+		}
+
+		if !more {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package remotelog implements the standardized remote log retrieval
+// protocol of the ANTS library. The client pulls the buffered log records
+// of the peer device in small batches. Only one batch is transferred at
+// a time, so log dumps never starve the operational traffic.
+package remotelog
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+//#################//
+//### Constants ###//
+//#################//
+
+const (
+	opFetch byte = 1
+
+	flagMore byte = 1 << 0 // More records are buffered.
+
+	// maxBatchSize is the maximum size of the records of one response in bytes.
+	maxBatchSize = 512
+
+	// maxMessageSize is the maximum size of a record message in bytes.
+	// Longer messages are truncated.
+	maxMessageSize = maxBatchSize - 16
+)
+
+//#################//
+//### Variables ###//
+//#################//
+
+// Errors:
+var (
+	// ErrInvalidResponse is returned if the response of the peer could not be parsed.
+	ErrInvalidResponse = errors.New("invalid response")
+)
+
+//###################//
+//### Record type ###//
+//###################//
+
+// Level is the severity of a log record.
+type Level byte
+
+// Log levels:
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+// A Record is a single log record of the device.
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Message string
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// encodeRecord encodes a record: Time (8 Bytes) | Level (1 Byte) | Length (uvarint) | Message.
+// The time is a little-endian Unix time in nanoseconds.
+func encodeRecord(buf []byte, r Record) []byte {
+	msg := r.Message
+	if len(msg) > maxMessageSize {
+		msg = msg[:maxMessageSize]
+	}
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(r.Time.UnixNano()))
+	buf = append(buf, b[:]...)
+	buf = append(buf, byte(r.Level))
+
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(msg)))]...)
+	return append(buf, msg...)
+}
+
+// decodeRecords decodes all records of a response.
+func decodeRecords(data []byte) ([]Record, error) {
+	var records []Record
+
+	for len(data) > 0 {
+		if len(data) < 9 {
+			return nil, ErrInvalidResponse
+		}
+
+		r := Record{
+			Time:  time.Unix(0, int64(binary.LittleEndian.Uint64(data))),
+			Level: Level(data[8]),
+		}
+		data = data[9:]
+
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return nil, ErrInvalidResponse
+		}
+		data = data[n:]
+
+		r.Message = string(data[:l])
+		data = data[l:]
+
+		records = append(records, r)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,68 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remotelog
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchBatching(t *testing.T) {
+	s := &Server{capacity: 3}
+	for i := 0; i < 4; i++ {
+		s.Log(LevelInfo, strings.Repeat("x", 200))
+	}
+
+	// The oldest record was dropped and the batch size is limited.
+	require.Len(t, s.records, 3)
+
+	resp := s.fetch(1, 10)
+	require.Equal(t, flagMore, resp[2])
+	records, err := decodeRecords(resp[3:])
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, LevelInfo, records[0].Level)
+
+	resp = s.fetch(2, 10)
+	require.Equal(t, byte(0), resp[2])
+	require.Empty(t, s.records)
+}
+
+func TestClientFetch(t *testing.T) {
+	a, b := net.Pipe()
+	pa, pb := ants.NewPort(a), ants.NewPort(b)
+	defer pa.Close()
+	defer pb.Close()
+
+	s := NewServer(pb, 10)
+	s.Log(LevelError, "sensor failure")
+	go s.Serve()
+
+	records, more, err := NewClient(pa, time.Second).Fetch(0)
+	require.NoError(t, err)
+	require.False(t, more)
+	require.Len(t, records, 1)
+	require.Equal(t, "sensor failure", records[0].Message)
+	require.Equal(t, LevelError, records[0].Level)
+}
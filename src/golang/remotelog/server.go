@@ -0,0 +1,122 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remotelog
+
+import (
+	"sync"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//###################//
+//### Server type ###//
+//###################//
+
+// A Server buffers the log records of a device and
+// answers the fetch requests of the peer.
+// Use it to implement devices and device simulators.
+type Server struct {
+	service  *ants.Service
+	capacity int
+
+	mutex   sync.Mutex
+	records []Record
+}
+
+// NewServer creates a new remote log server on the port.
+// It buffers at most capacity records. The oldest records are dropped first.
+func NewServer(p *ants.Port, capacity int) *Server {
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	return &Server{
+		service:  p.Service(ants.ServiceLog),
+		capacity: capacity,
+	}
+}
+
+// Log buffers a log record.
+func (s *Server) Log(level Level, msg string) {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.records) >= s.capacity {
+		s.records = s.records[1:]
+	}
+
+	s.records = append(s.records, Record{
+		Time:    time.Now(),
+		Level:   level,
+		Message: msg,
+	})
+}
+
+// Serve answers the fetch requests until the port is closed.
+// Returns the port's read or write error.
+func (s *Server) Serve() error {
+	for {
+		req, err := s.service.Read()
+		if err != nil {
+			return err
+		}
+
+		// Skip invalid requests.
+		if len(req) < 3 || req[0] != opFetch {
+			continue
+		}
+
+		if err = s.service.Write(s.fetch(req[1], int(req[2]))); err != nil {
+			return err
+		}
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// fetch removes up to max records from the buffer and returns the response.
+func (s *Server) fetch(id byte, max int) []byte {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	resp := []byte{opFetch, id, 0}
+
+	// Keep the response small. At least one record is always sent.
+	n := 0
+	for n < max && n < len(s.records) {
+		r := encodeRecord(nil, s.records[n])
+		if n > 0 && len(resp)+len(r) > maxBatchSize {
+			break
+		}
+		resp = append(resp, r...)
+		n++
+	}
+
+	s.records = s.records[n:]
+	if len(s.records) > 0 {
+		resp[2] |= flagMore
+	}
+
+	return resp
+}
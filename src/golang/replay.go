@@ -0,0 +1,157 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// Length of the replay counter, which is prepended to encrypted data chunks.
+	replayCounterLength = 8
+
+	// Number of counters below the highest received counter, which are
+	// still accepted. Urgent data chunks overtake pending data chunks.
+	replayWindowSize = 64
+)
+
+// Errors:
+var (
+	errReplayedDataChunk = errors.New("replayed data chunk")
+)
+
+//##########################//
+//### Replay Window type ###//
+//##########################//
+
+// replayWindow tracks the received replay counters. Counters above the
+// highest received counter are always accepted. Lower counters are
+// accepted once within the window and rejected, if they are too old.
+type replayWindow struct {
+	highest uint64
+	bitmap  uint64 // Bit i is set if the counter highest-i was received.
+	valid   bool
+}
+
+// check returns false if the counter was already received or is too old.
+func (w *replayWindow) check(counter uint64) bool {
+	if !w.valid || counter > w.highest {
+		return true
+	}
+
+	diff := w.highest - counter
+	return diff < replayWindowSize && w.bitmap&(1<<diff) == 0
+}
+
+// mark records the received counter.
+func (w *replayWindow) mark(counter uint64) {
+	if !w.valid {
+		w.highest, w.bitmap, w.valid = counter, 1, true
+		return
+	}
+
+	if counter > w.highest {
+		shift := counter - w.highest
+		if shift < replayWindowSize {
+			w.bitmap <<= shift
+		} else {
+			w.bitmap = 0
+		}
+		w.bitmap |= 1
+		w.highest = counter
+		return
+	}
+
+	if diff := w.highest - counter; diff < replayWindowSize {
+		w.bitmap |= 1 << diff
+	}
+}
+
+// unmark forgets the received counter, so it is accepted once more.
+func (w *replayWindow) unmark(counter uint64) {
+	if !w.valid || counter > w.highest {
+		return
+	}
+
+	if diff := w.highest - counter; diff < replayWindowSize {
+		w.bitmap &^= 1 << diff
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// sealReplayCounter seals the payload with the next replay counter:
+// Counter | Ciphertext
+// The counter and the session ID are authenticated as additional data,
+// so data chunks of previous sessions are rejected.
+// This method must be only called by the write loop.
+func (s *session) sealReplayCounter(authFlags byte, payload []byte) ([]byte, error) {
+	s.writeCounter++
+
+	ad := s.replayAdditionalData(authFlags)
+	binary.LittleEndian.PutUint64(ad[len(ad)-replayCounterLength:], s.writeCounter)
+
+	sealed, err := s.cipher.Seal(payload, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ad[len(ad)-replayCounterLength:], sealed...), nil
+}
+
+// openReplayCounter opens the payload sealed with a replay counter and
+// rejects replayed data chunks. The counter is recorded as received.
+// This method must be only called by the read messages loop.
+func (s *session) openReplayCounter(authFlags byte, payload []byte) ([]byte, error) {
+	if len(payload) < replayCounterLength {
+		return nil, ErrAuthenticationFailed
+	}
+
+	ad := s.replayAdditionalData(authFlags)
+	copy(ad[len(ad)-replayCounterLength:], payload[:replayCounterLength])
+
+	// Authenticate the counter first. Tampered counters must
+	// never shift the replay window.
+	data, err := s.cipher.Open(payload[replayCounterLength:], ad)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := binary.LittleEndian.Uint64(payload[:replayCounterLength])
+	if !s.readWindow.check(counter) {
+		return nil, errReplayedDataChunk
+	}
+	s.readWindow.mark(counter)
+	s.readCounter = counter
+
+	return data, nil
+}
+
+// replayAdditionalData returns the additional data of a data chunk:
+// Flags | Session ID | Counter
+// The counter is left empty.
+func (s *session) replayAdditionalData(authFlags byte) []byte {
+	ad := make([]byte, 1+len(s.id)+replayCounterLength)
+	ad[0] = authFlags
+	copy(ad[1:], s.id)
+	return ad
+}
@@ -0,0 +1,72 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+//#################//
+//### Responder ###//
+//#################//
+
+// respondLoop passes the received data chunks to the responder hook
+// and queues the responses for transmission.
+func (p *Port) respondLoop() {
+	var m *Message
+
+	for {
+		// Urgent data chunks have a precedence over the bulk data chunks.
+		select {
+		case <-p.closeChan:
+			// Just release this goroutine if the port is closed.
+			return
+		case m = <-p.readUrgentChunkChan:
+		default:
+			select {
+			case <-p.closeChan:
+				// Just release this goroutine if the port is closed.
+				return
+			case m = <-p.readUrgentChunkChan:
+			case m = <-p.readDataChunkChan:
+			}
+		}
+
+		// Obtain the response.
+		response := p.config.Responder(m)
+		if response == nil {
+			continue
+		}
+
+		// Queue the response on the same channel type,
+		// but never block if the port gets closed in the meantime.
+		p.addPendingWrites(1)
+		if m.Urgent {
+			select {
+			case <-p.closeChan:
+				p.addPendingWrites(-1)
+				return
+			case p.writeUrgentChunkChan <- response:
+			}
+		} else {
+			select {
+			case <-p.closeChan:
+				p.addPendingWrites(-1)
+				return
+			case p.writeDataChunkChan <- writeChunk{data: response}:
+			}
+		}
+	}
+}
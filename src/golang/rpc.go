@@ -0,0 +1,228 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Kinds of the RPC data chunks.
+	rpcRequest   = 0
+	rpcResponse  = 1
+	rpcUnhandled = 2 // The peer has no call handler registered.
+
+	// Header length of the RPC data chunks: Kind | Call ID
+	rpcHeaderLength = 1 + 2
+)
+
+// Errors:
+var (
+	// ErrCallUnhandled is returned by Call if the peer has no call handler registered.
+	ErrCallUnhandled = errors.New("call not handled by the peer")
+)
+
+//###########//
+//### RPC ###//
+//###########//
+
+// Call sends the request to the peer and waits for the matching response.
+// The request is passed to the handler registered with OnCall on the peer.
+// Each call has an own correlation ID, so multiple calls may be pending
+// concurrently. Calls are transmitted on the ServiceRPC service channel and
+// never returned by Read. If the timeout is reached, then ErrTimeout is
+// returned. Pass zero to wait until the port is closed.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) Call(request []byte, timeout time.Duration) ([]byte, error) {
+	p.startRPC()
+
+	// Register the pending call.
+	resultChan := make(chan rpcResult, 1)
+
+	p.rpcMutex.Lock()
+	p.rpcID++
+	id := p.rpcID
+	p.rpcPending[id] = resultChan
+	p.rpcMutex.Unlock()
+
+	defer func() {
+		p.rpcMutex.Lock()
+		delete(p.rpcPending, id)
+		p.rpcMutex.Unlock()
+	}()
+
+	// Send the request.
+	err := p.Service(ServiceRPC).Write(newRPCChunk(rpcRequest, id, request))
+	if err != nil {
+		return nil, err
+	}
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	select {
+	case <-p.closeChan:
+		return nil, ErrClosed
+	case <-timeoutChan:
+		return nil, ErrTimeout
+	case r := <-resultChan:
+		return r.response, r.err
+	}
+}
+
+// OnCall registers the handler, which answers the calls of the peer.
+// The returned response is sent back to the calling peer. Registering
+// another handler replaces the previous one. Pass nil to unregister the
+// handler. Calls of the peer fail with ErrCallUnhandled without a handler.
+// The handler is called from an own goroutine for each call.
+func (p *Port) OnCall(f func(request []byte) []byte) {
+	p.startRPC()
+
+	// Lock the mutex.
+	p.rpcMutex.Lock()
+	defer p.rpcMutex.Unlock()
+
+	p.rpcHandler = f
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// rpcResult is the result of a pending call.
+type rpcResult struct {
+	response []byte
+	err      error
+}
+
+// newRPCChunk creates a RPC data chunk:
+// Kind | Call ID | Payload
+func newRPCChunk(kind byte, id uint16, payload []byte) []byte {
+	chunk := make([]byte, rpcHeaderLength, rpcHeaderLength+len(payload))
+	chunk[0] = kind
+	binary.LittleEndian.PutUint16(chunk[1:], id)
+	return append(chunk, payload...)
+}
+
+// startRPC registers the RPC service and starts the dispatch routine once.
+func (p *Port) startRPC() {
+	p.rpcOnce.Do(func() {
+		p.rpcMutex.Lock()
+		p.rpcPending = make(map[uint16]chan rpcResult)
+		p.rpcMutex.Unlock()
+
+		go p.rpcLoop(p.Service(ServiceRPC))
+	})
+}
+
+// rejectCall answers a received request, if no call handler was
+// ever registered and therefore the RPC service is unregistered.
+func (p *Port) rejectCall(data []byte) {
+	if len(data) < rpcHeaderLength || data[0] != rpcRequest {
+		return
+	}
+	id := binary.LittleEndian.Uint16(data[1:])
+
+	// Don't block the read messages routine and don't register the service.
+	s := &Service{port: p, id: ServiceRPC}
+	go func() {
+		_ = s.Write(newRPCChunk(rpcUnhandled, id, nil))
+	}()
+}
+
+// rpcLoop dispatches the received RPC data chunks.
+func (p *Port) rpcLoop(s *Service) {
+	for {
+		data, err := s.Read()
+		if err != nil {
+			// The port was closed.
+			return
+		}
+
+		err = p.dispatchRPCChunk(s, data)
+		if err != nil {
+			p.log.Warningf("rpc: %v", err)
+		}
+	}
+}
+
+// dispatchRPCChunk passes a request to the call handler
+// and a response to the matching pending call.
+func (p *Port) dispatchRPCChunk(s *Service, data []byte) error {
+	if len(data) < rpcHeaderLength {
+		return fmt.Errorf("invalid data chunk: header is missing")
+	}
+
+	kind := data[0]
+	id := binary.LittleEndian.Uint16(data[1:])
+	payload := data[rpcHeaderLength:]
+
+	// Lock the mutex.
+	p.rpcMutex.Lock()
+	handler := p.rpcHandler
+	resultChan := p.rpcPending[id]
+	p.rpcMutex.Unlock()
+
+	switch kind {
+	case rpcRequest:
+		// Don't block the dispatch routine, because the
+		// handler might call the peer itself.
+		go func() {
+			if handler == nil {
+				_ = s.Write(newRPCChunk(rpcUnhandled, id, nil))
+				return
+			}
+
+			err := s.Write(newRPCChunk(rpcResponse, id, handler(payload)))
+			if err != nil && err != ErrClosed {
+				p.log.Warningf("rpc: failed to send response: %v", err)
+			}
+		}()
+
+	case rpcResponse, rpcUnhandled:
+		if resultChan == nil {
+			// The call timed out in the meantime.
+			p.log.Debugf("rpc: discarding response of unknown call %v", id)
+			return nil
+		}
+
+		r := rpcResult{response: payload}
+		if kind == rpcUnhandled {
+			r = rpcResult{err: ErrCallUnhandled}
+		}
+
+		// The channel is buffered and receives only one result.
+		select {
+		case resultChan <- r:
+		default:
+		}
+
+	default:
+		return fmt.Errorf("invalid data chunk: unknown kind %v", kind)
+	}
+
+	return nil
+}
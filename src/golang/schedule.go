@@ -0,0 +1,124 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"time"
+)
+
+//#############################//
+//### TransmitSchedule type ###//
+//#############################//
+
+// A TransmitSchedule restricts the transmission to time slots, which repeat
+// every period. It is used on shared radio or bus media, where each node
+// is assigned speaking turns (TDMA). The nodes have to share a synchronized
+// wall clock. The periods are aligned to the epoch.
+type TransmitSchedule struct {
+	// Period is the duration of a complete schedule cycle.
+	Period time.Duration
+
+	// Slots are the time slots within the period, in which
+	// the transmission of a message may start.
+	Slots []TransmitSlot
+
+	// Epoch is the reference point in time of the first period.
+	// The default is the Unix epoch.
+	Epoch time.Time
+}
+
+// A TransmitSlot is a time slot within the schedule period.
+// Size the slot, so a message fits into it. Messages started
+// at the end of the slot overrun the slot.
+type TransmitSlot struct {
+	// Offset is the start of the slot relative to the start of the period.
+	Offset time.Duration
+
+	// Duration of the slot.
+	Duration time.Duration
+}
+
+// Wait returns the duration until a transmission may start at the point in time.
+// Zero is returned if the point in time is within a slot.
+func (s *TransmitSchedule) Wait(now time.Time) time.Duration {
+	if s == nil || s.Period <= 0 || len(s.Slots) == 0 {
+		return 0
+	}
+
+	epoch := s.Epoch
+	if epoch.IsZero() {
+		epoch = time.Unix(0, 0)
+	}
+
+	// The position within the current period.
+	pos := now.Sub(epoch) % s.Period
+	if pos < 0 {
+		pos += s.Period
+	}
+
+	// Find the slot, which contains the position or starts next.
+	// Slots of the next period are considered by shifting them.
+	var wait time.Duration = -1
+	for _, slot := range s.Slots {
+		if slot.Duration <= 0 {
+			continue
+		}
+
+		offset := slot.Offset % s.Period
+		for _, start := range []time.Duration{offset - s.Period, offset, offset + s.Period} {
+			if pos >= start && pos < start+slot.Duration {
+				return 0
+			} else if start > pos && (wait < 0 || start-pos < wait) {
+				wait = start - pos
+			}
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// waitForTransmitSlot blocks until the transmission may start.
+// Returns ErrClosed if the port was closed and ErrAborted if an
+// abort was requested on the optional abort channel.
+func (p *Port) waitForTransmitSlot(abortChan <-chan struct{}) error {
+	for {
+		wait := p.config.TransmitSchedule.Wait(time.Now())
+		if wait <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-p.closeChan:
+			timer.Stop()
+			return ErrClosed
+		case <-abortChan:
+			timer.Stop()
+			return ErrAborted
+		case <-timer.C:
+		}
+	}
+}
@@ -19,30 +19,203 @@
 package serial
 
 import (
+	"io"
 	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//###################//
+//### Parity type ###//
+//###################//
+
+// Parity defines the parity bit of each transmitted character.
+type Parity int
+
+const (
+	// ParityNone transmits no parity bit. This is the default.
+	ParityNone Parity = iota
+
+	// ParityOdd sets the parity bit, if the number of set data bits is even.
+	ParityOdd
+
+	// ParityEven sets the parity bit, if the number of set data bits is odd.
+	ParityEven
+
+	// ParityMark always sets the parity bit.
+	// Not supported on macOS, the BSDs and illumos.
+	ParityMark
+
+	// ParitySpace never sets the parity bit.
+	// Not supported on macOS, the BSDs and illumos.
+	ParitySpace
+)
+
+//######################//
+//### StopBits type ###//
+//######################//
+
+// StopBits defines the number of stop bits of each transmitted character.
+type StopBits int
+
+const (
+	// StopBits1 transmits one stop bit. This is the default.
+	StopBits1 StopBits = iota
+
+	// StopBits1Half transmits one and a half stop bits.
+	// Only supported on Windows.
+	StopBits1Half
+
+	// StopBits2 transmits two stop bits.
+	StopBits2
+)
+
+//#########################//
+//### FlowControl type ###//
+//#########################//
+
+// FlowControl defines how the transmission is paused,
+// as long as the receiving side is not ready.
+type FlowControl int
+
+const (
+	// FlowControlNone disables the flow control. This is the default.
+	FlowControlNone FlowControl = iota
+
+	// FlowControlHardware pauses the transmission with the RTS and CTS lines.
+	// Supported on Linux, macOS, the BSDs, illumos and Windows.
+	FlowControlHardware
+
+	// FlowControlSoftware pauses the transmission with the XON (0x11) and
+	// XOFF (0x13) characters. The driver consumes these characters, so the
+	// binary data of the ANTS messages must never contain them. Only use it
+	// with ANTS, if the line is shared with a text protocol.
+	// Supported on Linux, macOS, the BSDs, illumos and Windows.
+	FlowControlSoftware
 )
 
+//###################//
+//### Config type ###//
+//###################//
+
 // A Config represents the serial port configuration.
 type Config struct {
 	// Name specifies the port name or path.
+	// Use the callout devices on macOS, the BSDs and illumos, for example
+	// /dev/cu.usbserial on macOS, /dev/cuaU0 on FreeBSD and OpenBSD,
+	// /dev/dtyU0 on NetBSD and /dev/cua/a on illumos. Windows ports are
+	// named like COM3. List returns the available devices.
 	Name string
 
 	// Baud specifies the Baudrate.
 	Baud int
 
+	// DataBits is the number of data bits of each character from 5 to 8.
+	// The default value is 8.
+	DataBits int
+
+	// Parity defines the parity bit of each character.
+	// The default is ParityNone.
+	Parity Parity
+
+	// StopBits defines the number of stop bits of each character.
+	// The default is StopBits1.
+	StopBits StopBits
+
+	// FlowControl enables the hardware or software flow control.
+	// The default is FlowControlNone.
+	FlowControl FlowControl
+
+	// BaudCandidates are additional baudrates, which are tried in order
+	// if the handshake fails with the baudrate specified by Baud.
+	BaudCandidates []int
+
+	// Handshake is called after the serial port was opened to verify
+	// the connection to the device. If it returns an error, then the serial port
+	// is closed and reopened with the next baudrate candidate.
+	// If BaudCandidates are set and Handshake is nil, the ANTS handshake
+	// is probed with ants.ProbeHandshake and the PortConfig.
+	Handshake func(rw io.ReadWriteCloser) error
+
+	// PortConfig is the configuration of the ANTS port, which is used
+	// by the default handshake. Pass the same config to ants.NewPort.
+	PortConfig *ants.Config
+
 	// The total read timeout of one data chunk.
 	// The default value is 5 Seconds.
 	ReadTimeout time.Duration
+
+	// InterCharTimeout is the driver-level inter-character timeout (VTIME).
+	// A read returns as soon as the line was idle for this duration after
+	// a byte was received, instead of waiting out the full ReadTimeout.
+	// The resolution is 100 milliseconds and the maximum is 25.5 seconds.
+	// Windows applies it with a millisecond resolution.
+	// Zero disables the inter-character timeout.
+	InterCharTimeout time.Duration
+
+	// MinBytes is the driver-level minimum byte count of a read (VMIN).
+	// A read returns as soon as MinBytes bytes were received
+	// or the inter-character timeout expired. The maximum is 255.
+	// Not supported on Windows, where a read returns the received bytes
+	// without waiting for MinBytes. The default value is 1.
+	MinBytes int
 }
 
 //###############//
 //### Private ###//
 //###############//
 
+// bauds returns the baudrates to try in order without duplicates.
+func (c *Config) bauds() []int {
+	bauds := []int{c.Baud}
+	if c.handshake() == nil {
+		return bauds
+	}
+
+Loop:
+	for _, b := range c.BaudCandidates {
+		for _, o := range bauds {
+			if b == o {
+				continue Loop
+			}
+		}
+		bauds = append(bauds, b)
+	}
+
+	return bauds
+}
+
+// handshake returns the handshake, which verifies the connection.
+// The ANTS handshake is probed by default, if baudrate candidates are set.
+// Nil is returned if no handshake is required.
+func (c *Config) handshake() func(rw io.ReadWriteCloser) error {
+	if c.Handshake != nil || len(c.BaudCandidates) == 0 {
+		return c.Handshake
+	}
+
+	return func(rw io.ReadWriteCloser) error {
+		return ants.ProbeHandshake(rw, c.PortConfig)
+	}
+}
+
 // setDefaults sets the default values for unset variables.
 func (c *Config) setDefaults() {
 	// Set the read timeout to the default value if not set.
 	if int64(c.ReadTimeout) <= 0 {
 		c.ReadTimeout = 1 * time.Second
 	}
+
+	if c.DataBits == 0 {
+		c.DataBits = 8
+	}
+
+	if c.MinBytes <= 0 {
+		c.MinBytes = 1
+	} else if c.MinBytes > 255 {
+		c.MinBytes = 255
+	}
+
+	if c.InterCharTimeout > 25500*time.Millisecond {
+		c.InterCharTimeout = 25500 * time.Millisecond
+	}
 }
@@ -0,0 +1,58 @@
+//go:build windows
+// +build windows
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows error codes returned if the serial device was removed.
+const (
+	errorBadCommand         = 22
+	errorGenFailure         = 31
+	errorDeviceNotConnected = 1167
+	errorDeviceRemoved      = 1617
+)
+
+// isRemovedError returns true if the platform-specific error
+// indicates, that the serial device was removed.
+func isRemovedError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return false
+	}
+
+	switch errno {
+	case errorBadCommand, errorGenFailure, errorDeviceNotConnected, errorDeviceRemoved:
+		return true
+	default:
+		return false
+	}
+}
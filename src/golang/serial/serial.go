@@ -21,30 +21,85 @@
 package serial
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"strings"
+)
 
-	"github.com/tarm/serial"
+var (
+	// ErrDeviceRemoved is returned by Read and Write if the serial device
+	// was removed, for example if an USB adapter was unplugged.
+	// The ANTS port is closed with this error and Port.Err() returns it.
+	ErrDeviceRemoved error = deviceRemovedError{}
 )
 
+// deviceRemovedError signals the removal of the device to the ANTS port.
+type deviceRemovedError struct{}
+
+func (deviceRemovedError) Error() string {
+	return "serial device removed"
+}
+
+// DeviceRemoved implements the error interface expected by the ANTS port.
+func (deviceRemovedError) DeviceRemoved() bool {
+	return true
+}
+
 // OpenPort opens a serial port with the config and
 // returns an io.ReadWriteCloser interface.
+// If the handshake fails, then the baudrate candidates are tried in order.
+// Without a custom handshake, the ANTS handshake verifies the baudrate
+// candidates.
 func OpenPort(config *Config) (io.ReadWriteCloser, error) {
 	// Set the default config values for unset values.
 	config.setDefaults()
 
-	// Create the serial configuration.
-	c := &serial.Config{
-		Name:        config.Name,
-		Baud:        config.Baud,
-		ReadTimeout: config.ReadTimeout,
+	var errs []string
+	handshake := config.handshake()
+
+	for _, baud := range config.bauds() {
+		serialPort, err := openPort(config, baud)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without handshake there is nothing to verify.
+		if handshake == nil {
+			return serialPort, nil
+		}
+
+		err = handshake(serialPort)
+		if err == nil {
+			return serialPort, nil
+		}
+
+		// Close the serial port and try the next baudrate.
+		serialPort.Close()
+		errs = append(errs, fmt.Sprintf("%v baud: %v", baud, err))
 	}
 
-	// Open the serial port.
-	serialPort, err := serial.OpenPort(c)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	return nil, fmt.Errorf("handshake failed with all baudrates: %s", strings.Join(errs, ", "))
+}
+
+// Dial opens the serial port. It implements the ants.Transport interface,
+// so a port can be created with ants.DialPort and is reopened on reconnects.
+func (c *Config) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	return OpenPort(c)
+}
+
+//###############//
+//### Private ###//
+//###############//
 
-	return serialPort, nil
+// mapError replaces platform-specific errors, which indicate
+// the removal of the device, with ErrDeviceRemoved.
+func mapError(err error) error {
+	if err != nil && isRemovedError(err) {
+		return ErrDeviceRemoved
+	}
+	return err
 }
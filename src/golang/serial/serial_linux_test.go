@@ -0,0 +1,203 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang/ptytest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a pseudo terminal and its tty as serial port with the config.
+func openPTY(t *testing.T, config Config) (*ptytest.PTY, *port) {
+	pty, err := ptytest.Open()
+	require.NoError(t, err)
+	t.Cleanup(func() { pty.Close() })
+
+	config.Name = pty.Name
+	rw, err := OpenPort(&config)
+	require.NoError(t, err)
+	t.Cleanup(func() { rw.Close() })
+
+	return pty, rw.(*port)
+}
+
+// termios returns the current termios attributes of the serial port.
+func termios(t *testing.T, p *port) *unix.Termios {
+	tio, err := unix.IoctlGetTermios(p.fd, getTermiosRequest)
+	require.NoError(t, err)
+	return tio
+}
+
+func TestOpenPort(t *testing.T) {
+	_, p := openPTY(t, Config{
+		Baud:             57600,
+		DataBits:         7,
+		Parity:           ParityEven,
+		StopBits:         StopBits2,
+		FlowControl:      FlowControlSoftware,
+		MinBytes:         8,
+		InterCharTimeout: 300 * time.Millisecond,
+	})
+
+	tio := termios(t, p)
+
+	// Raw mode.
+	require.Zero(t, tio.Lflag&(unix.ECHO|unix.ICANON|unix.ISIG|unix.IEXTEN))
+	require.Zero(t, tio.Oflag&unix.OPOST)
+	require.Zero(t, tio.Iflag&(unix.ICRNL|unix.INLCR|unix.IGNCR|unix.ISTRIP))
+	require.Equal(t, uint32(unix.CREAD|unix.CLOCAL), tio.Cflag&(unix.CREAD|unix.CLOCAL))
+
+	// Character format and flow control. The pseudo terminals
+	// force eight data bits without parity bit.
+	require.Equal(t, uint32(unix.CSTOPB), tio.Cflag&(unix.PARODD|unix.CSTOPB|unix.CRTSCTS))
+	require.Equal(t, uint32(unix.INPCK|unix.IXON|unix.IXOFF), tio.Iflag&(unix.INPCK|unix.IXON|unix.IXOFF))
+
+	// Baudrate.
+	require.Equal(t, uint32(unix.B57600), tio.Cflag&unix.CBAUD)
+
+	// Driver-level read timeouts.
+	require.Equal(t, uint8(8), tio.Cc[unix.VMIN])
+	require.Equal(t, uint8(3), tio.Cc[unix.VTIME])
+
+	// Unsupported settings are rejected.
+	pty, err := ptytest.Open()
+	require.NoError(t, err)
+	defer pty.Close()
+
+	_, err = OpenPort(&Config{Name: pty.Name, Baud: 12345})
+	require.Error(t, err)
+	_, err = OpenPort(&Config{Name: pty.Name, Baud: 9600, DataBits: 4})
+	require.Error(t, err)
+}
+
+func TestReconfigure(t *testing.T) {
+	pty, p := openPTY(t, Config{Baud: 115200, ReadTimeout: 50 * time.Millisecond})
+
+	err := p.Reconfigure(&Config{
+		Baud:        9600,
+		Parity:      ParityMark,
+		FlowControl: FlowControlHardware,
+		MinBytes:    4,
+		ReadTimeout: 2 * time.Second,
+	})
+	require.NoError(t, err)
+
+	tio := termios(t, p)
+	require.Equal(t, uint32(unix.B9600), tio.Cflag&unix.CBAUD)
+	require.Equal(t, uint32(unix.PARODD|unix.CMSPAR|unix.CRTSCTS), tio.Cflag&(unix.PARODD|unix.CMSPAR|unix.CSTOPB|unix.CRTSCTS))
+	require.Equal(t, uint32(unix.INPCK), tio.Iflag&(unix.INPCK|unix.IXON|unix.IXOFF))
+	require.Equal(t, uint8(4), tio.Cc[unix.VMIN])
+	require.Equal(t, 2*time.Second, p.readTimeout)
+
+	// The raw mode is kept.
+	require.Zero(t, tio.Lflag&(unix.ECHO|unix.ICANON))
+
+	// Invalid settings keep the attributes.
+	require.Error(t, p.Reconfigure(&Config{Baud: 12345}))
+	require.Error(t, p.Reconfigure(Config{Baud: 9600}))
+	require.Equal(t, tio, termios(t, p))
+
+	// The bytes pass after the reconfiguration.
+	_, err = p.Write([]byte("ok"))
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = pty.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ok"), buf)
+
+	require.NoError(t, p.Close())
+	require.Equal(t, errClosed, p.Reconfigure(&Config{Baud: 9600}))
+}
+
+func TestReadTimeouts(t *testing.T) {
+	pty, p := openPTY(t, Config{
+		Baud:             9600,
+		ReadTimeout:      100 * time.Millisecond,
+		MinBytes:         4,
+		InterCharTimeout: 200 * time.Millisecond,
+	})
+	buf := make([]byte, 16)
+
+	// Nothing is received within the read timeout.
+	start := time.Now()
+	n, err := p.Read(buf)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// The read returns as soon as the minimum byte count was received.
+	_, err = pty.Write([]byte{1, 2, 3, 4})
+	require.NoError(t, err)
+	n, err = p.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3, 4}, buf[:n])
+
+	// Less bytes are returned after the inter-character timeout.
+	_, err = pty.Write([]byte{5, 6})
+	require.NoError(t, err)
+	start = time.Now()
+	n, err = p.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 6}, buf[:n])
+	require.True(t, time.Since(start) >= 150*time.Millisecond)
+
+	// Blocking reads wait beyond the read timeout.
+	require.NoError(t, p.SetBlocking(true))
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		pty.Write([]byte{7, 8, 9, 10})
+	}()
+	n, err = p.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{7, 8, 9, 10}, buf[:n])
+
+	// Close releases a blocked read.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Close()
+	}()
+	_, err = p.Read(buf)
+	require.Equal(t, errClosed, err)
+}
+
+func TestModemControl(t *testing.T) {
+	_, p := openPTY(t, Config{Baud: 9600})
+
+	// The break holds the line for the duration.
+	start := time.Now()
+	require.NoError(t, p.SendBreak(50*time.Millisecond))
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// Pseudo terminals have no modem lines.
+	require.Error(t, p.SetDTR(true))
+	require.Error(t, p.SetRTS(false))
+	_, _, _, _, err := p.ModemLines()
+	require.Error(t, err)
+
+	require.NoError(t, p.Close())
+	require.Equal(t, errClosed, p.SendBreak(time.Millisecond))
+	require.Equal(t, errClosed, p.SetDTR(true))
+	require.Equal(t, errClosed, p.SetRTS(true))
+	_, _, _, _, err = p.ModemLines()
+	require.Equal(t, errClosed, err)
+}
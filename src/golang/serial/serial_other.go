@@ -0,0 +1,148 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !solaris && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!solaris,!windows
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+var (
+	errModemControlUnsupported = errors.New("modem control is not supported on this platform")
+
+	parities = map[Parity]serial.Parity{
+		ParityNone:  serial.ParityNone,
+		ParityOdd:   serial.ParityOdd,
+		ParityEven:  serial.ParityEven,
+		ParityMark:  serial.ParityMark,
+		ParitySpace: serial.ParitySpace,
+	}
+
+	stopBits = map[StopBits]serial.StopBits{
+		StopBits1:     serial.Stop1,
+		StopBits1Half: serial.Stop1Half,
+		StopBits2:     serial.Stop2,
+	}
+)
+
+//#################//
+//### Port type ###//
+//#################//
+
+// port wraps the serial port and maps the errors
+// of a removed device to ErrDeviceRemoved.
+type port struct {
+	*serial.Port
+}
+
+// Read reads from the serial port.
+func (p *port) Read(b []byte) (int, error) {
+	n, err := p.Port.Read(b)
+	return n, mapError(err)
+}
+
+// Write writes to the serial port.
+func (p *port) Write(b []byte) (int, error) {
+	n, err := p.Port.Write(b)
+	return n, mapError(err)
+}
+
+// Reconfigure implements the ants.ReconfigurableSource interface.
+// It is not supported on this platform.
+func (p *port) Reconfigure(settings interface{}) error {
+	return errors.New("failed to reconfigure serial port: not supported on this platform")
+}
+
+// SendBreak implements the ants.ModemControlSource interface.
+// It is not supported on this platform.
+func (p *port) SendBreak(d time.Duration) error {
+	return errModemControlUnsupported
+}
+
+// SetDTR implements the ants.ModemControlSource interface.
+// It is not supported on this platform.
+func (p *port) SetDTR(on bool) error {
+	return errModemControlUnsupported
+}
+
+// SetRTS implements the ants.ModemControlSource interface.
+// It is not supported on this platform.
+func (p *port) SetRTS(on bool) error {
+	return errModemControlUnsupported
+}
+
+// ModemLines implements the ants.ModemControlSource interface.
+// It is not supported on this platform.
+func (p *port) ModemLines() (cts, dsr, cd, ri bool, err error) {
+	return false, false, false, false, errModemControlUnsupported
+}
+
+// List returns the paths of the available serial devices.
+// It is not supported on this platform.
+func List() ([]string, error) {
+	return nil, errors.New("failed to list serial ports: not supported on this platform")
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// openPort opens the serial port with the given baudrate.
+// The driver-level inter-character timeout, the minimum byte count
+// and the flow control are not supported on this platform.
+func openPort(config *Config, baud int) (io.ReadWriteCloser, error) {
+	if config.FlowControl != FlowControlNone {
+		return nil, errors.New("failed to open serial port: flow control is not supported on this platform")
+	}
+
+	parity, ok := parities[config.Parity]
+	if !ok {
+		return nil, fmt.Errorf("failed to open serial port: unsupported parity: %v", config.Parity)
+	}
+
+	stop, ok := stopBits[config.StopBits]
+	if !ok {
+		return nil, fmt.Errorf("failed to open serial port: unsupported stop bits: %v", config.StopBits)
+	}
+
+	// Create the serial configuration.
+	c := &serial.Config{
+		Name:        config.Name,
+		Baud:        baud,
+		ReadTimeout: config.ReadTimeout,
+		Size:        byte(config.DataBits),
+		Parity:      parity,
+		StopBits:    stop,
+	}
+
+	// Open the serial port.
+	serialPort, err := serial.OpenPort(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+
+	return &port{Port: serialPort}, nil
+}
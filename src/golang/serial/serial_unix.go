@@ -0,0 +1,450 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || solaris
+// +build linux darwin freebsd netbsd openbsd solaris
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	errClosed                = errors.New("serial port closed")
+	errLineErrorsUnsupported = errors.New("line error counters are not supported on this platform")
+)
+
+//#################//
+//### Port type ###//
+//#################//
+
+// port is a serial port using the termios interface directly.
+// A closing pipe is polled next to the file descriptor,
+// so a blocked read returns as soon as the port is closed.
+type port struct {
+	fd          int
+	readTimeout time.Duration
+
+	closeR int
+	closeW int
+
+	mutex    sync.Mutex
+	blocking bool
+	isClosed bool
+}
+
+// Read reads from the serial port. It returns zero bytes if nothing
+// was received within the read timeout. In blocking mode, it waits until
+// data was received. Once data is available, the driver-level minimum
+// byte count and inter-character timeout apply.
+func (p *port) Read(b []byte) (int, error) {
+	for {
+		// Obtain the poll timeout.
+		p.mutex.Lock()
+		timeout := int(p.readTimeout / time.Millisecond)
+		if p.blocking {
+			timeout = -1
+		}
+		p.mutex.Unlock()
+
+		fds := []unix.PollFd{
+			{Fd: int32(p.fd), Events: unix.POLLIN},
+			{Fd: int32(p.closeR), Events: unix.POLLIN},
+		}
+
+		n, err := unix.Poll(fds, timeout)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return 0, mapError(err)
+		}
+
+		if fds[1].Revents != 0 {
+			return 0, errClosed
+		} else if n == 0 {
+			return 0, nil
+		}
+
+		n, err = unix.Read(p.fd, b)
+		if err == unix.EINTR {
+			continue
+		} else if n < 0 {
+			n = 0
+		}
+
+		// The file descriptor is hung up if the device was removed.
+		// Reads return zero bytes immediately from now on.
+		if n == 0 && err == nil && fds[0].Revents&unix.POLLHUP != 0 {
+			return 0, ErrDeviceRemoved
+		}
+
+		return n, mapError(err)
+	}
+}
+
+// Write writes to the serial port.
+func (p *port) Write(b []byte) (int, error) {
+	n, err := unix.Write(p.fd, b)
+	if n < 0 {
+		n = 0
+	}
+	return n, mapError(err)
+}
+
+// LineErrors returns the cumulative counts of the hardware parity, framing
+// and overrun errors reported by the serial driver. The ANTS port merges
+// them into its statistics. Only supported on Linux.
+func (p *port) LineErrors() (parity, framing, overrun uint64, err error) {
+	return getLineErrors(p.fd)
+}
+
+// SetBlocking switches between reads, which return after the read timeout
+// if no data is available, and reads, which block until data is available.
+func (p *port) SetBlocking(blocking bool) error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	p.blocking = blocking
+	return nil
+}
+
+// Reconfigure applies the baudrate, the character format, the flow control
+// and the read timeouts of the *Config to the open serial port. The name,
+// the baudrate candidates and the handshake are ignored. Already written
+// bytes are transmitted with the previous settings. It implements the
+// ants.ReconfigurableSource interface.
+func (p *port) Reconfigure(settings interface{}) error {
+	config, ok := settings.(*Config)
+	if !ok {
+		return fmt.Errorf("invalid settings type: %T", settings)
+	}
+
+	// Set the default config values for unset values.
+	c := *config
+	c.setDefaults()
+
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	t, err := unix.IoctlGetTermios(p.fd, getTermiosRequest)
+	if err != nil {
+		return fmt.Errorf("failed to get serial port attributes: %v", err)
+	}
+
+	if err = setAttributes(t, &c, c.Baud); err != nil {
+		return err
+	}
+
+	// Wait until the written bytes were transmitted.
+	if err = unix.IoctlSetTermios(p.fd, drainTermiosRequest, t); err != nil {
+		return fmt.Errorf("failed to set serial port attributes: %v", mapError(err))
+	}
+
+	p.readTimeout = c.ReadTimeout
+	return nil
+}
+
+// SendBreak holds the transmit line low for the duration, which signals
+// a break to the device. It implements the ants.ModemControlSource interface.
+func (p *port) SendBreak(d time.Duration) error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	if err := unix.IoctlSetInt(p.fd, unix.TIOCSBRK, 0); err != nil {
+		return fmt.Errorf("failed to start break: %v", mapError(err))
+	}
+
+	time.Sleep(d)
+
+	if err := unix.IoctlSetInt(p.fd, unix.TIOCCBRK, 0); err != nil {
+		return fmt.Errorf("failed to stop break: %v", mapError(err))
+	}
+
+	return nil
+}
+
+// SetDTR sets or clears the data terminal ready line.
+// It implements the ants.ModemControlSource interface.
+func (p *port) SetDTR(on bool) error {
+	return p.setModemLine(unix.TIOCM_DTR, on)
+}
+
+// SetRTS sets or clears the request to send line. Don't use it
+// with the hardware flow control, which drives the line itself.
+// It implements the ants.ModemControlSource interface.
+func (p *port) SetRTS(on bool) error {
+	return p.setModemLine(unix.TIOCM_RTS, on)
+}
+
+// ModemLines returns the states of the clear to send, data set ready,
+// carrier detect and ring indicator lines.
+// It implements the ants.ModemControlSource interface.
+func (p *port) ModemLines() (cts, dsr, cd, ri bool, err error) {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return false, false, false, false, errClosed
+	}
+
+	lines, err := unix.IoctlGetInt(p.fd, unix.TIOCMGET)
+	if err != nil {
+		return false, false, false, false, fmt.Errorf("failed to get modem lines: %v", mapError(err))
+	}
+
+	return lines&unix.TIOCM_CTS != 0, lines&unix.TIOCM_DSR != 0, lines&unix.TIOCM_CAR != 0, lines&unix.TIOCM_RNG != 0, nil
+}
+
+// Close the serial port and release blocked reads.
+func (p *port) Close() error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+	p.isClosed = true
+
+	// Release blocked reads.
+	unix.Write(p.closeW, []byte{0})
+
+	err := unix.Close(p.fd)
+	unix.Close(p.closeW)
+	unix.Close(p.closeR)
+
+	return err
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// openPort opens the serial port with the given baudrate.
+func openPort(config *Config, baud int) (io.ReadWriteCloser, error) {
+	// Open without waiting for the carrier detect line.
+	fd, err := unix.Open(config.Name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+
+	// Close the file descriptor on error.
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+		}
+	}()
+
+	// Configure the raw mode.
+	t, err := unix.IoctlGetTermios(fd, getTermiosRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get serial port attributes: %v", err)
+	}
+
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXANY
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag |= unix.CREAD | unix.CLOCAL
+
+	if err = setAttributes(t, config, baud); err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+
+	if err = unix.IoctlSetTermios(fd, setTermiosRequest, t); err != nil {
+		return nil, fmt.Errorf("failed to set serial port attributes: %v", err)
+	}
+
+	// Switch to blocking reads, so the termios timeouts apply.
+	if err = unix.SetNonblock(fd, false); err != nil {
+		return nil, fmt.Errorf("failed to set serial port blocking mode: %v", err)
+	}
+
+	// Create the closing pipe.
+	var pipe [2]int
+	if err = closePipe(pipe[:]); err != nil {
+		return nil, fmt.Errorf("failed to create serial port close pipe: %v", err)
+	}
+
+	return &port{
+		fd:          fd,
+		readTimeout: config.ReadTimeout,
+		closeR:      pipe[0],
+		closeW:      pipe[1],
+	}, nil
+}
+
+// closePipe creates a pipe, whose file descriptors are closed on exec.
+// Not all platforms provide pipe2, so the file descriptors are
+// flagged while no process is forked.
+func closePipe(pipe []int) error {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+
+	if err := unix.Pipe(pipe); err != nil {
+		return err
+	}
+	unix.CloseOnExec(pipe[0])
+	unix.CloseOnExec(pipe[1])
+
+	return nil
+}
+
+// setModemLine sets or clears the modem control line.
+func (p *port) setModemLine(line int, on bool) error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	var err error
+	if on {
+		err = unix.IoctlSetPointerInt(p.fd, unix.TIOCMBIS, line)
+	} else {
+		err = unix.IoctlSetPointerInt(p.fd, unix.TIOCMBIC, line)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set modem line: %v", mapError(err))
+	}
+
+	return nil
+}
+
+// setAttributes sets the character format, the flow control, the baudrate
+// and the driver-level read timeouts of the termios attributes.
+func setAttributes(t *unix.Termios, config *Config, baud int) error {
+	if err := setLineAttributes(t, config); err != nil {
+		return err
+	}
+
+	if err := setSpeed(t, baud); err != nil {
+		return err
+	}
+
+	// Set the driver-level minimum byte count and inter-character timeout.
+	t.Cc[unix.VMIN] = uint8(config.MinBytes)
+	t.Cc[unix.VTIME] = uint8(config.InterCharTimeout / (100 * time.Millisecond))
+
+	return nil
+}
+
+// setLineAttributes sets the character format and the
+// flow control of the termios attributes.
+func setLineAttributes(t *unix.Termios, config *Config) error {
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS | cmspar
+	t.Iflag &^= unix.INPCK | unix.IXON | unix.IXOFF
+
+	// The flag types differ between the platforms.
+	switch config.DataBits {
+	case 5:
+		t.Cflag |= unix.CS5
+	case 6:
+		t.Cflag |= unix.CS6
+	case 7:
+		t.Cflag |= unix.CS7
+	case 8:
+		t.Cflag |= unix.CS8
+	default:
+		return fmt.Errorf("unsupported data bits: %v", config.DataBits)
+	}
+
+	switch config.Parity {
+	case ParityNone:
+	case ParityOdd:
+		t.Cflag |= unix.PARENB | unix.PARODD
+	case ParityEven:
+		t.Cflag |= unix.PARENB
+	case ParityMark, ParitySpace:
+		if cmspar == 0 {
+			return fmt.Errorf("mark and space parity are not supported on this platform")
+		}
+		t.Cflag |= unix.PARENB | cmspar
+		if config.Parity == ParityMark {
+			t.Cflag |= unix.PARODD
+		}
+	default:
+		return fmt.Errorf("unsupported parity: %v", config.Parity)
+	}
+
+	// Let the driver check the parity of the received characters.
+	if config.Parity != ParityNone {
+		t.Iflag |= unix.INPCK
+	}
+
+	switch config.StopBits {
+	case StopBits1:
+	case StopBits2:
+		t.Cflag |= unix.CSTOPB
+	default:
+		return fmt.Errorf("unsupported stop bits: %v", config.StopBits)
+	}
+
+	switch config.FlowControl {
+	case FlowControlNone:
+	case FlowControlHardware:
+		t.Cflag |= unix.CRTSCTS
+	case FlowControlSoftware:
+		t.Iflag |= unix.IXON | unix.IXOFF
+	default:
+		return fmt.Errorf("unsupported flow control: %v", config.FlowControl)
+	}
+
+	return nil
+}
+
+// List returns the paths of the available serial devices
+// following the device naming conventions of the platform.
+func List() ([]string, error) {
+	var names []string
+	for _, pattern := range devicePatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list serial ports: %v", err)
+		}
+		names = append(names, matches...)
+	}
+
+	return names, nil
+}
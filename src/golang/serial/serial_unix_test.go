@@ -0,0 +1,141 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || solaris
+// +build linux darwin freebsd netbsd openbsd solaris
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetAttributes(t *testing.T) {
+	cases := []struct {
+		name         string
+		config       Config
+		cflag, iflag uint64
+		vmin, vtime  uint8
+		err          bool
+	}{
+		{
+			name:  "defaults",
+			cflag: unix.CS8,
+			vmin:  1,
+		},
+		{
+			name:   "7E2",
+			config: Config{DataBits: 7, Parity: ParityEven, StopBits: StopBits2},
+			cflag:  unix.CS7 | unix.PARENB | unix.CSTOPB,
+			iflag:  unix.INPCK,
+			vmin:   1,
+		},
+		{
+			name:   "5O1",
+			config: Config{DataBits: 5, Parity: ParityOdd},
+			cflag:  unix.CS5 | unix.PARENB | unix.PARODD,
+			iflag:  unix.INPCK,
+			vmin:   1,
+		},
+		{
+			name:   "mark parity",
+			config: Config{Parity: ParityMark},
+			cflag:  unix.CS8 | unix.PARENB | unix.PARODD | cmspar,
+			iflag:  unix.INPCK,
+			vmin:   1,
+			err:    cmspar == 0,
+		},
+		{
+			name:   "space parity",
+			config: Config{Parity: ParitySpace},
+			cflag:  unix.CS8 | unix.PARENB | cmspar,
+			iflag:  unix.INPCK,
+			vmin:   1,
+			err:    cmspar == 0,
+		},
+		{
+			name:   "hardware flow control",
+			config: Config{FlowControl: FlowControlHardware},
+			cflag:  unix.CS8 | unix.CRTSCTS,
+			vmin:   1,
+		},
+		{
+			name:   "software flow control",
+			config: Config{FlowControl: FlowControlSoftware},
+			cflag:  unix.CS8,
+			iflag:  unix.IXON | unix.IXOFF,
+			vmin:   1,
+		},
+		{
+			name:   "read timeouts",
+			config: Config{MinBytes: 16, InterCharTimeout: 250 * time.Millisecond},
+			cflag:  unix.CS8,
+			vmin:   16,
+			vtime:  2,
+		},
+		{
+			name:   "maximum read timeouts",
+			config: Config{MinBytes: 1000, InterCharTimeout: time.Minute},
+			cflag:  unix.CS8,
+			vmin:   255,
+			vtime:  255,
+		},
+		{name: "data bits", config: Config{DataBits: 9}, err: true},
+		{name: "stop bits", config: Config{StopBits: StopBits1Half}, err: true},
+		{name: "parity", config: Config{Parity: Parity(-1)}, err: true},
+		{name: "flow control", config: Config{FlowControl: FlowControl(-1)}, err: true},
+	}
+
+	// The managed flags are cleared. Others are kept.
+	const managedCflag = unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS | cmspar
+	const managedIflag = unix.INPCK | unix.IXON | unix.IXOFF
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.config.setDefaults()
+
+			var tio unix.Termios
+			tio.Cflag |= unix.CS6 | unix.PARENB | unix.CSTOPB | unix.CREAD
+			tio.Iflag |= unix.IXON | unix.INPCK | unix.IGNBRK
+
+			err := setAttributes(&tio, &c.config, 9600)
+			if c.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, c.cflag, uint64(tio.Cflag)&managedCflag)
+			require.Equal(t, c.iflag, uint64(tio.Iflag)&managedIflag)
+			require.Equal(t, uint64(unix.CREAD), uint64(tio.Cflag)&unix.CREAD)
+			require.Equal(t, uint64(unix.IGNBRK), uint64(tio.Iflag)&unix.IGNBRK)
+			require.Equal(t, c.vmin, tio.Cc[unix.VMIN])
+			require.Equal(t, c.vtime, tio.Cc[unix.VTIME])
+		})
+	}
+
+	// Invalid baudrates are rejected.
+	var tio unix.Termios
+	config := Config{}
+	config.setDefaults()
+	require.Error(t, setAttributes(&tio, &config, 0))
+}
@@ -0,0 +1,528 @@
+//go:build windows
+// +build windows
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const (
+	// Flags of the device control block.
+	dcbBinary              = 0x0001
+	dcbParity              = 0x0002
+	dcbOutxCtsFlow         = 0x0004
+	dcbOutxDsrFlow         = 0x0008
+	dcbDTRControlMask      = 0x0030
+	dcbDTRControlEnable    = 0x0010
+	dcbDsrSensitivity      = 0x0040
+	dcbOutX                = 0x0100
+	dcbInX                 = 0x0200
+	dcbErrorChar           = 0x0400
+	dcbNull                = 0x0800
+	dcbRTSControlMask      = 0x3000
+	dcbRTSControlEnable    = 0x1000
+	dcbRTSControlHandshake = 0x2000
+	dcbAbortOnError        = 0x4000
+
+	// Functions of EscapeCommFunction.
+	setRTS   = 3
+	clrRTS   = 4
+	setDTR   = 5
+	clrDTR   = 6
+	setBreak = 8
+	clrBreak = 9
+
+	// Line states of GetCommModemStatus.
+	msCTSOn  = 0x0010
+	msDSROn  = 0x0020
+	msRingOn = 0x0040
+	msRLSDOn = 0x0080
+
+	// The software flow control characters and the number of buffered
+	// bytes, which trigger them.
+	xonChar   = 0x11
+	xoffChar  = 0x13
+	xonLimit  = 2048
+	xoffLimit = 512
+
+	// Size of the input and output buffers of the driver.
+	driverBufferSize = 4096
+
+	maxDWORD = 0xffffffff
+)
+
+var (
+	errClosed = errors.New("serial port closed")
+
+	kernel32               = windows.NewLazySystemDLL("kernel32.dll")
+	procGetCommState       = kernel32.NewProc("GetCommState")
+	procSetCommState       = kernel32.NewProc("SetCommState")
+	procSetupComm          = kernel32.NewProc("SetupComm")
+	procEscapeCommFunction = kernel32.NewProc("EscapeCommFunction")
+	procGetCommModemStatus = kernel32.NewProc("GetCommModemStatus")
+
+	parities = map[Parity]byte{
+		ParityNone:  0,
+		ParityOdd:   1,
+		ParityEven:  2,
+		ParityMark:  3,
+		ParitySpace: 4,
+	}
+
+	stopBits = map[StopBits]byte{
+		StopBits1:     0,
+		StopBits1Half: 1,
+		StopBits2:     2,
+	}
+)
+
+// dcb is the device control block, which holds the settings of the serial port.
+type dcb struct {
+	DCBlength  uint32
+	BaudRate   uint32
+	Flags      uint32
+	wReserved  uint16
+	XonLim     uint16
+	XoffLim    uint16
+	ByteSize   byte
+	Parity     byte
+	StopBits   byte
+	XonChar    byte
+	XoffChar   byte
+	ErrorChar  byte
+	EofChar    byte
+	EvtChar    byte
+	wReserved1 uint16
+}
+
+//#################//
+//### Port type ###//
+//#################//
+
+// port is a serial port using the Windows communication functions.
+// The reads and writes are overlapped, so a blocked read returns
+// as soon as the port is closed.
+type port struct {
+	handle windows.Handle
+
+	mutex    sync.Mutex
+	blocking bool
+	isClosed bool
+}
+
+// Read reads from the serial port. It returns zero bytes if nothing
+// was received within the read timeout. In blocking mode, it waits until
+// data was received. Once data is available, the inter-character
+// timeout applies.
+func (p *port) Read(b []byte) (int, error) {
+	for {
+		n, err := p.transfer(b, windows.ReadFile)
+		if err != nil || n > 0 {
+			return n, err
+		}
+
+		// Lock the mutex.
+		p.mutex.Lock()
+		blocking := p.blocking
+		p.mutex.Unlock()
+
+		if !blocking {
+			return 0, nil
+		}
+	}
+}
+
+// Write writes to the serial port.
+func (p *port) Write(b []byte) (int, error) {
+	return p.transfer(b, windows.WriteFile)
+}
+
+// SetBlocking switches between reads, which return after the read timeout
+// if no data is available, and reads, which block until data is available.
+func (p *port) SetBlocking(blocking bool) error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	p.blocking = blocking
+	return nil
+}
+
+// Reconfigure applies the baudrate, the character format, the flow control
+// and the read timeouts of the *Config to the open serial port. The name,
+// the baudrate candidates and the handshake are ignored. Already written
+// bytes are transmitted with the previous settings. It implements the
+// ants.ReconfigurableSource interface.
+func (p *port) Reconfigure(settings interface{}) error {
+	config, ok := settings.(*Config)
+	if !ok {
+		return fmt.Errorf("invalid settings type: %T", settings)
+	}
+
+	// Set the default config values for unset values.
+	c := *config
+	c.setDefaults()
+
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	// Wait until the written bytes were transmitted.
+	if err := windows.FlushFileBuffers(p.handle); err != nil {
+		return fmt.Errorf("failed to flush serial port: %v", mapError(err))
+	}
+
+	return configure(p.handle, &c, c.Baud)
+}
+
+// SendBreak holds the transmit line low for the duration, which signals
+// a break to the device. It implements the ants.ModemControlSource interface.
+func (p *port) SendBreak(d time.Duration) error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	if err := escapeCommFunction(p.handle, setBreak); err != nil {
+		return fmt.Errorf("failed to start break: %v", mapError(err))
+	}
+
+	time.Sleep(d)
+
+	if err := escapeCommFunction(p.handle, clrBreak); err != nil {
+		return fmt.Errorf("failed to stop break: %v", mapError(err))
+	}
+
+	return nil
+}
+
+// SetDTR sets or clears the data terminal ready line.
+// It implements the ants.ModemControlSource interface.
+func (p *port) SetDTR(on bool) error {
+	if on {
+		return p.setModemLine(setDTR)
+	}
+	return p.setModemLine(clrDTR)
+}
+
+// SetRTS sets or clears the request to send line. Don't use it
+// with the hardware flow control, which drives the line itself.
+// It implements the ants.ModemControlSource interface.
+func (p *port) SetRTS(on bool) error {
+	if on {
+		return p.setModemLine(setRTS)
+	}
+	return p.setModemLine(clrRTS)
+}
+
+// ModemLines returns the states of the clear to send, data set ready,
+// carrier detect and ring indicator lines.
+// It implements the ants.ModemControlSource interface.
+func (p *port) ModemLines() (cts, dsr, cd, ri bool, err error) {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return false, false, false, false, errClosed
+	}
+
+	var lines uint32
+	r, _, err := procGetCommModemStatus.Call(uintptr(p.handle), uintptr(unsafe.Pointer(&lines)))
+	if r == 0 {
+		return false, false, false, false, fmt.Errorf("failed to get modem lines: %v", mapError(err))
+	}
+
+	return lines&msCTSOn != 0, lines&msDSROn != 0, lines&msRLSDOn != 0, lines&msRingOn != 0, nil
+}
+
+// Close the serial port and release blocked reads.
+func (p *port) Close() error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+	p.isClosed = true
+
+	// Release blocked reads and writes.
+	windows.CancelIoEx(p.handle, nil)
+
+	return windows.CloseHandle(p.handle)
+}
+
+// List returns the names of the available serial devices,
+// which are registered in the serial communication device map.
+func List() ([]string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DEVICEMAP\SERIALCOMM`, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		// No serial device was ever connected.
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list serial ports: %v", err)
+	}
+	defer k.Close()
+
+	values, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list serial ports: %v", err)
+	}
+
+	var names []string
+	for _, v := range values {
+		name, _, err := k.GetStringValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list serial ports: %v", err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// openPort opens the serial port with the given baudrate.
+// The driver-level minimum byte count is not supported on this platform.
+func openPort(config *Config, baud int) (io.ReadWriteCloser, error) {
+	// Ports above COM9 are only accessible within the device namespace.
+	name := config.Name
+	if !strings.HasPrefix(name, `\\.\`) {
+		name = `\\.\` + name
+	}
+
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+
+	h, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+		windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL|windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+
+	// Close the handle on error.
+	defer func() {
+		if err != nil {
+			windows.CloseHandle(h)
+		}
+	}()
+
+	r, _, err := procSetupComm.Call(uintptr(h), driverBufferSize, driverBufferSize)
+	if r == 0 {
+		return nil, fmt.Errorf("failed to set serial port buffers: %v", err)
+	}
+
+	if err = configure(h, config, baud); err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+
+	return &port{handle: h}, nil
+}
+
+// transfer runs the overlapped read or write operation
+// and waits for its completion.
+func (p *port) transfer(b []byte, op func(windows.Handle, []byte, *uint32, *windows.Overlapped) error) (int, error) {
+	// Each operation signals its own event,
+	// because reads and writes are concurrent.
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create serial port event: %v", err)
+	}
+	defer windows.CloseHandle(event)
+
+	var done uint32
+	o := windows.Overlapped{HEvent: event}
+
+	err = op(p.handle, b, &done, &o)
+	if err == windows.ERROR_IO_PENDING {
+		err = windows.GetOverlappedResult(p.handle, &o, &done, true)
+	}
+
+	if err != nil && p.closed() {
+		return int(done), errClosed
+	}
+	return int(done), mapError(err)
+}
+
+// closed returns true if the port was closed.
+func (p *port) closed() bool {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.isClosed
+}
+
+// setModemLine sets or clears the modem control line
+// with the function of EscapeCommFunction.
+func (p *port) setModemLine(function uintptr) error {
+	// Lock the mutex.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.isClosed {
+		return errClosed
+	}
+
+	if err := escapeCommFunction(p.handle, function); err != nil {
+		return fmt.Errorf("failed to set modem line: %v", mapError(err))
+	}
+
+	return nil
+}
+
+// configure applies the settings and the read timeouts to the serial port.
+func configure(h windows.Handle, config *Config, baud int) error {
+	var d dcb
+	d.DCBlength = uint32(unsafe.Sizeof(d))
+
+	r, _, err := procGetCommState.Call(uintptr(h), uintptr(unsafe.Pointer(&d)))
+	if r == 0 {
+		return fmt.Errorf("failed to get serial port attributes: %v", mapError(err))
+	}
+
+	if err = setAttributes(&d, config, baud); err != nil {
+		return err
+	}
+
+	r, _, err = procSetCommState.Call(uintptr(h), uintptr(unsafe.Pointer(&d)))
+	if r == 0 {
+		return fmt.Errorf("failed to set serial port attributes: %v", mapError(err))
+	}
+
+	timeouts := readTimeouts(config)
+	if err = windows.SetCommTimeouts(h, &timeouts); err != nil {
+		return fmt.Errorf("failed to set serial port timeouts: %v", mapError(err))
+	}
+
+	return nil
+}
+
+// setAttributes sets the baudrate, the character format and the
+// flow control of the device control block. The DTR line is enabled.
+func setAttributes(d *dcb, config *Config, baud int) error {
+	if baud <= 0 {
+		return fmt.Errorf("unsupported baudrate: %v", baud)
+	} else if config.DataBits < 5 || config.DataBits > 8 {
+		return fmt.Errorf("unsupported data bits: %v", config.DataBits)
+	}
+
+	parity, ok := parities[config.Parity]
+	if !ok {
+		return fmt.Errorf("unsupported parity: %v", config.Parity)
+	}
+
+	stop, ok := stopBits[config.StopBits]
+	if !ok {
+		return fmt.Errorf("unsupported stop bits: %v", config.StopBits)
+	}
+
+	d.BaudRate = uint32(baud)
+	d.ByteSize = byte(config.DataBits)
+	d.Parity = parity
+	d.StopBits = stop
+
+	// Never abort the reads and writes after a line error.
+	d.Flags &^= dcbParity | dcbOutxCtsFlow | dcbOutxDsrFlow | dcbDTRControlMask | dcbDsrSensitivity |
+		dcbOutX | dcbInX | dcbErrorChar | dcbNull | dcbRTSControlMask | dcbAbortOnError
+	d.Flags |= dcbBinary | dcbDTRControlEnable
+
+	// Let the driver check the parity of the received characters.
+	if config.Parity != ParityNone {
+		d.Flags |= dcbParity
+	}
+
+	switch config.FlowControl {
+	case FlowControlNone:
+		d.Flags |= dcbRTSControlEnable
+	case FlowControlHardware:
+		d.Flags |= dcbOutxCtsFlow | dcbRTSControlHandshake
+	case FlowControlSoftware:
+		d.Flags |= dcbRTSControlEnable | dcbOutX | dcbInX
+		d.XonChar, d.XoffChar = xonChar, xoffChar
+		d.XonLim, d.XoffLim = xonLimit, xoffLimit
+	default:
+		return fmt.Errorf("unsupported flow control: %v", config.FlowControl)
+	}
+
+	return nil
+}
+
+// readTimeouts returns the driver-level read timeouts. A read returns the
+// received bytes immediately or waits for the first byte until the read
+// timeout. With the inter-character timeout, it returns as soon as the
+// line was idle for this duration after a byte was received.
+func readTimeouts(config *Config) windows.CommTimeouts {
+	timeout := config.ReadTimeout / time.Millisecond
+	if timeout >= maxDWORD {
+		timeout = maxDWORD - 1
+	}
+
+	t := windows.CommTimeouts{
+		ReadIntervalTimeout:        maxDWORD,
+		ReadTotalTimeoutMultiplier: maxDWORD,
+		ReadTotalTimeoutConstant:   uint32(timeout),
+	}
+	if config.InterCharTimeout > 0 {
+		t.ReadIntervalTimeout = uint32(config.InterCharTimeout / time.Millisecond)
+		t.ReadTotalTimeoutMultiplier = 0
+	}
+
+	return t
+}
+
+// escapeCommFunction directs the serial port to perform the function.
+func escapeCommFunction(h windows.Handle, function uintptr) error {
+	r, _, err := procEscapeCommFunction.Call(uintptr(h), function)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
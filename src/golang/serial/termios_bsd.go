@@ -0,0 +1,75 @@
+//go:build darwin || freebsd || netbsd || openbsd
+// +build darwin freebsd netbsd openbsd
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	getTermiosRequest = unix.TIOCGETA
+	setTermiosRequest = unix.TIOCSETA
+
+	// drainTermiosRequest sets the attributes after the output was transmitted.
+	drainTermiosRequest = unix.TIOCSETAW
+
+	// The mark and space parity are not supported.
+	cmspar = 0
+)
+
+// Use the callout devices, which don't wait for the carrier detect line.
+// FreeBSD names on-board UARTs cuau* and USB adapters cuaU*. OpenBSD names
+// them cua0* and cuaU*. NetBSD names them dty0* and dtyU*. macOS names
+// them cu.*, for example cu.usbserial-1410.
+var devicePatterns = map[string][]string{
+	"darwin":  {"/dev/cu.*"},
+	"freebsd": {"/dev/cuau*", "/dev/cuaU*"},
+	"openbsd": {"/dev/cua0*", "/dev/cuaU*"},
+	"netbsd":  {"/dev/dty0*", "/dev/dtyU*"},
+}[runtime.GOOS]
+
+// setSpeed sets the input and output baudrate of the termios attributes.
+// The BSD and macOS termios interfaces use the plain baudrate as speed value.
+func setSpeed(t *unix.Termios, baud int) error {
+	if baud <= 0 {
+		return fmt.Errorf("unsupported baudrate: %v", baud)
+	}
+
+	setSpeedValue(&t.Ispeed, baud)
+	setSpeedValue(&t.Ospeed, baud)
+
+	return nil
+}
+
+// setSpeedValue sets the speed field. Its type differs between the BSDs.
+func setSpeedValue[T uint32 | int32 | uint64](speed *T, baud int) {
+	*speed = T(baud)
+}
+
+// getLineErrors returns the hardware error counters of the serial driver.
+// They are not exposed on this platform.
+func getLineErrors(fd int) (parity, framing, overrun uint64, err error) {
+	return 0, 0, 0, errLineErrorsUnsupported
+}
@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	getTermiosRequest = unix.TCGETS
+	setTermiosRequest = unix.TCSETS
+
+	// drainTermiosRequest sets the attributes after the output was transmitted.
+	drainTermiosRequest = unix.TCSETSW
+
+	// cmspar selects the mark and space parity.
+	cmspar = unix.CMSPAR
+)
+
+var (
+	bauds = map[int]uint32{
+		1200:    unix.B1200,
+		2400:    unix.B2400,
+		4800:    unix.B4800,
+		9600:    unix.B9600,
+		19200:   unix.B19200,
+		38400:   unix.B38400,
+		57600:   unix.B57600,
+		115200:  unix.B115200,
+		230400:  unix.B230400,
+		460800:  unix.B460800,
+		500000:  unix.B500000,
+		576000:  unix.B576000,
+		921600:  unix.B921600,
+		1000000: unix.B1000000,
+		1500000: unix.B1500000,
+		2000000: unix.B2000000,
+		3000000: unix.B3000000,
+		4000000: unix.B4000000,
+	}
+
+	// Serial devices of the on-board UARTs, USB adapters and USB CDC ACM devices.
+	devicePatterns = []string{"/dev/ttyS*", "/dev/ttyUSB*", "/dev/ttyACM*", "/dev/ttyAMA*"}
+)
+
+// setSpeed sets the input and output baudrate of the termios attributes.
+func setSpeed(t *unix.Termios, baud int) error {
+	rate, ok := bauds[baud]
+	if !ok {
+		return fmt.Errorf("unsupported baudrate: %v", baud)
+	}
+
+	t.Cflag &^= unix.CBAUD
+	t.Cflag |= rate
+	t.Ispeed = rate
+	t.Ospeed = rate
+
+	return nil
+}
+
+// serialICounter is the serial_icounter_struct of the TIOCGICOUNT ioctl.
+type serialICounter struct {
+	cts, dsr, rng, dcd int32
+	rx, tx             int32
+	frame, overrun     int32
+	parity, brk        int32
+	bufOverrun         int32
+	reserved           [9]int32
+}
+
+// getLineErrors returns the hardware error counters of the serial driver.
+func getLineErrors(fd int) (parity, framing, overrun uint64, err error) {
+	var c serialICounter
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TIOCGICOUNT, uintptr(unsafe.Pointer(&c)))
+	if errno != 0 {
+		return 0, 0, 0, errno
+	}
+
+	return uint64(uint32(c.parity)), uint64(uint32(c.frame)), uint64(uint32(c.overrun)) + uint64(uint32(c.bufOverrun)), nil
+}
@@ -0,0 +1,91 @@
+//go:build solaris
+// +build solaris
+
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package serial
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	getTermiosRequest = unix.TCGETS
+	setTermiosRequest = unix.TCSETS
+
+	// drainTermiosRequest sets the attributes after the output was transmitted.
+	drainTermiosRequest = unix.TCSETSW
+
+	// The mark and space parity are not supported.
+	cmspar = 0
+
+	// cbaudExt and cibaudExt extend the CBAUD and CIBAUD
+	// fields for baudrates above 38400.
+	cbaudExt  = 0x200000
+	cibaudExt = 0x400000
+)
+
+var (
+	bauds = map[int]uint32{
+		1200:   unix.B1200,
+		2400:   unix.B2400,
+		4800:   unix.B4800,
+		9600:   unix.B9600,
+		19200:  unix.B19200,
+		38400:  unix.B38400,
+		57600:  unix.B57600,
+		76800:  unix.B76800,
+		115200: unix.B115200,
+		153600: unix.B153600,
+		230400: unix.B230400,
+		307200: unix.B307200,
+		460800: unix.B460800,
+		921600: unix.B921600,
+	}
+
+	// illumos provides the callout devices in /dev/cua
+	// and the dial-in devices in /dev/term.
+	devicePatterns = []string{"/dev/cua/*"}
+)
+
+// setSpeed sets the baudrate of the termios attributes. The input
+// baudrate is zero and therefore equals the output baudrate.
+func setSpeed(t *unix.Termios, baud int) error {
+	rate, ok := bauds[baud]
+	if !ok {
+		return fmt.Errorf("unsupported baudrate: %v", baud)
+	}
+
+	t.Cflag &^= unix.CBAUD | cbaudExt | unix.CIBAUD | cibaudExt
+	if rate > unix.CBAUD {
+		t.Cflag |= cbaudExt | (rate - unix.CBAUD - 1)
+	} else {
+		t.Cflag |= rate
+	}
+
+	return nil
+}
+
+// getLineErrors returns the hardware error counters of the serial driver.
+// They are not exposed on this platform.
+func getLineErrors(fd int) (parity, framing, overrun uint64, err error) {
+	return 0, 0, 0, errLineErrorsUnsupported
+}
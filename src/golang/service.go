@@ -0,0 +1,272 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+//#################//
+//### Constants ###//
+//#################//
+
+// Service identifiers of the standardized service channels.
+// The identifiers 0 to 127 are reserved for the ANTS library.
+const (
+	ServiceConfig   byte = 1 // Remote configuration get/set protocol.
+	ServiceLog      byte = 2 // Remote log retrieval.
+	ServiceRPC      byte = 3 // Request/response calls of Port.Call.
+	ServiceTransfer byte = 4 // File transfer.
+	ServiceDFU      byte = 5 // Firmware update.
+)
+
+const (
+	readServiceChunkChanSize  = 5
+	writeServiceChunkChanSize = 5
+)
+
+//####################//
+//### Service type ###//
+//####################//
+
+// A Service is a logical channel, which is multiplexed over the data
+// messages of a port. Data chunks of a service are never returned by
+// Port.Read, but only by the Read method of the service with the same
+// identifier on the peer side. Services share the bulk transmission
+// queue with Port.Write.
+type Service struct {
+	port      *Port
+	id        byte
+	readChan  chan *Message
+	requestID uint32
+}
+
+// Service returns the service channel with the identifier.
+// The service is registered on the first call. Received data chunks of
+// unregistered services are discarded.
+func (p *Port) Service(id byte) *Service {
+	// Lock the mutex.
+	p.servicesMutex.Lock()
+	defer p.servicesMutex.Unlock()
+
+	s, ok := p.services[id]
+	if !ok {
+		// The request IDs start at a random value, so a restarted
+		// port does not repeat the last request ID.
+		s = &Service{
+			port:      p,
+			id:        id,
+			readChan:  make(chan *Message, readServiceChunkChanSize),
+			requestID: uint32(time.Now().UnixNano()),
+		}
+		p.services[id] = s
+	}
+
+	return s
+}
+
+// ID returns the service identifier.
+func (s *Service) ID() byte {
+	return s.id
+}
+
+// Read a verified data chunk of the service.
+// Optionally pass a timeout duration.
+// If the timeout is reached, then ErrTimeout is returned.
+// If the port is closed, then ErrClosed is returned.
+func (s *Service) Read(timeout ...time.Duration) ([]byte, error) {
+	m, err := s.ReadMessage(timeout...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Data, nil
+}
+
+// ReadMessage reads a verified data chunk of the service
+// including its reception metadata.
+// Optionally pass a timeout duration.
+// If the timeout is reached, then ErrTimeout is returned.
+// If the port is closed, then ErrClosed is returned.
+func (s *Service) ReadMessage(timeout ...time.Duration) (*Message, error) {
+	// Services are available in responder mode, so don't use readChunk.
+	var timeoutChan <-chan time.Time
+	if len(timeout) > 0 && timeout[0] > 0 {
+		timer := time.NewTimer(timeout[0])
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	select {
+	case <-s.port.closeChan:
+		return nil, ErrClosed
+	case <-timeoutChan:
+		return nil, ErrTimeout
+	case m := <-s.readChan:
+		return m, nil
+	}
+}
+
+// Write a data chunk to the service of the peer.
+// This method blocks as long as the write queue is full.
+// If the port is closed, then ErrClosed is returned.
+func (s *Service) Write(data []byte) error {
+	if err := s.port.breaker.allow(); err != nil {
+		return err
+	}
+
+	// Prepend the service identifier.
+	chunk := make([]byte, 0, len(data)+1)
+	chunk = append(chunk, s.id)
+	chunk = append(chunk, data...)
+
+	// Track the pending data chunk until it was written.
+	s.port.addPendingWrites(1)
+
+	select {
+	case <-s.port.closeChan:
+		s.port.addPendingWrites(-1)
+		return ErrClosed
+	case s.port.writeServiceChunkChan <- chunk:
+		return nil
+	}
+}
+
+// Request sends a request with the operation and the payload to the service
+// of the peer and waits for the matching response. The request is resent
+// if no response was received within the timeout, until the retries are
+// exhausted. The peer has to answer duplicated requests with the same response.
+// Stale responses of timed out requests are discarded.
+// Request: Operation | Request ID | Payload
+// Response: Operation | Request ID | Status | Payload
+// Returns the status and the payload of the response.
+// If no response was received, then ErrTimeout is returned.
+// If the port is closed, then ErrClosed is returned.
+func (s *Service) Request(op byte, payload []byte, timeout time.Duration, retries int) (status byte, resp []byte, err error) {
+	id := s.nextRequestID()
+	req := make([]byte, 0, 2+len(payload))
+	req = append(req, op, id)
+	req = append(req, payload...)
+
+	for i := 0; ; i++ {
+		err = s.Write(req)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to send request: %v", err)
+		}
+
+		status, resp, err = s.waitForResponse(op, id, timeout)
+		if err != ErrTimeout || i >= retries {
+			return status, resp, err
+		}
+	}
+}
+
+// Notify sends a request with the operation and the payload to the service
+// of the peer like Request, but does not wait for the response.
+// This method blocks as long as the write queue is full.
+// If the port is closed, then ErrClosed is returned.
+func (s *Service) Notify(op byte, payload []byte) error {
+	req := make([]byte, 0, 2+len(payload))
+	req = append(req, op, s.nextRequestID())
+	req = append(req, payload...)
+
+	return s.Write(req)
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// nextRequestID returns the next request ID.
+func (s *Service) nextRequestID() byte {
+	return byte(atomic.AddUint32(&s.requestID, 1))
+}
+
+// waitForResponse waits for the response of the request.
+// Stale responses of timed out requests are discarded.
+func (s *Service) waitForResponse(op byte, id byte, timeout time.Duration) (status byte, resp []byte, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, nil, ErrTimeout
+		}
+
+		resp, err = s.Read(remaining)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if len(resp) < 3 || resp[0] != op || resp[1] != id {
+			continue
+		}
+
+		return resp[2], resp[3:], nil
+	}
+}
+
+// dispatchServiceMessage passes the received service data chunk to the registered service.
+// If reject is set, then errServiceBusy is returned instead of waiting for a busy service.
+// This method must be only called by the read messages loop.
+func (p *Port) dispatchServiceMessage(m *Message, reject bool) error {
+	if len(m.Data) == 0 {
+		return fmt.Errorf("invalid service data chunk: service identifier is missing")
+	}
+
+	// Remove the service identifier.
+	id := m.Data[0]
+	m.Data = m.Data[1:]
+
+	// Obtain the registered service.
+	p.servicesMutex.Lock()
+	s, ok := p.services[id]
+	p.servicesMutex.Unlock()
+
+	if !ok {
+		// Let calls of the peer fail fast instead of timing out.
+		if id == ServiceRPC {
+			p.rejectCall(m.Data)
+			return nil
+		}
+
+		p.log.Debugf("read data: discarding data chunk of unregistered service %v", id)
+		return nil
+	}
+
+	// Push the data chunk to the service channel. Don't block the read
+	// routine with a busy service, if the data message can be rejected.
+	if reject {
+		select {
+		case s.readChan <- m:
+			return nil
+		default:
+			p.log.Debugf("read data: service %v is busy: rejecting data chunk", id)
+			return errServiceBusy
+		}
+	}
+
+	select {
+	case <-p.closeChan:
+		return ErrClosed
+	case s.readChan <- m:
+	}
+
+	return nil
+}
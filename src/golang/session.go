@@ -0,0 +1,382 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Length of the random nonce of a session handshake without key exchange.
+	sessionNonceLength = 16
+)
+
+// Errors:
+var (
+	errHandshakeNotAuthenticated = errors.New("handshake not authenticated")
+)
+
+//####################//
+//### Session type ###//
+//####################//
+
+// session is the agreed session of the encrypted data chunks. The session
+// handshake agrees on a new session, if the key exchange or the replay
+// protection is enabled. Each session starts with new replay counters.
+type session struct {
+	cipher Cipher
+	id     []byte // Transcript of the handshake. Authenticated with the replay counters.
+
+	writeCounter uint64       // Only used by the write loop.
+	readWindow   replayWindow // Only used by the read messages loop.
+	readCounter  uint64       // Counter of the last opened data chunk.
+}
+
+// sessionInitiator is the pending session of a sent handshake request.
+type sessionInitiator struct {
+	ephemeral *ecdh.PrivateKey // Only set with the key exchange.
+	nonce     []byte           // Ephemeral public key or random nonce.
+	request   []byte
+}
+
+// sessionResponder is the pending session of a received handshake request.
+// The session is activated, once the peer confirmed it.
+type sessionResponder struct {
+	request []byte
+	reply   []byte // Resent for a retransmitted request.
+	session *session
+	info    *PeerInfo
+}
+
+// sessionFields are the fields of a received handshake, which agree on the session.
+type sessionFields struct {
+	staticKey    *ecdh.PublicKey // Only set with the key exchange.
+	ephemeralKey *ecdh.PublicKey // Only set with the key exchange.
+	nonce        []byte          // Ephemeral public key or random nonce.
+	tagPos       int
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// hasSessionHandshake returns a boolean whenever the encrypted data chunks
+// require a session, which is agreed by an authenticated handshake.
+func (c *Config) hasSessionHandshake() bool {
+	return c.KeyExchange != nil || (c.Cipher != nil && c.ReplayProtection)
+}
+
+// newSessionRequest creates the payload of a handshake request with a new
+// nonce and records it as pending session. Nil is returned if the session
+// handshake is not possible.
+// This method must be only called by the write loop.
+func (p *Port) newSessionRequest() []byte {
+	request, ephemeral, nonce, err := p.newSessionPayload(handshakeRequest)
+	if err != nil {
+		p.log.Errorf("handshake: %v", err)
+		return nil
+	}
+
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	// The request is not authenticated. The responder keeps its session,
+	// until the confirmation proves the key of the initiator.
+	p.sessionInitiator = &sessionInitiator{ephemeral: ephemeral, nonce: nonce, request: request}
+
+	return request
+}
+
+// newSessionPayload creates the handshake payload with the session fields,
+// but without the authentication tag:
+// Static Public Key | Ephemeral Public Key
+// The random nonce is appended instead, if the key exchange is disabled.
+func (p *Port) newSessionPayload(kind byte) (payload []byte, ephemeral *ecdh.PrivateKey, nonce []byte, err error) {
+	payload = newHandshakePayload(p.config, kind)
+
+	kx := p.config.KeyExchange
+	if kx == nil {
+		nonce = make([]byte, sessionNonceLength)
+		if _, err = rand.Read(nonce); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create nonce: %v", err)
+		}
+		return append(payload, nonce...), nil, nonce, nil
+	}
+
+	if err = kx.validate(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	ephemeral, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create ephemeral key: %v", err)
+	}
+	nonce = ephemeral.PublicKey().Bytes()
+
+	payload = append(payload, kx.PrivateKey.PublicKey().Bytes()...)
+	return append(payload, nonce...), ephemeral, nonce, nil
+}
+
+// parseSessionFields extracts the session fields of a received handshake.
+// Static public keys, which are not pinned, are rejected.
+func (p *Port) parseSessionFields(payload []byte, info *PeerInfo) (f sessionFields, err error) {
+	kx := p.config.KeyExchange
+	if kx == nil {
+		if payload[6]&featureReplayCounter == 0 || len(payload) < handshakePayloadLength+sessionNonceLength {
+			return f, fmt.Errorf("peer did not enable the replay protection")
+		}
+
+		f.tagPos = handshakePayloadLength + sessionNonceLength
+		f.nonce = payload[handshakePayloadLength:f.tagPos]
+		return f, nil
+	}
+
+	if err = kx.validate(); err != nil {
+		return f, err
+	} else if payload[6]&featureKeyExchange == 0 || len(payload) < handshakePayloadLength+keyExchangeFieldsLength {
+		return f, fmt.Errorf("peer did not enable the key exchange")
+	}
+
+	// Static Public Key | Ephemeral Public Key
+	fields := payload[handshakePayloadLength:]
+	f.tagPos = handshakePayloadLength + keyExchangeFieldsLength
+	f.staticKey, err = ecdh.X25519().NewPublicKey(fields[:keyExchangePublicKeyLength])
+	if err != nil {
+		return f, fmt.Errorf("invalid peer public key: %v", err)
+	} else if !kx.isPinned(f.staticKey) {
+		return f, ErrPeerKeyRejected
+	}
+	f.ephemeralKey, err = ecdh.X25519().NewPublicKey(fields[keyExchangePublicKeyLength:keyExchangeFieldsLength])
+	if err != nil {
+		return f, fmt.Errorf("invalid peer ephemeral key: %v", err)
+	}
+	f.nonce = f.ephemeralKey.Bytes()
+	info.PublicKey = f.staticKey
+
+	return f, nil
+}
+
+// newSessionCipher returns the cipher of the session. The key exchange
+// derives a new session key, otherwise the configured cipher is used.
+func (p *Port) newSessionCipher(transcript []byte, ephemeral *ecdh.PrivateKey, f sessionFields, initiator bool) (Cipher, error) {
+	if p.config.KeyExchange == nil {
+		return p.config.Cipher, nil
+	}
+	return p.config.KeyExchange.deriveSessionCipher(transcript, ephemeral, f, initiator)
+}
+
+// handleReceivedSessionHandshake handles the authenticated handshakes of
+// the session. Unauthenticated handshakes never change the session.
+// This method must be only called by the read messages loop.
+func (p *Port) handleReceivedSessionHandshake(payload []byte, info *PeerInfo) (err error) {
+	// Report the rejected handshakes.
+	defer func() {
+		if err != nil {
+			p.emitEvent(EventAuthenticationFailed, "handshake rejected: %v", err)
+			err = fmt.Errorf("handshake: %v", err)
+		}
+	}()
+
+	f, err := p.parseSessionFields(payload, info)
+	if err != nil {
+		return err
+	}
+
+	if payload[0] == handshakeRequest {
+		return p.replySessionHandshake(payload[:f.tagPos], f, info)
+	}
+	return p.completeSessionHandshake(payload, f, info)
+}
+
+// replySessionHandshake replies to the handshake request of the peer with
+// a new nonce. The reply is authenticated with the key of this node.
+// The current session is kept, until the peer confirmed the new session
+// with the proof of its key.
+// This method must be only called by the read messages loop.
+func (p *Port) replySessionHandshake(request []byte, f sessionFields, info *PeerInfo) error {
+	// Resend the reply of a retransmitted request. A new reply
+	// would not match the confirmation of the first reply.
+	if p.sessionResponder != nil && bytes.Equal(p.sessionResponder.request, request) {
+		p.writeControlMessage(enq, umsn, p.sessionResponder.reply...)
+		return nil
+	}
+
+	// Both peers sent a handshake request at the same time. The handshake
+	// of the request with the higher nonce is completed. The peer replies
+	// to the own request.
+	p.stateMutex.Lock()
+	initiator := p.sessionInitiator
+	p.stateMutex.Unlock()
+	if initiator != nil && bytes.Compare(initiator.nonce, f.nonce) > 0 {
+		return nil
+	}
+
+	reply, ephemeral, _, err := p.newSessionPayload(handshakeReply)
+	if err != nil {
+		return err
+	}
+
+	transcript := handshakeTranscript(request, reply)
+	c, err := p.newSessionCipher(transcript, ephemeral, f, false)
+	if err != nil {
+		return err
+	}
+
+	tag, err := c.Seal(nil, append([]byte("reply"), transcript...))
+	if err != nil {
+		return err
+	}
+	reply = append(reply, tag...)
+
+	p.sessionResponder = &sessionResponder{
+		request: append([]byte(nil), request...),
+		reply:   reply,
+		session: &session{cipher: c, id: transcript},
+		info:    info,
+	}
+	p.writeControlMessage(enq, umsn, reply...)
+
+	return nil
+}
+
+// completeSessionHandshake authenticates the handshake reply of the peer,
+// activates the new session and confirms it to the peer.
+// This method must be only called by the read messages loop.
+func (p *Port) completeSessionHandshake(reply []byte, f sessionFields, info *PeerInfo) error {
+	// Ignore late replies of completed handshakes.
+	p.stateMutex.Lock()
+	initiator := p.sessionInitiator
+	p.stateMutex.Unlock()
+	if initiator == nil {
+		return nil
+	}
+
+	transcript := handshakeTranscript(initiator.request, reply[:f.tagPos])
+	c, err := p.newSessionCipher(transcript, initiator.ephemeral, f, true)
+	if err != nil {
+		return err
+	} else if _, err = c.Open(reply[f.tagPos:], append([]byte("reply"), transcript...)); err != nil {
+		return errHandshakeNotAuthenticated
+	}
+
+	tag, err := c.Seal(nil, append([]byte("confirm"), transcript...))
+	if err != nil {
+		return err
+	}
+	p.writeControlMessage(enq, umsn, append([]byte{handshakeConfirm}, tag...)...)
+
+	p.activateSession(&session{cipher: c, id: transcript}, info)
+	return nil
+}
+
+// handleReceivedHandshakeConfirm activates the pending session,
+// once the peer confirmed it.
+// This method must be only called by the read messages loop.
+func (p *Port) handleReceivedHandshakeConfirm(tag []byte) error {
+	pending := p.sessionResponder
+	if pending == nil {
+		return nil
+	}
+
+	if _, err := pending.session.cipher.Open(tag, append([]byte("confirm"), pending.session.id...)); err != nil {
+		p.emitEvent(EventAuthenticationFailed, "handshake rejected: %v", errHandshakeNotAuthenticated)
+		return fmt.Errorf("handshake: %v", errHandshakeNotAuthenticated)
+	}
+
+	// The peer starts a new session with a new message sequence.
+	// Its partially received binary data is stale.
+	p.resetReadSequence()
+	p.resetBinaryDataBuffer()
+	p.activatePendingSession()
+
+	return nil
+}
+
+// openPendingSession opens a data chunk, which could not be opened with
+// the current session, with the pending session. The confirmation of the
+// peer got lost, if it succeeds. The data chunk proves the session, so
+// the session is activated.
+// This method must be only called by the read messages loop.
+func (p *Port) openPendingSession(open func(s *session) ([]byte, error)) ([]byte, bool) {
+	if p.sessionResponder == nil {
+		return nil, false
+	}
+
+	data, err := open(p.sessionResponder.session)
+	if err != nil {
+		return nil, false
+	}
+
+	p.log.Debugf("handshake: confirmation lost: activating the session of the received data chunk")
+	p.activatePendingSession()
+	return data, true
+}
+
+// activatePendingSession activates the pending session of the received handshake.
+// This method must be only called by the read messages loop.
+func (p *Port) activatePendingSession() {
+	pending := p.sessionResponder
+	p.sessionResponder = nil
+	p.activateSession(pending.session, pending.info)
+}
+
+// activateSession sets the session and the parameters of the peer.
+// The pending handshake of the write loop is completed.
+func (p *Port) activateSession(s *session, info *PeerInfo) {
+	p.setPeerInfo(info)
+
+	p.stateMutex.Lock()
+	p.session = s
+	p.sessionInitiator = nil
+	p.stateMutex.Unlock()
+
+	// Never block the read routine. Nobody is waiting for a late handshake.
+	select {
+	case p.handshakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// currentSession returns the session of the data chunks.
+// Nil is returned if the encryption is disabled.
+func (p *Port) currentSession() (*session, error) {
+	// Lock the mutex.
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	if p.session == nil && p.config.hasSessionHandshake() {
+		return nil, ErrNoSessionKey
+	}
+	return p.session, nil
+}
+
+// handshakeTranscript returns the hash of the handshake request and
+// the handshake reply without its authentication tag.
+func handshakeTranscript(request, reply []byte) []byte {
+	h := sha256.New()
+	h.Write(request)
+	h.Write(reply)
+	return h.Sum(nil)
+}
@@ -0,0 +1,219 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package sim provides a deterministic simulation of the link between two
+// ANTS ports. The protocol timeouts of the ports are driven by a virtual
+// Clock, which is advanced by the test. The acknowledgement timeouts,
+// retransmissions and read message timeouts are tested without sleeping.
+//
+// Pass the clock with ants.Config.Clock to both ports and connect them with
+// NewPipePair. Wait with Clock.BlockUntil until a port started its timer,
+// before the clock is advanced.
+package sim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//##################//
+//### Clock type ###//
+//##################//
+
+// A Clock is a virtual clock, which implements the ants.Clock interface.
+// Its time only moves forward with Advance. This implementation is thread-safe.
+type Clock struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*timer // Active timers in the order they were started.
+}
+
+// NewClock creates a new virtual clock, which starts at the time.
+func NewClock(start time.Time) *Clock {
+	c := &Clock{
+		now: start,
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// Now returns the current virtual time.
+func (c *Clock) Now() time.Time {
+	// Lock the mutex.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// NewTimer creates a timer, which sends the virtual time on its channel
+// as soon as the clock was advanced by the duration.
+func (c *Clock) NewTimer(d time.Duration) ants.Timer {
+	t := &timer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// AfterFunc creates a timer, which calls f in its own goroutine
+// as soon as the clock was advanced by the duration.
+func (c *Clock) AfterFunc(d time.Duration, f func()) ants.Timer {
+	t := &timer{
+		clock: c,
+		f:     f,
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by the duration. The expired timers fire
+// in the order of their expiration. Timers with the same expiration fire
+// in the order they were started. The time of the clock is set to the
+// expiration time of each timer before it fires.
+func (c *Clock) Advance(d time.Duration) {
+	// Lock the mutex.
+	c.mutex.Lock()
+	target := c.now.Add(d)
+
+	for {
+		// Find the next expired timer.
+		var next *timer
+		for _, t := range c.timers {
+			if !t.at.After(target) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		c.now = next.at
+		c.remove(next)
+		next.fire(c.now)
+	}
+
+	c.now = target
+	c.mutex.Unlock()
+}
+
+// Timers returns the number of active timers.
+func (c *Clock) Timers() int {
+	// Lock the mutex.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.timers)
+}
+
+// BlockUntil blocks until at least n timers are active. Use it to wait
+// until the ports started their timeouts, before the clock is advanced.
+// The pending deliveries of the pipe pairs with a latency count as well.
+func (c *Clock) BlockUntil(n int) {
+	// Lock the mutex.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// remove removes the timer from the active timers.
+// The clock mutex must be locked.
+func (c *Clock) remove(t *timer) bool {
+	for i, o := range c.timers {
+		if o == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+//##################//
+//### Timer type ###//
+//##################//
+
+type timer struct {
+	clock *Clock
+	at    time.Time
+	c     chan time.Time
+	f     func()
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() bool {
+	c := t.clock
+
+	// Lock the mutex.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.remove(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	c := t.clock
+
+	// Lock the mutex.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	active := c.remove(t)
+
+	// Fire right away like the timers of the time package.
+	if d <= 0 {
+		t.fire(c.now)
+		return active
+	}
+
+	t.at = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+
+	return active
+}
+
+// fire delivers the time or calls the function.
+// The clock mutex must be locked.
+func (t *timer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+
+	// Drop the time if the previous one was not received yet.
+	select {
+	case t.c <- now:
+	default:
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sim
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+//###################//
+//### Config type ###//
+//###################//
+
+// Config defines the simulated link of a pipe pair.
+// Both directions share the same settings.
+type Config struct {
+	// Latency delays the delivery of each written data chunk
+	// until the clock was advanced by this duration.
+	Latency time.Duration
+
+	// Drop is called with each data chunk written to an end. The data chunk
+	// is lost, if true is returned. The ports write each frame with a single
+	// write, so lost frames are simulated deterministically.
+	// The function must not retain the data.
+	Drop func(data []byte) bool
+}
+
+//#################//
+//### Pipe Pair ###//
+//#################//
+
+// NewPipePair creates two connected in-memory sources for ants.NewPort,
+// whose latency is driven by the virtual clock. Data written to one end is
+// read from the other end. Optionally pass a config to simulate latency and
+// lost data chunks. Closing an end returns io.EOF on the reads of the other end.
+func NewPipePair(c *Clock, config ...*Config) (io.ReadWriteCloser, io.ReadWriteCloser) {
+	// Get the config.
+	var conf Config
+	if len(config) > 0 && config[0] != nil {
+		conf = *config[0]
+	}
+
+	// Each direction has its own link.
+	ab := newLink(c, &conf)
+	ba := newLink(c, &conf)
+
+	return &end{read: ba, write: ab}, &end{read: ab, write: ba}
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+type segment struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// A link transmits the bytes in one direction.
+type link struct {
+	clock  *Clock
+	config *Config
+
+	mutex        sync.Mutex
+	cond         *sync.Cond
+	buffer       []byte    // Delivered bytes.
+	pending      []segment // Bytes on the way in the order they were written.
+	readerClosed bool
+	writerClosed bool
+}
+
+func newLink(c *Clock, conf *Config) *link {
+	l := &link{
+		clock:  c,
+		config: conf,
+	}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+func (l *link) Read(p []byte) (int, error) {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for {
+		if l.readerClosed {
+			return 0, io.ErrClosedPipe
+		}
+
+		// Move the arrived bytes to the buffer.
+		now := l.clock.Now()
+		for len(l.pending) > 0 && !l.pending[0].deliverAt.After(now) {
+			l.buffer = append(l.buffer, l.pending[0].data...)
+			l.pending = l.pending[1:]
+		}
+
+		if len(l.buffer) > 0 {
+			n := copy(p, l.buffer)
+			l.buffer = l.buffer[n:]
+			return n, nil
+		}
+
+		if len(l.pending) == 0 && l.writerClosed {
+			return 0, io.EOF
+		}
+
+		l.cond.Wait()
+	}
+}
+
+func (l *link) Write(p []byte) (int, error) {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writerClosed || l.readerClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if l.config.Drop != nil && l.config.Drop(p) {
+		return len(p), nil
+	}
+
+	// Copy the data, because the caller might reuse the slice.
+	l.pending = append(l.pending, segment{
+		data:      append([]byte(nil), p...),
+		deliverAt: l.clock.Now().Add(l.config.Latency),
+	})
+
+	// Wake up the reader as soon as the bytes arrive.
+	// Broadcast with the mutex held to not miss the wait.
+	if l.config.Latency > 0 {
+		l.clock.AfterFunc(l.config.Latency, func() {
+			l.mutex.Lock()
+			l.cond.Broadcast()
+			l.mutex.Unlock()
+		})
+	}
+	l.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (l *link) closeReader() {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.readerClosed = true
+	l.cond.Broadcast()
+}
+
+func (l *link) closeWriter() {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.writerClosed = true
+	l.cond.Broadcast()
+}
+
+// An end is one side of a pipe pair.
+type end struct {
+	read      *link
+	write     *link
+	closeOnce sync.Once
+}
+
+func (e *end) Read(p []byte) (int, error) {
+	return e.read.Read(p)
+}
+
+func (e *end) Write(p []byte) (int, error) {
+	return e.write.Write(p)
+}
+
+func (e *end) Close() error {
+	e.closeOnce.Do(func() {
+		e.read.closeReader()
+		e.write.closeWriter()
+	})
+	return nil
+}
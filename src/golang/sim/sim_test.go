@@ -0,0 +1,145 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// warnings records the warning log messages.
+type warnings struct {
+	ants.NopLogger
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (w *warnings) Warningf(format string, args ...interface{}) {
+	w.mutex.Lock()
+	w.messages = append(w.messages, fmt.Sprintf(format, args...))
+	w.mutex.Unlock()
+}
+
+func (w *warnings) contains(msg string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, m := range w.messages {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClock(t *testing.T) {
+	c := NewClock(epoch)
+	require.Equal(t, epoch, c.Now())
+
+	t1 := c.NewTimer(2 * time.Second)
+	t2 := c.NewTimer(time.Second)
+	called := make(chan struct{})
+	c.AfterFunc(3*time.Second, func() { close(called) })
+	require.Equal(t, 3, c.Timers())
+
+	c.Advance(time.Second)
+	require.Equal(t, epoch.Add(time.Second), <-t2.C())
+	require.Empty(t, t1.C())
+	require.Equal(t, 2, c.Timers())
+
+	// A stopped timer never fires.
+	require.True(t, t1.Stop())
+	require.False(t, t1.Stop())
+
+	c.Advance(5 * time.Second)
+	require.Equal(t, epoch.Add(6*time.Second), c.Now())
+	<-called
+	require.Empty(t, t1.C())
+	require.Zero(t, c.Timers())
+
+	// A reset timer expires relative to the current time.
+	require.False(t, t1.Reset(time.Second))
+	c.Advance(time.Second)
+	require.Equal(t, epoch.Add(7*time.Second), <-t1.C())
+}
+
+func TestAckTimeout(t *testing.T) {
+	c := NewClock(epoch)
+
+	// Lose the first transmission of the data message.
+	var dropped bool
+	a, b := NewPipePair(c, &Config{
+		Drop: func(data []byte) bool {
+			if !dropped && bytes.Contains(data, []byte("ants")) {
+				dropped = true
+				return true
+			}
+			return false
+		},
+	})
+
+	pa := ants.NewPort(a, &ants.Config{Clock: c, AckTimeout: time.Minute})
+	defer pa.Close()
+	pb := ants.NewPort(b, &ants.Config{Clock: c})
+	defer pb.Close()
+
+	require.NoError(t, pa.Write([]byte("ants")))
+
+	// Nothing arrives before the acknowledgement timeout.
+	c.BlockUntil(1)
+	_, err := pb.Read(10 * time.Millisecond)
+	require.Equal(t, ants.ErrTimeout, err)
+
+	// The data message is retransmitted after the timeout.
+	c.Advance(time.Minute)
+	data, err := pb.Read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ants"), data)
+	require.Eventually(t, func() bool { return pa.Stats().Snapshot().Retransmissions == 1 }, time.Second, time.Millisecond)
+}
+
+func TestReadMessageTimeout(t *testing.T) {
+	c := NewClock(epoch)
+	a, b := NewPipePair(c, &Config{Latency: time.Second})
+
+	w := &warnings{}
+	pb := ants.NewPort(b, &ants.Config{Clock: c, Logger: w, ReadMessageTimeout: 10 * time.Second})
+	defer pb.Close()
+
+	// An interrupted data message arrives after the latency.
+	_, err := a.Write([]byte{0x10, 0x02, 0x01, 'a', 'n'})
+	require.NoError(t, err)
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+
+	// The partial message is discarded after the read message timeout.
+	c.BlockUntil(1)
+	c.Advance(10 * time.Second)
+	require.Eventually(t, func() bool {
+		return w.contains("read data: read message timeout reached: discarding data")
+	}, time.Second, time.Millisecond)
+}
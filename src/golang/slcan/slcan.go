@@ -0,0 +1,256 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package slcan provides an io.ReadWriteCloser interface, which tunnels
+// the ANTS byte stream over CAN with an SLCAN (serial line CAN) adapter.
+// The byte stream is segmented into CAN frames of up to 8 bytes and
+// reassembled in order on the receiving side. The ANTS framing and
+// checksums take care of the message boundaries and corruptions.
+package slcan
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxDataLength = 8
+	maxLineLength = 64
+	readSize      = 256
+)
+
+var (
+	// ErrInvalidBitrate is returned if the bitrate is not supported by SLCAN.
+	ErrInvalidBitrate = errors.New("invalid CAN bitrate")
+
+	bitrates = map[int]byte{
+		10000:   '0',
+		20000:   '1',
+		50000:   '2',
+		100000:  '3',
+		125000:  '4',
+		250000:  '5',
+		500000:  '6',
+		800000:  '7',
+		1000000: '8',
+	}
+)
+
+//###################//
+//### Config type ###//
+//###################//
+
+// A Config represents the SLCAN adapter configuration.
+type Config struct {
+	// Bitrate of the CAN bus in bits per second.
+	// Supported are the SLCAN bitrates from 10 kbit/s to 1 Mbit/s.
+	// The default value is 500 kbit/s.
+	Bitrate int
+
+	// TxID is the CAN identifier of the transmitted frames.
+	TxID uint32
+
+	// RxID is the CAN identifier of the received frames.
+	// Frames with other identifiers are ignored.
+	RxID uint32
+
+	// Extended enables the 29-bit extended CAN identifiers.
+	Extended bool
+}
+
+//################//
+//### CAN type ###//
+//################//
+
+type can struct {
+	rw     io.ReadWriteCloser
+	config Config
+
+	readMutex sync.Mutex
+	data      []byte // Reassembled payload bytes.
+	line      []byte // Received bytes of the incomplete line.
+
+	writeMutex sync.Mutex
+}
+
+// Open configures and opens the CAN channel of the SLCAN adapter,
+// which is connected with the io.ReadWriteCloser (usually a serial port).
+func Open(rw io.ReadWriteCloser, config Config) (io.ReadWriteCloser, error) {
+	if config.Bitrate == 0 {
+		config.Bitrate = 500000
+	}
+
+	b, ok := bitrates[config.Bitrate]
+	if !ok {
+		return nil, ErrInvalidBitrate
+	}
+
+	c := &can{
+		rw:     rw,
+		config: config,
+	}
+
+	// Close a possibly open channel, set the bitrate and open the channel.
+	for _, cmd := range []string{"C\r", "S" + string(b) + "\r", "O\r"} {
+		if _, err := rw.Write([]byte(cmd)); err != nil {
+			return nil, fmt.Errorf("failed to configure SLCAN adapter: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+// Read reads the reassembled payload bytes of the received CAN frames.
+// It returns zero bytes if the underlying reader did not receive
+// a complete CAN frame.
+func (c *can) Read(p []byte) (int, error) {
+	// Lock the mutex.
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if len(c.data) == 0 {
+		buf := make([]byte, readSize)
+		n, err := c.rw.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		c.parse(buf[:n])
+	}
+
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+
+	return n, nil
+}
+
+// Write segments the bytes into CAN frames and transmits them.
+func (c *can) Write(p []byte) (int, error) {
+	// Lock the mutex.
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxDataLength {
+			n = maxDataLength
+		}
+
+		if _, err := c.rw.Write(c.encodeFrame(p[:n])); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close the CAN channel and the underlying io.ReadWriteCloser.
+func (c *can) Close() error {
+	// Lock the mutex.
+	c.writeMutex.Lock()
+	c.rw.Write([]byte("C\r"))
+	c.writeMutex.Unlock()
+
+	return c.rw.Close()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// encodeFrame encodes a transmit command: t|T | ID | Length | Data | CR
+func (c *can) encodeFrame(data []byte) []byte {
+	var b bytes.Buffer
+
+	if c.config.Extended {
+		fmt.Fprintf(&b, "T%08X", c.config.TxID&0x1FFFFFFF)
+	} else {
+		fmt.Fprintf(&b, "t%03X", c.config.TxID&0x7FF)
+	}
+
+	fmt.Fprintf(&b, "%d%X\r", len(data), data)
+	return b.Bytes()
+}
+
+// parse splits the received bytes into lines and
+// appends the payload of the matching CAN frames.
+func (c *can) parse(buf []byte) {
+	for _, b := range buf {
+		// Lines are terminated by a carriage return. Errors are signaled with a bell.
+		if b != '\r' && b != '\a' {
+			if len(c.line) < maxLineLength {
+				c.line = append(c.line, b)
+			}
+			continue
+		}
+
+		c.parseLine(c.line)
+		c.line = c.line[:0]
+	}
+}
+
+// parseLine appends the payload of a received CAN frame.
+// Other lines, like command responses, are ignored.
+func (c *can) parseLine(line []byte) {
+	// Obtain the identifier length.
+	var idLen int
+	switch {
+	case len(line) > 0 && line[0] == 't' && !c.config.Extended:
+		idLen = 3
+	case len(line) > 0 && line[0] == 'T' && c.config.Extended:
+		idLen = 8
+	default:
+		return
+	}
+
+	if len(line) < 2+idLen {
+		return
+	}
+
+	id, err := strconv.ParseUint(string(line[1:1+idLen]), 16, 32)
+	if err != nil || uint32(id) != c.config.RxID {
+		return
+	}
+
+	l := int(line[1+idLen] - '0')
+	if l < 0 || l > maxDataLength {
+		return
+	}
+
+	// A timestamp might follow the data.
+	hexData := line[2+idLen:]
+	if len(hexData) < 2*l {
+		return
+	}
+
+	data := make([]byte, l)
+	if _, err = hex.Decode(data, hexData[:2*l]); err != nil {
+		return
+	}
+
+	c.data = append(c.data, data...)
+}
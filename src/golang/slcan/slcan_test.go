@@ -0,0 +1,61 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package slcan
+
+import (
+	"testing"
+
+	"github.com/desertbit/ants/src/golang/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLCAN(t *testing.T) {
+	l := loopback.New()
+
+	// Transmitted frames are received again with the loopback.
+	c, err := Open(l, Config{TxID: 0x123, RxID: 0x123})
+	require.NoError(t, err)
+	defer c.Close()
+
+	data := []byte("Hello CAN World\n")
+	n, err := c.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	// Frames of other identifiers are ignored.
+	l.Write([]byte("t4561FF\r\a"))
+
+	var received []byte
+	buf := make([]byte, 5)
+	for len(received) < len(data) {
+		n, err = c.Read(buf)
+		require.NoError(t, err)
+		require.NotZero(t, n)
+		received = append(received, buf[:n]...)
+	}
+	require.Equal(t, data, received)
+
+	_, err = Open(l, Config{Bitrate: 42})
+	require.Equal(t, ErrInvalidBitrate, err)
+}
+
+func TestEncodeFrame(t *testing.T) {
+	c := &can{config: Config{TxID: 0x1ABCDEF, Extended: true}}
+	require.Equal(t, "T01ABCDEF201FF\r", string(c.encodeFrame([]byte{0x01, 0xFF})))
+}
@@ -0,0 +1,172 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"sync"
+	"time"
+)
+
+//##################//
+//### Stats type ###//
+//##################//
+
+// Stats holds the traffic counters of a port.
+// Obtain it with Port.Stats(). It is safe for concurrent use.
+type Stats struct {
+	mutex    sync.Mutex
+	counters StatsSnapshot
+}
+
+// A StatsSnapshot is a copy of the traffic counters at a point in time.
+type StatsSnapshot struct {
+	// Time when the snapshot was taken.
+	Time time.Time
+
+	// Duration is the period covered by the counters. For a snapshot
+	// this is the time since the port was created or the counters were reset.
+	// For a delta this is the time between both snapshots.
+	Duration time.Duration
+
+	// BytesSent and BytesReceived count the raw bytes
+	// written to and read from the source.
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// DataMessagesSent counts all data message transmissions
+	// including the retransmissions.
+	DataMessagesSent uint64
+
+	// DataMessagesReceived counts the received data messages with a valid checksum.
+	DataMessagesReceived uint64
+
+	// Retransmissions counts the retransmitted data messages.
+	Retransmissions uint64
+
+	// TransmissionsFailed counts the data messages given up by the ARQ strategy.
+	TransmissionsFailed uint64
+
+	// ChecksumErrors counts the received messages with an invalid checksum.
+	ChecksumErrors uint64
+
+	// NaksReceived counts the received negative acknowledges. The peer
+	// reported a corrupted data message with NakCRCErrors, an overflowed
+	// reassembly buffer with NakBufferOverflows, an unsupported message
+	// format with NakUnsupportedVersions, an overload with NakBusy and
+	// an undecodable delta encoded data chunk with NakDeltaMismatches.
+	NaksReceived           uint64
+	NakCRCErrors           uint64
+	NakBufferOverflows     uint64
+	NakUnsupportedVersions uint64
+	NakBusy                uint64
+	NakDeltaMismatches     uint64
+
+	// FECCorrections counts the received bytes, which were corrected by the
+	// forward error correction. FECFailures counts the received blocks with
+	// too many corrupted bytes to be corrected.
+	FECCorrections uint64
+	FECFailures    uint64
+
+	// ParityErrors, FramingErrors and OverrunErrors count the hardware
+	// line errors, if the source implements the LineErrorSource interface.
+	ParityErrors  uint64
+	FramingErrors uint64
+	OverrunErrors uint64
+
+	start time.Time // Start of the counting period.
+}
+
+// Snapshot returns a copy of the current counters.
+func (s *Stats) Snapshot() StatsSnapshot {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.counters
+	c.Time = time.Now()
+	c.Duration = c.Time.Sub(c.start)
+
+	return c
+}
+
+// Reset sets all counters to zero and starts a new counting period.
+func (s *Stats) Reset() {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.counters = StatsSnapshot{
+		start: time.Now(),
+	}
+}
+
+// Delta returns the counter differences between the snapshot and an earlier
+// snapshot. Use it to compute rates over custom intervals. If the counters
+// were reset in between, then the counters since the reset are returned.
+func (s StatsSnapshot) Delta(since StatsSnapshot) StatsSnapshot {
+	if s.start != since.start {
+		return s
+	}
+
+	return StatsSnapshot{
+		Time:                   s.Time,
+		Duration:               s.Time.Sub(since.Time),
+		BytesSent:              s.BytesSent - since.BytesSent,
+		BytesReceived:          s.BytesReceived - since.BytesReceived,
+		DataMessagesSent:       s.DataMessagesSent - since.DataMessagesSent,
+		DataMessagesReceived:   s.DataMessagesReceived - since.DataMessagesReceived,
+		Retransmissions:        s.Retransmissions - since.Retransmissions,
+		TransmissionsFailed:    s.TransmissionsFailed - since.TransmissionsFailed,
+		ChecksumErrors:         s.ChecksumErrors - since.ChecksumErrors,
+		NaksReceived:           s.NaksReceived - since.NaksReceived,
+		NakCRCErrors:           s.NakCRCErrors - since.NakCRCErrors,
+		NakBufferOverflows:     s.NakBufferOverflows - since.NakBufferOverflows,
+		NakUnsupportedVersions: s.NakUnsupportedVersions - since.NakUnsupportedVersions,
+		NakBusy:                s.NakBusy - since.NakBusy,
+		NakDeltaMismatches:     s.NakDeltaMismatches - since.NakDeltaMismatches,
+		FECCorrections:         s.FECCorrections - since.FECCorrections,
+		FECFailures:            s.FECFailures - since.FECFailures,
+		ParityErrors:           s.ParityErrors - since.ParityErrors,
+		FramingErrors:          s.FramingErrors - since.FramingErrors,
+		OverrunErrors:          s.OverrunErrors - since.OverrunErrors,
+		start:                  s.start,
+	}
+}
+
+//############//
+//### Port ###//
+//############//
+
+// Stats returns the traffic counters of the port.
+func (p *Port) Stats() *Stats {
+	return &p.stats
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// update modifies the counters with the passed function.
+func (s *Stats) update(f func(c *StatsSnapshot)) {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f(&s.counters)
+}
@@ -0,0 +1,172 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"io"
+	"sync"
+)
+
+//##############//
+//### Stream ###//
+//##############//
+
+// ReadFrom reads from r until io.EOF and writes the data as data chunks
+// of the maximum message size to the port. This avoids the generic
+// 32 KB copy buffers of io.Copy. The number of written bytes is returned.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, p.config.MaxMessageSize)
+
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			// The write queue takes over the data chunk.
+			chunk := make([]byte, nr)
+			copy(chunk, buf[:nr])
+
+			if err = p.Write(chunk); err != nil {
+				return n, err
+			}
+			n += int64(nr)
+		}
+
+		if rerr == io.EOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// WriteTo writes the received data chunks to w until the port is closed.
+// The data chunks are passed to w without intermediate copies.
+// The number of written bytes is returned.
+func (p *Port) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		m, err := p.ReadMessage()
+		if err == ErrClosed {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		nw, err := w.Write(m.Data)
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		} else if nw != len(m.Data) {
+			return n, io.ErrShortWrite
+		}
+	}
+}
+
+// Stream returns an io.ReadWriteCloser, which exposes the received data
+// chunks as a continuous byte stream. Bytes of a data chunk, which did not
+// fit into the buffer passed to Read, are returned by the next Read call.
+// Each Write transmits one data chunk. Reads return io.EOF once the port
+// is closed. Closing the stream closes the port.
+// Don't mix the stream with direct reads from the port.
+func (p *Port) Stream() io.ReadWriteCloser {
+	return &stream{port: p}
+}
+
+//###################//
+//### Stream type ###//
+//###################//
+
+type stream struct {
+	port *Port
+
+	mutex    sync.Mutex
+	leftover []byte // Unread bytes of the last data chunk.
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// Wait for the next data chunk if everything was read.
+	for len(s.leftover) == 0 {
+		data, err := s.port.Read()
+		if err == ErrClosed {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		s.leftover = data
+	}
+
+	n := copy(b, s.leftover)
+	s.leftover = s.leftover[n:]
+
+	return n, nil
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// The caller might reuse the buffer. The write queue takes over the copy.
+	chunk := make([]byte, len(b))
+	copy(chunk, b)
+
+	if err := s.port.Write(chunk); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (s *stream) Close() error {
+	return s.port.Close()
+}
+
+// ReadFrom lets io.Copy use the chunked transmission of the port.
+func (s *stream) ReadFrom(r io.Reader) (int64, error) {
+	return s.port.ReadFrom(r)
+}
+
+// WriteTo lets io.Copy pass the data chunks without intermediate copies.
+// Buffered bytes of a previous Read are written first.
+func (s *stream) WriteTo(w io.Writer) (n int64, err error) {
+	// Lock the mutex.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.leftover) > 0 {
+		nw, err := w.Write(s.leftover)
+		n += int64(nw)
+		s.leftover = s.leftover[nw:]
+		if err != nil {
+			return n, err
+		} else if len(s.leftover) > 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+
+	nc, err := s.port.WriteTo(w)
+	return n + nc, err
+}
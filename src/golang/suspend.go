@@ -0,0 +1,125 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"fmt"
+	"io"
+)
+
+// IsSuspended returns true if the port is suspended, because its source
+// failed and Config.SuspendOnError is set. Pass a replacement source to Resume.
+func (p *Port) IsSuspended() bool {
+	// Lock the mutex.
+	p.sourceMutex.Lock()
+	defer p.sourceMutex.Unlock()
+
+	return p.suspended
+}
+
+// Resume continues the suspended port with the new source, for example
+// the reopened serial device. The failed source is closed. The message
+// sequence, the unacknowledged data messages and a partially received
+// transmission are continued, so the peer does not notice the interruption
+// as long as its retries are not exhausted. The port takes the ownership
+// of the new source, unless an error is returned.
+// ErrNotSuspended is returned if the port is not suspended.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) Resume(source io.ReadWriteCloser) error {
+	if source == nil {
+		return fmt.Errorf("failed to resume port: nil source passed")
+	}
+
+	// Lock the close mutex to prevent a concurrent close,
+	// which would leak the new source.
+	p.closeMutex.Lock()
+	if p.isClosed {
+		p.closeMutex.Unlock()
+		return ErrClosed
+	}
+
+	p.sourceMutex.Lock()
+	if !p.suspended {
+		p.sourceMutex.Unlock()
+		p.closeMutex.Unlock()
+		return ErrNotSuspended
+	}
+
+	// Replace the source and wake up the suspended routines.
+	old := p.source
+	p.source = source
+	p.suspended = false
+	close(p.resumeChan)
+	p.resumeChan = make(chan struct{})
+	p.sourceMutex.Unlock()
+	p.closeMutex.Unlock()
+
+	// Dismiss the error. The source failed anyway.
+	_ = old.Close()
+
+	p.log.Debugf("port resumed with a new source")
+	p.emitEvent(EventResumed, "port resumed with a new source")
+
+	return nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// suspend suspends the port because of the error of the source, if enabled,
+// and waits until the port is resumed. Returns true if the port was resumed
+// with a new source. Returns false if the suspension is disabled or if the
+// port was closed. The failed source is compared with the current source,
+// so a late failure of an already replaced source is retried immediately.
+func (p *Port) suspend(source io.ReadWriteCloser, cause error) bool {
+	if !p.config.SuspendOnError || p.IsClosed() {
+		return false
+	}
+
+	// Lock the mutex.
+	p.sourceMutex.Lock()
+	replaced := p.source != source
+	first := !replaced && !p.suspended
+	if first {
+		p.suspended = true
+	}
+	resumeChan := p.resumeChan
+	p.sourceMutex.Unlock()
+
+	if replaced {
+		return true
+	}
+
+	// Only report the first detection. Both loop routines might detect it.
+	if first {
+		p.log.Warningf("source failed: port suspended: %v", cause)
+		p.emitEvent(EventSuspended, "source failed: port suspended: %v", cause)
+		if p.config.OnSuspend != nil {
+			p.config.OnSuspend(cause)
+		}
+	}
+
+	select {
+	case <-p.closeChan:
+		return false
+	case <-resumeChan:
+		return true
+	}
+}
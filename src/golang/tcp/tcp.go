@@ -0,0 +1,113 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package tcp provides socket sources for ANTS ports, so the ANTS framing
+// can run over TCP or Unix domain sockets, for example to reach serial
+// device servers like ser2net or a Moxa NPort.
+package tcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+var (
+	// ErrUnsupportedNetwork is returned if the network is not a TCP or Unix socket network.
+	ErrUnsupportedNetwork = errors.New("unsupported network")
+)
+
+//############//
+//### Dial ###//
+//############//
+
+// Dial connects to the address on the named network and returns
+// the connection as a source for ants.NewPort.
+// Supported networks are "tcp", "tcp4", "tcp6" and "unix".
+func Dial(ctx context.Context, network, address string) (io.ReadWriteCloser, error) {
+	if !isSupportedNetwork(network) {
+		return nil, ErrUnsupportedNetwork
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// Transport returns a transport for ants.DialPort, which dials the address
+// on the named network. The port redials the transport if the EOF
+// behavior is ants.EOFReconnect.
+func Transport(network, address string) ants.Transport {
+	return ants.TransportFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return Dial(ctx, network, address)
+	})
+}
+
+//#####################//
+//### Listener type ###//
+//#####################//
+
+// A Listener accepts socket connections as sources for ants.NewPort.
+type Listener struct {
+	ln net.Listener
+}
+
+// Listen announces on the local address of the named network.
+// Supported networks are "tcp", "tcp4", "tcp6" and "unix".
+func Listen(network, address string) (*Listener, error) {
+	if !isSupportedNetwork(network) {
+		return nil, ErrUnsupportedNetwork
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{ln: ln}, nil
+}
+
+// Accept waits for the next connection and returns it as a source.
+func (l *Listener) Accept() (io.ReadWriteCloser, error) {
+	return l.ln.Accept()
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close stops listening. Already accepted connections are not closed.
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+func isSupportedNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	default:
+		return false
+	}
+}
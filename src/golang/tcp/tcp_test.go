@@ -0,0 +1,71 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tcp
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSockets(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		address := "127.0.0.1:0"
+		if network == "unix" {
+			address = filepath.Join(t.TempDir(), "ants.sock")
+		}
+
+		l, err := Listen(network, address)
+		require.NoError(t, err)
+
+		accepted := make(chan *ants.Port, 1)
+		go func() {
+			source, err := l.Accept()
+			if err == nil {
+				accepted <- ants.NewPort(source)
+			}
+		}()
+
+		p, err := ants.DialPort(context.Background(), Transport(network, l.Addr().String()))
+		require.NoError(t, err)
+
+		peer := <-accepted
+		require.NoError(t, p.Write([]byte(network)))
+
+		data, err := peer.Read(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte(network), data)
+
+		p.Close()
+		peer.Close()
+		l.Close()
+	}
+}
+
+func TestUnsupportedNetwork(t *testing.T) {
+	_, err := Dial(context.Background(), "udp", "127.0.0.1:1")
+	require.Equal(t, ErrUnsupportedNetwork, err)
+
+	_, err = Listen("udp", "127.0.0.1:0")
+	require.Equal(t, ErrUnsupportedNetwork, err)
+}
@@ -0,0 +1,253 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package testutil connects two ANTS ports in memory with a simulated link.
+// The link delays, throttles and corrupts the transmitted bytes, so the
+// acknowledgement and retransmission semantics between two peers can be
+// tested without serial hardware.
+package testutil
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//###################//
+//### Config type ###//
+//###################//
+
+// Config defines the simulated link of a pipe pair.
+// Both directions share the same settings.
+type Config struct {
+	// Latency delays the delivery of each written data chunk.
+	Latency time.Duration
+
+	// Bandwidth limits the transmission in bytes per second.
+	// Zero disables the limit.
+	Bandwidth int
+
+	// ErrorRate is the probability between 0 and 1, that a transmitted
+	// byte is corrupted by flipping one of its bits.
+	ErrorRate float64
+
+	// Seed of the pseudo-random error injection. The same seed corrupts
+	// the same bytes. Zero seeds with the current time.
+	Seed int64
+}
+
+//#################//
+//### Pipe Pair ###//
+//#################//
+
+// NewPipePair creates two connected in-memory sources for ants.NewPort.
+// Data written to one end is read from the other end.
+// Optionally pass a config to simulate latency, bandwidth limits and
+// byte errors. Closing an end returns io.EOF on the reads of the other end.
+func NewPipePair(config ...*Config) (io.ReadWriteCloser, io.ReadWriteCloser) {
+	// Get the config.
+	var c Config
+	if len(config) > 0 && config[0] != nil {
+		c = *config[0]
+	}
+
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	// Each direction has its own link.
+	ab := newLink(&c, seed)
+	ba := newLink(&c, seed+1)
+
+	return &end{read: ba, write: ab}, &end{read: ab, write: ba}
+}
+
+//#################//
+//### Port Pair ###//
+//#################//
+
+// NewPortPair creates two ports, which are connected by a pipe pair.
+// Optionally pass a config to simulate the link. The ports are closed
+// when the test and all its subtests completed.
+func NewPortPair(tb testing.TB, config ...*Config) (*ants.Port, *ants.Port) {
+	a, b := NewPipePair(config...)
+	pa, pb := ants.NewPort(a), ants.NewPort(b)
+	tb.Cleanup(func() {
+		pa.Close()
+		pb.Close()
+	})
+	return pa, pb
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+type segment struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// A link transmits the bytes in one direction.
+type link struct {
+	config *Config
+	rand   *rand.Rand
+
+	mutex        sync.Mutex
+	cond         *sync.Cond
+	buffer       []byte    // Delivered bytes.
+	pending      []segment // Bytes on the way, ordered by their delivery time.
+	busyUntil    time.Time // Transmission end of the last written bytes.
+	readerClosed bool
+	writerClosed bool
+}
+
+func newLink(c *Config, seed int64) *link {
+	l := &link{
+		config: c,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+func (l *link) Read(p []byte) (int, error) {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for {
+		if l.readerClosed {
+			return 0, io.ErrClosedPipe
+		}
+
+		// Move the arrived bytes to the buffer.
+		now := time.Now()
+		for len(l.pending) > 0 && !l.pending[0].deliverAt.After(now) {
+			l.buffer = append(l.buffer, l.pending[0].data...)
+			l.pending = l.pending[1:]
+		}
+
+		if len(l.buffer) > 0 {
+			n := copy(p, l.buffer)
+			l.buffer = l.buffer[n:]
+			return n, nil
+		}
+
+		if len(l.pending) == 0 {
+			if l.writerClosed {
+				return 0, io.EOF
+			}
+		} else {
+			// Wake up as soon as the next bytes arrive.
+			// Broadcast with the mutex held to not miss the wait.
+			time.AfterFunc(l.pending[0].deliverAt.Sub(now), func() {
+				l.mutex.Lock()
+				l.cond.Broadcast()
+				l.mutex.Unlock()
+			})
+		}
+
+		l.cond.Wait()
+	}
+}
+
+func (l *link) Write(p []byte) (int, error) {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writerClosed || l.readerClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	// Copy the data, because the caller might reuse the slice.
+	data := append([]byte(nil), p...)
+
+	// Corrupt the bytes randomly.
+	if l.config.ErrorRate > 0 {
+		for i := range data {
+			if l.rand.Float64() < l.config.ErrorRate {
+				data[i] ^= 1 << uint(l.rand.Intn(8))
+			}
+		}
+	}
+
+	// The bytes are transmitted after the previously written bytes.
+	now := time.Now()
+	if l.busyUntil.Before(now) {
+		l.busyUntil = now
+	}
+	if l.config.Bandwidth > 0 {
+		l.busyUntil = l.busyUntil.Add(time.Duration(len(data)) * time.Second / time.Duration(l.config.Bandwidth))
+	}
+
+	l.pending = append(l.pending, segment{
+		data:      data,
+		deliverAt: l.busyUntil.Add(l.config.Latency),
+	})
+	l.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (l *link) closeReader() {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.readerClosed = true
+	l.cond.Broadcast()
+}
+
+func (l *link) closeWriter() {
+	// Lock the mutex.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.writerClosed = true
+	l.cond.Broadcast()
+}
+
+// An end is one side of a pipe pair.
+type end struct {
+	read      *link
+	write     *link
+	closeOnce sync.Once
+}
+
+func (e *end) Read(p []byte) (int, error) {
+	return e.read.Read(p)
+}
+
+func (e *end) Write(p []byte) (int, error) {
+	return e.write.Write(p)
+}
+
+func (e *end) Close() error {
+	e.closeOnce.Do(func() {
+		e.read.closeReader()
+		e.write.closeWriter()
+	})
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package testutil
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipePair(t *testing.T) {
+	a, b := NewPipePair(&Config{
+		Latency:   20 * time.Millisecond,
+		Bandwidth: 1000,
+	})
+
+	// The bytes arrive after the latency and the transmission time.
+	start := time.Now()
+	_, err := a.Write(make([]byte, 10))
+	require.NoError(t, err)
+
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(b, buf)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 30*time.Millisecond)
+
+	// Closing an end is reported to the other end.
+	require.NoError(t, a.Close())
+	_, err = b.Read(buf)
+	require.Equal(t, io.EOF, err)
+	_, err = a.Read(buf)
+	require.Equal(t, io.ErrClosedPipe, err)
+	_, err = b.Write(buf)
+	require.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestPortsWithByteErrors(t *testing.T) {
+	a, b := NewPipePair(&Config{
+		Latency:   time.Millisecond,
+		ErrorRate: 0.01,
+		Seed:      1,
+	})
+
+	c := &ants.Config{AckTimeout: 50 * time.Millisecond}
+	p, peer := ants.NewPort(a, c), ants.NewPort(b, c)
+	defer p.Close()
+	defer peer.Close()
+
+	// The corrupted data messages are retransmitted.
+	for i := byte(0); i < 10; i++ {
+		data := []byte{i, 'a', 'n', 't', 's'}
+		require.NoError(t, p.Write(data))
+
+		received, err := peer.Read(5 * time.Second)
+		require.NoError(t, err)
+		require.Equal(t, data, received)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	throughputWindow  = time.Second
+	throughputBuckets = 10
+	throughputBucket  = throughputWindow / throughputBuckets
+)
+
+//############//
+//### Port ###//
+//############//
+
+// Throughput returns the raw bytes per second written to and read from the
+// source during the last second. Use it as a gauge of the link utilization,
+// for example to compare it with the line rate of a serial port.
+func (p *Port) Throughput() (sent, received float64) {
+	return p.throughput.rates(time.Now())
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// throughputMeter counts the transmitted bytes within the last second
+// in buckets of a tenth of a second. It is safe for concurrent use.
+type throughputMeter struct {
+	mutex   sync.Mutex
+	start   time.Time
+	current int64                        // Index of the current bucket.
+	buckets [throughputBuckets][2]uint64 // Sent and received bytes.
+}
+
+// add counts the sent and received bytes.
+func (m *throughputMeter) add(now time.Time, sent, received int) {
+	// Lock the mutex.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	b := &m.buckets[m.advance(now)]
+	b[0] += uint64(sent)
+	b[1] += uint64(received)
+}
+
+// rates returns the sent and received bytes per second.
+func (m *throughputMeter) rates(now time.Time) (sent, received float64) {
+	// Lock the mutex.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.advance(now)
+
+	var s, r uint64
+	for _, b := range m.buckets {
+		s += b[0]
+		r += b[1]
+	}
+
+	// The current bucket is still filling.
+	period := (throughputBuckets-1)*throughputBucket + time.Duration(now.UnixNano()%int64(throughputBucket))
+	if age := now.Sub(m.start); age < period {
+		period = age
+	}
+	if period <= 0 {
+		return 0, 0
+	}
+
+	return float64(s) / period.Seconds(), float64(r) / period.Seconds()
+}
+
+// advance clears the buckets, which left the window,
+// and returns the index of the current bucket.
+func (m *throughputMeter) advance(now time.Time) int {
+	if m.start.IsZero() {
+		m.start = now
+	}
+
+	current := now.UnixNano() / int64(throughputBucket)
+	for i := 0; i < throughputBuckets && m.current < current; i++ {
+		m.current++
+		m.buckets[m.current%throughputBuckets] = [2]uint64{}
+	}
+	m.current = current
+
+	return int(current % throughputBuckets)
+}
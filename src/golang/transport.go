@@ -0,0 +1,102 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+//######################//
+//### Transport type ###//
+//######################//
+
+// A Transport dials the source of a port. Serial ports, TCP connections,
+// Bluetooth links or custom transports are handled uniformly. If the
+// EOF behavior is EOFReconnect, then the port redials the transport
+// after the source reached the end of file.
+type Transport interface {
+	// Dial opens a new source. The context is cancelled if the port is closed.
+	Dial(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// The TransportFunc type is an adapter to use ordinary functions as transports.
+type TransportFunc func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// Dial calls f(ctx).
+func (f TransportFunc) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	return f(ctx)
+}
+
+// TCPTransport returns a transport, which dials the TCP address.
+func TCPTransport(address string) Transport {
+	return TransportFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", address)
+	})
+}
+
+// DialPort dials the transport and creates a new ANTS port with the source.
+// Optionally pass a configuration. Set the EOF behavior to EOFReconnect
+// to redial the transport if the source reached the end of file.
+// The Config.OnEOF hook has a precedence over the transport.
+func DialPort(ctx context.Context, t Transport, config ...*Config) (*Port, error) {
+	// Get a copy of the config. The transport is private to the port,
+	// so the config can be shared by multiple ports.
+	var c Config
+	if len(config) > 0 {
+		c = *config[0]
+	}
+	c.transport = t
+
+	// Dial the initial source.
+	source, err := t.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPort(source, &c), nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// redial obtains a new source from the OnEOF hook or the transport.
+// Dialing is cancelled if the port is closed.
+func (p *Port) redial() (io.ReadWriteCloser, error) {
+	if p.config.OnEOF != nil {
+		return p.config.OnEOF()
+	}
+
+	// Cancel the dial if the port is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.closeChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return p.config.transport.Dial(ctx)
+}
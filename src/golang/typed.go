@@ -0,0 +1,188 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//##################//
+//### Codec type ###//
+//##################//
+
+// A Codec converts values of type T to data chunks and back.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONCodec is a Codec, which encodes the values with JSON.
+type JSONCodec[T any] struct{}
+
+// Marshal encodes the value with JSON.
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON data chunk.
+func (JSONCodec[T]) Unmarshal(data []byte) (v T, err error) {
+	err = json.Unmarshal(data, &v)
+	return v, err
+}
+
+//#########################//
+//### MessageCodec type ###//
+//#########################//
+
+// A MessageCodec converts arbitrary values to data chunks and back.
+// Set it with Config.MessageCodec. Implement it to plug in other
+// encodings like CBOR or Protobuf, for example by calling
+// cbor.Marshal and cbor.Unmarshal.
+type MessageCodec interface {
+	// Marshal encodes the value.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes the data chunk into the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONMessageCodec is a MessageCodec, which encodes the values with JSON.
+type JSONMessageCodec struct{}
+
+// Marshal encodes the value with JSON.
+func (JSONMessageCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON data chunk.
+func (JSONMessageCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// BinaryMessageCodec is a MessageCodec for values, which encode themselves.
+// The values have to implement encoding.BinaryMarshaler and their pointers
+// encoding.BinaryUnmarshaler.
+type BinaryMessageCodec struct{}
+
+// Marshal encodes the value with its MarshalBinary method.
+func (BinaryMessageCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement encoding.BinaryMarshaler", v)
+	}
+	return m.MarshalBinary()
+}
+
+// Unmarshal decodes the data chunk with the UnmarshalBinary method of v.
+func (BinaryMessageCodec) Unmarshal(data []byte, v interface{}) error {
+	u, ok := v.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T does not implement encoding.BinaryUnmarshaler", v)
+	}
+	return u.UnmarshalBinary(data)
+}
+
+//###########################//
+//### Structured Messages ###//
+//###########################//
+
+// SendMsg encodes the value with the Config.MessageCodec and writes it
+// as one data chunk.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) SendMsg(v interface{}) error {
+	data, err := p.config.MessageCodec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+
+	return p.Write(data)
+}
+
+// RecvMsg reads the next data chunk and decodes it with the
+// Config.MessageCodec into the value pointed to by v.
+// Optionally pass a timeout. ErrTimeout is returned if the timeout is reached.
+// If the port is closed, then ErrClosed is returned.
+func (p *Port) RecvMsg(v interface{}, timeout ...time.Duration) error {
+	data, err := p.Read(timeout...)
+	if err != nil {
+		return err
+	}
+
+	err = p.config.MessageCodec.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("failed to decode message: %v", err)
+	}
+
+	return nil
+}
+
+//##################//
+//### Typed type ###//
+//##################//
+
+// Typed wraps a port, which exchanges values of a single type T.
+// Each value is transmitted as one data chunk.
+type Typed[T any] struct {
+	port  *Port
+	codec Codec[T]
+}
+
+// NewTyped creates a typed wrapper of the port, which uses the codec.
+func NewTyped[T any](p *Port, c Codec[T]) *Typed[T] {
+	return &Typed[T]{
+		port:  p,
+		codec: c,
+	}
+}
+
+// Port returns the wrapped port.
+func (t *Typed[T]) Port() *Port {
+	return t.port
+}
+
+// Read reads and decodes the next value.
+// Optionally pass a timeout. ErrTimeout is returned if the timeout is reached.
+// If the port is closed, then ErrClosed is returned.
+func (t *Typed[T]) Read(timeout ...time.Duration) (v T, err error) {
+	data, err := t.port.Read(timeout...)
+	if err != nil {
+		return v, err
+	}
+
+	v, err = t.codec.Unmarshal(data)
+	if err != nil {
+		return v, fmt.Errorf("failed to decode value: %v", err)
+	}
+
+	return v, nil
+}
+
+// Write encodes and writes the value.
+// If the port is closed, then ErrClosed is returned.
+func (t *Typed[T]) Write(v T) error {
+	data, err := t.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %v", err)
+	}
+
+	return t.port.Write(data)
+}
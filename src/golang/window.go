@@ -0,0 +1,566 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ants
+
+import (
+	"time"
+)
+
+const (
+	// maxSendWindow is the maximum number of data messages in flight.
+	// The gap of a lost data message never exceeds the resend requests.
+	maxSendWindow = maxResendRequests
+)
+
+//########################//
+//### Send Window type ###//
+//########################//
+
+// windowFrame is a data message of the send window.
+type windowFrame struct {
+	frame    []byte
+	buf      *frameBuffer // Holds the frame. Released once removed from the send window.
+	info     InFlightFrame
+	attempt  ARQAttempt
+	deadline time.Time // Retransmission deadline. Zero waits forever.
+	acked    bool
+	done     func(err error) // Called in the order of transmission. Might be nil.
+}
+
+// sendWindow holds the data messages, which are in flight.
+// It is only used by the write loop.
+type sendWindow struct {
+	size     int
+	frames   []*windowFrame // In the order of transmission.
+	clock    Clock
+	timer    Timer
+	failures int   // Incremented each time the send window was given up.
+	err      error // The cause of the last failure.
+}
+
+// newSendWindow returns nil if the size does not allow
+// more than one data message in flight.
+func newSendWindow(size int, clock Clock) *sendWindow {
+	if size <= 1 {
+		return nil
+	}
+
+	// Create the retransmission timer in a stopped state.
+	return &sendWindow{
+		size:  size,
+		clock: clock,
+		timer: newStoppedTimer(clock),
+	}
+}
+
+// frame returns the data message with the message sequence number or nil.
+func (w *sendWindow) frame(msn byte) *windowFrame {
+	for _, f := range w.frames {
+		if f.info.MSN == msn {
+			return f
+		}
+	}
+	return nil
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// writeDataChunkWindowed transmits the data messages of the data chunk
+// within the send window without waiting for the acknowledgements.
+// The result is reported as soon as all data messages were acknowledged.
+// Returns ErrClosed if the port was closed.
+func (p *Port) writeDataChunkWindowed(flags byte, chunk writeChunk, chunks int) error {
+	failures := p.window.failures
+
+	// Delta encode the data chunk if enabled. The base is updated right away,
+	// because the following data chunks are transmitted before the acknowledgement.
+	msgFlags, payload := p.encodeDataChunk(flags, chunk.data)
+	p.setWriteDeltaBase(msgFlags, chunk.data)
+
+	// Encrypt the data chunk if enabled.
+	msgFlags, payload, err := p.sealDataChunk(msgFlags, payload)
+	if err != nil {
+		p.log.Errorf("write data: %v", err)
+		p.completeWindowedDataChunk(flags, chunk, chunks, err)
+		return nil
+	}
+	total := len(payload)
+	maxSize := p.maxMessageSize()
+
+	for sent := 0; ; {
+		// Urgent data chunks must not wait behind the whole transmission.
+		if sent > 0 {
+			if err := p.writePendingUrgentChunks(); err != nil {
+				return err
+			}
+		}
+
+		// Set the append data flag on all but the last data message.
+		part, partFlags := payload[sent:], msgFlags|flagPipelined
+		if flags&flagUrgent == 0 && len(part) > maxSize {
+			part, partFlags = part[:maxSize], partFlags|flagAppendData
+		}
+		sent += len(part)
+
+		// Report the progress and the result once acknowledged.
+		progress, last := sent, sent == total
+		done := func(err error) {
+			if err == nil && flags&(flagUrgent|flagService) == 0 && p.config.OnWriteProgress != nil {
+				p.config.OnWriteProgress(progress, total)
+			}
+			if last {
+				p.completeWindowedDataChunk(flags, chunk, chunks, err)
+			}
+		}
+
+		err := p.sendWindowed(partFlags, part, done, failures)
+		if err == ErrClosed {
+			return err
+		} else if err != nil {
+			// The send window was given up before all data messages were sent.
+			p.completeWindowedDataChunk(flags, chunk, chunks, err)
+			return nil
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// completeWindowedDataChunk reports the result of a data chunk,
+// which was transmitted within the send window.
+func (p *Port) completeWindowedDataChunk(flags byte, chunk writeChunk, chunks int, err error) {
+	if err == ErrMaxRetriesReached && p.config.OnWriteError != nil {
+		p.config.OnWriteError(chunk.data, err)
+	}
+	if err != nil {
+		// The peer might not have received the data chunk.
+		// Send a keyframe next time.
+		p.setWriteDeltaBase(flags, nil)
+	}
+
+	p.completeDataChunk(chunk, chunks, err)
+}
+
+// sendWindowed waits for a free slot of the send window and transmits the
+// data message. Returns ErrClosed if the port was closed and the cause of
+// the failure if the send window was given up since the passed failure count.
+func (p *Port) sendWindowed(flags byte, data []byte, done func(err error), failures int) error {
+	w := p.window
+
+	// Wait for a free slot of the send window.
+	for len(w.frames) >= w.size {
+		if err := p.waitForWindowEvent(); err != nil {
+			return err
+		}
+	}
+	if w.failures != failures {
+		return w.err
+	}
+
+	// Pause the bulk transmission if the peer is nearly out of buffer space.
+	// Urgent messages are never paused.
+	if flags&flagUrgent == 0 {
+		if err := p.waitForPeerBuffer(len(data), p.abortChan); err != nil {
+			if err == ErrAborted {
+				p.giveUpWindow(err)
+			}
+			return err
+		}
+		p.consumePeerBuffer(len(data))
+	}
+
+	// Resends of the same data message keep the message sequence number.
+	msn := p.nextMSN()
+	now := p.config.Clock.Now()
+
+	buf := getFrameBuffer()
+	f := &windowFrame{
+		frame: p.encodeDataMessageFrame(buf, msn, flags, data),
+		buf:   buf,
+		info: InFlightFrame{
+			MSN:    msn,
+			Urgent: flags&flagUrgent != 0,
+			Size:   len(data),
+			Since:  now,
+		},
+		attempt: ARQAttempt{
+			MSN:   msn,
+			Since: now,
+		},
+		done: done,
+	}
+	w.frames = append(w.frames, f)
+
+	return p.transmitWindowFrame(f)
+}
+
+// waitForWindowEvent waits for a control message, a retransmission timeout
+// or an abort request and handles it. Returns ErrClosed if the port was closed.
+func (p *Port) waitForWindowEvent() error {
+	select {
+	case <-p.closeChan:
+		return ErrClosed
+	case cm := <-p.readControlMessageChan:
+		p.handleWindowControlMessage(cm)
+	case <-p.windowTimeout():
+		p.handleWindowTimeouts()
+	case <-p.abortChan:
+		p.giveUpWindow(ErrAborted)
+	}
+
+	return nil
+}
+
+// drainWindow waits until all data messages of the send window were
+// acknowledged or given up. Returns ErrClosed if the port was closed.
+func (p *Port) drainWindow() error {
+	for p.window != nil && len(p.window.frames) > 0 {
+		if err := p.waitForWindowEvent(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transmitWindowFrame writes the data message of the send window
+// to the source and starts its retransmission timeout.
+func (p *Port) transmitWindowFrame(f *windowFrame) error {
+	err := p.transmitDataMessageFrame(f.frame, f.attempt.Transmissions > 0, p.transferAbortChan(f.info.Urgent))
+	if err == ErrAborted {
+		// The data messages of the send window report the abort.
+		p.giveUpWindow(err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f.attempt.Transmissions++
+	f.info.Retries = f.attempt.Transmissions - 1
+
+	f.deadline = time.Time{}
+	if timeout := p.config.ARQStrategy.Timeout(f.attempt); timeout > 0 {
+		f.deadline = p.config.Clock.Now().Add(timeout)
+	}
+
+	p.publishWindow()
+	return nil
+}
+
+// windowControlMessages returns the control message channel
+// if data messages of the send window are in flight. Otherwise nil.
+func (p *Port) windowControlMessages() <-chan controlMessage {
+	if p.window == nil || len(p.window.frames) == 0 {
+		return nil
+	}
+	return p.readControlMessageChan
+}
+
+// windowTimeout returns a channel, which fires at the next retransmission
+// deadline of the send window. Nil is returned if there is none.
+func (p *Port) windowTimeout() <-chan time.Time {
+	w := p.window
+	if w == nil {
+		return nil
+	}
+
+	// Find the next deadline.
+	var next time.Time
+	for _, f := range w.frames {
+		if !f.acked && !f.deadline.IsZero() && (next.IsZero() || f.deadline.Before(next)) {
+			next = f.deadline
+		}
+	}
+
+	// Stop the timer and drain a pending tick.
+	if !w.timer.Stop() {
+		select {
+		case <-w.timer.C():
+		default:
+		}
+	}
+
+	if next.IsZero() {
+		return nil
+	}
+
+	w.timer.Reset(next.Sub(w.clock.Now()))
+	return w.timer.C()
+}
+
+// handleWindowControlMessage handles the response of the peer
+// to a data message of the send window.
+func (p *Port) handleWindowControlMessage(cm controlMessage) {
+	// A negative acknowledge with the unknown message sequence number can't be
+	// assigned to a data message. The peer requests a resend as soon as it
+	// detects the gap. Otherwise the retransmission timeout handles it.
+	f := p.window.frame(cm.MSN)
+	if f == nil || f.acked {
+		p.log.Debugf("write data: discarding control message with unexpected message sequence number (MSN=%v)", cm.MSN)
+		return
+	}
+
+	switch cm.TypeCharacter {
+	case ack:
+		f.acked = true
+		p.completeWindowFrames()
+	case nak:
+		// Retransmissions can't resolve some rejections of the peer.
+		f.attempt.NakReason = cm.Reason
+		if err := cm.Reason.err(); err != nil {
+			p.log.Warningf("write data: data message rejected by the peer: %v (MSN=%v)", cm.Reason, f.info.MSN)
+			p.giveUpDataMessage(f.info.MSN, f.attempt.Transmissions, p.currentMSN())
+			p.giveUpWindow(err)
+			return
+		}
+		p.retransmitWindowFrame(f, ARQReasonNak)
+	case rsd:
+		p.retransmitWindowFrame(f, ARQReasonResendRequest)
+	}
+}
+
+// handleWindowTimeouts retransmits the data messages of the send window,
+// which were not acknowledged in time.
+func (p *Port) handleWindowTimeouts() {
+	w := p.window
+	failures := w.failures
+	now := p.config.Clock.Now()
+
+	for _, f := range append([]*windowFrame(nil), w.frames...) {
+		// Stop if the send window was given up.
+		if w.failures != failures {
+			return
+		}
+
+		if !f.acked && !f.deadline.IsZero() && !now.Before(f.deadline) {
+			p.log.Debugf("write data: no response from peer in time (MSN=%v)", f.info.MSN)
+			p.retransmitWindowFrame(f, ARQReasonTimeout)
+		}
+	}
+}
+
+// retransmitWindowFrame asks the ARQ strategy whether to retransmit the data
+// message. Otherwise all data messages of the send window are given up.
+func (p *Port) retransmitWindowFrame(f *windowFrame, reason ARQReason) {
+	f.attempt.Reason = reason
+	if reason != ARQReasonNak {
+		f.attempt.NakReason = NakReasonUnspecified
+	}
+
+	if !p.config.ARQStrategy.Retransmit(f.attempt) {
+		// Abort all data messages sent so far. Their order can't be restored.
+		p.giveUpDataMessage(f.info.MSN, f.attempt.Transmissions, p.currentMSN())
+		p.giveUpWindow(ErrMaxRetriesReached)
+		return
+	}
+
+	// A failed write closes the port.
+	_ = p.transmitWindowFrame(f)
+}
+
+// completeWindowFrames removes the leading acknowledged data messages
+// from the send window and reports their results in order.
+func (p *Port) completeWindowFrames() {
+	w := p.window
+
+	for len(w.frames) > 0 && w.frames[0].acked {
+		f := w.frames[0]
+		w.frames = w.frames[1:]
+		f.buf.release()
+
+		if f.done != nil {
+			f.done(nil)
+		}
+	}
+
+	p.publishWindow()
+}
+
+// giveUpWindow removes all data messages from the send window and reports
+// the error as their result. The peer is told to discard aborted transfers.
+func (p *Port) giveUpWindow(err error) {
+	w := p.window
+	frames := w.frames
+	w.frames = nil
+	w.failures++
+	w.err = err
+	p.publishWindow()
+
+	if err == ErrAborted {
+		p.log.Debugf("write data: transfer aborted (MSN=%v)", p.currentMSN())
+		p.writeControlMessage(can, p.currentMSN())
+	}
+
+	for _, f := range frames {
+		f.buf.release()
+		if f.done != nil {
+			f.done(err)
+		}
+	}
+}
+
+// publishWindow publishes the unacknowledged data messages for DebugState.
+func (p *Port) publishWindow() {
+	var frames []InFlightFrame
+	for _, f := range p.window.frames {
+		if !f.acked {
+			frames = append(frames, f.info)
+		}
+	}
+
+	p.setInFlightFrames(frames)
+}
+
+//########################//
+//### Reorder receiver ###//
+//########################//
+
+// reorderedMessage is an out of order data message of the peer's send window.
+type reorderedMessage struct {
+	crcType CRCType
+	flags   byte
+	binData []byte
+}
+
+// receivePipelinedDataMessage restores the order of the data messages
+// of the peer's send window. Out of order data messages are buffered
+// until the missing ones were resent.
+// This method must be only called by the read messages loop.
+func (p *Port) receivePipelinedDataMessage(pmsn byte, crcType CRCType, flags byte, binData []byte) error {
+	// Discard out of order data messages, which are stuck behind a gap.
+	if len(p.readReorder) > 0 && p.config.Clock.Now().Sub(p.readReorderTime) > p.config.ReassemblyTimeout {
+		p.log.Warningf("read data: reorder timeout reached: discarding %v out of order data messages", len(p.readReorder))
+		p.resetReorderBuffer()
+		p.readLastPMSNValid = false
+	}
+
+	if !p.readLastPMSNValid {
+		return p.processInOrderDataMessage(pmsn, crcType, flags, binData)
+	}
+
+	d := sequenceDistance(p.readLastPMSN, pmsn)
+	switch {
+	case d == 1:
+		return p.processInOrderDataMessage(pmsn, crcType, flags, binData)
+
+	case d == 0 || d >= 255-maxSendWindow:
+		// A resend of an already received data message. The acknowledge got lost.
+		p.log.Debugf("read data: discarding duplicate data message (PMSN=%v)", pmsn)
+		return nil
+
+	case d <= maxSendWindow:
+		p.reorderDataMessage(pmsn, d, crcType, flags, binData)
+		return nil
+
+	default:
+		// The peer restarted its message sequence.
+		if len(p.readReorder) > 0 {
+			p.log.Warningf("read data: unexpected message sequence number %v: discarding %v out of order data messages", pmsn, len(p.readReorder))
+			p.resetReorderBuffer()
+		}
+		return p.processInOrderDataMessage(pmsn, crcType, flags, binData)
+	}
+}
+
+// processInOrderDataMessage processes the data message, which follows the
+// previous one without a gap. Afterwards the buffered data messages, which
+// follow without a gap, are processed, too.
+func (p *Port) processInOrderDataMessage(pmsn byte, crcType CRCType, flags byte, binData []byte) error {
+	p.readLastPMSN = pmsn
+	p.readLastPMSNValid = true
+
+	if err := p.processDataMessage(pmsn, crcType, flags, binData); err != nil {
+		return err
+	}
+
+	for {
+		next := nextSequenceNumber(p.readLastPMSN)
+		m, ok := p.readReorder[next]
+		if !ok {
+			return nil
+		}
+		delete(p.readReorder, next)
+		p.readLastPMSN = next
+
+		// The data message was already acknowledged.
+		err := p.processDataMessage(next, m.crcType, m.flags, m.binData)
+		if err == ErrClosed {
+			return err
+		} else if err != nil {
+			p.log.Warningf("read data: handle out of order data message: %v", err)
+		}
+	}
+}
+
+// reorderDataMessage buffers the out of order data message, which is d
+// steps ahead of the previous in order data message, and requests a resend
+// of the missing data messages, which were not requested so far.
+func (p *Port) reorderDataMessage(pmsn byte, d int, crcType CRCType, flags byte, binData []byte) {
+	if _, ok := p.readReorder[pmsn]; ok {
+		p.log.Debugf("read data: discarding duplicate data message (PMSN=%v)", pmsn)
+		return
+	}
+
+	// The gap up to the farthest buffered data message was already requested.
+	farthest := 0
+	for msn := range p.readReorder {
+		if dist := sequenceDistance(p.readLastPMSN, msn); dist > farthest {
+			farthest = dist
+		}
+	}
+
+	msn := advanceSequenceNumber(p.readLastPMSN, farthest)
+	for i := farthest + 1; i < d; i++ {
+		msn = nextSequenceNumber(msn)
+		p.log.Debugf("read data: sequence gap detected: requesting resend of message %v", msn)
+		p.writeControlMessage(rsd, msn)
+	}
+
+	// Buffer a copy, because the body buffer is reused.
+	if len(p.readReorder) == 0 {
+		p.readReorder = make(map[byte]reorderedMessage)
+		p.readReorderTime = p.config.Clock.Now()
+	}
+	p.readReorder[pmsn] = reorderedMessage{
+		crcType: crcType,
+		flags:   flags,
+		binData: append([]byte(nil), binData...),
+	}
+}
+
+// resetReorderBuffer discards the buffered out of order data messages.
+func (p *Port) resetReorderBuffer() {
+	p.readReorder = nil
+}
+
+// sequenceDistance returns the number of steps from the message
+// sequence number a to b. Both must not be the unknown message sequence number.
+func sequenceDistance(a, b byte) int {
+	return (int(b) - int(a) + 255) % 255
+}
+
+// advanceSequenceNumber returns the message sequence number n steps after msn.
+func advanceSequenceNumber(msn byte, n int) byte {
+	for i := 0; i < n; i++ {
+		msn = nextSequenceNumber(msn)
+	}
+	return msn
+}
@@ -0,0 +1,239 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xfer
+
+import (
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//#####################//
+//### Receiver type ###//
+//#####################//
+
+// A Receiver receives the files of the peer and writes them to the sinks
+// returned by the open function. A partially received file is kept, so
+// the sender resumes the transfer, even on the new port of a reconnector.
+// This implementation is thread-safe.
+type Receiver struct {
+	open   func(f File) (io.Writer, error)
+	config *Config
+
+	mutex        sync.Mutex
+	transfer     *transfer
+	lastResponse []byte // Sent again for a duplicated request.
+}
+
+// transfer is a partially received file.
+type transfer struct {
+	file     File
+	sink     io.Writer
+	received int64
+	checksum uint32
+}
+
+// NewReceiver creates a new file receiver. The open function is called
+// for each new file and returns the sink of its content. If the sink is
+// an io.Closer, then it is closed once the transfer ended.
+// Optionally pass a configuration.
+func NewReceiver(open func(f File) (io.Writer, error), config ...*Config) *Receiver {
+	return &Receiver{
+		open:   open,
+		config: getConfig(config),
+	}
+}
+
+// Serve answers the requests of the peer until the port is closed.
+// Returns the port's read or write error. Call it again with the
+// new port after a reconnect to resume the transfer.
+func (r *Receiver) Serve(p *ants.Port) error {
+	service := p.Service(ants.ServiceTransfer)
+
+	for {
+		req, err := service.Read()
+		if err != nil {
+			return err
+		}
+
+		// Skip invalid requests.
+		if len(req) < 2 {
+			continue
+		}
+
+		if err = service.Write(r.handle(req)); err != nil {
+			return err
+		}
+	}
+}
+
+// Abort discards the partially received file. Config.OnComplete
+// is called with ErrAborted, if a transfer was in progress.
+func (r *Receiver) Abort() {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.finish(ErrAborted)
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// handle processes the request and returns the response.
+func (r *Receiver) handle(req []byte) []byte {
+	// Lock the mutex.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	op, id, payload := req[0], req[1], req[2:]
+
+	// Answer a duplicated request with the same response.
+	// The sender resent it, because the response got lost.
+	if r.lastResponse != nil && r.lastResponse[0] == op && r.lastResponse[1] == id {
+		return r.lastResponse
+	}
+
+	var status byte
+	var resp []byte
+
+	switch op {
+	case opBegin:
+		status, resp = r.begin(payload)
+	case opData:
+		status, resp = r.data(payload)
+	case opEnd:
+		status, resp = r.end()
+	case opAbort:
+		r.finish(ErrAborted)
+		status = statusOK
+	default:
+		status = statusInvalidRequest
+	}
+
+	// Response: Operation | Request ID | Status | Payload
+	r.lastResponse = append([]byte{op, id, status}, resp...)
+	return r.lastResponse
+}
+
+// begin starts a new transfer or resumes the partially received file.
+// The response payload is the offset to continue at.
+func (r *Receiver) begin(payload []byte) (byte, []byte) {
+	f, ok := decodeBegin(payload)
+	if !ok {
+		return statusInvalidRequest, nil
+	}
+
+	// Resume the partially received file.
+	if t := r.transfer; t != nil && t.file == f {
+		return statusOK, encodeOffset(nil, t.received)
+	}
+
+	// Discard another partially received file.
+	r.finish(ErrAborted)
+
+	sink, err := r.open(f)
+	if err != nil {
+		return statusFailed, []byte(err.Error())
+	}
+	r.transfer = &transfer{
+		file: f,
+		sink: sink,
+	}
+
+	return statusOK, encodeOffset(nil, 0)
+}
+
+// data writes the received chunk to the sink. The response payload
+// is the expected offset, if the chunk does not continue the file.
+func (r *Receiver) data(payload []byte) (byte, []byte) {
+	t := r.transfer
+	if t == nil {
+		return statusNoTransfer, nil
+	}
+
+	offset, ok := decodeOffset(payload)
+	if !ok {
+		return statusInvalidRequest, nil
+	} else if offset != t.received {
+		return statusInvalidOffset, encodeOffset(nil, t.received)
+	}
+
+	chunk := payload[offsetLength:]
+	if int64(len(chunk)) > t.file.Size-t.received {
+		return statusInvalidRequest, nil
+	}
+
+	if _, err := t.sink.Write(chunk); err != nil {
+		r.finish(err)
+		return statusFailed, []byte(err.Error())
+	}
+	t.received += int64(len(chunk))
+	t.checksum = crc32.Update(t.checksum, crc32.IEEETable, chunk)
+
+	if r.config.OnProgress != nil {
+		r.config.OnProgress(t.file, t.received)
+	}
+
+	return statusOK, nil
+}
+
+// end verifies the received file and ends the transfer.
+func (r *Receiver) end() (byte, []byte) {
+	t := r.transfer
+	if t == nil {
+		return statusNoTransfer, nil
+	}
+
+	if t.received != t.file.Size || t.checksum != t.file.Checksum {
+		r.finish(ErrChecksumMismatch)
+		return statusChecksumMismatch, nil
+	}
+
+	if err := r.finish(nil); err != nil {
+		return statusFailed, []byte(err.Error())
+	}
+
+	return statusOK, nil
+}
+
+// finish ends the current transfer with the error, closes the sink and
+// reports the result. Returns the error or the failure of the sink close.
+func (r *Receiver) finish(err error) error {
+	t := r.transfer
+	if t == nil {
+		return err
+	}
+	r.transfer = nil
+
+	if c, ok := t.sink.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if r.config.OnComplete != nil {
+		r.config.OnComplete(t.file, err)
+	}
+
+	return err
+}
@@ -0,0 +1,180 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xfer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/desertbit/ants/src/golang"
+)
+
+//##############//
+//### Public ###//
+//##############//
+
+// Send transfers size bytes of r as file with the name to the receiver of
+// the peer. Optionally pass a configuration. If the peer received a part
+// of the same file before, then the transfer is resumed. Call Send again
+// after an interrupted transfer, for example on the port of a reconnector.
+// ErrChecksumMismatch is returned if the received file is corrupt.
+// A port can't send files, while it serves a receiver.
+func Send(p *ants.Port, name string, r io.ReaderAt, size int64, config ...*Config) error {
+	s := &sender{
+		service: p.Service(ants.ServiceTransfer),
+		config:  getConfig(config),
+	}
+
+	// Calculate the checksum of the file content.
+	checksum, err := Checksum(r, size)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	f := File{Name: name, Size: size, Checksum: checksum}
+
+	// Start or resume the transfer.
+	status, resp, err := s.request(opBegin, encodeBegin(f))
+	if err != nil {
+		return err
+	} else if err = statusError(status, resp); err != nil {
+		return err
+	}
+
+	offset, ok := decodeOffset(resp)
+	if !ok || offset > size {
+		return ErrInvalidResponse
+	}
+
+	// Transfer the remaining chunks one at a time.
+	buf := make([]byte, offsetLength+s.config.ChunkSize)
+	for offset < size {
+		n := int64(s.config.ChunkSize)
+		if n > size-offset {
+			n = size - offset
+		}
+
+		chunk := buf[offsetLength : offsetLength+n]
+		if err = readFull(r, chunk, offset); err != nil {
+			// Tell the peer to discard the partial file.
+			_, _, _ = s.request(opAbort, nil)
+			return fmt.Errorf("failed to read file: %v", err)
+		}
+		encodeOffset(buf[:0], offset)
+
+		status, resp, err = s.request(opData, buf[:offsetLength+n])
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case statusOK:
+			offset += n
+		case statusInvalidOffset:
+			// The peer expects another offset, for example because
+			// a response got lost. Continue at the expected offset.
+			offset, ok = decodeOffset(resp)
+			if !ok || offset > size {
+				return ErrInvalidResponse
+			}
+		default:
+			return statusError(status, resp)
+		}
+
+		if s.config.OnProgress != nil {
+			s.config.OnProgress(f, offset)
+		}
+	}
+
+	// Let the peer verify the checksum.
+	status, resp, err = s.request(opEnd, nil)
+	if err != nil {
+		return err
+	}
+	return statusError(status, resp)
+}
+
+// Checksum calculates the CRC-32 (IEEE) checksum of size bytes of r,
+// which is announced in File.Checksum.
+func Checksum(r io.ReaderAt, size int64) (uint32, error) {
+	var crc uint32
+	buf := make([]byte, checksumBufferSize)
+
+	for offset := int64(0); offset < size; {
+		n := int64(len(buf))
+		if n > size-offset {
+			n = size - offset
+		}
+
+		if err := readFull(r, buf[:n], offset); err != nil {
+			return 0, err
+		}
+
+		crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		offset += n
+	}
+
+	return crc, nil
+}
+
+//###################//
+//### sender type ###//
+//###################//
+
+type sender struct {
+	service *ants.Service
+	config  *Config
+}
+
+// request sends the request and waits for its response. The receiver
+// answers duplicated requests with the same response.
+func (s *sender) request(op byte, payload []byte) (status byte, resp []byte, err error) {
+	return s.service.Request(op, payload, s.config.Timeout, s.config.Retries)
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// statusError returns the error of the response status.
+func statusError(status byte, payload []byte) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusChecksumMismatch:
+		return ErrChecksumMismatch
+	case statusNoTransfer:
+		return ErrNoTransfer
+	case statusFailed:
+		return fmt.Errorf("peer failed: %s", payload)
+	default:
+		return ErrInvalidResponse
+	}
+}
+
+// readFull reads exactly len(buf) bytes of r at the offset.
+func readFull(r io.ReaderAt, buf []byte, offset int64) error {
+	n, err := r.ReadAt(buf, offset)
+	if n == len(buf) {
+		return nil
+	} else if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
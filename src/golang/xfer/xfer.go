@@ -0,0 +1,197 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package xfer implements the standardized file transfer protocol of the
+// ANTS library. The sender transfers a file chunk by chunk to the receiver
+// of the peer, which writes it to a sink. Only one chunk is in flight at a
+// time, so big transfers never starve the operational traffic. Interrupted
+// transfers are resumed at the offset already received by the peer.
+package xfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+//#################//
+//### Constants ###//
+//#################//
+
+// Operations:
+const (
+	opBegin byte = 1
+	opData  byte = 2
+	opEnd   byte = 3
+	opAbort byte = 4
+)
+
+// Status codes:
+const (
+	statusOK               byte = 0
+	statusInvalidRequest   byte = 1
+	statusInvalidOffset    byte = 2
+	statusChecksumMismatch byte = 3
+	statusFailed           byte = 4
+	statusNoTransfer       byte = 5
+)
+
+const (
+	defaultChunkSize = 1024
+	defaultTimeout   = 5 * time.Second
+	defaultRetries   = 3
+
+	// beginHeaderLength is the length of the begin request payload without the name.
+	beginHeaderLength = 12
+
+	// offsetLength is the length of an encoded offset.
+	offsetLength = 8
+
+	checksumBufferSize = 32 * 1024
+)
+
+//#################//
+//### Variables ###//
+//#################//
+
+// Errors:
+var (
+	// ErrInvalidResponse is returned if the response of the peer could not be parsed.
+	ErrInvalidResponse = errors.New("invalid response")
+
+	// ErrChecksumMismatch is returned if the checksum of the received
+	// file does not match. The peer discarded the transfer.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrAborted is passed to Config.OnComplete if a partially received
+	// file was replaced by another transfer or the transfer was aborted.
+	ErrAborted = errors.New("transfer aborted")
+
+	// ErrNoTransfer is returned if the peer has no transfer in progress,
+	// for example because it was restarted.
+	ErrNoTransfer = errors.New("no transfer in progress")
+)
+
+//#################//
+//### File type ###//
+//#################//
+
+// A File describes a transferred file.
+type File struct {
+	Name     string
+	Size     int64
+	Checksum uint32 // CRC-32 (IEEE) of the file content.
+}
+
+//###################//
+//### Config type ###//
+//###################//
+
+// A Config represents the configuration of a file transfer.
+type Config struct {
+	// ChunkSize is the maximum size of the file data of a single request.
+	// The default is 1024 bytes.
+	ChunkSize int
+
+	// Timeout is the maximum duration to wait for a response of the receiver.
+	// The default is 5 seconds.
+	Timeout time.Duration
+
+	// Retries is the number of times a request is resent if no response
+	// was received within the timeout.
+	// The default is 3.
+	Retries int
+
+	// OnProgress is called with the number of transferred bytes
+	// each time a chunk was transferred. It is called on both sides.
+	OnProgress func(f File, transferred int64)
+
+	// OnComplete is called by the receiver once a transfer ended.
+	// The error is nil if the file was received completely with a
+	// valid checksum. The sink was closed already, if it is an io.Closer.
+	OnComplete func(f File, err error)
+}
+
+// setDefaults sets the default values for unset variables.
+func (c *Config) setDefaults() {
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = defaultChunkSize
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+
+	if c.Retries < 0 {
+		c.Retries = 0
+	} else if c.Retries == 0 {
+		c.Retries = defaultRetries
+	}
+}
+
+// getConfig returns a copy of the optional config with the default values.
+func getConfig(config []*Config) *Config {
+	var c Config
+	if len(config) > 0 && config[0] != nil {
+		c = *config[0]
+	}
+	c.setDefaults()
+
+	return &c
+}
+
+//###############//
+//### Private ###//
+//###############//
+
+// encodeBegin encodes the begin request payload:
+// Size (8 Bytes) | Checksum (4 Bytes) | Name
+func encodeBegin(f File) []byte {
+	buf := make([]byte, beginHeaderLength, beginHeaderLength+len(f.Name))
+	binary.LittleEndian.PutUint64(buf, uint64(f.Size))
+	binary.LittleEndian.PutUint32(buf[8:], f.Checksum)
+	return append(buf, f.Name...)
+}
+
+// decodeBegin decodes the begin request payload.
+func decodeBegin(payload []byte) (f File, ok bool) {
+	if len(payload) < beginHeaderLength {
+		return f, false
+	}
+
+	f.Size = int64(binary.LittleEndian.Uint64(payload))
+	f.Checksum = binary.LittleEndian.Uint32(payload[8:])
+	f.Name = string(payload[beginHeaderLength:])
+
+	return f, f.Size >= 0
+}
+
+// encodeOffset appends the little-endian offset to buf.
+func encodeOffset(buf []byte, offset int64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, uint64(offset))
+}
+
+// decodeOffset decodes the little-endian offset at the start of the payload.
+func decodeOffset(payload []byte) (int64, bool) {
+	if len(payload) < offsetLength {
+		return 0, false
+	}
+
+	offset := int64(binary.LittleEndian.Uint64(payload))
+	return offset, offset >= 0
+}
@@ -0,0 +1,151 @@
+/*
+ *  Ants - Let the ants handle your serial communication.
+ *  Copyright (C) 2015  Roland Singer <roland.singer[at]desertbit.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package xfer
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/desertbit/ants/src/golang"
+	"github.com/desertbit/ants/src/golang/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// sink collects the received file content.
+type sink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *sink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSend(t *testing.T) {
+	pa, pb := testutil.NewPortPair(t)
+
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	s := &sink{}
+	var file File
+	done := make(chan error, 1)
+	r := NewReceiver(func(f File) (io.Writer, error) {
+		file = f
+		return s, nil
+	}, &Config{
+		OnComplete: func(f File, err error) { done <- err },
+	})
+	go r.Serve(pb)
+
+	var progress []int64
+	err := Send(pa, "firmware.bin", bytes.NewReader(data), int64(len(data)), &Config{
+		ChunkSize:  512,
+		OnProgress: func(f File, transferred int64) { progress = append(progress, transferred) },
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	require.Equal(t, File{Name: "firmware.bin", Size: 5000, Checksum: crc32.ChecksumIEEE(data)}, file)
+	require.True(t, s.closed)
+	require.Equal(t, data, s.Bytes())
+	require.Len(t, progress, 10)
+	require.Equal(t, int64(len(data)), progress[9])
+
+	// A file shorter than the passed size is never sent.
+	require.Error(t, Send(pa, "short", bytes.NewReader(data[:10]), 20))
+}
+
+func TestResume(t *testing.T) {
+	pa, pb := testutil.NewPortPair(t)
+
+	data := bytes.Repeat([]byte("ants"), 256)
+	f := File{Name: "log.txt", Size: int64(len(data)), Checksum: crc32.ChecksumIEEE(data)}
+
+	s := &sink{}
+	r := NewReceiver(func(File) (io.Writer, error) { return s, nil })
+
+	// The first chunk was received before the link failed.
+	resp := r.handle(append([]byte{opBegin, 1}, encodeBegin(f)...))
+	require.Equal(t, []byte{opBegin, 1, statusOK, 0, 0, 0, 0, 0, 0, 0, 0}, resp)
+	resp = r.handle(append(append([]byte{opData, 2}, encodeOffset(nil, 0)...), data[:100]...))
+	require.Equal(t, []byte{opData, 2, statusOK}, resp)
+	go r.Serve(pb)
+
+	var progress []int64
+	err := Send(pa, f.Name, bytes.NewReader(data), f.Size, &Config{
+		ChunkSize:  512,
+		OnProgress: func(f File, transferred int64) { progress = append(progress, transferred) },
+	})
+	require.NoError(t, err)
+	require.Equal(t, data, s.Bytes())
+	require.Equal(t, []int64{612, 1024}, progress)
+}
+
+func TestReceiverRequests(t *testing.T) {
+	f := File{Name: "x", Size: 4, Checksum: crc32.ChecksumIEEE([]byte("ants"))}
+
+	var result error
+	r := NewReceiver(func(File) (io.Writer, error) { return &sink{}, nil }, &Config{
+		OnComplete: func(f File, err error) { result = err },
+	})
+
+	// Data without a transfer.
+	resp := r.handle(append([]byte{opData, 1}, encodeOffset(nil, 0)...))
+	require.Equal(t, []byte{opData, 1, statusNoTransfer}, resp)
+
+	r.handle(append([]byte{opBegin, 2}, encodeBegin(f)...))
+	resp = r.handle(append(append([]byte{opData, 3}, encodeOffset(nil, 0)...), "an"...))
+	require.Equal(t, []byte{opData, 3, statusOK}, resp)
+
+	// A duplicated request is answered with the same response.
+	resp = r.handle(append(append([]byte{opData, 3}, encodeOffset(nil, 0)...), "an"...))
+	require.Equal(t, []byte{opData, 3, statusOK}, resp)
+
+	// A resent chunk is answered with the expected offset.
+	resp = r.handle(append(append([]byte{opData, 4}, encodeOffset(nil, 0)...), "an"...))
+	require.Equal(t, append([]byte{opData, 4, statusInvalidOffset}, encodeOffset(nil, 2)...), resp)
+
+	// The corrupt file is discarded.
+	r.handle(append(append([]byte{opData, 5}, encodeOffset(nil, 2)...), "tz"...))
+	resp = r.handle([]byte{opEnd, 6})
+	require.Equal(t, []byte{opEnd, 6, statusChecksumMismatch}, resp)
+	require.Equal(t, ErrChecksumMismatch, result)
+
+	resp = r.handle([]byte{opEnd, 7})
+	require.Equal(t, []byte{opEnd, 7, statusNoTransfer}, resp)
+	require.Equal(t, ErrNoTransfer, statusError(resp[2], resp[3:]))
+}
+
+func TestSendTimeout(t *testing.T) {
+	pa, _ := testutil.NewPortPair(t)
+
+	// The peer serves no receiver.
+	start := time.Now()
+	err := Send(pa, "x", bytes.NewReader([]byte{1}), 1, &Config{
+		Timeout: 20 * time.Millisecond,
+		Retries: 1,
+	})
+	require.Equal(t, ants.ErrTimeout, err)
+	require.True(t, time.Since(start) >= 40*time.Millisecond)
+}